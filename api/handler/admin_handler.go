@@ -0,0 +1,326 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"simplopay.com/backend/base"
+	"simplopay.com/backend/pkg/opay"
+
+	"github.com/gorilla/mux"
+)
+
+// AdminHandler handles the operator facing HTTP requests.
+type AdminHandler struct {
+	opayInstance *opay.Opay
+	orderStore   base.OrderStore
+}
+
+// NewAdminHandler creates a new AdminHandler.
+func NewAdminHandler(opayInstance *opay.Opay, orderStore base.OrderStore) *AdminHandler {
+	return &AdminHandler{opayInstance: opayInstance, orderStore: orderStore}
+}
+
+// MetaView represents a registered order type.
+type MetaView struct {
+	OrderType   string       `json:"order_type"`
+	UnsetCode   int64        `json:"unset_code"`
+	ReverseCode *int64       `json:"reverse_code,omitempty"`
+	Statuses    []StatusView `json:"statuses"`
+}
+
+// StatusView represents a status code of an order type.
+type StatusView struct {
+	Code int64  `json:"code"`
+	Note string `json:"note"`
+	Step string `json:"step"`
+}
+
+// Metas lists the registered order types and what their status codes mean.
+func (h *AdminHandler) Metas(w http.ResponseWriter, r *http.Request) {
+	metas := h.opayInstance.Metas()
+	views := make([]MetaView, 0, len(metas))
+	for _, meta := range metas {
+		view := MetaView{
+			OrderType: meta.OrderType(),
+			UnsetCode: meta.UnsetCode(),
+		}
+		if code, ok := meta.ReverseCode(); ok {
+			view.ReverseCode = &code
+		}
+		for _, status := range meta.Statuses() {
+			view.Statuses = append(view.Statuses, StatusView{
+				Code: status.Code,
+				Note: status.Note,
+				Step: status.Step.String(),
+			})
+		}
+		views = append(views, view)
+	}
+	writeJSON(w, views)
+}
+
+// Stats reports the queue depth, the busy workers and the per-type counts.
+func (h *AdminHandler) Stats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.opayInstance.Stats())
+}
+
+// InFlight lists the requests being processed.
+func (h *AdminHandler) InFlight(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.opayInstance.InFlight())
+}
+
+// AuditRequest gives the reason of a dead letter action, the operator is the authenticated one.
+type AuditRequest struct {
+	Note string `json:"note"`
+}
+
+// ReplayResponse reports the outcome of a replayed dead letter.
+type ReplayResponse struct {
+	Id       int64   `json:"id"`
+	Error    string  `json:"error,omitempty"`
+	Executed string  `json:"executed,omitempty"`
+	Took     float64 `json:"took_seconds"`
+}
+
+// DeadLetters lists the failed requests, filtered by the "status" query and capped by "limit".
+func (h *AdminHandler) DeadLetters(w http.ResponseWriter, r *http.Request) {
+	store := h.opayInstance.DeadLetters()
+	if store == nil {
+		writeDeadLetterError(w, opay.ErrNoDeadLetterStore)
+		return
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	list, err := store.List(r.URL.Query().Get("status"), limit)
+	if err != nil {
+		writeDeadLetterError(w, err)
+		return
+	}
+	writeJSON(w, list)
+}
+
+// DeadLetter shows a failed request with its attempts and audit notes.
+func (h *AdminHandler) DeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, ok := deadLetterId(w, r)
+	if !ok {
+		return
+	}
+	store := h.opayInstance.DeadLetters()
+	if store == nil {
+		writeDeadLetterError(w, opay.ErrNoDeadLetterStore)
+		return
+	}
+	dl, err := store.Get(id)
+	if err != nil {
+		writeDeadLetterError(w, err)
+		return
+	}
+	writeJSON(w, dl)
+}
+
+// EditDeadLetter corrects the serialized orders of a pending dead letter.
+func (h *AdminHandler) EditDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, ok := deadLetterId(w, r)
+	if !ok {
+		return
+	}
+	operator, ok := operatorFrom(w, r)
+	if !ok {
+		return
+	}
+	var edit opay.DeadLetterEdit
+	if err := json.NewDecoder(r.Body).Decode(&edit); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	edit.Operator = operator
+	dl, err := h.opayInstance.EditDeadLetter(id, edit)
+	if err != nil {
+		writeDeadLetterError(w, err)
+		return
+	}
+	writeJSON(w, dl)
+}
+
+// ReplayDeadLetter resubmits a pending dead letter to the engine.
+func (h *AdminHandler) ReplayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, ok := deadLetterId(w, r)
+	if !ok {
+		return
+	}
+	operator, ok := operatorFrom(w, r)
+	if !ok {
+		return
+	}
+	var audit AuditRequest
+	if err := json.NewDecoder(r.Body).Decode(&audit); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	resp, err := h.opayInstance.Replay(id, operator, audit.Note)
+	if resp == nil {
+		writeDeadLetterError(w, err)
+		return
+	}
+	view := ReplayResponse{
+		Id:       id,
+		Executed: resp.Executed.String(),
+		Took:     resp.Duration().Seconds(),
+	}
+	if resp.Err != nil {
+		view.Error = resp.Err.Error()
+	} else if err != nil {
+		// Processed, but the outcome could not be recorded.
+		view.Error = err.Error()
+	}
+	writeJSON(w, view)
+}
+
+// DiscardDeadLetter gives up a pending dead letter.
+func (h *AdminHandler) DiscardDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, ok := deadLetterId(w, r)
+	if !ok {
+		return
+	}
+	operator, ok := operatorFrom(w, r)
+	if !ok {
+		return
+	}
+	var audit AuditRequest
+	if err := json.NewDecoder(r.Body).Decode(&audit); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	dl, err := h.opayInstance.DiscardDeadLetter(id, operator, audit.Note)
+	if err != nil {
+		writeDeadLetterError(w, err)
+		return
+	}
+	writeJSON(w, dl)
+}
+
+// ConsistencyReport lists the orders whose stored status disagrees with their details.
+type ConsistencyReport struct {
+	Checked         int                   `json:"checked"`
+	Inconsistencies []*base.Inconsistency `json:"inconsistencies"`
+	Next            string                `json:"next,omitempty"` //the "after" query of the next page, empty when all are checked
+}
+
+// CheckOrders replays the details of a page of the stored orders, "limit" orders after the "after" order id.
+func (h *AdminHandler) CheckOrders(w http.ResponseWriter, r *http.Request) {
+	db := h.opayInstance.DB()
+	if db == nil || h.orderStore == nil {
+		http.Error(w, "Order store is not available", http.StatusServiceUnavailable)
+		return
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	report := ConsistencyReport{Inconsistencies: []*base.Inconsistency{}}
+	checked, next, err := base.CheckOrders(db, h.orderStore, r.URL.Query().Get("after"), limit, h.opayInstance.Meta, func(i *base.Inconsistency) {
+		report.Inconsistencies = append(report.Inconsistencies, i)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	report.Checked, report.Next = checked, next
+	writeJSON(w, report)
+}
+
+// OrderGroupView represents the orders of a business operation, such as an order with its fees and reversals.
+type OrderGroupView struct {
+	GroupId string            `json:"group_id"`
+	Status  string            `json:"status"` //rolled up from the orders
+	Orders  []*base.BaseOrder `json:"orders"`
+}
+
+// OrderGroup shows the group of the order, the order alone if it has no related orders.
+func (h *AdminHandler) OrderGroup(w http.ResponseWriter, r *http.Request) {
+	db := h.opayInstance.DB()
+	if db == nil || h.orderStore == nil {
+		http.Error(w, "Order store is not available", http.StatusServiceUnavailable)
+		return
+	}
+	o, err := h.orderStore.FindById(db, mux.Vars(r)["id"], false)
+	if err != nil {
+		writeOrderError(w, err)
+		return
+	}
+	var (
+		orders []*base.BaseOrder
+		status string
+	)
+	if o.GroupId == "" {
+		// Not grouped, the group is the order itself.
+		meta, ok := h.opayInstance.Meta(o.Type)
+		if !ok {
+			http.Error(w, "Unknown order type "+o.Type, http.StatusInternalServerError)
+			return
+		}
+		o.SetMeta(meta)
+		orders = []*base.BaseOrder{o}
+		status, err = base.RollupStatus(orders)
+	} else {
+		orders, status, err = base.LoadGroup(db, h.orderStore, o.GroupId, h.opayInstance.Meta)
+	}
+	if err != nil {
+		writeOrderError(w, err)
+		return
+	}
+	writeJSON(w, OrderGroupView{GroupId: o.GroupId, Status: status, Orders: orders})
+}
+
+// OrderChildren lists the orders added as the children of the order, such as its fees and reversals.
+func (h *AdminHandler) OrderChildren(w http.ResponseWriter, r *http.Request) {
+	db := h.opayInstance.DB()
+	if db == nil || h.orderStore == nil {
+		http.Error(w, "Order store is not available", http.StatusServiceUnavailable)
+		return
+	}
+	children, err := h.orderStore.FindChildren(db, mux.Vars(r)["id"])
+	if err != nil {
+		writeOrderError(w, err)
+		return
+	}
+	writeJSON(w, children)
+}
+
+func writeOrderError(w http.ResponseWriter, err error) {
+	if errors.Is(err, base.ErrOrderNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func deadLetterId(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid dead letter id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+func writeDeadLetterError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, opay.ErrDeadLetterNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, opay.ErrNotPending), errors.Is(err, opay.ErrDeadLetterConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, opay.ErrNoDeadLetterStore):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+	case errors.Is(err, opay.ErrAuditNoteRequired), errors.Is(err, opay.ErrNoOrderCodec):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		// Mostly the edited orders failed to decode.
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(v)
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net/http"
 
+	"simplopay.com/backend/base"
 	"simplopay.com/backend/internal/auth"
 	userpkg "simplopay.com/backend/internal/user"
 
@@ -16,8 +17,31 @@ type ContextKey string
 
 const (
 	ContextKeyUserID ContextKey = "userID"
+	// ContextKeyOperator holds the operator authenticated by the admin token.
+	ContextKeyOperator ContextKey = "operator"
 )
 
+// operatorFrom returns the authenticated operator, it writes 401 if there is none.
+func operatorFrom(w http.ResponseWriter, r *http.Request) (string, bool) {
+	operator, ok := r.Context().Value(ContextKeyOperator).(string)
+	if !ok || operator == "" {
+		http.Error(w, "Operator not authenticated", http.StatusUnauthorized)
+		return "", false
+	}
+	return operator, true
+}
+
+// requestAudit records who made the request, for the details of the orders it changes.
+func requestAudit(r *http.Request, actorID, actorType string) base.Audit {
+	return base.Audit{
+		Ip:        r.RemoteAddr,
+		ActorId:   actorID,
+		ActorType: actorType,
+		RequestId: r.Header.Get("X-Request-Id"),
+		UserAgent: r.UserAgent(),
+	}
+}
+
 // AuthHandler handles authentication related HTTP requests.
 type AuthHandler struct {
 	authService auth.AuthService
@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"simplopay.com/backend/base"
+	"simplopay.com/backend/handles"
+	"simplopay.com/backend/internal/transaction"
+	userpkg "simplopay.com/backend/internal/user"
+
+	"github.com/gorilla/mux"
+)
+
+// BillHandler handles the bill payment API requests.
+type BillHandler struct {
+	transactionService transaction.TransactionService
+	catalog            *handles.BillCatalog
+}
+
+// NewBillHandler creates a new BillHandler.
+func NewBillHandler(transactionService transaction.TransactionService, catalog *handles.BillCatalog) *BillHandler {
+	return &BillHandler{transactionService: transactionService, catalog: catalog}
+}
+
+// Billers lists the billers of the "category" query, all of them if empty.
+func (h *BillHandler) Billers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.catalog.Billers(r.URL.Query().Get("category")))
+}
+
+// PayBillRequest represents the request body for paying a bill.
+type PayBillRequest struct {
+	BillerID  string            `json:"biller_id"`
+	ProductID string            `json:"product_id"`
+	Fields    map[string]string `json:"fields"`
+	Amount    float64           `json:"amount"`
+}
+
+// PayBillResponse represents the order and the receipt of a bill payment.
+type PayBillResponse struct {
+	OrderID string               `json:"order_id"`
+	Receipt *handles.BillReceipt `json:"receipt"`
+}
+
+// PayBill debits the caller's wallet and pays the bill.
+func (h *BillHandler) PayBill(w http.ResponseWriter, r *http.Request) {
+	var reqBody PayBillRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&reqBody); err != nil || reqBody.Amount <= 0 || reqBody.BillerID == "" || reqBody.ProductID == "" {
+		http.Error(w, "Biller, product and a positive amount are required", http.StatusBadRequest)
+		return
+	}
+	userID, ok := r.Context().Value(ContextKeyUserID).(string)
+	if !ok || userID == "" {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	bill := &handles.Bill{BillerId: reqBody.BillerID, ProductId: reqBody.ProductID, Fields: reqBody.Fields}
+	orderID, receipt, err := h.transactionService.PayBill(userID, bill, reqBody.Amount, requestAudit(r, userID, base.ACTOR_USER))
+	if err != nil {
+		writeBillError(w, err)
+		return
+	}
+	writeJSON(w, PayBillResponse{OrderID: orderID, Receipt: receipt})
+}
+
+// RequeryBill finishes a pending bill payment by the result of the biller gateway.
+func (h *BillHandler) RequeryBill(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["id"]
+	receipt, err := h.transactionService.RequeryBill(orderID)
+	if err != nil {
+		writeBillError(w, err)
+		return
+	}
+	writeJSON(w, PayBillResponse{OrderID: orderID, Receipt: receipt})
+}
+
+func writeBillError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, handles.ErrBillerNotFound), errors.Is(err, handles.ErrBillProduct),
+		errors.Is(err, handles.ErrBillAmount), errors.Is(err, handles.ErrBillField),
+		errors.Is(err, handles.ErrBillCustomer):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, handles.ErrBillNotFound), errors.Is(err, userpkg.ErrUserNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, transaction.ErrBillsUnavailable):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, "Failed to pay the bill", http.StatusInternalServerError)
+	}
+}
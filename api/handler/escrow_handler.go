@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"simplopay.com/backend/base"
+	"simplopay.com/backend/handles"
+	"simplopay.com/backend/internal/transaction"
+	userpkg "simplopay.com/backend/internal/user"
+	"simplopay.com/backend/pkg/opay"
+
+	"github.com/gorilla/mux"
+)
+
+// EscrowHandler handles the escrow payment API requests.
+type EscrowHandler struct {
+	transactionService transaction.TransactionService
+}
+
+// NewEscrowHandler creates a new EscrowHandler.
+func NewEscrowHandler(transactionService transaction.TransactionService) *EscrowHandler {
+	return &EscrowHandler{transactionService: transactionService}
+}
+
+// InitiateEscrowRequest represents the request body for paying a seller through escrow.
+type InitiateEscrowRequest struct {
+	SellerID string  `json:"seller_id"`
+	Amount   float64 `json:"amount"`
+	Note     string  `json:"note"`
+}
+
+// InitiateEscrow moves the amount from the caller's wallet into escrow for the seller.
+func (h *EscrowHandler) InitiateEscrow(w http.ResponseWriter, r *http.Request) {
+	var reqBody InitiateEscrowRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&reqBody); err != nil || reqBody.SellerID == "" || reqBody.Amount <= 0 {
+		http.Error(w, "Seller ID and a positive amount are required", http.StatusBadRequest)
+		return
+	}
+	userID, ok := r.Context().Value(ContextKeyUserID).(string)
+	if !ok || userID == "" {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	audit := requestAudit(r, userID, base.ACTOR_USER)
+	audit.Note = reqBody.Note
+	orderID, opayResp, err := h.transactionService.InitiateEscrow(userID, reqBody.SellerID, reqBody.Amount, audit)
+	if err != nil {
+		writeEscrowError(w, err)
+		return
+	}
+	writeJSON(w, newOrderResponse(userID, orderID, opayResp))
+}
+
+// EscrowActionRequest represents the optional note of an action on an escrow.
+type EscrowActionRequest struct {
+	Note string `json:"note"`
+}
+
+// ConfirmEscrow releases the escrow to the seller, by the buyer.
+func (h *EscrowHandler) ConfirmEscrow(w http.ResponseWriter, r *http.Request) {
+	h.act(w, r, h.transactionService.ConfirmEscrow)
+}
+
+// CancelEscrow refunds the escrow to the buyer, by the seller.
+func (h *EscrowHandler) CancelEscrow(w http.ResponseWriter, r *http.Request) {
+	h.act(w, r, h.transactionService.CancelEscrow)
+}
+
+// DisputeEscrow suspends the automatic release of the escrow, by the buyer.
+func (h *EscrowHandler) DisputeEscrow(w http.ResponseWriter, r *http.Request) {
+	h.act(w, r, h.transactionService.DisputeEscrow)
+}
+
+// act applies the action of the caller to the escrow of the "id" path variable.
+func (h *EscrowHandler) act(w http.ResponseWriter, r *http.Request,
+	action func(orderID, userID string, audit base.Audit) (*opay.Response, error)) {
+	var reqBody EscrowActionRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+	}
+	userID, ok := r.Context().Value(ContextKeyUserID).(string)
+	if !ok || userID == "" {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	orderID := mux.Vars(r)["id"]
+	audit := requestAudit(r, userID, base.ACTOR_USER)
+	audit.Note = reqBody.Note
+	opayResp, err := action(orderID, userID, audit)
+	if err != nil {
+		writeEscrowError(w, err)
+		return
+	}
+	writeJSON(w, newOrderResponse(userID, orderID, opayResp))
+}
+
+// ResolveEscrowRequest represents how an operator resolved a disputed escrow.
+type ResolveEscrowRequest struct {
+	Release bool   `json:"release"` // released to the seller if true, or refunded to the buyer
+	Note    string `json:"note"`
+}
+
+// ResolveEscrow releases or refunds a disputed escrow, the authenticated operator and a note are recorded in the order details.
+func (h *EscrowHandler) ResolveEscrow(w http.ResponseWriter, r *http.Request) {
+	operator, ok := operatorFrom(w, r)
+	if !ok {
+		return
+	}
+	var reqBody ResolveEscrowRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&reqBody); err != nil || reqBody.Note == "" {
+		http.Error(w, "Note is required", http.StatusBadRequest)
+		return
+	}
+	orderID := mux.Vars(r)["id"]
+	audit := requestAudit(r, operator, base.ACTOR_ADMIN)
+	audit.Note = reqBody.Note
+	opayResp, err := h.transactionService.ResolveEscrow(orderID, reqBody.Release, audit)
+	if err != nil {
+		writeEscrowError(w, err)
+		return
+	}
+	writeJSON(w, newOrderResponse("", orderID, opayResp))
+}
+
+func writeEscrowError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, transaction.ErrSelfTransfer), errors.Is(err, transaction.ErrInvalidAmount),
+		errors.Is(err, transaction.ErrInvalidTransferDetails), errors.Is(err, handles.ErrEscrowAccount):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, transaction.ErrNotEscrowParty):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, base.ErrOrderNotFound), errors.Is(err, userpkg.ErrUserNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, transaction.ErrEscrowState), errors.Is(err, base.ErrStatusConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, transaction.ErrEscrowsUnavailable):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, "Failed to process the escrow", http.StatusInternalServerError)
+	}
+}
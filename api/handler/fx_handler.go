@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"simplopay.com/backend/handles"
+)
+
+// FXHandler handles the FX rates and quotes API requests.
+type FXHandler struct {
+	fx    *handles.FX
+	rates *handles.RateTable
+}
+
+// NewFXHandler creates a new FXHandler.
+func NewFXHandler(fx *handles.FX, rates *handles.RateTable) *FXHandler {
+	return &FXHandler{fx: fx, rates: rates}
+}
+
+// Rates lists the mid rates, the quotes apply the spreads on top of them.
+func (h *FXHandler) Rates(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.rates.Rates())
+}
+
+// QuoteRequest represents the request body for a quote to sell an amount of a currency.
+type QuoteRequest struct {
+	From string  `json:"from"`
+	To   string  `json:"to"`
+	Sell float64 `json:"sell"`
+}
+
+// Quote locks the rate of an exchange for the caller, the quote can be used once until it expires.
+func (h *FXHandler) Quote(w http.ResponseWriter, r *http.Request) {
+	var reqBody QuoteRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&reqBody); err != nil || reqBody.From == "" || reqBody.To == "" || reqBody.Sell <= 0 {
+		http.Error(w, "Currencies and a positive sell amount are required", http.StatusBadRequest)
+		return
+	}
+	userID, ok := r.Context().Value(ContextKeyUserID).(string)
+	if !ok || userID == "" {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	quote, err := h.fx.NewQuote(userID, reqBody.From, reqBody.To, reqBody.Sell)
+	switch {
+	case errors.Is(err, handles.ErrQuoteAmount):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, handles.ErrRateNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, "Failed to quote: "+err.Error(), http.StatusInternalServerError)
+	default:
+		writeJSON(w, quote)
+	}
+}
@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"simplopay.com/backend/handles"
+
+	"github.com/gorilla/mux"
+)
+
+// The header of the gateway callback signature, hex encoded HMAC-SHA256 of the body
+const gatewaySignatureHeader = "X-Gateway-Signature"
+
+// The gateway callbacks are small, larger bodies are rejected
+const maxCallbackBytes = 64 << 10
+
+// GatewayHandler handles the callbacks of the payment gateway and their review queue.
+type GatewayHandler struct {
+	gateway *handles.Gateway
+}
+
+// NewGatewayHandler creates a new GatewayHandler.
+func NewGatewayHandler(gateway *handles.Gateway) *GatewayHandler {
+	return &GatewayHandler{gateway: gateway}
+}
+
+// GatewayCallbackResponse represents the outcome of a gateway callback.
+type GatewayCallbackResponse struct {
+	EventID   string `json:"event_id"`
+	Reference string `json:"reference"`
+	Result    string `json:"result"`
+}
+
+// Callback verifies the signed callback of the gateway, and finishes the referenced recharge.
+func (h *GatewayHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxCallbackBytes+1))
+	if err != nil || len(body) > maxCallbackBytes {
+		http.Error(w, "Invalid callback body", http.StatusBadRequest)
+		return
+	}
+	cb, result, err := h.gateway.Handle(body, r.Header.Get(gatewaySignatureHeader))
+	switch {
+	case errors.Is(err, handles.ErrCallbackSignature):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case errors.Is(err, handles.ErrCallbackFormat), errors.Is(err, handles.ErrCallbackExpired):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, handles.ErrCallbackReplay):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		// Not recorded as handled, the gateway may send it again.
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, GatewayCallbackResponse{EventID: cb.EventId, Reference: cb.Reference, Result: result})
+}
+
+// PaymentReviews lists the callbacks in review of the "status" query, open by default.
+func (h *GatewayHandler) PaymentReviews(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = handles.REVIEW_OPEN
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	reviews, err := h.gateway.Reviews(status, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if reviews == nil {
+		reviews = []*handles.PaymentReview{}
+	}
+	writeJSON(w, reviews)
+}
+
+// ResolveReviewRequest represents how an operator resolved a callback in review.
+type ResolveReviewRequest struct {
+	Note string `json:"note"`
+}
+
+// ResolvePaymentReview closes a callback in review, e.g. after a manual recharge or a refund.
+func (h *GatewayHandler) ResolvePaymentReview(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid review id", http.StatusBadRequest)
+		return
+	}
+	var reqBody ResolveReviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	review, err := h.gateway.Resolve(id, reqBody.Note)
+	switch {
+	case errors.Is(err, handles.ErrReviewNote):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, handles.ErrReviewNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, handles.ErrReviewResolved):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, review)
+}
@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"simplopay.com/backend/handles"
+
+	"github.com/gorilla/mux"
+)
+
+// PayoutHandler handles the callbacks of the payout providers, and the reviews of the timed out payouts.
+type PayoutHandler struct {
+	payouts *handles.Payouts
+}
+
+// NewPayoutHandler creates a new PayoutHandler.
+func NewPayoutHandler(payouts *handles.Payouts) *PayoutHandler {
+	return &PayoutHandler{payouts: payouts}
+}
+
+// PayoutCallbackRequest represents the notification of a payout provider.
+type PayoutCallbackRequest struct {
+	Reference string `json:"reference"`
+}
+
+// PayoutCallbackResponse acknowledges a notification, the payout itself is not disclosed to the unauthenticated caller.
+type PayoutCallbackResponse struct {
+	Status string `json:"status"`
+}
+
+// Callback finishes the withdrawal of the notified payout.
+// The notification is not trusted: the result is queried from the provider,
+// so the callback doesn't need to be authenticated.
+func (h *PayoutHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	var reqBody PayoutCallbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil || reqBody.Reference == "" {
+		http.Error(w, "A payout reference is required", http.StatusBadRequest)
+		return
+	}
+	_, err := h.payouts.Notify(mux.Vars(r)["provider"], reqBody.Reference)
+	switch {
+	case errors.Is(err, handles.ErrPayoutProvider), errors.Is(err, handles.ErrPayoutNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		// The provider retries the callback, and the poller finishes it anyway.
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, PayoutCallbackResponse{Status: "accepted"})
+}
+
+// PayoutReviews lists the timed out payouts the provider didn't confirm cancelled, up to the "limit" query.
+func (h *PayoutHandler) PayoutReviews(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	reviews, err := h.payouts.Reviews(limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if reviews == nil {
+		reviews = []*handles.Payout{}
+	}
+	writeJSON(w, reviews)
+}
+
+// ResolvePayoutRequest represents the result of a payout in review, as checked with the provider by an operator.
+type ResolvePayoutRequest struct {
+	Succeeded bool   `json:"succeeded"`
+	Note      string `json:"note"`
+}
+
+// ResolvePayout finishes the withdrawal of a payout in review, the authenticated operator and the note are kept as the reason.
+func (h *PayoutHandler) ResolvePayout(w http.ResponseWriter, r *http.Request) {
+	operator, ok := operatorFrom(w, r)
+	if !ok {
+		return
+	}
+	var reqBody ResolvePayoutRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&reqBody); err != nil || reqBody.Note == "" {
+		http.Error(w, "Note is required", http.StatusBadRequest)
+		return
+	}
+	payout, err := h.payouts.Resolve(mux.Vars(r)["id"], reqBody.Succeeded, operator+": "+reqBody.Note)
+	switch {
+	case errors.Is(err, handles.ErrPayoutNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, handles.ErrPayoutStatus):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, payout)
+}
@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"simplopay.com/backend/internal/schedule"
+	userpkg "simplopay.com/backend/internal/user"
+
+	"github.com/gorilla/mux"
+)
+
+// ScheduleHandler handles the scheduled transfer API requests.
+type ScheduleHandler struct {
+	scheduler *schedule.Scheduler
+	userRepo  userpkg.UserRepository
+}
+
+// NewScheduleHandler creates a new ScheduleHandler.
+func NewScheduleHandler(scheduler *schedule.Scheduler, userRepo userpkg.UserRepository) *ScheduleHandler {
+	return &ScheduleHandler{scheduler: scheduler, userRepo: userRepo}
+}
+
+// CreateScheduleRequest represents the request body for scheduling transfers, the times are unix seconds.
+type CreateScheduleRequest struct {
+	PayeeID    string  `json:"payee_id"`
+	Amount     float64 `json:"amount"`
+	Note       string  `json:"note"`
+	Kind       string  `json:"kind"`     // once, interval or cron
+	Interval   int64   `json:"interval"` // seconds
+	Cron       string  `json:"cron"`
+	StartAt    int64   `json:"start_at"`
+	EndAt      int64   `json:"end_at"`
+	MaxRuns    int     `json:"max_runs"`
+	OnFailure  string  `json:"on_failure"` // skip or pause, skip if empty
+	MaxRetries int     `json:"max_retries"`
+	RetryDelay int64   `json:"retry_delay"` // seconds
+}
+
+// CreateSchedule schedules the transfers from the caller's wallet to the payee.
+func (h *ScheduleHandler) CreateSchedule(w http.ResponseWriter, r *http.Request) {
+	var reqBody CreateScheduleRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&reqBody); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	userID, ok := r.Context().Value(ContextKeyUserID).(string)
+	if !ok || userID == "" {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	if reqBody.PayeeID != "" {
+		if _, err := h.userRepo.FindUserByID(reqBody.PayeeID); err != nil {
+			if errors.Is(err, userpkg.ErrUserNotFound) {
+				http.Error(w, "Payee not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Failed to find the payee", http.StatusInternalServerError)
+			return
+		}
+	}
+	s, err := h.scheduler.Create(&schedule.Schedule{
+		UserID:     userID,
+		PayeeID:    reqBody.PayeeID,
+		Amount:     reqBody.Amount,
+		Note:       reqBody.Note,
+		Kind:       reqBody.Kind,
+		Interval:   reqBody.Interval,
+		Cron:       reqBody.Cron,
+		StartAt:    reqBody.StartAt,
+		EndAt:      reqBody.EndAt,
+		MaxRuns:    reqBody.MaxRuns,
+		OnFailure:  reqBody.OnFailure,
+		MaxRetries: reqBody.MaxRetries,
+		RetryDelay: reqBody.RetryDelay,
+	})
+	if err != nil {
+		writeScheduleError(w, err)
+		return
+	}
+	writeJSON(w, s)
+}
+
+// ListSchedules lists the caller's schedules.
+func (h *ScheduleHandler) ListSchedules(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(ContextKeyUserID).(string)
+	if !ok || userID == "" {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	list, err := h.scheduler.List(userID)
+	if err != nil {
+		writeScheduleError(w, err)
+		return
+	}
+	if list == nil {
+		list = []*schedule.Schedule{}
+	}
+	writeJSON(w, list)
+}
+
+// GetSchedule shows the caller's schedule.
+func (h *ScheduleHandler) GetSchedule(w http.ResponseWriter, r *http.Request) {
+	h.act(w, r, h.scheduler.Get)
+}
+
+// PauseSchedule pauses the caller's schedule.
+func (h *ScheduleHandler) PauseSchedule(w http.ResponseWriter, r *http.Request) {
+	h.act(w, r, h.scheduler.Pause)
+}
+
+// ResumeSchedule resumes the caller's schedule, skipping the occurrences missed while paused.
+func (h *ScheduleHandler) ResumeSchedule(w http.ResponseWriter, r *http.Request) {
+	h.act(w, r, h.scheduler.Resume)
+}
+
+// CancelSchedule cancels the caller's schedule.
+func (h *ScheduleHandler) CancelSchedule(w http.ResponseWriter, r *http.Request) {
+	h.act(w, r, h.scheduler.Cancel)
+}
+
+// act applies the action of the caller to the schedule of the "id" path variable.
+func (h *ScheduleHandler) act(w http.ResponseWriter, r *http.Request, action func(userID, id string) (*schedule.Schedule, error)) {
+	userID, ok := r.Context().Value(ContextKeyUserID).(string)
+	if !ok || userID == "" {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	s, err := action(userID, mux.Vars(r)["id"])
+	if err != nil {
+		writeScheduleError(w, err)
+		return
+	}
+	writeJSON(w, s)
+}
+
+func writeScheduleError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, schedule.ErrInvalidSchedule), errors.Is(err, schedule.ErrNoOccurrence):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, schedule.ErrScheduleNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, schedule.ErrScheduleStatus), errors.Is(err, schedule.ErrScheduleConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "Failed to process the schedule", http.StatusInternalServerError)
+	}
+}
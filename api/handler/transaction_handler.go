@@ -5,9 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
+	"simplopay.com/backend/base"
+	"simplopay.com/backend/internal/account"
 	"simplopay.com/backend/internal/transaction"
 	userpkg "simplopay.com/backend/internal/user"
+	"simplopay.com/backend/pkg/opay"
+
+	"github.com/gorilla/mux"
 )
 
 // TransactionHandler handles transaction related API requests.
@@ -27,6 +33,19 @@ type InitiateP2PTransferRequest struct {
 	Amount           float64 `json:"amount"`
 }
 
+// InitiateP2PTransferResponse represents the response body of a P2P transfer.
+type InitiateP2PTransferResponse struct {
+	Message    string         `json:"message"`
+	OrderID    string         `json:"order_id"`
+	Step       int            `json:"step"`
+	Status     int64          `json:"status"`
+	Balances   []opay.Balance `json:"balances"`
+	QueuedAt   time.Time      `json:"queued_at"`
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at"`
+	Retries    int            `json:"retries"`
+}
+
 // InitiateP2PTransfer handles requests to initiate a P2P transfer.
 func (h *TransactionHandler) InitiateP2PTransfer(w http.ResponseWriter, r *http.Request) {
 	// 1. Parse request body
@@ -66,7 +85,7 @@ func (h *TransactionHandler) InitiateP2PTransfer(w http.ResponseWriter, r *http.
 
 	// 5. Initiate the P2P transfer via the transaction service
 	// The service handles self-transfer check and further validation
-	orderID, _, err := h.transactionService.InitiateP2PTransfer(senderUserID, receiverUser.ID, reqBody.Amount)
+	orderID, opayResp, err := h.transactionService.InitiateP2PTransfer(senderUserID, receiverUser.ID, reqBody.Amount, requestAudit(r, senderUserID, base.ACTOR_USER))
 	if err != nil {
 		// Handle specific transaction initiation errors
 		if errors.Is(err, transaction.ErrSelfTransfer) {
@@ -79,14 +98,182 @@ func (h *TransactionHandler) InitiateP2PTransfer(w http.ResponseWriter, r *http.
 	}
 
 	// 6. Respond to the client
-	// The opayResp contains the final status and any results.
-	// For simplicity, just return a success message for now.
-	// In a real app, you might return more details from opayResp.
+	// The opayResp contains the final status, the balances after settlement and the timing.
+	// Only the sender's own balances are disclosed.
+	resp := InitiateP2PTransferResponse{
+		Message:    fmt.Sprintf("P2P Transfer initiated successfully. Order ID: %s", orderID),
+		OrderID:    orderID,
+		Step:       int(opayResp.Executed),
+		Status:     opayResp.InitiatorStatus,
+		Balances:   []opay.Balance{},
+		QueuedAt:   opayResp.QueuedAt,
+		StartedAt:  opayResp.StartedAt,
+		FinishedAt: opayResp.FinishedAt,
+		Retries:    opayResp.Retries,
+	}
+	for _, balance := range opayResp.Balances {
+		if balance.Uid == senderUserID {
+			resp.Balances = append(resp.Balances, balance)
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"message":  fmt.Sprintf("P2P Transfer initiated successfully. Order ID: %s", orderID),
-		"order_id": orderID,
-	})
+	json.NewEncoder(w).Encode(resp)
+}
+
+// OrderResponse represents the outcome of a single order.
+type OrderResponse struct {
+	OrderID  string         `json:"order_id"`
+	Step     string         `json:"step"`
+	Status   int64          `json:"status"`
+	Balances []opay.Balance `json:"balances"`
+}
+
+// newOrderResponse discloses only the balances of uid, or every balance of the order to an operator if uid is empty.
+func newOrderResponse(uid, orderID string, opayResp *opay.Response) OrderResponse {
+	resp := OrderResponse{
+		OrderID:  orderID,
+		Step:     opayResp.Executed.String(),
+		Status:   opayResp.InitiatorStatus,
+		Balances: []opay.Balance{},
+	}
+	for _, balance := range opayResp.Balances {
+		if uid == "" || balance.Uid == uid {
+			resp.Balances = append(resp.Balances, balance)
+		}
+	}
+	return resp
+}
+
+// InitiateWithdrawalRequest represents the request body for initiating a withdrawal.
+type InitiateWithdrawalRequest struct {
+	Amount      float64 `json:"amount"`
+	Destination string  `json:"destination"` // the default payout account if empty
+}
+
+// InitiateWithdrawal debits the caller's wallet and dispatches the payout.
+func (h *TransactionHandler) InitiateWithdrawal(w http.ResponseWriter, r *http.Request) {
+	var reqBody InitiateWithdrawalRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&reqBody); err != nil || reqBody.Amount <= 0 {
+		http.Error(w, "A positive amount is required", http.StatusBadRequest)
+		return
+	}
+	userID, ok := r.Context().Value(ContextKeyUserID).(string)
+	if !ok || userID == "" {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	orderID, opayResp, err := h.transactionService.InitiateWithdrawal(userID, reqBody.Amount, reqBody.Destination, requestAudit(r, userID, base.ACTOR_USER))
+	if err != nil {
+		http.Error(w, "Failed to initiate withdrawal", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, newOrderResponse(userID, orderID, opayResp))
+}
+
+// InitiateRechargeRequest represents the request body for recharging through the payment gateway.
+type InitiateRechargeRequest struct {
+	Amount float64 `json:"amount"`
+}
+
+// InitiateRecharge creates a pending recharge, its order id is the payment reference to pay through the gateway.
+func (h *TransactionHandler) InitiateRecharge(w http.ResponseWriter, r *http.Request) {
+	var reqBody InitiateRechargeRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&reqBody); err != nil || reqBody.Amount <= 0 {
+		http.Error(w, "A positive amount is required", http.StatusBadRequest)
+		return
+	}
+	userID, ok := r.Context().Value(ContextKeyUserID).(string)
+	if !ok || userID == "" {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+	orderID, opayResp, err := h.transactionService.InitiateRecharge(userID, reqBody.Amount, requestAudit(r, userID, base.ACTOR_USER))
+	if err != nil {
+		http.Error(w, "Failed to initiate recharge", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, newOrderResponse(userID, orderID, opayResp))
+}
+
+// RechargeRequest represents the request body of an operator crediting a wallet.
+type RechargeRequest struct {
+	UserID string  `json:"user_id"`
+	Amount float64 `json:"amount"`
+	Note   string  `json:"note"`
+}
+
+// Recharge credits a user's wallet on behalf of an operator, a note is required for the order details.
+func (h *TransactionHandler) Recharge(w http.ResponseWriter, r *http.Request) {
+	operator, ok := operatorFrom(w, r)
+	if !ok {
+		return
+	}
+	var reqBody RechargeRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&reqBody); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if reqBody.UserID == "" || reqBody.Amount <= 0 || reqBody.Note == "" {
+		http.Error(w, "User ID, positive amount and note are required", http.StatusBadRequest)
+		return
+	}
+	audit := requestAudit(r, operator, base.ACTOR_ADMIN)
+	audit.Note = reqBody.Note
+	orderID, opayResp, err := h.transactionService.Recharge(reqBody.UserID, reqBody.Amount, audit)
+	if err != nil {
+		if errors.Is(err, userpkg.ErrUserNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to recharge", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, newOrderResponse(reqBody.UserID, orderID, opayResp))
+}
+
+// ReverseTransferRequest represents an operator reversing a P2P transfer.
+type ReverseTransferRequest struct {
+	Amount float64 `json:"amount"` // zero reverses the remaining amount
+	Note   string  `json:"note"`
+}
+
+// ReverseP2PTransfer returns a successful transfer to the sender, the authenticated operator and a note are recorded in the order details.
+func (h *TransactionHandler) ReverseP2PTransfer(w http.ResponseWriter, r *http.Request) {
+	operator, ok := operatorFrom(w, r)
+	if !ok {
+		return
+	}
+	var reqBody ReverseTransferRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&reqBody); err != nil || reqBody.Amount < 0 || reqBody.Note == "" {
+		http.Error(w, "Non-negative amount and note are required", http.StatusBadRequest)
+		return
+	}
+	orderID := mux.Vars(r)["id"]
+	audit := requestAudit(r, operator, base.ACTOR_ADMIN)
+	audit.Note = reqBody.Note
+	opayResp, err := h.transactionService.ReverseP2PTransfer(orderID, reqBody.Amount, audit)
+	if err != nil {
+		switch {
+		case errors.Is(err, base.ErrOrderNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, opay.ErrOverReversal), errors.Is(err, opay.ErrNotReversible), errors.Is(err, opay.ErrIncorrectAmount):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, account.ErrInsufficientBalance):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		default:
+			http.Error(w, "Failed to reverse the transfer", http.StatusInternalServerError)
+		}
+		return
+	}
+	writeJSON(w, newOrderResponse("", orderID, opayResp))
 }
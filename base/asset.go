@@ -0,0 +1,107 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+/*
+ * 资产注册表
+ * 将资产代码映射为4位数字的资产ID，写入订单ID
+ * ISO 4217 货币使用其数字代码(1~999)，自定义资产使用 CUSTOM_ASSET_ID_MIN 及以上的ID
+ */
+
+const (
+	CUSTOM_ASSET_ID_MIN = 1000
+	MAX_ASSET_ID        = 9999
+)
+
+var (
+	ErrAssetNotFound = errors.New("asset is not registered.")
+	ErrAssetId       = fmt.Errorf("asset id must be between 1 and %d.", MAX_ASSET_ID)
+)
+
+var assets = struct {
+	ids   map[string]int
+	codes map[int]string
+	lock  sync.RWMutex
+}{
+	ids:   make(map[string]int),
+	codes: make(map[int]string),
+}
+
+// 常用的 ISO 4217 货币
+var iso4217 = map[string]int{
+	"CNY": 156,
+	"EUR": 978,
+	"GBP": 826,
+	"GHS": 936,
+	"JPY": 392,
+	"KES": 404,
+	"NGN": 566,
+	"USD": 840,
+	"XAF": 950,
+	"XOF": 952,
+	"ZAR": 710,
+}
+
+func init() {
+	for code, id := range iso4217 {
+		RegAsset(code, id)
+	}
+}
+
+// 注册资产代码及其数字ID，代码与ID均不可重复注册
+func RegAsset(code string, id int) error {
+	if len(code) == 0 {
+		return errors.New("asset code can not be empty.")
+	}
+	if id <= 0 || id > MAX_ASSET_ID {
+		return ErrAssetId
+	}
+	assets.lock.Lock()
+	defer assets.lock.Unlock()
+	if old, ok := assets.ids[code]; ok {
+		return fmt.Errorf("asset %s has been registered as %04d.", code, old)
+	}
+	if old, ok := assets.codes[id]; ok {
+		return fmt.Errorf("asset id %04d has been registered by %s.", id, old)
+	}
+	assets.ids[code] = id
+	assets.codes[id] = code
+	return nil
+}
+
+// 获取资产代码的数字ID
+func AssetId(code string) (int, bool) {
+	assets.lock.RLock()
+	defer assets.lock.RUnlock()
+	id, ok := assets.ids[code]
+	return id, ok
+}
+
+// 获取数字ID对应的资产代码
+func AssetCode(id int) (string, bool) {
+	assets.lock.RLock()
+	defer assets.lock.RUnlock()
+	code, ok := assets.codes[id]
+	return code, ok
+}
+
+// 已注册的资产代码，按ID排序
+func Assets() []string {
+	assets.lock.RLock()
+	defer assets.lock.RUnlock()
+	ids := make([]int, 0, len(assets.codes))
+	for id := range assets.codes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	codes := make([]string, len(ids))
+	for i, id := range ids {
+		codes[i] = assets.codes[id]
+	}
+	return codes
+}
@@ -0,0 +1,151 @@
+package base
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+ * 订单明细审计链
+ * 每条明细记录操作人、请求及原因，并包含上一条明细的哈希，
+ * 首条明细的上一哈希为订单的创世哈希(绑定订单ID、类型、用户、资产与金额)，
+ * 修改或删除任一条已存储的明细都会使其后的哈希校验失败
+ * 哈希为服务端密钥的 HMAC-SHA256，没有密钥无法重算整条审计链
+ */
+
+// 操作人类型
+const (
+	ACTOR_USER   = "user"
+	ACTOR_ADMIN  = "admin"
+	ACTOR_SYSTEM = "system"
+)
+
+// 一次订单操作的审计信息
+type Audit struct {
+	Ip        string
+	Note      string
+	ActorId   string
+	ActorType string //ACTOR_USER, ACTOR_ADMIN or ACTOR_SYSTEM
+	RequestId string
+	UserAgent string
+	Reason    string //原因代码
+	Metadata  map[string]string
+}
+
+// 审计链的密钥
+var auditKey struct {
+	key  []byte
+	lock sync.RWMutex
+}
+
+// 设置审计链的服务端密钥，须在创建订单前设置，且各进程一致
+// 更换密钥后，旧密钥计算的明细无法通过校验
+func SetAuditKey(key []byte) {
+	auditKey.lock.Lock()
+	auditKey.key = append([]byte(nil), key...)
+	auditKey.lock.Unlock()
+}
+
+func auditHash(b []byte) string {
+	auditKey.lock.RLock()
+	mac := hmac.New(sha256.New, auditKey.key)
+	auditKey.lock.RUnlock()
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 明细审计链校验失败
+type AuditError struct {
+	OrderId string
+	Index   int //出错的明细序号
+	Reason  string
+}
+
+func (e *AuditError) Error() string {
+	return fmt.Sprintf("order %s: detail %d: %s", e.OrderId, e.Index, e.Reason)
+}
+
+func (a Audit) detail(status int64) *Detail {
+	return &Detail{
+		UpdatedAt: time.Now().Unix(),
+		Status:    status,
+		Note:      a.Note,
+		Ip:        a.Ip,
+		ActorId:   a.ActorId,
+		ActorType: a.ActorType,
+		RequestId: a.RequestId,
+		UserAgent: a.UserAgent,
+		Reason:    a.Reason,
+		Metadata:  a.Metadata,
+	}
+}
+
+// 订单的创世哈希
+func (this *BaseOrder) genesis() string {
+	return auditHash([]byte("base_order:" + this.Id + ":" + this.Type + ":" + this.Uid + ":" + this.Aid + ":" +
+		strconv.FormatFloat(this.Amount, 'f', -1, 64)))
+}
+
+// 明细链的末端哈希，无明细时为空
+func (this *BaseOrder) headHash() string {
+	if n := len(this.Details); n > 0 {
+		return this.Details[n-1].Hash
+	}
+	return ""
+}
+
+// 将明细接入审计链
+func (this *BaseOrder) chain(d *Detail) *Detail {
+	d.PrevHash = this.headHash()
+	if len(d.PrevHash) == 0 {
+		d.PrevHash = this.genesis()
+	}
+	d.Hash = d.digest()
+	return d
+}
+
+// 明细的哈希，覆盖除 Hash 以外的全部字段
+func (d *Detail) digest() string {
+	c := *d
+	c.Hash = ""
+	b, _ := json.Marshal(&c)
+	return auditHash(b)
+}
+
+// 新建一条不改变状态的明细，并接入审计链
+func (this *BaseOrder) AddDetail(audit Audit) *Detail {
+	d := this.chain(audit.detail(this.Status))
+	this.Details = append(this.Details, d)
+	this.detailsString = ""
+	return d
+}
+
+// 校验订单明细的审计链
+// 每条明细都须有哈希，去掉哈希的明细不能当作旧明细跳过
+func (this *BaseOrder) VerifyDetails() error {
+	prev := this.genesis()
+	for i, d := range this.Details {
+		if len(d.Hash) == 0 {
+			return &AuditError{OrderId: this.Id, Index: i, Reason: "missing hash"}
+		}
+		want := prev
+		if d.PrevHash != want {
+			return &AuditError{OrderId: this.Id, Index: i, Reason: "broken chain"}
+		}
+		if d.digest() != d.Hash {
+			return &AuditError{OrderId: this.Id, Index: i, Reason: "content modified"}
+		}
+		prev = d.Hash
+	}
+	// 截去末尾的状态变更也可发现
+	if n := len(this.Details); n > 0 && this.Details[n-1].Status != this.Status {
+		return &AuditError{OrderId: this.Id, Index: n - 1, Reason: "status does not match the order"}
+	}
+	return nil
+}
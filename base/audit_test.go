@@ -0,0 +1,63 @@
+package base
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestVerifyDetails(t *testing.T) {
+	SetAuditKey([]byte("audit-key"))
+	defer SetAuditKey(nil)
+	g, _ := NewSnowflakeGenerator(1)
+	id, err := g.NewOrderid("NGN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &BaseOrder{Id: id, Type: "recharge", Uid: "u1", Aid: "NGN", Amount: 100, Status: 1}
+	o.AddDetail(Audit{ActorId: "u1", ActorType: ACTOR_USER, Note: "created"})
+	o.AddDetail(Audit{ActorId: "a1", ActorType: ACTOR_ADMIN, Note: "checked", Reason: "KYC_OK"})
+	o.AddDetail(Audit{ActorId: "sys", ActorType: ACTOR_SYSTEM, Metadata: map[string]string{"job": "reconcile"}})
+	if err := o.VerifyDetails(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 经JSON存储后仍可校验
+	b, err := json.Marshal(o.Details)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored Details
+	if err := json.Unmarshal(b, &stored); err != nil {
+		t.Fatal(err)
+	}
+	o.Details = stored
+	if err := o.VerifyDetails(); err != nil {
+		t.Fatal(err)
+	}
+
+	o.Details[1].Note = "edited"
+	if err, ok := o.VerifyDetails().(*AuditError); !ok || err.Index != 1 || err.Reason != "content modified" {
+		t.Fatalf("expect content modified at 1, got %v", err)
+	}
+	o.Details[1].Note = "checked"
+
+	// 去掉哈希的明细不能当作旧明细
+	hash := o.Details[0].Hash
+	o.Details[0].Hash = ""
+	if err, ok := o.VerifyDetails().(*AuditError); !ok || err.Index != 0 || err.Reason != "missing hash" {
+		t.Fatalf("expect missing hash at 0, got %v", err)
+	}
+	o.Details[0].Hash = hash
+
+	// 没有密钥无法重算审计链
+	SetAuditKey([]byte("forged"))
+	if err, ok := o.VerifyDetails().(*AuditError); !ok || err.Index != 0 || err.Reason != "broken chain" {
+		t.Fatalf("expect broken chain at 0 with another key, got %v", err)
+	}
+	SetAuditKey([]byte("audit-key"))
+
+	o.Details = append(o.Details[:1], o.Details[2])
+	if err, ok := o.VerifyDetails().(*AuditError); !ok || err.Index != 1 || err.Reason != "broken chain" {
+		t.Fatalf("expect broken chain at 1, got %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+
+	"simplopay.com/backend/pkg/opay"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+ * 订单组
+ * 一笔业务产生的多个订单(手续费、冲正、分账、批量代付等)归入同一组，
+ * 组ID为根订单的ID，子订单记录父订单ID及与父订单的关系，
+ * 组的整体状态由子订单的处理行为汇总得出
+ */
+
+// 子订单与父订单的关系
+const (
+	RELATION_FEE        = "fee"
+	RELATION_REVERSAL   = "reversal"
+	RELATION_SPLIT      = "split"
+	RELATION_BATCH_ITEM = "batch_item"
+)
+
+// 订单组的汇总状态
+const (
+	GROUP_PENDING    = "pending"    //均未开始处理
+	GROUP_PROCESSING = "processing" //部分订单仍在处理中
+	GROUP_SUCCEEDED  = "succeeded"  //均已成功
+	GROUP_FAILED     = "failed"     //均已失败或撤销
+	GROUP_PARTIAL    = "partial"    //均已结束，部分成功部分失败
+)
+
+var (
+	ErrRelation   = errors.New("relation kind is invalid.")
+	ErrOrderMeta  = errors.New("order meta is not set.")
+	ErrEmptyGroup = errors.New("order group is empty.")
+)
+
+var relations = map[string]bool{
+	RELATION_FEE:        true,
+	RELATION_REVERSAL:   true,
+	RELATION_SPLIT:      true,
+	RELATION_BATCH_ITEM: true,
+}
+
+// 将订单添加为子订单，两者归入父订单所在的组，父订单无组时以其ID为组ID
+func (this *BaseOrder) AddChild(child *BaseOrder, relation string) error {
+	if !relations[relation] {
+		return ErrRelation
+	}
+	if child == this || child.Id == this.Id {
+		return errors.New("order can not be a child of itself.")
+	}
+	if len(this.GroupId) == 0 {
+		this.GroupId = this.Id
+	}
+	child.GroupId = this.GroupId
+	child.ParentId = this.Id
+	child.Relation = relation
+	return nil
+}
+
+// 是否为组的根订单
+func (this *BaseOrder) IsGroupRoot() bool {
+	return len(this.GroupId) > 0 && this.GroupId == this.Id
+}
+
+// 汇总组内订单的状态，订单须已 SetMeta
+func RollupStatus(orders []*BaseOrder) (string, error) {
+	if len(orders) == 0 {
+		return "", ErrEmptyGroup
+	}
+	var pending, processing, succeeded, failed int
+	for _, o := range orders {
+		if o.meta == nil {
+			return "", ErrOrderMeta
+		}
+		status, ok := o.meta.Status(o.Status)
+		if !ok {
+			return "", opay.ErrInvalidStatus
+		}
+		switch status.Step {
+		case opay.UNSET, opay.PEND:
+			pending++
+		case opay.DO:
+			processing++
+		case opay.SUCCEED, opay.SYNC_DEAL, opay.REVERSE:
+			succeeded++
+		case opay.FAIL, opay.CANCEL:
+			failed++
+		}
+	}
+	switch {
+	case pending == len(orders):
+		return GROUP_PENDING, nil
+	case pending > 0 || processing > 0:
+		return GROUP_PROCESSING, nil
+	case succeeded == len(orders):
+		return GROUP_SUCCEEDED, nil
+	case failed == len(orders):
+		return GROUP_FAILED, nil
+	}
+	return GROUP_PARTIAL, nil
+}
+
+// 读取组内全部订单并设置其 Meta，返回订单及汇总状态
+// metaOf 按订单类型查找 Meta，如 (*opay.Opay).Meta
+func LoadGroup(e sqlx.Ext, store OrderStore, groupId string, metaOf func(orderType string) (*opay.Meta, bool)) ([]*BaseOrder, string, error) {
+	orders, err := store.FindGroup(e, groupId)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, o := range orders {
+		meta, ok := metaOf(o.Type)
+		if !ok {
+			return nil, "", fmt.Errorf("order %s: unknown order type %s.", o.Id, o.Type)
+		}
+		o.meta = meta
+	}
+	status, err := RollupStatus(orders)
+	if err != nil {
+		return nil, "", err
+	}
+	return orders, status, nil
+}
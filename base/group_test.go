@@ -0,0 +1,58 @@
+package base
+
+import (
+	"testing"
+
+	"simplopay.com/backend/pkg/opay"
+)
+
+func TestRollupStatus(t *testing.T) {
+	meta, err := opay.NewOpayWithTxManager(opay.NewMemStore(), 10, 2).RegMeta("payout", opay.HandlerFunc(nil), []opay.Status{
+		{Code: 1, Step: opay.PEND},
+		{Code: 2, Step: opay.DO},
+		{Code: 3, Step: opay.SUCCEED},
+		{Code: 4, Step: opay.FAIL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := &BaseOrder{Id: "batch", meta: meta}
+	newGroup := func(statuses ...int64) []*BaseOrder {
+		orders := make([]*BaseOrder, len(statuses))
+		for i, status := range statuses {
+			orders[i] = &BaseOrder{Id: string(rune('a' + i)), Status: status, meta: meta}
+			if err := root.AddChild(orders[i], RELATION_BATCH_ITEM); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return orders
+	}
+	group := newGroup(1)
+	if group[0].GroupId != "batch" || group[0].ParentId != "batch" || !root.IsGroupRoot() {
+		t.Fatalf("unexpected group: %+v", group[0])
+	}
+	if err := root.AddChild(group[0], "gift"); err != ErrRelation {
+		t.Fatalf("expect ErrRelation, got %v", err)
+	}
+
+	cases := []struct {
+		statuses []int64
+		want     string
+	}{
+		{[]int64{1, 1}, GROUP_PENDING},
+		{[]int64{1, 3}, GROUP_PROCESSING},
+		{[]int64{2, 4}, GROUP_PROCESSING},
+		{[]int64{3, 3}, GROUP_SUCCEEDED},
+		{[]int64{4, 4}, GROUP_FAILED},
+		{[]int64{3, 4}, GROUP_PARTIAL},
+	}
+	for _, c := range cases {
+		status, err := RollupStatus(newGroup(c.statuses...))
+		if err != nil || status != c.want {
+			t.Fatalf("%v: got %q, %v, want %q", c.statuses, status, err, c.want)
+		}
+	}
+	if _, err := RollupStatus([]*BaseOrder{{Status: 1}}); err != ErrOrderMeta {
+		t.Fatalf("expect ErrOrderMeta, got %v", err)
+	}
+}
@@ -1,16 +1,15 @@
 package base
 
 import (
-	"errors"
 	"fmt"
 	"math/rand"
-	"strings"
 	"sync"
 	"time"
 )
 
 var timeZone = time.UTC
 
+// 设置旧格式订单ID的时区，新格式固定为UTC
 func SetTimeZone(name string, hourOffset int) {
 	timeZone = time.FixedZone(name, hourOffset*60*60)
 }
@@ -24,6 +23,8 @@ var orderid = &struct {
 // 可保证同一进程内全局唯一，重复概率为0
 // 不同进程生成的ID几乎不会重复，但仍有重复概率
 // 建议：全部产品使用同一个进程生成ID
+//
+// Deprecated: 多进程部署时使用 NewOrderid
 func CreateOrderid(aid string) string {
 	switch len(aid) {
 	case 0:
@@ -46,26 +47,35 @@ func CreateOrderid(aid string) string {
 	return fmt.Sprintf("%s%09d%09d%s", t.Format("060102150405"), t.Nanosecond(), salt, aid)
 }
 
+// 获取订单ID的资产代码，新格式返回注册的完整代码
 func GetAidFromOrderid(orderid string) string {
-	length := len(orderid)
-	if length < 2 {
-		return ""
-	}
-	return strings.TrimPrefix(orderid[length-2:], "0")
+	return orderidAid(orderid)
 }
 
+// 校验新旧两种格式的订单ID，新格式会校验校验位
 func CheckOrderid(orderid string) (aid string, err error) {
-	if len(orderid) != 32 {
-		return "", errors.New("orderid is not the correct length.")
+	if len(orderid) == ORDERID_LEN {
+		info, err := ParseOrderid(orderid)
+		if err != nil {
+			return "", err
+		}
+		return info.Aid, nil
+	}
+	if len(orderid) != LEGACY_ORDERID_LEN {
+		return "", ErrOrderidLength
 	}
 	aid = GetAidFromOrderid(orderid)
 	if len(aid) == 0 {
-		return "", errors.New("orderid's 'aid' section is incorrect.")
+		return "", ErrOrderidAid
 	}
 	return aid, nil
 }
 
 func GetTimeFromOrderid(orderid string) time.Time {
+	if len(orderid) == ORDERID_LEN {
+		t, _ := time.Parse(orderidTimeLayout, orderid[:12]+"."+orderid[12:15])
+		return t
+	}
 	length := len(orderid)
 	if length < 12 {
 		return time.Time{}
@@ -2,6 +2,7 @@ package base
 
 import (
 	"testing"
+	"time"
 )
 
 func TestCreateOrderid(t *testing.T) {
@@ -14,3 +15,99 @@ func TestCreateOrderid(t *testing.T) {
 func TestGetTimeFromOrderid(t *testing.T) {
 	t.Log(GetTimeFromOrderid("1612011008581826898744368413960e"))
 }
+
+func TestSnowflakeGenerator(t *testing.T) {
+	g, _ := NewSnowflakeGenerator(7)
+	now := time.Date(2024, 10, 18, 12, 30, 45, 129e6, time.UTC)
+	g.clock = func() time.Time { return now }
+
+	seen := make(map[string]bool)
+	for i := 0; i <= MAX_SEQUENCE+1; i++ {
+		orderid, err := g.NewOrderid("NGN")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[orderid] {
+			t.Fatalf("repeat orderid: %s", orderid)
+		}
+		seen[orderid] = true
+	}
+
+	// The clock moving backward does not repeat the ids either.
+	now = now.Add(-time.Second)
+	orderid, _ := g.NewOrderid("NGN")
+	info, err := ParseOrderid(orderid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Aid != "NGN" || info.Node != 7 || info.Legacy || !info.Time.Equal(now.Add(time.Second+time.Millisecond)) {
+		t.Fatalf("unexpected orderid info: %+v", info)
+	}
+	if aid, err := CheckOrderid(orderid); aid != "NGN" || err != nil {
+		t.Fatalf("unexpected check result: %q, %v", aid, err)
+	}
+	t.Log(orderid)
+}
+
+func TestCheckOrderid(t *testing.T) {
+	g, _ := NewSnowflakeGenerator(1)
+	g.clock = func() time.Time { return time.Date(2024, 10, 18, 12, 30, 45, 0, time.UTC) }
+	orderid, _ := g.NewOrderid("NGN")
+
+	// A single typo and an adjacent transposition are caught.
+	typo := []byte(orderid)
+	typo[3] = typo[3] + 1
+	swapped := []byte(orderid)
+	swapped[16], swapped[17] = orderid[17], orderid[16]
+
+	// The early format with the 2 bytes aid is no longer accepted.
+	v1 := "241018123045000" + "001" + "0000" + "NG"
+	v1 += string(luhnCheckChar(v1))
+
+	cases := []struct {
+		orderid string
+		err     error
+	}{
+		{orderid, nil},
+		{v1, ErrOrderidLength},
+		{"1612011008581826898744368413960e", nil},
+		{string(typo), ErrOrderidChecksum},
+		{string(swapped), ErrOrderidChecksum},
+		{"24101812304500100000NGk", ErrOrderidLength},
+		{orderid[:26] + "-", ErrOrderidChar},
+	}
+	for _, c := range cases {
+		if _, err := CheckOrderid(c.orderid); err != c.err {
+			t.Errorf("%s: got %v, want %v", c.orderid, err, c.err)
+		}
+	}
+}
+
+func TestAsset(t *testing.T) {
+	if err := RegAsset("NIBSS_NGN", CUSTOM_ASSET_ID_MIN+566); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegAsset("NAIRA", 566); err == nil {
+		t.Fatal("expect the repeat asset id to be refused")
+	}
+	if _, err := NewOrderid("NGN"); err != ErrNoIDGenerator {
+		t.Fatalf("expect ErrNoIDGenerator, got %v", err)
+	}
+	g, _ := NewSnowflakeGenerator(1)
+	SetIDGenerator(g)
+	defer SetIDGenerator(nil)
+	orderid, err := NewOrderid("NIBSS_NGN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aid := GetAidFromOrderid(orderid); aid != "NIBSS_NGN" {
+		t.Fatalf("expect NIBSS_NGN, got %q", aid)
+	}
+	o := &BaseOrder{Aid: "NGN", LinkId: orderid}
+	if aid := o.GetLinkAid(); aid != "NIBSS_NGN" {
+		t.Fatalf("expect the link aid NIBSS_NGN, got %q", aid)
+	}
+	if _, err := NewOrderid("XYZ"); err != ErrAssetNotFound {
+		t.Fatalf("expect ErrAssetNotFound, got %v", err)
+	}
+}
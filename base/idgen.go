@@ -0,0 +1,215 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * 分布式订单ID
+ * 格式(27字节)：UTC时间到毫秒15 + 节点号3 + 序列号4 + 资产ID4 + 校验位1
+ * 时间格式为 060102150405 加3位毫秒，资产ID见资产注册表
+ * 节点号在各进程间唯一时，ID全局唯一，不存在重复概率
+ * 校验位为 Luhn mod N 算法，可发现单个字符错误及相邻字符对调
+ */
+
+// 订单ID生成器
+type IDGenerator interface {
+	NewOrderid(aid string) (string, error)
+}
+
+const (
+	ORDERID_LEN        = 27 //新格式长度
+	LEGACY_ORDERID_LEN = 32 //CreateOrderid 生成的旧格式长度
+
+	MAX_NODE_ID  = 999
+	MAX_SEQUENCE = 9999 //每毫秒每节点的最大序列号
+
+	orderidTimeLayout = "060102150405.000"
+	orderidAlphabet   = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+var (
+	ErrOrderidLength   = errors.New("orderid is not the correct length.")
+	ErrOrderidAid      = errors.New("orderid's 'aid' section is incorrect.")
+	ErrOrderidChar     = errors.New("orderid contains an invalid character.")
+	ErrOrderidChecksum = errors.New("orderid's check character is incorrect.")
+	ErrNodeId          = fmt.Errorf("node id must be between 0 and %d.", MAX_NODE_ID)
+	ErrNoIDGenerator   = errors.New("order id generator is not set.")
+)
+
+// 基于节点号与序列号的订单ID生成器
+type SnowflakeGenerator struct {
+	node  int
+	last  int64 //上次生成的毫秒时间戳
+	seq   int
+	clock func() time.Time
+	lock  sync.Mutex
+}
+
+var _ IDGenerator = (*SnowflakeGenerator)(nil)
+
+// node 为进程唯一的节点号，范围[0, MAX_NODE_ID]
+func NewSnowflakeGenerator(node int) (*SnowflakeGenerator, error) {
+	if node < 0 || node > MAX_NODE_ID {
+		return nil, ErrNodeId
+	}
+	return &SnowflakeGenerator{node: node, clock: time.Now}, nil
+}
+
+// 生成新格式的订单ID，aid 须为已注册的资产代码
+// 时钟回拨或同一毫秒内序列号用尽时，沿用并递增上次的时间戳，保证不重复
+func (g *SnowflakeGenerator) NewOrderid(aid string) (string, error) {
+	assetId, ok := AssetId(aid)
+	if !ok {
+		return "", ErrAssetNotFound
+	}
+	g.lock.Lock()
+	ms := g.clock().UnixMilli()
+	if ms > g.last {
+		g.last = ms
+		g.seq = 0
+	} else if g.seq < MAX_SEQUENCE {
+		g.seq++
+	} else {
+		g.last++
+		g.seq = 0
+	}
+	ms, seq := g.last, g.seq
+	g.lock.Unlock()
+
+	t := time.UnixMilli(ms).UTC().Format(orderidTimeLayout)
+	body := fmt.Sprintf("%s%03d%04d%04d", strings.Replace(t, ".", "", 1), g.node, seq, assetId)
+	return body + string(luhnCheckChar(body)), nil
+}
+
+// 旧格式的订单ID生成器，即 CreateOrderid
+type LegacyGenerator struct{}
+
+var _ IDGenerator = LegacyGenerator{}
+
+func (LegacyGenerator) NewOrderid(aid string) (string, error) {
+	return CreateOrderid(aid), nil
+}
+
+var idGenerator struct {
+	g    IDGenerator
+	lock sync.RWMutex
+}
+
+// 设置全局的订单ID生成器，没有默认值，未设置时生成订单ID返回 ErrNoIDGenerator
+// 多进程部署时，须为每个进程设置不同节点号的生成器
+func SetIDGenerator(g IDGenerator) {
+	idGenerator.lock.Lock()
+	idGenerator.g = g
+	idGenerator.lock.Unlock()
+}
+
+// 使用全局的订单ID生成器生成订单ID
+func NewOrderid(aid string) (string, error) {
+	idGenerator.lock.RLock()
+	g := idGenerator.g
+	idGenerator.lock.RUnlock()
+	if g == nil {
+		return "", ErrNoIDGenerator
+	}
+	return g.NewOrderid(aid)
+}
+
+// 订单ID的解析结果
+type OrderidInfo struct {
+	Time   time.Time
+	Aid    string //完整的资产代码，旧格式为截取的2字节
+	Node   int    //旧格式无节点号
+	Seq    int    //旧格式为随机盐值
+	Legacy bool   //是否为旧格式
+}
+
+// 解析新旧两种格式的订单ID，新格式会校验校验位
+func ParseOrderid(orderid string) (*OrderidInfo, error) {
+	switch len(orderid) {
+	case LEGACY_ORDERID_LEN:
+		aid, err := CheckOrderid(orderid)
+		if err != nil {
+			return nil, err
+		}
+		seq, _ := strconv.Atoi(orderid[21:30])
+		return &OrderidInfo{
+			Time:   GetTimeFromOrderid(orderid),
+			Aid:    aid,
+			Seq:    seq,
+			Legacy: true,
+		}, nil
+	case ORDERID_LEN:
+	default:
+		return nil, ErrOrderidLength
+	}
+	for i := 0; i < len(orderid); i++ {
+		if strings.IndexByte(orderidAlphabet, orderid[i]) < 0 {
+			return nil, ErrOrderidChar
+		}
+	}
+	if !luhnValid(orderid) {
+		return nil, ErrOrderidChecksum
+	}
+	t, err := time.Parse(orderidTimeLayout, orderid[:12]+"."+orderid[12:15])
+	if err != nil {
+		return nil, ErrOrderidChar
+	}
+	node, err1 := strconv.Atoi(orderid[15:18])
+	seq, err2 := strconv.Atoi(orderid[18:22])
+	if err1 != nil || err2 != nil {
+		return nil, ErrOrderidChar
+	}
+	aid := orderidAid(orderid)
+	if len(aid) == 0 {
+		return nil, ErrOrderidAid
+	}
+	return &OrderidInfo{Time: t, Aid: aid, Node: node, Seq: seq}, nil
+}
+
+// 资产代码，未注册的资产ID返回空
+func orderidAid(orderid string) string {
+	switch len(orderid) {
+	case ORDERID_LEN:
+		id, err := strconv.Atoi(orderid[22:26])
+		if err != nil {
+			return ""
+		}
+		code, _ := AssetCode(id)
+		return code
+	}
+	length := len(orderid)
+	if length < 2 {
+		return ""
+	}
+	return strings.TrimPrefix(orderid[length-2:], "0")
+}
+
+// Luhn mod N 算法的校验位
+func luhnCheckChar(s string) byte {
+	n := len(orderidAlphabet)
+	factor, sum := 2, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		addend := factor * strings.IndexByte(orderidAlphabet, s[i])
+		factor = 3 - factor
+		sum += addend/n + addend%n
+	}
+	return orderidAlphabet[(n-sum%n)%n]
+}
+
+// 校验含校验位的字符串
+func luhnValid(s string) bool {
+	n := len(orderidAlphabet)
+	factor, sum := 1, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		addend := factor * strings.IndexByte(orderidAlphabet, s[i])
+		factor = 3 - factor
+		sum += addend/n + addend%n
+	}
+	return sum%n == 0
+}
@@ -11,8 +11,7 @@ import (
 	"time"
 	"unsafe"
 
-	"github.com/henrylee2cn/opay"
-	"github.com/jmoiron/sqlx"
+	"simplopay.com/backend/pkg/opay"
 )
 
 type (
@@ -24,8 +23,17 @@ type (
 		LinkId  string `json:"link_id" db:"link_id"`
 		LinkUid string `json:"link_uid" db:"link_uid"`
 		Type    string `json:"type" db:"type"` //order type
+		//group and parent of the related orders, see AddChild
+		GroupId  string `json:"group_id,omitempty" db:"group_id"`
+		ParentId string `json:"parent_id,omitempty" db:"parent_id"`
+		Relation string `json:"relation,omitempty" db:"relation"` //relation kind to the parent
 		//the amount of change for the Uid-Aid account, balance of positive and negative representation
-		Amount        float64 `json:"amount" db:"amount"`
+		Amount float64 `json:"amount" db:"amount"`
+		//the fee and its VAT charged to the Uid-Aid account besides the Amount
+		Fee    float64 `json:"fee" db:"fee"`
+		FeeVat float64 `json:"fee_vat" db:"fee_vat"`
+		//the amount already reversed by the reversal children, the same sign as Amount
+		Reversed      float64 `json:"reversed" db:"reversed"`
 		Summary       string  `json:"summary" db:"summary"`
 		Details       Details `json:"details" db:"details"`
 		detailsString string
@@ -43,13 +51,23 @@ type (
 		Status    int64  `json:"status" db:"-"`
 		Note      string `json:"note" db:"-"`
 		Ip        string `json:"ip" db:"-"`
+
+		// audit trail, see Audit
+		ActorId   string            `json:"actor_id,omitempty" db:"-"`
+		ActorType string            `json:"actor_type,omitempty" db:"-"`
+		RequestId string            `json:"request_id,omitempty" db:"-"`
+		UserAgent string            `json:"user_agent,omitempty" db:"-"`
+		Reason    string            `json:"reason,omitempty" db:"-"` //reason code
+		Metadata  map[string]string `json:"metadata,omitempty" db:"-"`
+		PrevHash  string            `json:"prev_hash,omitempty" db:"-"` //hash of the previous detail, or the genesis of the order
+		Hash      string            `json:"hash,omitempty" db:"-"`
 	}
 )
 
 var _ opay.IOrder = new(BaseOrder)
 
-//note: if param note is empty, do not append detail;
-//and if param id is empty, the BaseOrder is new one.
+// note: if param note is empty, do not append detail;
+// and if param id is empty, the BaseOrder is new one.
 func NewBaseOrderFromAid(
 	meta *opay.Meta,
 	aid string,
@@ -60,7 +78,28 @@ func NewBaseOrderFromAid(
 	ip string,
 	note ...string,
 ) (*BaseOrder, error) {
-	return newBaseOrder(meta, CreateOrderid(aid), aid, uid, amount, summary, targetStatus, ip, note...)
+	id, err := NewOrderid(aid)
+	if err != nil {
+		return nil, err
+	}
+	return newBaseOrder(meta, id, aid, uid, amount, summary, targetStatus, newAudit(ip, note...))
+}
+
+// 新建订单，首条明细记录完整的审计信息，见 SetTargetAudit
+func NewBaseOrderWithAudit(
+	meta *opay.Meta,
+	aid string,
+	uid string,
+	amount float64,
+	summary string,
+	targetStatus int64,
+	audit Audit,
+) (*BaseOrder, error) {
+	id, err := NewOrderid(aid)
+	if err != nil {
+		return nil, err
+	}
+	return newBaseOrder(meta, id, aid, uid, amount, summary, targetStatus, audit)
 }
 
 func NewBaseOrderFromId(
@@ -77,7 +116,7 @@ func NewBaseOrderFromId(
 	if err != nil {
 		return nil, err
 	}
-	return newBaseOrder(meta, id, aid, uid, amount, summary, targetStatus, ip, note...)
+	return newBaseOrder(meta, id, aid, uid, amount, summary, targetStatus, newAudit(ip, note...))
 }
 
 func newBaseOrder(
@@ -88,8 +127,7 @@ func newBaseOrder(
 	amount float64,
 	summary string,
 	targetStatus int64,
-	ip string,
-	note ...string,
+	audit Audit,
 ) (*BaseOrder, error) {
 	if meta == nil {
 		return nil, errors.New("Param meta can not be nil.")
@@ -98,7 +136,8 @@ func newBaseOrder(
 	if !ok {
 		return nil, errors.New("Target status is invalid.")
 	}
-	if len(aid) == 0 || len(aid) > 2 || strings.HasPrefix(aid, "0") {
+	// 注册的资产，或旧格式订单ID的2字节资产代码
+	if _, ok := AssetId(aid); !ok && (len(aid) == 0 || len(aid) > 2 || strings.HasPrefix(aid, "0")) {
 		return nil, errors.New("wrong aid format.")
 	}
 	var o = &BaseOrder{
@@ -113,7 +152,7 @@ func newBaseOrder(
 		Details:   []*Detail{},
 		meta:      meta,
 	}
-	err := o.SetTarget(targetStatus, ip, note...)
+	err := o.SetTargetAudit(targetStatus, audit)
 	if err != nil {
 		return nil, err
 	}
@@ -159,38 +198,62 @@ func (this *BaseOrder) GetAmount() float64 {
 	return this.Amount
 }
 
+// Get the fee and its VAT charged besides the amount, both positive.
+func (this *BaseOrder) GetFee() (fee, vat float64) {
+	return this.Fee, this.FeeVat
+}
+
+// Record the fee and its VAT, before the order is created.
+func (this *BaseOrder) SetFee(fee, vat float64) {
+	this.Fee, this.FeeVat = fee, vat
+}
+
 // Async execution, and mark pending.
-func (this *BaseOrder) Pend(tx *sqlx.Tx, kv opay.KV) error {
+func (this *BaseOrder) Pend(tx opay.Tx, kv opay.KV) error {
 	return errors.New("*BaseOrder does not implement opay.IOrder (missing Pend method).")
 }
 
 // Async execution, and mark the doing.
-func (this *BaseOrder) Do(tx *sqlx.Tx, kv opay.KV) error {
+func (this *BaseOrder) Do(tx opay.Tx, kv opay.KV) error {
 	return errors.New("*BaseOrder does not implement opay.IOrder (missing Do method).")
 }
 
 // Async execution, and mark the successful.
-func (this *BaseOrder) Succeed(tx *sqlx.Tx, kv opay.KV) error {
+func (this *BaseOrder) Succeed(tx opay.Tx, kv opay.KV) error {
 	return errors.New("*BaseOrder does not implement opay.IOrder (missing Succeed method).")
 }
 
 // Async execution, and mark canceled.
-func (this *BaseOrder) Cancel(tx *sqlx.Tx, kv opay.KV) error {
+func (this *BaseOrder) Cancel(tx opay.Tx, kv opay.KV) error {
 	return errors.New("*BaseOrder does not implement opay.IOrder (missing Cancel method).")
 }
 
 // Async execution, and mark failure.
-func (this *BaseOrder) Fail(tx *sqlx.Tx, kv opay.KV) error {
+func (this *BaseOrder) Fail(tx opay.Tx, kv opay.KV) error {
 	return errors.New("*BaseOrder does not implement opay.IOrder (missing Fail method).")
 }
 
 // Sync execution, and mark the successful.
-func (this *BaseOrder) SyncDeal(tx *sqlx.Tx, kv opay.KV) error {
+func (this *BaseOrder) SyncDeal(tx opay.Tx, kv opay.KV) error {
 	return errors.New("*BaseOrder does not implement opay.IOrder (missing SyncDeal method).")
 }
 
 // Set the target Action.
 func (this *BaseOrder) SetTarget(targetStatus int64, ip string, note ...string) error {
+	return this.SetTargetAudit(targetStatus, newAudit(ip, note...))
+}
+
+func newAudit(ip string, note ...string) Audit {
+	audit := Audit{Ip: ip}
+	if len(note) > 0 {
+		audit.Note = note[0]
+	}
+	return audit
+}
+
+// Set the target Action, and record who did it and why.
+// The empty note defaults to the note of the target status.
+func (this *BaseOrder) SetTargetAudit(targetStatus int64, audit Audit) error {
 	if this.Status == targetStatus {
 		return errors.New("Target status and the current status is the same.")
 	}
@@ -199,18 +262,11 @@ func (this *BaseOrder) SetTarget(targetStatus int64, ip string, note ...string)
 	if this.Details == nil {
 		this.Details = []*Detail{}
 	}
-	var _note string
-	if len(note) == 0 {
-		_note = this.meta.Note(this.Status)
-	} else {
-		_note = note[0]
+	if len(audit.Note) == 0 {
+		audit.Note = this.meta.Note(this.Status)
 	}
-	this.Details = append(this.Details, &Detail{
-		UpdatedAt: time.Now().Unix(),
-		Status:    this.Status,
-		Note:      _note,
-		Ip:        ip,
-	})
+	this.Details = append(this.Details, this.chain(audit.detail(this.Status)))
+	this.detailsString = ""
 	return nil
 }
 
@@ -245,6 +301,11 @@ func (this *BaseOrder) GetId() string {
 	return this.Id
 }
 
+// Get the amount already reversed, the same sign as the amount.
+func (this *BaseOrder) GetReversed() float64 {
+	return this.Reversed
+}
+
 // Get the order's summary.
 func (this *BaseOrder) GetSummary() string {
 	return this.Summary
@@ -268,6 +329,33 @@ func (this *BaseOrder) GetLinkAid() string {
 	return GetAidFromOrderid(this.LinkId)
 }
 
+// 不含方法的别名，避免编解码时递归
+type baseOrder BaseOrder
+
+// MarshalJSON implements the json Marshaler interface, the previous status is kept for resubmitting.
+func (this *BaseOrder) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		*baseOrder
+		PreStatus int64 `json:"pre_status"`
+	}{(*baseOrder)(this), this.preStatus})
+}
+
+// UnmarshalJSON implements the json Unmarshaler interface.
+func (this *BaseOrder) UnmarshalJSON(b []byte) error {
+	v := struct {
+		*baseOrder
+		PreStatus *int64 `json:"pre_status"`
+	}{baseOrder: (*baseOrder)(this)}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if v.PreStatus != nil {
+		this.preStatus = *v.PreStatus
+	}
+	this.detailsString = ""
+	return nil
+}
+
 var (
 	_ sql.Scanner   = &Details{}
 	_ driver.Valuer = &Details{}
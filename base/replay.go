@@ -0,0 +1,136 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+
+	"simplopay.com/backend/pkg/opay"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+ * 明细重放
+ * 按订单类型的状态变更图，从未设置状态开始依次重放订单明细，
+ * 发现不可能的状态变更，并重建订单的当前状态与上一状态
+ */
+
+// 明细重放失败
+type ReplayError struct {
+	OrderId string
+	Index   int //出错的明细序号
+	From    int64
+	To      int64
+	Reason  string
+}
+
+func (e *ReplayError) Error() string {
+	return fmt.Sprintf("order %s: detail %d: %d -> %d: %s", e.OrderId, e.Index, e.From, e.To, e.Reason)
+}
+
+// 订单的存储状态与明细不一致
+type Inconsistency struct {
+	OrderId  string `json:"order_id"`
+	Type     string `json:"type"`
+	Stored   int64  `json:"stored"`   //存储的状态
+	Replayed int64  `json:"replayed"` //重放得到的状态
+	Reason   string `json:"reason"`
+}
+
+var ErrNoDetails = errors.New("order has no details.")
+
+// 重放明细，返回重放得到的当前状态与上一状态，订单须已 SetMeta
+// 状态不变的明细为备注(见 AddDetail)，不视为状态变更
+func (this *BaseOrder) ReplayDetails() (status, preStatus int64, err error) {
+	if this.meta == nil {
+		return 0, 0, ErrOrderMeta
+	}
+	if len(this.Details) == 0 {
+		return 0, 0, ErrNoDetails
+	}
+	status = this.meta.UnsetCode()
+	preStatus = status
+	for i, d := range this.Details {
+		if d.Status == status {
+			continue
+		}
+		fail := func(reason string) (int64, int64, error) {
+			return 0, 0, &ReplayError{OrderId: this.Id, Index: i, From: status, To: d.Status, Reason: reason}
+		}
+		from, _ := this.meta.Status(status)
+		to, ok := this.meta.Status(d.Status)
+		if !ok || to.Step == opay.UNSET {
+			return fail("unregistered status")
+		}
+		switch from.Step {
+		case opay.CANCEL, opay.FAIL, opay.SUCCEED, opay.SYNC_DEAL, opay.REVERSE:
+			return fail("order has been finished")
+		}
+		if to.Step == opay.CANCEL && from.Step != opay.PEND {
+			return fail("only the pending order can be canceled")
+		}
+		if !this.meta.CanTransit(status, d.Status) {
+			return fail("transition is not allowed")
+		}
+		preStatus, status = status, d.Status
+	}
+	return status, preStatus, nil
+}
+
+// 按明细重建订单的当前状态与上一状态
+func (this *BaseOrder) Rebuild() error {
+	status, preStatus, err := this.ReplayDetails()
+	if err != nil {
+		return err
+	}
+	this.Status, this.preStatus = status, preStatus
+	return nil
+}
+
+// 检查订单的存储状态、状态变更历史及明细审计链，一致时返回 nil
+func (this *BaseOrder) CheckConsistency() *Inconsistency {
+	report := &Inconsistency{OrderId: this.Id, Type: this.Type, Stored: this.Status}
+	status, _, err := this.ReplayDetails()
+	if err != nil {
+		report.Reason = err.Error()
+		return report
+	}
+	report.Replayed = status
+	if status != this.Status {
+		report.Reason = "stored status disagrees with the details"
+		return report
+	}
+	if err := this.VerifyDetails(); err != nil {
+		report.Reason = err.Error()
+		return report
+	}
+	return nil
+}
+
+// 按ID顺序检查一页存储的订单，after 为上一页返回的 next，首页为空，发现不一致时调用 fn
+// metaOf 按订单类型查找 Meta，如 (*opay.Opay).Meta，返回检查的订单数及下一页的 after，为空表示已检查完
+func CheckOrders(e sqlx.Ext, store OrderStore, after string, limit int, metaOf func(orderType string) (*opay.Meta, bool), fn func(*Inconsistency)) (count int, next string, err error) {
+	if limit <= 0 || limit > MAX_PAGE_SIZE {
+		limit = MAX_PAGE_SIZE
+	}
+	orders, err := store.Scan(e, after, limit)
+	if err != nil {
+		return 0, "", err
+	}
+	for _, o := range orders {
+		count++
+		meta, ok := metaOf(o.Type)
+		if !ok {
+			fn(&Inconsistency{OrderId: o.Id, Type: o.Type, Stored: o.Status, Reason: "unknown order type"})
+			continue
+		}
+		o.meta = meta
+		if report := o.CheckConsistency(); report != nil {
+			fn(report)
+		}
+	}
+	if len(orders) == limit {
+		next = orders[len(orders)-1].Id
+	}
+	return count, next, nil
+}
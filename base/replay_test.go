@@ -0,0 +1,58 @@
+package base
+
+import (
+	"testing"
+
+	"simplopay.com/backend/pkg/opay"
+)
+
+func TestReplayDetails(t *testing.T) {
+	meta, err := opay.NewOpayWithTxManager(opay.NewMemStore(), 10, 2).RegMeta("withdraw", opay.HandlerFunc(nil), []opay.Status{
+		{Code: 1, Step: opay.PEND, Next: []int64{2, 4, 5}},
+		{Code: 2, Step: opay.DO, Next: []int64{3, 4}},
+		{Code: 3, Step: opay.SUCCEED},
+		{Code: 4, Step: opay.FAIL},
+		{Code: 5, Step: opay.CANCEL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newOrder := func(status int64, history ...int64) *BaseOrder {
+		o := &BaseOrder{Id: "w1", Type: "withdraw", Status: status, meta: meta}
+		for _, s := range history {
+			o.Details = append(o.Details, o.chain(&Detail{Status: s}))
+		}
+		return o
+	}
+
+	o := newOrder(0, 1, 1, 2, 3)
+	if err := o.Rebuild(); err != nil {
+		t.Fatal(err)
+	}
+	if o.Status != 3 || o.PreStatus() != 2 {
+		t.Fatalf("unexpected rebuilt status %d, %d", o.Status, o.PreStatus())
+	}
+
+	cases := []struct {
+		history []int64
+		index   int
+	}{
+		{[]int64{1, 3}, 1},    //跳过处理中
+		{[]int64{1, 2, 5}, 2}, //撤销处理中的订单
+		{[]int64{1, 4, 2}, 2}, //已结束
+		{[]int64{1, 9}, 1},    //未注册
+	}
+	for _, c := range cases {
+		_, _, err := newOrder(0, c.history...).ReplayDetails()
+		if e, ok := err.(*ReplayError); !ok || e.Index != c.index {
+			t.Fatalf("%v: expect ReplayError at %d, got %v", c.history, c.index, err)
+		}
+	}
+
+	if report := newOrder(2, 1, 2, 3).CheckConsistency(); report == nil || report.Replayed != 3 {
+		t.Fatalf("expect an inconsistency, got %+v", report)
+	}
+	if report := newOrder(3, 1, 2, 3).CheckConsistency(); report != nil {
+		t.Fatalf("unexpected inconsistency %+v", report)
+	}
+}
@@ -0,0 +1,385 @@
+package base
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"simplopay.com/backend/pkg/opay"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+ * 订单存储
+ */
+type (
+	// 订单存储接口，读出的订单须由调用方 SetMeta
+	OrderStore interface {
+		// 新建订单
+		Insert(e sqlx.Ext, o *BaseOrder) error
+
+		// 乐观更新订单状态，仅当库中状态仍为 o.PreStatus() 时生效，否则返回 ErrStatusConflict
+		// 同时追加 SetTarget 记录的最后一条明细，库中的明细链末端须与之衔接
+		UpdateStatus(e sqlx.Ext, o *BaseOrder) error
+
+		// 追加一条不改变状态的明细，库中的明细链末端须与 o 一致，否则返回 ErrStatusConflict
+		AppendDetail(e sqlx.Ext, o *BaseOrder, audit Audit) (*Detail, error)
+
+		// 累加冲正金额，锁定订单后检查累计冲正金额不超过订单金额，否则返回 opay.ErrOverReversal
+		// 同时保存订单所在的组，见 AddChild
+		AddReversed(e sqlx.Ext, o *BaseOrder, amount float64) error
+
+		// 查询订单，事务内加 FOR UPDATE 锁定
+		FindById(e sqlx.Ext, id string, forUpdate bool) (*BaseOrder, error)
+
+		// 查询关联订单
+		FindLinked(e sqlx.Ext, o *BaseOrder) (*BaseOrder, error)
+
+		// 查询组内全部订单，按创建时间正序
+		FindGroup(e sqlx.Ext, groupId string) ([]*BaseOrder, error)
+
+		// 查询子订单，按创建时间正序
+		FindChildren(e sqlx.Ext, parentId string) ([]*BaseOrder, error)
+
+		// 按ID顺序分批读取全部订单，after 为上一批最后的订单ID，首批为空
+		Scan(e sqlx.Ext, after string, limit int) ([]*BaseOrder, error)
+
+		// 按ID顺序分批查询类型及状态的订单，如待查询结果的缴费订单，after 同 Scan
+		FindByStatus(e sqlx.Ext, orderType string, status int64, after string, limit int) ([]*BaseOrder, error)
+
+		// 按用户分页查询订单，按创建时间倒序
+		// cursor 为上一页返回的游标，首页为空；返回的游标为空表示没有下一页
+		ListByUid(e sqlx.Ext, uid string, filter OrderFilter, cursor string, limit int) (orders []*BaseOrder, next string, err error)
+	}
+
+	// 订单查询条件，零值表示不限
+	OrderFilter struct {
+		Aid      string
+		Type     string
+		Statuses []int64
+		Since    int64 //创建时间下限(含)，秒
+		Until    int64 //创建时间上限(不含)，秒
+	}
+)
+
+var (
+	ErrOrderNotFound  = errors.New("order is not found.")
+	ErrStatusConflict = errors.New("order status has been changed by others.")
+	ErrCursor         = errors.New("cursor is incorrect.")
+)
+
+const (
+	DEFAULT_PAGE_SIZE = 20
+	MAX_PAGE_SIZE     = 100
+)
+
+// 订单表结构
+const OrderSchema = `
+CREATE TABLE IF NOT EXISTS base_orders (
+	id         VARCHAR(64) PRIMARY KEY,
+	aid        VARCHAR(32) NOT NULL,
+	uid        VARCHAR(64) NOT NULL,
+	link_id    VARCHAR(64) NOT NULL DEFAULT '',
+	link_uid   VARCHAR(64) NOT NULL DEFAULT '',
+	group_id   VARCHAR(64) NOT NULL DEFAULT '',
+	parent_id  VARCHAR(64) NOT NULL DEFAULT '',
+	relation   VARCHAR(16) NOT NULL DEFAULT '',
+	type       VARCHAR(64) NOT NULL,
+	amount     NUMERIC(20, 8) NOT NULL,
+	fee        NUMERIC(20, 8) NOT NULL DEFAULT 0,
+	fee_vat    NUMERIC(20, 8) NOT NULL DEFAULT 0,
+	reversed   NUMERIC(20, 8) NOT NULL DEFAULT 0,
+	summary    TEXT NOT NULL DEFAULT '',
+	details    JSONB NOT NULL DEFAULT '[]',
+	status     BIGINT NOT NULL,
+	created_at BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS base_orders_uid_idx ON base_orders (uid, created_at DESC, id DESC);
+CREATE INDEX IF NOT EXISTS base_orders_link_idx ON base_orders (link_id);
+ALTER TABLE base_orders ADD COLUMN IF NOT EXISTS group_id VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE base_orders ADD COLUMN IF NOT EXISTS parent_id VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE base_orders ADD COLUMN IF NOT EXISTS relation VARCHAR(16) NOT NULL DEFAULT '';
+ALTER TABLE base_orders ADD COLUMN IF NOT EXISTS fee NUMERIC(20, 8) NOT NULL DEFAULT 0;
+ALTER TABLE base_orders ADD COLUMN IF NOT EXISTS fee_vat NUMERIC(20, 8) NOT NULL DEFAULT 0;
+ALTER TABLE base_orders ADD COLUMN IF NOT EXISTS reversed NUMERIC(20, 8) NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS base_orders_group_idx ON base_orders (group_id, created_at, id) WHERE group_id <> '';
+CREATE INDEX IF NOT EXISTS base_orders_parent_idx ON base_orders (parent_id) WHERE parent_id <> '';
+CREATE INDEX IF NOT EXISTS base_orders_status_idx ON base_orders (type, status, id);
+`
+
+const orderColumns = `id, aid, uid, link_id, link_uid, group_id, parent_id, relation, type, amount, fee, fee_vat, reversed, summary, details, status, created_at`
+
+// 基于SQL数据库的订单存储，追加明细使用 PostgreSQL 的 jsonb 拼接
+type SQLOrderStore struct{}
+
+var _ OrderStore = (*SQLOrderStore)(nil)
+
+func NewSQLOrderStore() *SQLOrderStore {
+	return &SQLOrderStore{}
+}
+
+func (*SQLOrderStore) Insert(e sqlx.Ext, o *BaseOrder) error {
+	details, err := o.Details.Value()
+	if err != nil {
+		return err
+	}
+	_, err = e.Exec(e.Rebind(`INSERT INTO base_orders (`+orderColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		o.Id, o.Aid, o.Uid, o.LinkId, o.LinkUid, o.GroupId, o.ParentId, o.Relation,
+		o.Type, o.Amount, o.Fee, o.FeeVat, o.Reversed, o.Summary, details, o.Status, o.CreatedAt)
+	return err
+}
+
+// 比较并更新状态，并发的状态变更只有一个成功，且不会覆盖其他写入者追加的明细
+func (s *SQLOrderStore) UpdateStatus(e sqlx.Ext, o *BaseOrder) error {
+	appended, head := "[]", o.headHash()
+	if n := len(o.Details); n > 0 && o.Details[n-1].Status == o.Status {
+		b, err := json.Marshal(o.Details[n-1:])
+		if err != nil {
+			return err
+		}
+		appended = string(b)
+		if n > 1 {
+			head = o.Details[n-2].Hash
+		} else {
+			head = ""
+		}
+	}
+	// 组关系只会设置不会清除，空值不覆盖其他写入者设置的组关系
+	result, err := e.Exec(e.Rebind(`UPDATE base_orders
+		SET status = ?, link_id = ?, link_uid = ?,
+			group_id = COALESCE(NULLIF(?, ''), group_id), parent_id = COALESCE(NULLIF(?, ''), parent_id),
+			relation = COALESCE(NULLIF(?, ''), relation), fee = ?, fee_vat = ?,
+			details = details || CAST(? AS JSONB)
+		WHERE id = ? AND status = ? AND COALESCE(details->-1->>'hash', '') = ?`),
+		o.Status, o.LinkId, o.LinkUid, o.GroupId, o.ParentId, o.Relation, o.Fee, o.FeeVat,
+		appended, o.Id, o.PreStatus(), head)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		if _, err := s.FindById(e, o.Id, false); err != nil {
+			return err
+		}
+		return ErrStatusConflict
+	}
+	o.detailsString = ""
+	return nil
+}
+
+func (s *SQLOrderStore) AppendDetail(e sqlx.Ext, o *BaseOrder, audit Audit) (*Detail, error) {
+	head := o.headHash()
+	detail := o.AddDetail(audit)
+	// 失败时撤销内存中的明细
+	rollback := func() {
+		o.Details = o.Details[:len(o.Details)-1]
+		o.detailsString = ""
+	}
+	b, err := json.Marshal(Details{detail})
+	if err != nil {
+		rollback()
+		return nil, err
+	}
+	result, err := e.Exec(e.Rebind(`UPDATE base_orders SET details = details || CAST(? AS JSONB)
+		WHERE id = ? AND COALESCE(details->-1->>'hash', '') = ?`),
+		string(b), o.Id, head)
+	if err != nil {
+		rollback()
+		return nil, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		rollback()
+		return nil, err
+	}
+	if n == 0 {
+		rollback()
+		if _, err := s.FindById(e, o.Id, false); err != nil {
+			return nil, err
+		}
+		return nil, ErrStatusConflict
+	}
+	return detail, nil
+}
+
+// 先锁定订单，并发的冲正依次检查累计金额，两者都通过检查时后者仍会失败
+func (s *SQLOrderStore) AddReversed(e sqlx.Ext, o *BaseOrder, amount float64) error {
+	stored, err := s.FindById(e, o.Id, true)
+	if err != nil {
+		return err
+	}
+	result, err := e.Exec(e.Rebind(`UPDATE base_orders SET reversed = reversed + ?, group_id = ?
+		WHERE id = ? AND (reversed + ?) * amount > 0 AND ABS(reversed + ?) <= ABS(amount)`),
+		amount, o.GroupId, o.Id, amount, amount)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return opay.ErrOverReversal
+	}
+	o.Reversed = stored.Reversed + amount
+	return nil
+}
+
+func (*SQLOrderStore) FindById(e sqlx.Ext, id string, forUpdate bool) (*BaseOrder, error) {
+	query := `SELECT ` + orderColumns + ` FROM base_orders WHERE id = ?`
+	if forUpdate {
+		query += ` FOR UPDATE`
+	}
+	var o BaseOrder
+	err := sqlx.Get(e, &o, e.Rebind(query), id)
+	if err == sql.ErrNoRows {
+		return nil, ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	o.preStatus = o.Status
+	return &o, nil
+}
+
+func (s *SQLOrderStore) FindLinked(e sqlx.Ext, o *BaseOrder) (*BaseOrder, error) {
+	if len(o.LinkId) == 0 {
+		return nil, ErrOrderNotFound
+	}
+	return s.FindById(e, o.LinkId, false)
+}
+
+func (s *SQLOrderStore) FindGroup(e sqlx.Ext, groupId string) ([]*BaseOrder, error) {
+	if len(groupId) == 0 {
+		return nil, ErrOrderNotFound
+	}
+	return s.selectOrders(e, `group_id = ?`, groupId)
+}
+
+func (s *SQLOrderStore) FindChildren(e sqlx.Ext, parentId string) ([]*BaseOrder, error) {
+	return s.selectOrders(e, `parent_id = ?`, parentId)
+}
+
+func (s *SQLOrderStore) Scan(e sqlx.Ext, after string, limit int) ([]*BaseOrder, error) {
+	return s.scan(e, `id > ?`, after, limit)
+}
+
+func (s *SQLOrderStore) FindByStatus(e sqlx.Ext, orderType string, status int64, after string, limit int) ([]*BaseOrder, error) {
+	return s.scan(e, `type = ? AND status = ? AND id > ?`, orderType, status, after, limit)
+}
+
+// 按ID顺序查询一批订单，最后一个参数为数量
+func (*SQLOrderStore) scan(e sqlx.Ext, where string, args ...interface{}) ([]*BaseOrder, error) {
+	var orders []*BaseOrder
+	err := sqlx.Select(e, &orders, e.Rebind(`SELECT `+orderColumns+` FROM base_orders
+		WHERE `+where+` ORDER BY id LIMIT ?`), args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range orders {
+		o.preStatus = o.Status
+	}
+	return orders, nil
+}
+
+func (*SQLOrderStore) selectOrders(e sqlx.Ext, where string, args ...interface{}) ([]*BaseOrder, error) {
+	var orders []*BaseOrder
+	err := sqlx.Select(e, &orders, e.Rebind(`SELECT `+orderColumns+` FROM base_orders
+		WHERE `+where+` ORDER BY created_at, id`), args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range orders {
+		o.preStatus = o.Status
+	}
+	return orders, nil
+}
+
+func (*SQLOrderStore) ListByUid(e sqlx.Ext, uid string, filter OrderFilter, cursor string, limit int) ([]*BaseOrder, string, error) {
+	if limit <= 0 {
+		limit = DEFAULT_PAGE_SIZE
+	} else if limit > MAX_PAGE_SIZE {
+		limit = MAX_PAGE_SIZE
+	}
+	where := []string{"uid = ?"}
+	args := []interface{}{uid}
+	if len(filter.Aid) > 0 {
+		where = append(where, "aid = ?")
+		args = append(args, filter.Aid)
+	}
+	if len(filter.Type) > 0 {
+		where = append(where, "type = ?")
+		args = append(args, filter.Type)
+	}
+	if len(filter.Statuses) > 0 {
+		where = append(where, "status IN (?"+strings.Repeat(", ?", len(filter.Statuses)-1)+")")
+		for _, status := range filter.Statuses {
+			args = append(args, status)
+		}
+	}
+	if filter.Since > 0 {
+		where = append(where, "created_at >= ?")
+		args = append(args, filter.Since)
+	}
+	if filter.Until > 0 {
+		where = append(where, "created_at < ?")
+		args = append(args, filter.Until)
+	}
+	if len(cursor) > 0 {
+		createdAt, id, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		where = append(where, "(created_at, id) < (?, ?)")
+		args = append(args, createdAt, id)
+	}
+	// 多查一条，判断是否有下一页
+	args = append(args, limit+1)
+	var orders []*BaseOrder
+	err := sqlx.Select(e, &orders, e.Rebind(`SELECT `+orderColumns+` FROM base_orders
+		WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY created_at DESC, id DESC LIMIT ?`), args...)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, o := range orders {
+		o.preStatus = o.Status
+	}
+	var next string
+	if len(orders) > limit {
+		orders = orders[:limit]
+		last := orders[limit-1]
+		next = encodeCursor(last.CreatedAt, last.Id)
+	}
+	return orders, next, nil
+}
+
+// 游标为最后一条订单的创建时间与ID
+func encodeCursor(createdAt int64, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", createdAt, id)))
+}
+
+func decodeCursor(cursor string) (int64, string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", ErrCursor
+	}
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 || len(parts[1]) == 0 {
+		return 0, "", ErrCursor
+	}
+	createdAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", ErrCursor
+	}
+	return createdAt, parts[1], nil
+}
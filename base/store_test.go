@@ -0,0 +1,45 @@
+package base
+
+import (
+	"database/sql/driver"
+	"testing"
+
+	"simplopay.com/backend/pkg/opay/opaytest"
+)
+
+func TestCursor(t *testing.T) {
+	cursor := encodeCursor(1729254645, "24101812304500100000566k")
+	createdAt, id, err := decodeCursor(cursor)
+	if err != nil || createdAt != 1729254645 || id != "24101812304500100000566k" {
+		t.Fatalf("unexpected cursor: %d, %q, %v", createdAt, id, err)
+	}
+	if _, _, err := decodeCursor("bm90LWEtY3Vyc29y"); err != ErrCursor {
+		t.Fatalf("expect ErrCursor, got %v", err)
+	}
+}
+
+func TestUpdateStatusConflict(t *testing.T) {
+	db, mock := opaytest.NewSQLMock(t)
+	store := NewSQLOrderStore()
+	o := &BaseOrder{Id: "o1", Aid: "NGN", Uid: "alice", Amount: -100, Fee: 1.5, Status: 2, preStatus: 1}
+	parent := &BaseOrder{Id: "p1"}
+	parent.AddChild(o, RELATION_FEE)
+
+	// The group and the fee are written with the status.
+	mock.ExpectExec(`^UPDATE base_orders`).
+		WithArgs(int64(2), "", "", "p1", "p1", RELATION_FEE, 1.5, 0.0, "[]", "o1", int64(1), "").
+		WillReturnResult(1)
+	if err := store.UpdateStatus(db, o); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another writer changed the status first, nothing is updated.
+	o.preStatus = 1
+	mock.ExpectExec(`^UPDATE base_orders`).WillReturnResult(0)
+	mock.ExpectQuery(`FROM base_orders WHERE id = \?$`).WithArgs("o1").WillReturnRows(
+		[]string{"id", "aid", "uid", "group_id", "parent_id", "relation", "amount", "fee", "details", "status"},
+		[]driver.Value{"o1", "NGN", "alice", "p1", "p1", RELATION_FEE, -100.0, 1.5, []byte("[]"), int64(3)})
+	if err := store.UpdateStatus(db, o); err != ErrStatusConflict {
+		t.Fatalf("expect ErrStatusConflict, got %v", err)
+	}
+}
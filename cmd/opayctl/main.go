@@ -0,0 +1,205 @@
+// Command opayctl inspects, edits and replays the opay dead letters through the admin API,
+// and checks the stored orders against their details.
+//
+//	opayctl [-addr URL] [-token TOKEN] list [-status pending] [-limit 20]
+//	opayctl show ID
+//	opayctl edit ID -operator NAME -note TEXT [-initiator FILE] [-stakeholder FILE] [-addition FILE]
+//	opayctl replay ID -operator NAME -note TEXT
+//	opayctl discard ID -operator NAME -note TEXT
+//	opayctl check [-batch 100]
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+func main() {
+	log.SetFlags(0)
+	addr := flag.String("addr", envOr("OPAY_ADMIN_ADDR", "http://localhost:8080"), "address of the API server")
+	token := flag.String("token", os.Getenv("OPAY_ADMIN_TOKEN"), "admin token, defaults to $OPAY_ADMIN_TOKEN")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	c := &client{addr: *addr, token: *token, http: &http.Client{Timeout: time.Minute}}
+
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+	var err error
+	switch cmd {
+	case "list":
+		err = c.list(args)
+	case "show":
+		err = c.show(args)
+	case "edit":
+		err = c.edit(args)
+	case "replay", "discard":
+		err = c.audit(cmd, args)
+	case "check":
+		err = c.check(args)
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage: opayctl [-addr URL] [-token TOKEN] <command> [arguments]
+
+commands:
+  list    [-status pending] [-limit 20]      list the dead letters
+  show    ID                                  show a dead letter
+  edit    ID -operator -note [-initiator FILE] [-stakeholder FILE] [-addition FILE]
+  replay  ID -operator -note                  resubmit a pending dead letter
+  discard ID -operator -note                  give up a pending dead letter
+  check   [-batch 100]                        replay the details of all the orders`)
+	flag.PrintDefaults()
+}
+
+type client struct {
+	addr  string
+	token string
+	http  *http.Client
+}
+
+func (c *client) list(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	status := fs.String("status", "pending", "status of the dead letters, empty for all")
+	limit := fs.Int("limit", 20, "maximum number of the dead letters")
+	fs.Parse(args)
+	query := url.Values{}
+	query.Set("status", *status)
+	query.Set("limit", strconv.Itoa(*limit))
+	return c.do("GET", "/admin/opay/deadletters?"+query.Encode(), nil)
+}
+
+func (c *client) show(args []string) error {
+	id, err := parseId(args)
+	if err != nil {
+		return err
+	}
+	return c.do("GET", "/admin/opay/deadletters/"+id, nil)
+}
+
+func (c *client) edit(args []string) error {
+	id, err := parseId(args)
+	if err != nil {
+		return err
+	}
+	fs := flag.NewFlagSet("edit", flag.ExitOnError)
+	operator := fs.String("operator", "", "who edits the dead letter")
+	note := fs.String("note", "", "why the dead letter is edited")
+	initiator := fs.String("initiator", "", "JSON file of the initiator order")
+	stakeholder := fs.String("stakeholder", "", "JSON file of the stakeholder order")
+	addition := fs.String("addition", "", "JSON file of the addition")
+	fs.Parse(args[1:])
+
+	edit := map[string]interface{}{"operator": *operator, "note": *note}
+	for key, path := range map[string]string{"initiator": *initiator, "stakeholder": *stakeholder, "addition": *addition} {
+		if len(path) == 0 {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !json.Valid(data) {
+			return fmt.Errorf("%s: invalid JSON", path)
+		}
+		edit[key] = json.RawMessage(data)
+	}
+	return c.do("POST", "/admin/opay/deadletters/"+id+"/edit", edit)
+}
+
+func (c *client) audit(action string, args []string) error {
+	id, err := parseId(args)
+	if err != nil {
+		return err
+	}
+	fs := flag.NewFlagSet(action, flag.ExitOnError)
+	operator := fs.String("operator", "", "who takes the action")
+	note := fs.String("note", "", "why the action is taken")
+	fs.Parse(args[1:])
+	return c.do("POST", "/admin/opay/deadletters/"+id+"/"+action, map[string]string{
+		"operator": *operator,
+		"note":     *note,
+	})
+}
+
+func (c *client) check(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	batch := fs.Int("batch", 100, "number of the orders read at a time")
+	fs.Parse(args)
+	return c.do("GET", "/admin/orders/consistency?batch="+strconv.Itoa(*batch), nil)
+}
+
+// Send the request and print the indented JSON response.
+func (c *client) do(method, path string, body interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.addr+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Admin-Token", c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, data, "", "  "); err != nil {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	out.WriteByte('\n')
+	_, err = out.WriteTo(os.Stdout)
+	return err
+}
+
+func parseId(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("missing dead letter id")
+	}
+	if _, err := strconv.ParseInt(args[0], 10, 64); err != nil {
+		return "", fmt.Errorf("invalid dead letter id: %s", args[0])
+	}
+	return args[0], nil
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); len(v) > 0 {
+		return v
+	}
+	return def
+}
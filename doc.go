@@ -8,9 +8,10 @@
 // 1. 注册资产账户操作接口实例
 // 2. 实现订单接口
 // 3. 注册订单类型对应的操作接口实例
-// 4. 新建服务实例 var opay=NewOpay(db, 5000)
+// 4. 新建服务实例 var opay=NewOpay(db, 5000, 2)
 // 5. 开启服务协程 go opay.Serve()
-// 6. 推送订单 done, err:=opay.Push(Request{})
-// 7. 使用 <-done 等待订单处理结束
+// 6. 请求处理订单 resp:=opay.Do(&Request{})
+//
+// 本包为 simplopay.com/backend/pkg/opay 的别名，新代码请直接导入该包。
 
 package opay
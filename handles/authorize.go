@@ -0,0 +1,248 @@
+package handles
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"simplopay.com/backend/pkg/opay"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+ * 预授权：先冻结资金，之后全额或部分扣款，或撤销冻结
+ */
+type Authorize struct {
+	Background
+}
+
+// 预授权流程在订单处理行为上的映射，
+// 订单类型的状态列表按此声明各步骤
+const (
+	AUTHORIZE = opay.PEND    //冻结资金
+	CAPTURE   = opay.SUCCEED //扣款，部分扣款时订单金额即为扣款金额
+	VOID      = opay.CANCEL  //撤销冻结
+	EXPIRE    = opay.FAIL    //冻结过期
+)
+
+var (
+	holdSetting = struct {
+		store HoldStore
+		ttl   time.Duration
+		lock  sync.RWMutex
+	}{ttl: 7 * 24 * time.Hour}
+
+	ErrHoldUnset = errors.New("未设置资金冻结存储")
+	ErrOrderId   = errors.New("订单未提供ID")
+)
+
+// 设置资金冻结存储与冻结有效期，
+// 账面余额由资产注册的 opay.BalanceFunc 查询
+func SetHolds(store HoldStore, ttl time.Duration) {
+	holdSetting.lock.Lock()
+	defer holdSetting.lock.Unlock()
+	holdSetting.store = store
+	if ttl > 0 {
+		holdSetting.ttl = ttl
+	}
+}
+
+func holds() (HoldStore, time.Duration, error) {
+	holdSetting.lock.RLock()
+	defer holdSetting.lock.RUnlock()
+	if holdSetting.store == nil {
+		return nil, 0, ErrHoldUnset
+	}
+	return holdSetting.store, holdSetting.ttl, nil
+}
+
+// 编译期检查接口实现
+var _ Handler = (*Authorize)(nil)
+
+// 执行入口
+func (a *Authorize) ServeOpay(ctx *opay.Context) error {
+	if ctx.GreaterOrEqual(ctx.Request.Initiator.GetAmount(), 0) {
+		return opay.ErrIncorrectAmount
+	}
+	if ctx.HasStakeholder() &&
+		!ctx.Equal(ctx.Request.Initiator.GetAmount(), -ctx.Request.Stakeholder.GetAmount()) {
+		return opay.ErrIncorrectAmount
+	}
+	return a.Call(a, ctx)
+}
+
+// 冻结资金，并标记为等待处理状态
+func (a *Authorize) Pend() error {
+	store, ttl, err := holds()
+	if err != nil {
+		return err
+	}
+	ctx := a.Background.Context
+	tx, err := opay.AsSqlxTx(ctx.Request.Tx)
+	if err != nil {
+		return err
+	}
+	initiator := ctx.Request.Initiator
+	id, err := orderId(initiator)
+	if err != nil {
+		return err
+	}
+	amount := -initiator.GetAmount()
+
+	// 可用余额 = 账面余额 - 有效冻结，
+	// 查询账面余额时锁定账户，与其他冻结及扣款互斥，之后再统计冻结
+	ledger, err := ctx.Balance(initiator.GetUid(), initiator.GetAid())
+	if err != nil {
+		return err
+	}
+	held, err := store.Held(tx, initiator.GetUid(), initiator.GetAid())
+	if err != nil {
+		return err
+	}
+	if ctx.Smaller(ledger-held, amount) {
+		return ErrInsufficientFund
+	}
+
+	now := time.Now()
+	err = store.Place(tx, &Hold{
+		OrderId:   id,
+		Uid:       initiator.GetUid(),
+		Aid:       initiator.GetAid(),
+		Amount:    amount,
+		Status:    HOLD_ACTIVE,
+		ExpiresAt: now.Add(ttl).Unix(),
+		CreatedAt: now.Unix(),
+		UpdatedAt: now.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	// 创建订单
+	return ctx.Pend()
+}
+
+// 扣款，解除冻结，并标记订单为成功状态
+func (a *Authorize) Succeed() error {
+	store, _, err := holds()
+	if err != nil {
+		return err
+	}
+	ctx := a.Background.Context
+	tx, err := opay.AsSqlxTx(ctx.Request.Tx)
+	if err != nil {
+		return err
+	}
+	id, err := orderId(ctx.Request.Initiator)
+	if err != nil {
+		return err
+	}
+	hold, err := store.Get(tx, id)
+	if err != nil {
+		return err
+	}
+	captured := -ctx.Request.Initiator.GetAmount()
+	if ctx.Greater(captured, hold.Amount) {
+		return opay.ErrIncorrectAmount
+	}
+	err = store.Capture(tx, id, captured)
+	if err != nil {
+		return err
+	}
+
+	// 操作账户
+	err = ctx.UpdateBalance()
+	if err != nil {
+		return err
+	}
+
+	// 更新订单
+	return ctx.Succeed()
+}
+
+// 撤销冻结，并标记订单为撤销状态
+func (a *Authorize) Cancel() error {
+	err := a.void()
+	if err != nil {
+		return err
+	}
+	return a.Background.Context.Cancel()
+}
+
+// 冻结过期，标记冻结为过期，并标记订单为过期状态
+func (a *Authorize) Fail() error {
+	store, _, err := holds()
+	if err != nil {
+		return err
+	}
+	tx, err := opay.AsSqlxTx(a.Background.Context.Request.Tx)
+	if err != nil {
+		return err
+	}
+	id, err := orderId(a.Background.Context.Request.Initiator)
+	if err != nil {
+		return err
+	}
+	err = store.Expire(tx, id)
+	if err != nil {
+		return err
+	}
+	return a.Background.Context.Fail()
+}
+
+func (a *Authorize) void() error {
+	store, _, err := holds()
+	if err != nil {
+		return err
+	}
+	tx, err := opay.AsSqlxTx(a.Background.Context.Request.Tx)
+	if err != nil {
+		return err
+	}
+	id, err := orderId(a.Background.Context.Request.Initiator)
+	if err != nil {
+		return err
+	}
+	return store.Void(tx, id)
+}
+
+// 过期冻结的默认单次处理数量
+const DEFAULT_HOLD_BATCH = 100
+
+// 查询已过期的冻结，交由 expire 将其订单推进至过期状态（EXPIRE），返回处理的数量
+// 单个订单出错不影响其他订单，返回最后一个错误
+func ExpireHolds(q sqlx.Ext, limit int, expire func(orderId string) error) (int, error) {
+	store, _, err := holds()
+	if err != nil {
+		return 0, err
+	}
+	if limit <= 0 {
+		limit = DEFAULT_HOLD_BATCH
+	}
+	ids, err := store.Expired(q, limit)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, id := range ids {
+		if e := expire(id); e != nil {
+			err = fmt.Errorf("hold of order %s: %w", id, e)
+			continue
+		}
+		n++
+	}
+	return n, err
+}
+
+// 获取订单ID，用于关联冻结记录
+func orderId(order opay.IOrder) (string, error) {
+	o, ok := order.(interface {
+		GetId() string
+	})
+	if !ok || len(o.GetId()) == 0 {
+		return "", ErrOrderId
+	}
+	return o.GetId(), nil
+}
@@ -0,0 +1,465 @@
+package handles
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * 账单缴费
+ * 缴费机构目录列出缴费机构、缴费产品、产品要求的客户信息及金额规则，
+ * 缴费前按目录校验金额与客户信息，并向缴费网关核实客户，
+ * 缴费网关返回的回执及充值码(如电费充值码)记录在订单的成功明细中
+ */
+type (
+	// 缴费机构
+	Biller struct {
+		Id       string        `json:"id"`
+		Name     string        `json:"name"`
+		Category string        `json:"category"` //如 BILL_ELECTRICITY
+		Products []BillProduct `json:"products"`
+	}
+
+	// 缴费产品，固定金额的产品按 Amount 缴费，否则金额须在 Min 与 Max 之间
+	BillProduct struct {
+		Id     string      `json:"id"`
+		Name   string      `json:"name"`
+		Fixed  bool        `json:"fixed"`
+		Amount float64     `json:"amount"`
+		Min    float64     `json:"min"`
+		Max    float64     `json:"max"` //0为不限
+		Fields []BillField `json:"fields"`
+	}
+
+	// 产品要求的客户信息，第一项为客户参考号，如电表号、智能卡号
+	BillField struct {
+		Name    string         `json:"name"`
+		Label   string         `json:"label"`
+		Pattern string         `json:"pattern,omitempty"` //值须匹配的正则表达式
+		pattern *regexp.Regexp //添加到目录时编译
+	}
+
+	// 缴费内容
+	Bill struct {
+		BillerId     string            `json:"biller_id"`
+		ProductId    string            `json:"product_id"`
+		Fields       map[string]string `json:"fields"`
+		CustomerName string            `json:"customer_name,omitempty"` //由缴费网关核实
+	}
+
+	// 缴费回执
+	BillReceipt struct {
+		OrderId   string `json:"order_id"`
+		Status    string `json:"status"` //BILL_PAID, BILL_FAILED or BILL_PENDING
+		ReceiptNo string `json:"receipt_no,omitempty"`
+		Token     string `json:"token,omitempty"` //充值码
+		Message   string `json:"message,omitempty"`
+		PaidAt    int64  `json:"paid_at,omitempty"`
+	}
+
+	// 缴费网关
+	BillerGateway interface {
+		// 核实客户，返回客户名称
+		ValidateCustomer(bill *Bill) (name string, err error)
+
+		// 缴费，以订单ID为幂等键，结果不确定时返回 BILL_PENDING 的回执
+		Pay(orderId string, bill *Bill, amount float64) (*BillReceipt, error)
+
+		// 按订单ID查询缴费结果
+		Query(orderId string) (*BillReceipt, error)
+	}
+
+	// 缴费机构目录
+	BillCatalog struct {
+		billers map[string]*Biller
+		lock    sync.RWMutex
+	}
+
+	// 缴费服务
+	Bills struct {
+		catalog *BillCatalog
+		gateway BillerGateway
+	}
+)
+
+// 缴费机构类别
+const (
+	BILL_ELECTRICITY = "electricity"
+	BILL_CABLE_TV    = "cable_tv"
+	BILL_AIRTIME     = "airtime"
+	BILL_INTERNET    = "internet"
+)
+
+// 缴费结果
+const (
+	BILL_PAID    = "paid"
+	BILL_FAILED  = "failed"
+	BILL_PENDING = "pending"
+)
+
+// 缴费内容及缴费回执在订单附加参数中的键
+const (
+	BILL_KEY         = "bill"
+	BILL_RECEIPT_KEY = "bill_receipt"
+)
+
+var (
+	ErrBillsUnset     = errors.New("未设置缴费服务")
+	ErrBillRequired   = errors.New("缴费须提供缴费内容")
+	ErrBillerNotFound = errors.New("缴费机构不存在")
+	ErrBillProduct    = errors.New("缴费产品不存在")
+	ErrBillAmount     = errors.New("缴费金额不符合产品要求")
+	ErrBillField      = errors.New("客户信息不完整或格式不正确")
+	ErrBillCustomer   = errors.New("客户不存在")
+	ErrBillerFormat   = errors.New("缴费机构配置不正确")
+	ErrBillReceipt    = errors.New("缴费成功须提供回执")
+	ErrBillNotFound   = errors.New("缴费记录不存在")
+)
+
+func NewBillCatalog() *BillCatalog {
+	return &BillCatalog{billers: make(map[string]*Biller)}
+}
+
+// 添加或替换缴费机构，客户信息的正则表达式在此编译
+func (c *BillCatalog) Add(b Biller) error {
+	if len(b.Id) == 0 || len(b.Products) == 0 {
+		return ErrBillerFormat
+	}
+	seen := make(map[string]bool, len(b.Products))
+	products := make([]BillProduct, len(b.Products))
+	for i, p := range b.Products {
+		if len(p.Id) == 0 || seen[p.Id] || len(p.Fields) == 0 || p.Min < 0 || p.Max < 0 ||
+			(p.Fixed && p.Amount <= 0) || (p.Max > 0 && p.Max < p.Min) {
+			return fmt.Errorf("%w: biller %s product %s", ErrBillerFormat, b.Id, p.Id)
+		}
+		seen[p.Id] = true
+		fields := make([]BillField, len(p.Fields))
+		for j, f := range p.Fields {
+			if len(f.Name) == 0 {
+				return fmt.Errorf("%w: biller %s product %s", ErrBillerFormat, b.Id, p.Id)
+			}
+			if len(f.Pattern) > 0 {
+				pattern, err := regexp.Compile(f.Pattern)
+				if err != nil {
+					return fmt.Errorf("%w: biller %s field %s: %v", ErrBillerFormat, b.Id, f.Name, err)
+				}
+				f.pattern = pattern
+			}
+			fields[j] = f
+		}
+		p.Fields = fields
+		products[i] = p
+	}
+	b.Products = products
+	c.lock.Lock()
+	c.billers[b.Id] = &b
+	c.lock.Unlock()
+	return nil
+}
+
+// 从 JSON 数组导入缴费机构
+func (c *BillCatalog) Load(r io.Reader) (int, error) {
+	var billers []Biller
+	if err := json.NewDecoder(r).Decode(&billers); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrBillerFormat, err)
+	}
+	for _, b := range billers {
+		if err := c.Add(b); err != nil {
+			return 0, err
+		}
+	}
+	return len(billers), nil
+}
+
+// 从 JSON 文件导入缴费机构
+func (c *BillCatalog) LoadFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return c.Load(f)
+}
+
+// 查询缴费机构
+func (c *BillCatalog) Biller(id string) (Biller, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	b, ok := c.billers[id]
+	if !ok {
+		return Biller{}, false
+	}
+	return *b, true
+}
+
+// 缴费机构列表，category 为空时列出全部，按ID排序
+func (c *BillCatalog) Billers(category string) []Biller {
+	c.lock.RLock()
+	billers := make([]Biller, 0, len(c.billers))
+	for _, b := range c.billers {
+		if len(category) == 0 || b.Category == category {
+			billers = append(billers, *b)
+		}
+	}
+	c.lock.RUnlock()
+	sort.Slice(billers, func(i, j int) bool {
+		return billers[i].Id < billers[j].Id
+	})
+	return billers
+}
+
+// 按目录校验缴费内容及金额(正数)，返回缴费机构与产品
+func (c *BillCatalog) Check(bill *Bill, amount float64) (Biller, BillProduct, error) {
+	b, ok := c.Biller(bill.BillerId)
+	if !ok {
+		return Biller{}, BillProduct{}, ErrBillerNotFound
+	}
+	for _, p := range b.Products {
+		if p.Id != bill.ProductId {
+			continue
+		}
+		if p.Fixed && math.Abs(amount-p.Amount) > 1e-9 ||
+			!p.Fixed && (amount < p.Min || (p.Max > 0 && amount > p.Max)) {
+			return b, p, ErrBillAmount
+		}
+		for _, f := range p.Fields {
+			v := strings.TrimSpace(bill.Fields[f.Name])
+			if len(v) == 0 {
+				return b, p, fmt.Errorf("%w: %s", ErrBillField, f.Name)
+			}
+			if f.pattern != nil && !f.pattern.MatchString(v) {
+				return b, p, fmt.Errorf("%w: %s", ErrBillField, f.Name)
+			}
+		}
+		return b, p, nil
+	}
+	return b, BillProduct{}, ErrBillProduct
+}
+
+// 客户参考号，即产品要求的第一项客户信息
+func (p BillProduct) CustomerRef(bill *Bill) string {
+	if len(p.Fields) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(bill.Fields[p.Fields[0].Name])
+}
+
+// 新建缴费服务
+func NewBills(catalog *BillCatalog, gateway BillerGateway) *Bills {
+	return &Bills{catalog: catalog, gateway: gateway}
+}
+
+// 缴费机构目录
+func (bs *Bills) Catalog() *BillCatalog {
+	return bs.catalog
+}
+
+// 按目录校验缴费内容，并向缴费网关核实客户
+func (bs *Bills) Validate(bill *Bill, amount float64) error {
+	if _, _, err := bs.catalog.Check(bill, amount); err != nil {
+		return err
+	}
+	name, err := bs.gateway.ValidateCustomer(bill)
+	if err != nil {
+		return err
+	}
+	bill.CustomerName = name
+	return nil
+}
+
+// 通过缴费网关缴费
+func (bs *Bills) Pay(orderId string, bill *Bill, amount float64) (*BillReceipt, error) {
+	return bs.gateway.Pay(orderId, bill, amount)
+}
+
+// 查询缴费结果
+func (bs *Bills) Query(orderId string) (*BillReceipt, error) {
+	return bs.gateway.Query(orderId)
+}
+
+var billSetting = struct {
+	bills *Bills
+	lock  sync.RWMutex
+}{}
+
+// 设置账单缴费使用的缴费服务
+func SetBills(bills *Bills) {
+	billSetting.lock.Lock()
+	billSetting.bills = bills
+	billSetting.lock.Unlock()
+}
+
+func getBills() (*Bills, error) {
+	billSetting.lock.RLock()
+	defer billSetting.lock.RUnlock()
+	if billSetting.bills == nil {
+		return nil, ErrBillsUnset
+	}
+	return billSetting.bills, nil
+}
+
+/*
+ * 模拟缴费网关
+ */
+
+// 模拟缴费网关，仅认可登记的客户，用于测试及本地开发
+// 电费缴费返回20位充值码
+type SimBillerGateway struct {
+	catalog   *BillCatalog
+	customers map[string]string       //机构/客户参考号 -> 客户名称
+	outcomes  map[string]string       //机构/客户参考号 -> 缴费结果，未登记的缴费成功
+	receipts  map[string]*BillReceipt //订单ID
+	category  map[string]string       //订单ID -> 机构类别
+	clock     func() time.Time
+	lock      sync.Mutex
+}
+
+var _ BillerGateway = (*SimBillerGateway)(nil)
+
+func NewSimBillerGateway(catalog *BillCatalog) *SimBillerGateway {
+	return &SimBillerGateway{
+		catalog:   catalog,
+		customers: make(map[string]string),
+		outcomes:  make(map[string]string),
+		receipts:  make(map[string]*BillReceipt),
+		category:  make(map[string]string),
+		clock:     time.Now,
+	}
+}
+
+// 登记客户
+func (s *SimBillerGateway) AddCustomer(billerId, ref, name string) {
+	s.lock.Lock()
+	s.customers[billerId+"/"+ref] = name
+	s.lock.Unlock()
+}
+
+// 指定客户的缴费结果，BILL_FAILED 或 BILL_PENDING
+func (s *SimBillerGateway) SetOutcome(billerId, ref, status string) {
+	s.lock.Lock()
+	s.outcomes[billerId+"/"+ref] = status
+	s.lock.Unlock()
+}
+
+func (s *SimBillerGateway) customerKey(bill *Bill) (string, Biller, error) {
+	b, ok := s.catalog.Biller(bill.BillerId)
+	if !ok {
+		return "", b, ErrBillerNotFound
+	}
+	for _, p := range b.Products {
+		if p.Id == bill.ProductId {
+			return b.Id + "/" + p.CustomerRef(bill), b, nil
+		}
+	}
+	return "", b, ErrBillProduct
+}
+
+func (s *SimBillerGateway) ValidateCustomer(bill *Bill) (string, error) {
+	key, _, err := s.customerKey(bill)
+	if err != nil {
+		return "", err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	name, ok := s.customers[key]
+	if !ok {
+		return "", ErrBillCustomer
+	}
+	return name, nil
+}
+
+func (s *SimBillerGateway) Pay(orderId string, bill *Bill, amount float64) (*BillReceipt, error) {
+	key, biller, err := s.customerKey(bill)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if r, ok := s.receipts[orderId]; ok {
+		c := *r
+		return &c, nil
+	}
+	if _, ok := s.customers[key]; !ok {
+		return nil, ErrBillCustomer
+	}
+	r := &BillReceipt{OrderId: orderId, Status: BILL_PENDING}
+	s.receipts[orderId] = r
+	s.category[orderId] = biller.Category
+	switch s.outcomes[key] {
+	case BILL_FAILED:
+		r.Status, r.Message = BILL_FAILED, "declined by the biller"
+	case BILL_PENDING:
+	default:
+		if err := s.paid(orderId); err != nil {
+			return nil, err
+		}
+	}
+	c := *r
+	return &c, nil
+}
+
+func (s *SimBillerGateway) paid(orderId string) error {
+	r := s.receipts[orderId]
+	r.Status = BILL_PAID
+	r.ReceiptNo = fmt.Sprintf("SIM%08d", len(s.receipts))
+	r.PaidAt = s.clock().Unix()
+	if s.category[orderId] == BILL_ELECTRICITY {
+		token, err := simToken()
+		if err != nil {
+			return err
+		}
+		r.Token = token
+	}
+	return nil
+}
+
+func (s *SimBillerGateway) Query(orderId string) (*BillReceipt, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r, ok := s.receipts[orderId]
+	if !ok {
+		return nil, ErrBillNotFound
+	}
+	c := *r
+	return &c, nil
+}
+
+// 结束待定的缴费
+func (s *SimBillerGateway) Settle(orderId, status string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r, ok := s.receipts[orderId]
+	if !ok {
+		return ErrBillNotFound
+	}
+	if status == BILL_PAID {
+		return s.paid(orderId)
+	}
+	r.Status = status
+	return nil
+}
+
+// 20位数字的充值码，按4位分组
+func simToken() (string, error) {
+	n, err := rand.Int(rand.Reader, new(big.Int).Exp(big.NewInt(10), big.NewInt(20), nil))
+	if err != nil {
+		return "", err
+	}
+	digits := fmt.Sprintf("%020s", n.String())
+	groups := make([]string, 0, 5)
+	for i := 0; i < len(digits); i += 4 {
+		groups = append(groups, digits[i:i+4])
+	}
+	return strings.Join(groups, "-"), nil
+}
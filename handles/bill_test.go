@@ -0,0 +1,111 @@
+package handles
+
+import (
+	"errors"
+	"os"
+	"regexp"
+	"testing"
+
+	"simplopay.com/backend/pkg/opay"
+	"simplopay.com/backend/pkg/opay/opaytest"
+)
+
+func TestBillPayment(t *testing.T) {
+	catalog := NewBillCatalog()
+	f, err := os.Open("../config/billers.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := catalog.Load(f); err != nil {
+		t.Fatal(err)
+	}
+	sim := NewSimBillerGateway(catalog)
+	sim.AddCustomer("ikedc", "45011223344", "ADA OBI")
+	sim.AddCustomer("dstv", "1234567890", "TUNDE BELLO")
+	sim.SetOutcome("dstv", "1234567890", BILL_FAILED)
+	bills := NewBills(catalog, sim)
+	SetBills(bills)
+	defer SetBills(nil)
+
+	h := opaytest.NewHarness(2, "NGN")
+	meta := h.RegMeta("bill_payment", new(BillPayment),
+		opay.Status{Code: 1, Step: opay.PEND},
+		opay.Status{Code: 3, Step: opay.SUCCEED},
+		opay.Status{Code: 4, Step: opay.FAIL})
+	h.Ledger.Fund("alice", "NGN", 20000)
+
+	pend := func(id string, bill *Bill, amount float64) (*opaytest.Order, error) {
+		o := opaytest.NewOrder(meta, id, "alice", "NGN", -amount, 1)
+		return o, h.Opay.Do(&opay.Request{Initiator: o, Addition: map[string]interface{}{BILL_KEY: bill}}).Err
+	}
+	finish := func(o *opaytest.Order, receipt *BillReceipt) error {
+		target := int64(3)
+		if receipt.Status == BILL_FAILED {
+			target = 4
+		}
+		return h.Opay.Do(&opay.Request{Initiator: o.Move(target), Addition: map[string]interface{}{BILL_RECEIPT_KEY: receipt}}).Err
+	}
+
+	// 校验缴费内容与客户
+	for i, c := range []struct {
+		bill   Bill
+		amount float64
+		err    error
+	}{
+		{Bill{BillerId: "nepa"}, 1000, ErrBillerNotFound},
+		{Bill{BillerId: "ikedc", ProductId: "smart"}, 1000, ErrBillProduct},
+		{Bill{BillerId: "ikedc", ProductId: "prepaid", Fields: map[string]string{"meter_number": "45011223344"}}, 100, ErrBillAmount},
+		{Bill{BillerId: "dstv", ProductId: "compact", Fields: map[string]string{"smartcard_number": "1234567890"}}, 15000, ErrBillAmount},
+		{Bill{BillerId: "ikedc", ProductId: "prepaid", Fields: map[string]string{"meter_number": "4501"}}, 1000, ErrBillField},
+		{Bill{BillerId: "ikedc", ProductId: "prepaid", Fields: map[string]string{"meter_number": "45099999999"}}, 1000, ErrBillCustomer},
+	} {
+		if _, err := pend("x", &c.bill, c.amount); !errors.Is(err, c.err) {
+			t.Fatalf("%d: expect %v, got %v", i, c.err, err)
+		}
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 20000)
+
+	// 电费缴费成功，返回充值码
+	bill := &Bill{BillerId: "ikedc", ProductId: "prepaid", Fields: map[string]string{"meter_number": "45011223344"}}
+	o, err := pend("1", bill, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bill.CustomerName != "ADA OBI" {
+		t.Fatalf("unexpected customer %q", bill.CustomerName)
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 18000)
+	if err := h.Do(o.Move(3), nil).Err; !errors.Is(err, ErrBillReceipt) {
+		t.Fatalf("expect ErrBillReceipt, got %v", err)
+	}
+	o.Move(1)
+	receipt, err := bills.Pay("1", bill, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Status != BILL_PAID || !regexp.MustCompile(`^(\d{4}-){4}\d{4}$`).MatchString(receipt.Token) {
+		t.Fatalf("unexpected receipt %+v", receipt)
+	}
+	if again, _ := bills.Pay("1", bill, 2000); again.ReceiptNo != receipt.ReceiptNo {
+		t.Fatalf("expect the same receipt, got %+v", again)
+	}
+	if err := finish(o, receipt); err != nil {
+		t.Fatal(err)
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 18000)
+
+	// 缴费失败退回
+	bill = &Bill{BillerId: "dstv", ProductId: "compact", Fields: map[string]string{"smartcard_number": "1234567890"}}
+	if o, err = pend("2", bill, 15700); err != nil {
+		t.Fatal(err)
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 2300)
+	if receipt, _ = bills.Pay("2", bill, 15700); receipt.Status != BILL_FAILED {
+		t.Fatalf("unexpected receipt %+v", receipt)
+	}
+	if err := finish(o, receipt); err != nil {
+		t.Fatal(err)
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 18000)
+}
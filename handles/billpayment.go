@@ -0,0 +1,95 @@
+package handles
+
+import (
+	"simplopay.com/backend/pkg/opay"
+)
+
+/*
+ * 账单缴费
+ * 新建订单时校验缴费内容并从账户扣款，之后通过缴费网关缴费，
+ * 缴费成功时携带回执标记订单为成功，失败或撤销时退回扣款
+ */
+type BillPayment struct {
+	Background
+}
+
+// 编译期检查接口实现
+var _ Handler = (*BillPayment)(nil)
+
+// 执行入口
+func (b *BillPayment) ServeOpay(ctx *opay.Context) error {
+	if ctx.HasStakeholder() {
+		return opay.ErrExtraStakeholder
+	}
+	if ctx.GreaterOrEqual(ctx.Request.Initiator.GetAmount(), 0) {
+		return opay.ErrIncorrectAmount
+	}
+	return b.Call(b, ctx)
+}
+
+// 校验缴费内容并核实客户，扣款并标记为等待处理状态
+func (b *BillPayment) Pend() error {
+	bills, err := getBills()
+	if err != nil {
+		return err
+	}
+	ctx := b.Background.Context
+	bill, ok := ctx.Get(BILL_KEY).(*Bill)
+	if !ok {
+		return ErrBillRequired
+	}
+	err = bills.Validate(bill, -ctx.Request.Initiator.GetAmount())
+	if err != nil {
+		return err
+	}
+
+	// 操作账户
+	err = ctx.UpdateBalance()
+	if err != nil {
+		return err
+	}
+
+	// 创建订单
+	return ctx.Pend()
+}
+
+// 缴费成功，标记订单为成功状态，须提供缴费网关的回执
+func (b *BillPayment) Succeed() error {
+	ctx := b.Background.Context
+	receipt, ok := ctx.Get(BILL_RECEIPT_KEY).(*BillReceipt)
+	if !ok || receipt.Status != BILL_PAID {
+		return ErrBillReceipt
+	}
+	id, err := orderId(ctx.Request.Initiator)
+	if err != nil {
+		return err
+	}
+	if receipt.OrderId != id {
+		return ErrBillReceipt
+	}
+	return ctx.Succeed()
+}
+
+// 标记订单为撤销状态
+func (b *BillPayment) Cancel() error {
+	// 回滚账户
+	err := b.Background.Context.RollbackBalance()
+	if err != nil {
+		return err
+	}
+
+	// 更新订单
+	return b.Background.Context.Cancel()
+}
+
+// 标记订单为失败状态
+func (b *BillPayment) Fail() error {
+	// 回滚账户
+	err := b.Background.Context.RollbackBalance()
+	if err != nil {
+		return err
+	}
+
+	// 更新订单
+	return b.Background.Context.Fail()
+}
@@ -0,0 +1,436 @@
+package handles
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"simplopay.com/backend/pkg/opay"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+ * 担保交易
+ * 买方订单为发起方，卖方订单为关联方，新建订单时从买方账户转入担保账户，
+ * 买方确认收货或超过自动放款期限时由担保账户放款给卖方，卖方撤销时退回买方，
+ * 买方发起争议后暂停自动放款，由运营人员裁定放款或退款，
+ * 自动放款计划记录于 EscrowStore，到期后通过 EscrowReleaseFunc 放款
+ */
+type Escrow struct {
+	Background
+}
+
+// 编译期检查接口实现
+var _ Handler = (*Escrow)(nil)
+
+type (
+	// 自动放款计划
+	EscrowRelease struct {
+		OrderId   string  `json:"order_id" db:"order_id"` //买方订单ID
+		Uid       string  `json:"uid" db:"uid"`           //买方
+		Aid       string  `json:"aid" db:"aid"`
+		Amount    float64 `json:"amount" db:"amount"` //担保金额，正数
+		Status    string  `json:"status" db:"status"`
+		ReleaseAt int64   `json:"release_at" db:"release_at"`
+		CreatedAt int64   `json:"created_at" db:"created_at"`
+		UpdatedAt int64   `json:"updated_at" db:"updated_at"`
+	}
+
+	// 自动放款计划存储接口，计划不随订单事务回滚
+	EscrowStore interface {
+		// 新建或更新计划
+		Save(r *EscrowRelease) error
+
+		// 按买方订单ID查询
+		Get(orderId string) (*EscrowRelease, error)
+
+		// 到期未处理的计划，按放款时间及订单ID正序，从after之后开始，after为nil时从头开始
+		Due(now int64, after *EscrowRelease, limit int) ([]*EscrowRelease, error)
+	}
+
+	// 放款给卖方，订单仍处于担保中时放款，已确认、撤销或争议中的订单无需处理，应返回 nil
+	EscrowReleaseFunc func(orderId string) error
+
+	// 担保管理
+	Escrows struct {
+		account string //担保账户
+		timeout time.Duration
+		store   EscrowStore
+		release EscrowReleaseFunc
+		owns    func(uid string) bool
+		clock   func() time.Time
+	}
+)
+
+// 自动放款计划状态
+const (
+	ESCROW_SCHEDULED = "scheduled"
+	ESCROW_CLOSED    = "closed"
+)
+
+// 每次处理的到期计划数量
+const DEFAULT_ESCROW_BATCH = 100
+
+var (
+	ErrEscrowsUnset      = errors.New("未设置担保管理")
+	ErrEscrowNotFound    = errors.New("自动放款计划不存在")
+	ErrEscrowAccount     = errors.New("担保账户不能为交易方")
+	ErrEscrowTimeout     = errors.New("自动放款期限须大于0")
+	ErrEscrowReleaseFunc = errors.New("未设置放款处理")
+	ErrEscrowSchedule    = errors.New("自动放款计划与订单不符")
+)
+
+// 新建担保管理，担保资金计入 account 账户，超过 timeout 未确认收货的订单自动放款
+func NewEscrows(account string, timeout time.Duration, store EscrowStore, release EscrowReleaseFunc) (*Escrows, error) {
+	if len(account) == 0 {
+		return nil, ErrEscrowAccount
+	}
+	if timeout <= 0 {
+		return nil, ErrEscrowTimeout
+	}
+	return &Escrows{
+		account: account,
+		timeout: timeout,
+		store:   store,
+		release: release,
+		clock:   time.Now,
+	}, nil
+}
+
+// 担保账户
+func (es *Escrows) Account() string {
+	return es.account
+}
+
+// 设置本节点负责放款的买方，多个节点按账户分片分担到期计划，未设置时处理全部计划
+func (es *Escrows) SetOwns(owns func(uid string) bool) {
+	es.owns = owns
+}
+
+// 为担保订单计划自动放款，须在新建订单前调用，重复计划时沿用已有的计划
+func (es *Escrows) Schedule(orderId, uid, aid string, amount float64) (*EscrowRelease, error) {
+	r, err := es.store.Get(orderId)
+	if err == nil {
+		if r.Uid != uid || r.Aid != aid || r.Amount != amount {
+			return nil, ErrEscrowSchedule
+		}
+		return r, nil
+	}
+	if err != ErrEscrowNotFound {
+		return nil, err
+	}
+	now := es.clock()
+	r = &EscrowRelease{
+		OrderId:   orderId,
+		Uid:       uid,
+		Aid:       aid,
+		Amount:    amount,
+		Status:    ESCROW_SCHEDULED,
+		ReleaseAt: now.Add(es.timeout).Unix(),
+		CreatedAt: now.Unix(),
+		UpdatedAt: now.Unix(),
+	}
+	return r, es.store.Save(r)
+}
+
+// 查询计划
+func (es *Escrows) Get(orderId string) (*EscrowRelease, error) {
+	return es.store.Get(orderId)
+}
+
+// 处理本节点负责的最多limit个到期计划，放款后关闭计划，返回关闭的数量
+// 逐页查询到期计划，避免其他节点的计划占满一页而本节点的计划得不到处理
+// 单个计划出错不影响其他计划，返回最后一个错误
+func (es *Escrows) Poll(limit int) (int, error) {
+	if es.release == nil {
+		return 0, ErrEscrowReleaseFunc
+	}
+	if limit <= 0 {
+		limit = DEFAULT_ESCROW_BATCH
+	}
+	now := es.clock().Unix()
+	var n, handled int
+	var err error
+	var after *EscrowRelease
+	for handled < limit {
+		due, e := es.store.Due(now, after, limit)
+		if e != nil {
+			return n, e
+		}
+		if len(due) == 0 {
+			break
+		}
+		last := *due[len(due)-1]
+		after = &last
+		for _, r := range due {
+			if es.owns != nil && !es.owns(r.Uid) {
+				continue
+			}
+			handled++
+			if e := es.close(r); e != nil {
+				err = e
+			} else {
+				n++
+			}
+			if handled == limit {
+				break
+			}
+		}
+		if len(due) < limit {
+			break
+		}
+	}
+	return n, err
+}
+
+// 放款并关闭到期计划
+func (es *Escrows) close(r *EscrowRelease) error {
+	if err := es.release(r.OrderId); err != nil {
+		return fmt.Errorf("escrow of order %s: %w", r.OrderId, err)
+	}
+	r.Status, r.UpdatedAt = ESCROW_CLOSED, es.clock().Unix()
+	return es.store.Save(r)
+}
+
+var escrowSetting = struct {
+	escrows *Escrows
+	lock    sync.RWMutex
+}{}
+
+// 设置担保交易使用的担保管理
+func SetEscrows(escrows *Escrows) {
+	escrowSetting.lock.Lock()
+	escrowSetting.escrows = escrows
+	escrowSetting.lock.Unlock()
+}
+
+func getEscrows() (*Escrows, error) {
+	escrowSetting.lock.RLock()
+	defer escrowSetting.lock.RUnlock()
+	if escrowSetting.escrows == nil {
+		return nil, ErrEscrowsUnset
+	}
+	return escrowSetting.escrows, nil
+}
+
+// 执行入口
+func (e *Escrow) ServeOpay(ctx *opay.Context) error {
+	if !ctx.HasStakeholder() {
+		return opay.ErrStakeholderNotExist
+	}
+	if ctx.GreaterOrEqual(ctx.Request.Initiator.GetAmount(), 0) ||
+		ctx.SmallerOrEqual(ctx.Request.Stakeholder.GetAmount(), 0) ||
+		!ctx.Equal(ctx.Request.Initiator.GetAmount(), -ctx.Request.Stakeholder.GetAmount()) {
+		return opay.ErrIncorrectAmount
+	}
+	return e.Call(e, ctx)
+}
+
+// 从买方账户转入担保账户，并标记订单为等待处理状态
+func (e *Escrow) Pend() error {
+	ctx := e.Background.Context
+	buyer := ctx.Request.Initiator
+	err := e.shift(buyer.GetUid(), buyer.GetAid(), buyer.GetAmount())
+	if err != nil {
+		return err
+	}
+
+	// 创建订单
+	return ctx.Pend()
+}
+
+// 买方发起争议，暂停自动放款，标记订单为正在处理状态
+func (e *Escrow) Do() error {
+	return e.Background.Context.Do()
+}
+
+// 由担保账户放款给卖方，并标记订单为成功状态
+func (e *Escrow) Succeed() error {
+	ctx := e.Background.Context
+	seller := ctx.Request.Stakeholder
+	err := e.shift(seller.GetUid(), seller.GetAid(), seller.GetAmount())
+	if err != nil {
+		return err
+	}
+
+	// 更新订单
+	return ctx.Succeed()
+}
+
+// 卖方撤销，退回买方，并标记订单为撤销状态
+func (e *Escrow) Cancel() error {
+	err := e.refund()
+	if err != nil {
+		return err
+	}
+
+	// 更新订单
+	return e.Background.Context.Cancel()
+}
+
+// 争议裁定退款，退回买方，并标记订单为失败状态
+func (e *Escrow) Fail() error {
+	err := e.refund()
+	if err != nil {
+		return err
+	}
+
+	// 更新订单
+	return e.Background.Context.Fail()
+}
+
+// 由担保账户退回买方
+func (e *Escrow) refund() error {
+	buyer := e.Background.Context.Request.Initiator
+	return e.shift(buyer.GetUid(), buyer.GetAid(), -buyer.GetAmount())
+}
+
+// 交易方 uid 的账户变动 amount，担保账户反向变动
+func (e *Escrow) shift(uid, aid string, amount float64) error {
+	escrows, err := getEscrows()
+	if err != nil {
+		return err
+	}
+	ctx := e.Background.Context
+	if uid == escrows.account || ctx.Request.Stakeholder.GetUid() == escrows.account {
+		return ErrEscrowAccount
+	}
+	// 先扣款的一方在前，余额不足时不会先记入另一方
+	if amount < 0 {
+		if err = ctx.Settle(uid, aid, amount); err != nil {
+			return err
+		}
+		return ctx.Settle(escrows.account, aid, -amount)
+	}
+	if err = ctx.Settle(escrows.account, aid, -amount); err != nil {
+		return err
+	}
+	return ctx.Settle(uid, aid, amount)
+}
+
+/*
+ * 自动放款计划存储
+ */
+
+// 内存自动放款计划存储
+type MemEscrowStore struct {
+	releases map[string]*EscrowRelease
+	lock     sync.Mutex
+}
+
+var _ EscrowStore = (*MemEscrowStore)(nil)
+
+func NewMemEscrowStore() *MemEscrowStore {
+	return &MemEscrowStore{releases: make(map[string]*EscrowRelease)}
+}
+
+func (s *MemEscrowStore) Save(r *EscrowRelease) error {
+	s.lock.Lock()
+	c := *r
+	s.releases[r.OrderId] = &c
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemEscrowStore) Get(orderId string) (*EscrowRelease, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r, ok := s.releases[orderId]
+	if !ok {
+		return nil, ErrEscrowNotFound
+	}
+	c := *r
+	return &c, nil
+}
+
+func (s *MemEscrowStore) Due(now int64, after *EscrowRelease, limit int) ([]*EscrowRelease, error) {
+	s.lock.Lock()
+	var due []*EscrowRelease
+	for _, r := range s.releases {
+		if r.Status == ESCROW_SCHEDULED && r.ReleaseAt <= now && (after == nil || after.before(r)) {
+			c := *r
+			due = append(due, &c)
+		}
+	}
+	s.lock.Unlock()
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].before(due[j])
+	})
+	if limit > 0 && len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
+
+// 是否按到期顺序排在other之前
+func (r *EscrowRelease) before(other *EscrowRelease) bool {
+	if r.ReleaseAt != other.ReleaseAt {
+		return r.ReleaseAt < other.ReleaseAt
+	}
+	return r.OrderId < other.OrderId
+}
+
+// 自动放款计划表结构
+const EscrowSchema = `
+CREATE TABLE IF NOT EXISTS escrow_releases (
+	order_id   VARCHAR(64) PRIMARY KEY,
+	uid        VARCHAR(64) NOT NULL,
+	aid        VARCHAR(32) NOT NULL,
+	amount     NUMERIC(20, 8) NOT NULL CHECK (amount > 0),
+	status     VARCHAR(16) NOT NULL,
+	release_at BIGINT NOT NULL,
+	created_at BIGINT NOT NULL,
+	updated_at BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS escrow_releases_due_idx ON escrow_releases (release_at, order_id) WHERE status = 'scheduled';
+`
+
+// 基于SQL数据库的自动放款计划存储
+type SQLEscrowStore struct {
+	db sqlx.Ext
+}
+
+var _ EscrowStore = (*SQLEscrowStore)(nil)
+
+func NewSQLEscrowStore(db sqlx.Ext) *SQLEscrowStore {
+	return &SQLEscrowStore{db: db}
+}
+
+// 已关闭的计划不再更新
+func (s *SQLEscrowStore) Save(r *EscrowRelease) error {
+	_, err := sqlx.NamedExec(s.db, `INSERT INTO escrow_releases
+		(order_id, uid, aid, amount, status, release_at, created_at, updated_at)
+		VALUES (:order_id, :uid, :aid, :amount, :status, :release_at, :created_at, :updated_at)
+		ON CONFLICT (order_id) DO UPDATE SET status = EXCLUDED.status, updated_at = EXCLUDED.updated_at
+		WHERE escrow_releases.status = 'scheduled'`, r)
+	return err
+}
+
+func (s *SQLEscrowStore) Get(orderId string) (*EscrowRelease, error) {
+	var r EscrowRelease
+	err := sqlx.Get(s.db, &r, s.db.Rebind(`SELECT * FROM escrow_releases WHERE order_id = ?`), orderId)
+	if err == sql.ErrNoRows {
+		return nil, ErrEscrowNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (s *SQLEscrowStore) Due(now int64, after *EscrowRelease, limit int) ([]*EscrowRelease, error) {
+	var due []*EscrowRelease
+	if after == nil {
+		err := sqlx.Select(s.db, &due, s.db.Rebind(`SELECT * FROM escrow_releases
+			WHERE status = ? AND release_at <= ? ORDER BY release_at, order_id LIMIT ?`), ESCROW_SCHEDULED, now, limit)
+		return due, err
+	}
+	err := sqlx.Select(s.db, &due, s.db.Rebind(`SELECT * FROM escrow_releases
+		WHERE status = ? AND release_at <= ? AND (release_at, order_id) > (?, ?) ORDER BY release_at, order_id LIMIT ?`),
+		ESCROW_SCHEDULED, now, after.ReleaseAt, after.OrderId, limit)
+	return due, err
+}
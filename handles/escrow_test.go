@@ -0,0 +1,136 @@
+package handles
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"simplopay.com/backend/pkg/opay"
+	"simplopay.com/backend/pkg/opay/opaytest"
+)
+
+func TestEscrow(t *testing.T) {
+	h := opaytest.NewHarness(2, "NGN")
+	meta := h.RegMeta("escrow", new(Escrow),
+		opay.Status{Code: 1, Step: opay.PEND},
+		opay.Status{Code: 2, Step: opay.DO},
+		opay.Status{Code: 3, Step: opay.SUCCEED},
+		opay.Status{Code: 4, Step: opay.FAIL},
+		opay.Status{Code: 5, Step: opay.CANCEL})
+	h.Ledger.Fund("buyer", "NGN", 1000)
+
+	// 到期时仍在担保中的订单自动放款，未能新建的订单无需处理
+	type pair struct{ buyer, seller *opaytest.Order }
+	orders := map[string]pair{}
+	var released []string
+	release := func(orderId string) error {
+		p, ok := orders[orderId]
+		if !ok || p.buyer.Target != 1 {
+			return nil
+		}
+		released = append(released, orderId)
+		return h.Do(p.buyer.Move(3), p.seller.Move(3)).Err
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewMemEscrowStore()
+	escrows, err := NewEscrows("escrow", time.Hour, store, release)
+	if err != nil {
+		t.Fatal(err)
+	}
+	escrows.clock = func() time.Time { return now }
+	SetEscrows(escrows)
+	defer SetEscrows(nil)
+
+	hold := func(id, seller string, amount float64) (pair, error) {
+		p := pair{
+			buyer:  opaytest.NewOrder(meta, id, "buyer", "NGN", -amount, 1),
+			seller: opaytest.NewOrder(meta, id+"s", seller, "NGN", amount, 1),
+		}
+		if _, err := escrows.Schedule(id, "buyer", "NGN", amount); err != nil {
+			return p, err
+		}
+		if err := h.Do(p.buyer, p.seller).Err; err != nil {
+			return p, err
+		}
+		orders[id] = p
+		return p, nil
+	}
+	move := func(p pair, target int64) error {
+		return h.Do(p.buyer.Move(target), p.seller.Move(target)).Err
+	}
+
+	// 买方确认收货后放款
+	p, err := hold("1", "seller", 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Ledger.AssertBalance(t, "buyer", "NGN", 700)
+	h.Ledger.AssertBalance(t, "escrow", "NGN", 300)
+	h.Ledger.AssertBalance(t, "seller", "NGN", 0)
+	if err := move(p, 3); err != nil {
+		t.Fatal(err)
+	}
+	h.Ledger.AssertBalance(t, "escrow", "NGN", 0)
+	h.Ledger.AssertBalance(t, "seller", "NGN", 300)
+
+	// 卖方撤销后退回
+	if p, err = hold("2", "seller", 200); err != nil {
+		t.Fatal(err)
+	}
+	h.Ledger.AssertBalance(t, "buyer", "NGN", 500)
+	if err := move(p, 5); err != nil {
+		t.Fatal(err)
+	}
+	h.Ledger.AssertBalance(t, "buyer", "NGN", 700)
+	h.Ledger.AssertBalance(t, "escrow", "NGN", 0)
+
+	// 争议裁定退款
+	if p, err = hold("3", "seller", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := move(p, 2); err != nil {
+		t.Fatal(err)
+	}
+	h.Ledger.AssertBalance(t, "escrow", "NGN", 100)
+	if err := move(p, 4); err != nil {
+		t.Fatal(err)
+	}
+	h.Ledger.AssertBalance(t, "buyer", "NGN", 700)
+	h.Ledger.AssertBalance(t, "escrow", "NGN", 0)
+
+	// 余额不足或以担保账户为交易方时不入担保账户
+	if _, err := hold("4", "seller", 5000); !errors.Is(err, opaytest.ErrInsufficientBalance) {
+		t.Fatalf("expect ErrInsufficientBalance, got %v", err)
+	}
+	if _, err := hold("5", "escrow", 100); !errors.Is(err, ErrEscrowAccount) {
+		t.Fatalf("expect ErrEscrowAccount, got %v", err)
+	}
+	h.Ledger.AssertBalance(t, "buyer", "NGN", 700)
+	h.Ledger.AssertBalance(t, "escrow", "NGN", 0)
+
+	// 到期自动放款，已完成的订单仅关闭计划
+	if p, err = hold("6", "seller", 50); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := escrows.Schedule("6", "buyer", "NGN", 60); !errors.Is(err, ErrEscrowSchedule) {
+		t.Fatalf("expect ErrEscrowSchedule, got %v", err)
+	}
+	if n, err := escrows.Poll(0); err != nil || n != 0 {
+		t.Fatalf("expect nothing due, got %d, %v", n, err)
+	}
+	now = now.Add(time.Hour)
+	if n, err := escrows.Poll(0); err != nil || n != 6 {
+		t.Fatalf("expect 6 closed, got %d, %v", n, err)
+	}
+	if len(released) != 1 || released[0] != "6" {
+		t.Fatalf("unexpected released %v", released)
+	}
+	h.Ledger.AssertBalance(t, "seller", "NGN", 350)
+	h.Ledger.AssertBalance(t, "escrow", "NGN", 0)
+	if r, _ := escrows.Get("6"); r.Status != ESCROW_CLOSED {
+		t.Fatalf("expect the release closed, got %s", r.Status)
+	}
+	if n, err := escrows.Poll(0); err != nil || n != 0 {
+		t.Fatalf("expect nothing due, got %d, %v", n, err)
+	}
+}
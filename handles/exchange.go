@@ -1,7 +1,7 @@
 package handles
 
 import (
-	"github.com/henrylee2cn/opay"
+	"simplopay.com/backend/pkg/opay"
 )
 
 /*
@@ -23,9 +23,34 @@ func (e *Exchange) ServeOpay(ctx *opay.Context) error {
 		ctx.SmallerOrEqual(ctx.Request.Stakeholder.GetAmount(), 0) {
 		return opay.ErrIncorrectAmount
 	}
+	// 新建的兑换订单须按报价锁定的金额
+	if pre, _ := ctx.Request.Initiator.GetMeta().Status(ctx.Request.Initiator.PreStatus()); pre.Step == opay.UNSET {
+		if err := useQuote(ctx); err != nil {
+			return err
+		}
+	}
 	return e.Call(e, ctx)
 }
 
+// 校验并使用请求附加参数中的报价，报价随订单的事务标记为已使用，兑换失败时报价仍可使用
+func useQuote(ctx *opay.Context) error {
+	fx, err := getFX()
+	if err != nil {
+		return err
+	}
+	id, _ := ctx.Get(QUOTE_KEY).(string)
+	if len(id) == 0 {
+		return ErrQuoteRequired
+	}
+	initiator, stakeholder := ctx.Request.Initiator, ctx.Request.Stakeholder
+	if initiator.GetUid() != stakeholder.GetUid() {
+		return ErrQuoteMismatch
+	}
+	_, err = fx.UseQuote(ctx.Request.Tx, id, initiator.GetUid(), initiator.GetAid(), stakeholder.GetAid(),
+		initiator.GetAmount(), stakeholder.GetAmount())
+	return err
+}
+
 // 处理账户并标记订单为成功状态
 func (e *Exchange) Succeed() error {
 	// 操作账户
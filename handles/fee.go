@@ -0,0 +1,387 @@
+package handles
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+
+	"simplopay.com/backend/pkg/opay"
+)
+
+/*
+ * 手续费
+ * 按订单类型及用户的KYC等级配置收费规则，支持固定、比例、阶梯收费及封顶、保底，
+ * KYC等级由服务端按发起方用户查询，不取自请求，
+ * 手续费另计增值税，在订单金额之外向发起方收取，并在同一事务中计入收入账户，
+ * 手续费在新建订单时计算并记录于订单，订单撤销或失败时按记录的金额退回
+ * 订单支持时，每笔计入收入或增值税账户的金额另存为其手续费子订单
+ */
+type (
+	// 收费规则
+	FeeRule struct {
+		Kind  string    `json:"kind"` //FEE_FLAT, FEE_PERCENT or FEE_TIERED
+		Flat  float64   `json:"flat"` //固定收费
+		Bps   int       `json:"bps"`  //比例收费，万分之一
+		Tiers []FeeTier `json:"tiers,omitempty"`
+		Min   float64   `json:"min"` //保底
+		Max   float64   `json:"max"` //封顶，0为不封顶
+	}
+
+	// 收费配置文件中的一条规则，KycTier 为空时为订单类型的默认规则
+	FeeSchedule struct {
+		OrderType string `json:"order_type"`
+		KycTier   string `json:"kyc_tier,omitempty"`
+		FeeRule
+	}
+
+	// 阶梯，金额不超过 UpTo 时适用，UpTo 为0的阶梯不设上限且须为最后一档
+	FeeTier struct {
+		UpTo float64 `json:"up_to"`
+		Flat float64 `json:"flat"`
+		Bps  int     `json:"bps"`
+	}
+
+	// 用户KYC等级查询，未评级的用户返回空等级
+	KycTiers interface {
+		KycTier(uid string) (string, error)
+	}
+
+	// 可记录手续费的订单
+	FeeOrder interface {
+		opay.IOrder
+		GetFee() (fee, vat float64)
+		SetFee(fee, vat float64)
+	}
+
+	// 可记录手续费子订单的订单
+	FeeLegOrder interface {
+		FeeOrder
+		// 在事务中保存计入 account 的手续费子订单，refund 为退回时金额为负
+		AddFeeLeg(tx opay.Tx, account string, amount float64, refund bool) error
+	}
+
+	// 手续费子订单的处理器，子订单由收费的订单写入，不可单独处理
+	FeeLeg struct {
+		Background
+	}
+
+	// 收费配置
+	Fees struct {
+		rules      map[string]FeeRule //订单类型/KYC等级
+		vatBps     int                //增值税率，万分之一
+		revenue    string             //收入账户
+		vatAccount string             //增值税账户
+		kycTiers   KycTiers
+		decimals   int
+		lock       sync.RWMutex
+	}
+)
+
+// 收费方式
+const (
+	FEE_FLAT    = "flat"
+	FEE_PERCENT = "percent"
+	FEE_TIERED  = "tiered"
+)
+
+var (
+	ErrFeeRule     = errors.New("收费规则不正确")
+	ErrFeeVat      = errors.New("增值税率须在0至10000之间")
+	ErrFeeOrder    = errors.New("订单不支持记录手续费")
+	ErrFeesUnset   = errors.New("未设置收费配置")
+	ErrFeeAmount   = errors.New("计费金额不正确")
+	ErrFeeAccounts = errors.New("未设置收入账户")
+	ErrFeeLeg      = errors.New("手续费子订单不可单独处理")
+	ErrFeeFormat   = errors.New("收费配置文件格式不正确")
+)
+
+// 编译期检查接口实现
+var _ Handler = (*FeeLeg)(nil)
+
+func (f *FeeLeg) ServeOpay(ctx *opay.Context) error {
+	return ErrFeeLeg
+}
+
+// 新建收费配置，手续费计入 revenue 账户，按 decimals 位小数四舍五入
+func NewFees(revenue string, decimals int) *Fees {
+	return &Fees{
+		rules:      make(map[string]FeeRule),
+		revenue:    revenue,
+		vatAccount: revenue,
+		decimals:   decimals,
+	}
+}
+
+// 设置订单类型在KYC等级下的收费规则，tier 为空时为该类型的默认规则
+func (f *Fees) SetRule(orderType, tier string, rule FeeRule) error {
+	if err := rule.check(); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	f.rules[orderType+"/"+tier] = rule
+	f.lock.Unlock()
+	return nil
+}
+
+// 设置KYC等级的查询，未设置时按订单类型的默认规则收费
+func (f *Fees) SetKycTiers(tiers KycTiers) {
+	f.lock.Lock()
+	f.kycTiers = tiers
+	f.lock.Unlock()
+}
+
+// 发起方用户的KYC等级
+func (f *Fees) kycTier(uid string) (string, error) {
+	f.lock.RLock()
+	tiers := f.kycTiers
+	f.lock.RUnlock()
+	if tiers == nil {
+		return "", nil
+	}
+	return tiers.KycTier(uid)
+}
+
+// 导入收费规则，全部规则校验通过后才更新，返回导入的条数
+func (f *Fees) Load(r io.Reader) (int, error) {
+	var schedules []FeeSchedule
+	if err := json.NewDecoder(r).Decode(&schedules); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrFeeFormat, err)
+	}
+	for i, s := range schedules {
+		if len(s.OrderType) == 0 {
+			return 0, fmt.Errorf("%w: schedule %d", ErrFeeFormat, i)
+		}
+		if err := s.FeeRule.check(); err != nil {
+			return 0, fmt.Errorf("%w: schedule %d", err, i)
+		}
+	}
+	for _, s := range schedules {
+		f.SetRule(s.OrderType, s.KycTier, s.FeeRule)
+	}
+	return len(schedules), nil
+}
+
+// 从 JSON 文件导入收费规则
+func (f *Fees) LoadFile(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return f.Load(file)
+}
+
+// 设置增值税率及增值税账户，account 为空时计入收入账户
+func (f *Fees) SetVat(bps int, account string) error {
+	if bps < 0 || bps > 10000 {
+		return ErrFeeVat
+	}
+	f.lock.Lock()
+	f.vatBps = bps
+	if len(account) > 0 {
+		f.vatAccount = account
+	} else {
+		f.vatAccount = f.revenue
+	}
+	f.lock.Unlock()
+	return nil
+}
+
+func (f *Fees) rule(orderType, tier string) (FeeRule, bool) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if r, ok := f.rules[orderType+"/"+tier]; ok {
+		return r, true
+	}
+	r, ok := f.rules[orderType+"/"]
+	return r, ok
+}
+
+// 计算订单金额 amount(正数) 的手续费及增值税，未设置规则时不收费
+func (f *Fees) Compute(orderType, tier string, amount float64) (fee, vat float64, err error) {
+	if amount <= 0 || math.IsInf(amount, 0) || math.IsNaN(amount) {
+		return 0, 0, ErrFeeAmount
+	}
+	r, ok := f.rule(orderType, tier)
+	if !ok {
+		return 0, 0, nil
+	}
+	fee = f.round(r.fee(amount))
+	f.lock.RLock()
+	vat = f.round(fee * float64(f.vatBps) / 10000)
+	f.lock.RUnlock()
+	return fee, vat, nil
+}
+
+func (f *Fees) round(x float64) float64 {
+	p := math.Pow10(f.decimals)
+	return math.Round(x*p) / p
+}
+
+func (f *Fees) accounts() (revenue, vat string) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.revenue, f.vatAccount
+}
+
+func (r FeeRule) check() error {
+	if r.Flat < 0 || r.Bps < 0 || r.Bps > 10000 || r.Min < 0 || r.Max < 0 ||
+		(r.Max > 0 && r.Max < r.Min) {
+		return ErrFeeRule
+	}
+	switch r.Kind {
+	case FEE_FLAT, FEE_PERCENT:
+		if len(r.Tiers) > 0 {
+			return ErrFeeRule
+		}
+	case FEE_TIERED:
+		if len(r.Tiers) == 0 {
+			return ErrFeeRule
+		}
+		var prev float64
+		for i, t := range r.Tiers {
+			if t.Flat < 0 || t.Bps < 0 || t.Bps > 10000 {
+				return ErrFeeRule
+			}
+			if t.UpTo == 0 {
+				if i != len(r.Tiers)-1 {
+					return ErrFeeRule
+				}
+				continue
+			}
+			if t.UpTo <= prev {
+				return ErrFeeRule
+			}
+			prev = t.UpTo
+		}
+	default:
+		return ErrFeeRule
+	}
+	return nil
+}
+
+// 按规则计算未取整的手续费，超出全部阶梯时按最后一档收费
+func (r FeeRule) fee(amount float64) float64 {
+	var fee float64
+	switch r.Kind {
+	case FEE_FLAT:
+		fee = r.Flat
+	case FEE_PERCENT:
+		fee = r.Flat + amount*float64(r.Bps)/10000
+	case FEE_TIERED:
+		t := r.Tiers[len(r.Tiers)-1]
+		for _, tier := range r.Tiers {
+			if tier.UpTo == 0 || amount <= tier.UpTo {
+				t = tier
+				break
+			}
+		}
+		fee = t.Flat + amount*float64(t.Bps)/10000
+	}
+	if fee < r.Min {
+		fee = r.Min
+	}
+	if r.Max > 0 && fee > r.Max {
+		fee = r.Max
+	}
+	return fee
+}
+
+var feesSetting = struct {
+	fees *Fees
+	lock sync.RWMutex
+}{}
+
+// 设置转账、提现使用的收费配置，为 nil 时不收费
+func SetFees(fees *Fees) {
+	feesSetting.lock.Lock()
+	feesSetting.fees = fees
+	feesSetting.lock.Unlock()
+}
+
+func getFees() *Fees {
+	feesSetting.lock.RLock()
+	defer feesSetting.lock.RUnlock()
+	return feesSetting.fees
+}
+
+// 计算发起方订单的手续费并记录于订单，须在新建订单前调用
+func lockFee(ctx *opay.Context) error {
+	fees := getFees()
+	if fees == nil {
+		return nil
+	}
+	initiator := ctx.Request.Initiator
+	tier, err := fees.kycTier(initiator.GetUid())
+	if err != nil {
+		return err
+	}
+	fee, vat, err := fees.Compute(initiator.GetMeta().OrderType(), tier, math.Abs(initiator.GetAmount()))
+	if err != nil {
+		return err
+	}
+	o, ok := initiator.(FeeOrder)
+	if !ok {
+		if fee == 0 && vat == 0 {
+			return nil
+		}
+		return ErrFeeOrder
+	}
+	o.SetFee(fee, vat)
+	return nil
+}
+
+// 向发起方收取订单记录的手续费，计入收入账户
+func chargeFee(ctx *opay.Context) error {
+	return postFee(ctx, 1)
+}
+
+// 退回订单记录的手续费
+func refundFee(ctx *opay.Context) error {
+	return postFee(ctx, -1)
+}
+
+func postFee(ctx *opay.Context, sign float64) error {
+	o, ok := ctx.Request.Initiator.(FeeOrder)
+	if !ok {
+		return nil
+	}
+	fee, vat := o.GetFee()
+	if fee == 0 && vat == 0 {
+		return nil
+	}
+	fees := getFees()
+	if fees == nil {
+		return ErrFeesUnset
+	}
+	revenue, vatAccount := fees.accounts()
+	if len(revenue) == 0 || len(vatAccount) == 0 {
+		return ErrFeeAccounts
+	}
+	aid := o.GetAid()
+	err := ctx.Settle(o.GetUid(), aid, -sign*(fee+vat))
+	if err != nil {
+		return err
+	}
+	for _, leg := range []struct {
+		account string
+		amount  float64
+	}{{revenue, fee}, {vatAccount, vat}} {
+		if leg.amount == 0 {
+			continue
+		}
+		if err = ctx.Settle(leg.account, aid, sign*leg.amount); err != nil {
+			return err
+		}
+		if l, ok := o.(FeeLegOrder); ok {
+			if err = l.AddFeeLeg(ctx.Request.Tx, leg.account, sign*leg.amount, sign < 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
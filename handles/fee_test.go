@@ -0,0 +1,140 @@
+package handles
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"simplopay.com/backend/pkg/opay"
+	"simplopay.com/backend/pkg/opay/opaytest"
+)
+
+// 可记录手续费的测试订单
+type feeOrder struct {
+	*opaytest.Order
+	fee, vat float64
+}
+
+func (o *feeOrder) GetFee() (float64, float64) { return o.fee, o.vat }
+func (o *feeOrder) SetFee(fee, vat float64)    { o.fee, o.vat = fee, vat }
+
+// 可记录手续费子订单的测试订单
+type feeLegOrder struct {
+	feeOrder
+	legs []string
+}
+
+func (o *feeLegOrder) AddFeeLeg(tx opay.Tx, account string, amount float64, refund bool) error {
+	o.legs = append(o.legs, fmt.Sprintf("%s %v %v", account, amount, refund))
+	return nil
+}
+
+func TestFeeRules(t *testing.T) {
+	fees := NewFees("revenue", 2)
+	if err := fees.SetRule("withdraw", "", FeeRule{Kind: FEE_TIERED, Tiers: []FeeTier{{UpTo: 0}, {UpTo: 100}}}); !errors.Is(err, ErrFeeRule) {
+		t.Fatalf("expect ErrFeeRule, got %v", err)
+	}
+	if _, err := fees.Load(strings.NewReader(`[{"order_type": "transfer", "kind": "flat", "flat": -1}]`)); !errors.Is(err, ErrFeeRule) {
+		t.Fatalf("expect ErrFeeRule, got %v", err)
+	}
+	if _, err := NewFees("revenue", 2).LoadFile("../config/fees.json"); err != nil {
+		t.Fatal(err)
+	}
+	fees.SetRule("transfer", "", FeeRule{Kind: FEE_PERCENT, Bps: 150, Min: 10, Max: 100})
+	fees.SetRule("transfer", "tier3", FeeRule{Kind: FEE_FLAT, Flat: 5})
+	fees.SetRule("withdraw", "", FeeRule{Kind: FEE_TIERED, Tiers: []FeeTier{
+		{UpTo: 5000, Flat: 10},
+		{UpTo: 50000, Flat: 25},
+		{Flat: 50, Bps: 10},
+	}})
+	fees.SetVat(750, "")
+
+	cases := []struct {
+		orderType, tier string
+		amount, fee     float64
+	}{
+		{"transfer", "", 100, 10},      //保底
+		{"transfer", "", 2000, 30},     //比例
+		{"transfer", "", 100000, 100},  //封顶
+		{"transfer", "tier3", 2000, 5}, //KYC等级
+		{"withdraw", "", 5000, 10},
+		{"withdraw", "tier3", 5000.01, 25},
+		{"withdraw", "", 100000, 150},
+		{"recharge", "", 100, 0},
+	}
+	for _, c := range cases {
+		fee, vat, err := fees.Compute(c.orderType, c.tier, c.amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fee != c.fee || vat != fees.round(c.fee*0.075) {
+			t.Errorf("%s/%s %v: expect fee %v, got %v + %v", c.orderType, c.tier, c.amount, c.fee, fee, vat)
+		}
+	}
+}
+
+func TestFeeLegs(t *testing.T) {
+	fees := NewFees("revenue", 2)
+	fees.SetRule("transfer", "", FeeRule{Kind: FEE_FLAT, Flat: 10})
+	fees.SetRule("withdraw", "", FeeRule{Kind: FEE_PERCENT, Bps: 100})
+	fees.SetVat(1000, "vat")
+	SetFees(fees)
+	defer SetFees(nil)
+
+	h := opaytest.NewHarness(2, "NGN")
+	h.Ledger.Fund("alice", "NGN", 1000)
+
+	transfer := h.RegMeta("transfer", new(Transfer), opay.Status{Code: 1, Step: opay.SYNC_DEAL})
+	resp := h.Do(&feeOrder{Order: opaytest.NewOrder(transfer, "1", "alice", "NGN", -100, 1)},
+		opaytest.NewOrder(transfer, "1", "bob", "NGN", 100, 1))
+	if resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 889)
+	h.Ledger.AssertBalance(t, "bob", "NGN", 100)
+	h.Ledger.AssertBalance(t, "revenue", "NGN", 10)
+	h.Ledger.AssertBalance(t, "vat", "NGN", 1)
+
+	// 订单无法记录手续费
+	resp = h.Do(opaytest.NewOrder(transfer, "2", "alice", "NGN", -100, 1), opaytest.NewOrder(transfer, "2", "bob", "NGN", 100, 1))
+	if !errors.Is(resp.Err, ErrFeeOrder) {
+		t.Fatalf("expect ErrFeeOrder, got %v", resp.Err)
+	}
+
+	withdraw := h.RegMeta("withdraw", new(Withdraw),
+		opay.Status{Code: 1, Step: opay.PEND},
+		opay.Status{Code: 2, Step: opay.SUCCEED},
+		opay.Status{Code: 3, Step: opay.FAIL})
+	SetPayouts(NewPayouts(NewFakePayoutProvider("fake"), NewMemPayoutStore(), time.Hour, nil))
+	defer SetPayouts(nil)
+	order := &feeLegOrder{feeOrder: feeOrder{Order: opaytest.NewOrder(withdraw, "3", "alice", "NGN", -500, 1)}}
+	if resp := h.Do(order, nil); resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 383.5)
+	h.Ledger.AssertBalance(t, "revenue", "NGN", 15)
+
+	// 失败时按订单记录的手续费退回，不受规则变更影响
+	fees.SetRule("withdraw", "", FeeRule{Kind: FEE_FLAT, Flat: 1})
+	order.Move(3)
+	if resp := h.Do(order, nil); resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 889)
+	h.Ledger.AssertBalance(t, "revenue", "NGN", 10)
+	h.Ledger.AssertBalance(t, "vat", "NGN", 1)
+	// 收取及退回的手续费均记为子订单
+	if want := []string{"revenue 5 false", "vat 0.5 false", "revenue -5 true", "vat -0.5 true"}; !reflect.DeepEqual(order.legs, want) {
+		t.Fatalf("expect fee legs %v, got %v", want, order.legs)
+	}
+
+	// 余额不足以支付手续费
+	resp = h.Do(&feeOrder{Order: opaytest.NewOrder(withdraw, "4", "alice", "NGN", -888, 1)}, nil)
+	if !errors.Is(resp.Err, opaytest.ErrInsufficientBalance) {
+		t.Fatalf("expect ErrInsufficientBalance, got %v", resp.Err)
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 889)
+}
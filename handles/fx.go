@@ -0,0 +1,535 @@
+package handles
+
+import (
+	"bufio"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"simplopay.com/backend/pkg/opay"
+)
+
+/*
+ * 外汇报价
+ * 兑换前须先获取报价，报价锁定卖出与买入金额，在有效期内且仅可使用一次，
+ * 报价汇率为中间价扣除货币对的点差，买入金额按买入货币的精度向下取整
+ */
+type (
+	// 中间价
+	Rate struct {
+		From      string    `json:"from"`
+		To        string    `json:"to"`
+		Mid       float64   `json:"mid"` //1单位From兑换的To数量
+		Source    string    `json:"source"`
+		UpdatedAt time.Time `json:"updated_at"`
+	}
+
+	// 汇率提供者
+	RateProvider interface {
+		Rate(from, to string) (Rate, error)
+	}
+
+	// 报价
+	Quote struct {
+		Id        string    `json:"id"`
+		Uid       string    `json:"uid"`
+		From      string    `json:"from"`
+		To        string    `json:"to"`
+		Sell      float64   `json:"sell"` //卖出的From金额，正数
+		Buy       float64   `json:"buy"`  //买入的To金额，正数
+		Rate      float64   `json:"rate"` //扣除点差后的汇率
+		Mid       float64   `json:"mid"`
+		SpreadBps int       `json:"spread_bps"`
+		ExpiresAt time.Time `json:"expires_at"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+
+	// 报价存储接口
+	QuoteStore interface {
+		Save(q *Quote) error
+
+		// 在兑换订单的事务中取出报价并标记为已使用，报价只能使用一次，
+		// 事务回滚时报价仍可使用
+		Use(tx opay.Tx, id string) (*Quote, error)
+	}
+
+	// 外汇服务
+	FX struct {
+		provider  RateProvider
+		store     QuoteStore
+		ttl       time.Duration
+		spreads   map[string]int //货币对的点差，万分之一
+		spread    int            //默认点差
+		precision map[string]int //货币的小数位数
+		clock     func() time.Time
+		lock      sync.RWMutex
+	}
+)
+
+// 报价在订单附加参数中的键
+const QUOTE_KEY = "quote_id"
+
+// 未设置精度的货币的小数位数
+const DEFAULT_PRECISION = 2
+
+var (
+	ErrFXUnset        = errors.New("未设置外汇服务")
+	ErrRateNotFound   = errors.New("汇率不存在")
+	ErrRate           = errors.New("汇率不正确")
+	ErrQuoteRequired  = errors.New("兑换须提供报价")
+	ErrQuoteNotFound  = errors.New("报价不存在")
+	ErrQuoteUsed      = errors.New("报价已使用")
+	ErrQuoteExpired   = errors.New("报价已过期")
+	ErrQuoteMismatch  = errors.New("兑换订单与报价不符")
+	ErrSpread         = errors.New("点差须在0至10000之间")
+	ErrQuoteAmount    = errors.New("报价金额不正确")
+	ErrRateFileFormat = errors.New("汇率文件格式不正确")
+)
+
+// 新建外汇服务，报价有效期为 ttl
+func NewFX(provider RateProvider, store QuoteStore, ttl time.Duration) *FX {
+	return &FX{
+		provider:  provider,
+		store:     store,
+		ttl:       ttl,
+		spreads:   make(map[string]int),
+		precision: map[string]int{"JPY": 0, "KES": 2, "XAF": 0, "XOF": 0},
+		clock:     time.Now,
+	}
+}
+
+func pairKey(from, to string) string {
+	return from + "/" + to
+}
+
+// 设置货币对的点差，单位为万分之一
+func (fx *FX) SetSpread(from, to string, bps int) error {
+	if bps < 0 || bps >= 10000 {
+		return ErrSpread
+	}
+	fx.lock.Lock()
+	fx.spreads[pairKey(from, to)] = bps
+	fx.lock.Unlock()
+	return nil
+}
+
+// 设置未单独设置的货币对的点差
+func (fx *FX) SetDefaultSpread(bps int) error {
+	if bps < 0 || bps >= 10000 {
+		return ErrSpread
+	}
+	fx.lock.Lock()
+	fx.spread = bps
+	fx.lock.Unlock()
+	return nil
+}
+
+// 设置货币的小数位数
+func (fx *FX) SetPrecision(aid string, decimals int) {
+	fx.lock.Lock()
+	fx.precision[aid] = decimals
+	fx.lock.Unlock()
+}
+
+// 货币的小数位数
+func (fx *FX) Precision(aid string) int {
+	fx.lock.RLock()
+	defer fx.lock.RUnlock()
+	if p, ok := fx.precision[aid]; ok {
+		return p
+	}
+	return DEFAULT_PRECISION
+}
+
+func (fx *FX) spreadOf(from, to string) int {
+	fx.lock.RLock()
+	defer fx.lock.RUnlock()
+	if bps, ok := fx.spreads[pairKey(from, to)]; ok {
+		return bps
+	}
+	return fx.spread
+}
+
+// 为用户报价，卖出 sell 数量的 from 货币
+func (fx *FX) NewQuote(uid, from, to string, sell float64) (*Quote, error) {
+	if from == to || sell <= 0 || !fx.exact(from, sell) {
+		return nil, ErrQuoteAmount
+	}
+	rate, err := fx.provider.Rate(from, to)
+	if err != nil {
+		return nil, err
+	}
+	bps := fx.spreadOf(from, to)
+	applied := rate.Mid * float64(10000-bps) / 10000
+	buy := floor(sell*applied, fx.Precision(to))
+	if buy <= 0 {
+		return nil, ErrQuoteAmount
+	}
+	id, err := newQuoteId()
+	if err != nil {
+		return nil, err
+	}
+	now := fx.clock()
+	q := &Quote{
+		Id:        id,
+		Uid:       uid,
+		From:      from,
+		To:        to,
+		Sell:      sell,
+		Buy:       buy,
+		Rate:      applied,
+		Mid:       rate.Mid,
+		SpreadBps: bps,
+		ExpiresAt: now.Add(fx.ttl),
+		CreatedAt: now,
+	}
+	if err := fx.store.Save(q); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// 在兑换订单的事务中使用报价，校验兑换订单的用户、货币及两方金额
+// sell 与 buy 为订单的变动金额，卖出为负、买入为正
+func (fx *FX) UseQuote(tx opay.Tx, id, uid, from, to string, sell, buy float64) (*Quote, error) {
+	q, err := fx.store.Use(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !fx.clock().Before(q.ExpiresAt) {
+		return nil, ErrQuoteExpired
+	}
+	if q.Uid != uid || q.From != from || q.To != to ||
+		!fx.equal(from, -sell, q.Sell) || !fx.equal(to, buy, q.Buy) {
+		return nil, ErrQuoteMismatch
+	}
+	return q, nil
+}
+
+// 在货币精度内是否相等
+func (fx *FX) equal(aid string, a, b float64) bool {
+	return math.Abs(a-b) < 0.5*math.Pow10(-fx.Precision(aid))
+}
+
+// 金额是否不超出货币精度
+func (fx *FX) exact(aid string, amount float64) bool {
+	return fx.equal(aid, amount, math.Round(amount*math.Pow10(fx.Precision(aid)))/math.Pow10(fx.Precision(aid)))
+}
+
+func floor(f float64, decimals int) float64 {
+	p := math.Pow10(decimals)
+	return math.Floor(f*p+1e-9) / p
+}
+
+func newQuoteId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+var fxSetting = struct {
+	fx   *FX
+	lock sync.RWMutex
+}{}
+
+// 设置兑换使用的外汇服务
+func SetFX(fx *FX) {
+	fxSetting.lock.Lock()
+	fxSetting.fx = fx
+	fxSetting.lock.Unlock()
+}
+
+func getFX() (*FX, error) {
+	fxSetting.lock.RLock()
+	defer fxSetting.lock.RUnlock()
+	if fxSetting.fx == nil {
+		return nil, ErrFXUnset
+	}
+	return fxSetting.fx, nil
+}
+
+/*
+ * 汇率表
+ */
+
+// 汇率表，支持手工设置与从文件导入，未设置的反向货币对取倒数
+type RateTable struct {
+	rates map[string]Rate
+	lock  sync.RWMutex
+}
+
+var _ RateProvider = (*RateTable)(nil)
+
+func NewRateTable() *RateTable {
+	return &RateTable{rates: make(map[string]Rate)}
+}
+
+// 设置中间价
+func (t *RateTable) Set(from, to string, mid float64, source string) error {
+	if from == to || mid <= 0 || math.IsInf(mid, 0) || math.IsNaN(mid) {
+		return ErrRate
+	}
+	t.lock.Lock()
+	t.rates[pairKey(from, to)] = Rate{From: from, To: to, Mid: mid, Source: source, UpdatedAt: time.Now()}
+	t.lock.Unlock()
+	return nil
+}
+
+// 查询中间价
+func (t *RateTable) Rate(from, to string) (Rate, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if r, ok := t.rates[pairKey(from, to)]; ok {
+		return r, nil
+	}
+	if r, ok := t.rates[pairKey(to, from)]; ok {
+		return Rate{From: from, To: to, Mid: 1 / r.Mid, Source: r.Source, UpdatedAt: r.UpdatedAt}, nil
+	}
+	return Rate{}, ErrRateNotFound
+}
+
+// 全部中间价，按货币对排序
+func (t *RateTable) Rates() []Rate {
+	t.lock.RLock()
+	rates := make([]Rate, 0, len(t.rates))
+	for _, r := range t.rates {
+		rates = append(rates, r)
+	}
+	t.lock.RUnlock()
+	sort.Slice(rates, func(i, j int) bool {
+		return pairKey(rates[i].From, rates[i].To) < pairKey(rates[j].From, rates[j].To)
+	})
+	return rates
+}
+
+// 导入汇率，每行为 "FROM,TO,MID"，空行及 # 开头的行忽略
+// 全部行校验通过后才更新，返回导入的条数
+func (t *RateTable) Load(r io.Reader, source string) (int, error) {
+	type row struct {
+		from, to string
+		mid      float64
+	}
+	var rows []row
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) != 3 {
+			return 0, fmt.Errorf("%w: line %d", ErrRateFileFormat, n)
+		}
+		mid, err := strconv.ParseFloat(strings.TrimSpace(fields[2]), 64)
+		from, to := strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1])
+		if err != nil || mid <= 0 || math.IsInf(mid, 0) || len(from) == 0 || len(to) == 0 || from == to {
+			return 0, fmt.Errorf("%w: line %d", ErrRateFileFormat, n)
+		}
+		rows = append(rows, row{from, to, mid})
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	for _, r := range rows {
+		t.Set(r.from, r.to, r.mid, source)
+	}
+	return len(rows), nil
+}
+
+// 从文件导入汇率，来源记为文件路径
+func (t *RateTable) LoadFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return t.Load(f, path)
+}
+
+/*
+ * 内存报价存储
+ */
+
+// 内存报价存储，过期的报价在保存新报价时清理
+// 在 MemStore 的事务中使用报价时，使用标记写入事务，随事务回滚
+type MemQuoteStore struct {
+	quotes map[string]*Quote
+	used   map[string]bool
+	lock   sync.Mutex
+}
+
+var _ QuoteStore = (*MemQuoteStore)(nil)
+
+func NewMemQuoteStore() *MemQuoteStore {
+	return &MemQuoteStore{
+		quotes: make(map[string]*Quote),
+		used:   make(map[string]bool),
+	}
+}
+
+func (s *MemQuoteStore) Save(q *Quote) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id, old := range s.quotes {
+		if old.ExpiresAt.Before(q.CreatedAt) {
+			delete(s.quotes, id)
+			delete(s.used, id)
+		}
+	}
+	c := *q
+	s.quotes[q.Id] = &c
+	return nil
+}
+
+func (s *MemQuoteStore) Use(tx opay.Tx, id string) (*Quote, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	q, ok := s.quotes[id]
+	if !ok {
+		return nil, ErrQuoteNotFound
+	}
+	c := *q
+	if memTx, err := opay.AsMemTx(tx); err == nil {
+		key := "fx_quote_used/" + id
+		if _, used := memTx.Get(key); used {
+			return nil, ErrQuoteUsed
+		}
+		return &c, memTx.Put(key, true)
+	}
+	if s.used[id] {
+		return nil, ErrQuoteUsed
+	}
+	s.used[id] = true
+	return &c, nil
+}
+
+/*
+ * SQL报价存储
+ */
+
+// 报价表结构，时间为Unix毫秒
+const QuoteSchema = `
+CREATE TABLE IF NOT EXISTS fx_quotes (
+	id         VARCHAR(64) PRIMARY KEY,
+	uid        VARCHAR(64) NOT NULL,
+	from_aid   VARCHAR(32) NOT NULL,
+	to_aid     VARCHAR(32) NOT NULL,
+	sell       NUMERIC(20, 8) NOT NULL CHECK (sell > 0),
+	buy        NUMERIC(20, 8) NOT NULL CHECK (buy > 0),
+	rate       DOUBLE PRECISION NOT NULL,
+	mid        DOUBLE PRECISION NOT NULL,
+	spread_bps INT NOT NULL,
+	used       BOOLEAN NOT NULL DEFAULT FALSE,
+	expires_at BIGINT NOT NULL,
+	created_at BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS fx_quotes_expiry_idx ON fx_quotes (expires_at);
+`
+
+type quoteRow struct {
+	Id        string  `db:"id"`
+	Uid       string  `db:"uid"`
+	From      string  `db:"from_aid"`
+	To        string  `db:"to_aid"`
+	Sell      float64 `db:"sell"`
+	Buy       float64 `db:"buy"`
+	Rate      float64 `db:"rate"`
+	Mid       float64 `db:"mid"`
+	SpreadBps int     `db:"spread_bps"`
+	Used      bool    `db:"used"`
+	ExpiresAt int64   `db:"expires_at"`
+	CreatedAt int64   `db:"created_at"`
+}
+
+func (r *quoteRow) quote() *Quote {
+	return &Quote{
+		Id:        r.Id,
+		Uid:       r.Uid,
+		From:      r.From,
+		To:        r.To,
+		Sell:      r.Sell,
+		Buy:       r.Buy,
+		Rate:      r.Rate,
+		Mid:       r.Mid,
+		SpreadBps: r.SpreadBps,
+		ExpiresAt: time.UnixMilli(r.ExpiresAt),
+		CreatedAt: time.UnixMilli(r.CreatedAt),
+	}
+}
+
+// 基于SQL数据库的报价存储，报价在兑换订单的事务中标记为已使用，各实例共享
+type SQLQuoteStore struct {
+	db sqlx.Ext
+}
+
+var _ QuoteStore = (*SQLQuoteStore)(nil)
+
+func NewSQLQuoteStore(db sqlx.Ext) *SQLQuoteStore {
+	return &SQLQuoteStore{db: db}
+}
+
+func (s *SQLQuoteStore) Save(q *Quote) error {
+	_, err := sqlx.NamedExec(s.db, `INSERT INTO fx_quotes
+		(id, uid, from_aid, to_aid, sell, buy, rate, mid, spread_bps, expires_at, created_at)
+		VALUES (:id, :uid, :from_aid, :to_aid, :sell, :buy, :rate, :mid, :spread_bps, :expires_at, :created_at)`,
+		&quoteRow{
+			Id:        q.Id,
+			Uid:       q.Uid,
+			From:      q.From,
+			To:        q.To,
+			Sell:      q.Sell,
+			Buy:       q.Buy,
+			Rate:      q.Rate,
+			Mid:       q.Mid,
+			SpreadBps: q.SpreadBps,
+			ExpiresAt: q.ExpiresAt.UnixMilli(),
+			CreatedAt: q.CreatedAt.UnixMilli(),
+		})
+	return err
+}
+
+// 锁定报价行，并发使用同一报价时后者等待前者的事务结束
+func (s *SQLQuoteStore) Use(tx opay.Tx, id string) (*Quote, error) {
+	sqlTx, err := opay.AsSqlxTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	var r quoteRow
+	err = sqlTx.Get(&r, sqlTx.Rebind(`SELECT * FROM fx_quotes WHERE id = ? FOR UPDATE`), id)
+	if err == sql.ErrNoRows {
+		return nil, ErrQuoteNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.Used {
+		return nil, ErrQuoteUsed
+	}
+	if _, err := sqlTx.Exec(sqlTx.Rebind(`UPDATE fx_quotes SET used = TRUE WHERE id = ?`), id); err != nil {
+		return nil, err
+	}
+	return r.quote(), nil
+}
+
+// 删除 before 之前过期的报价，返回删除的条数
+func (s *SQLQuoteStore) Purge(before time.Time) (int64, error) {
+	res, err := s.db.Exec(s.db.Rebind(`DELETE FROM fx_quotes WHERE expires_at < ?`), before.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
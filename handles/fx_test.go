@@ -0,0 +1,72 @@
+package handles
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"simplopay.com/backend/pkg/opay"
+	"simplopay.com/backend/pkg/opay/opaytest"
+)
+
+func TestExchange(t *testing.T) {
+	rates := NewRateTable()
+	if _, err := rates.Load(strings.NewReader("# 中间价\nUSD,NGN,1500\n"), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rates.Load(strings.NewReader("USD,GBP,abc\n"), "test"); !errors.Is(err, ErrRateFileFormat) {
+		t.Fatalf("expect ErrRateFileFormat, got %v", err)
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fx := NewFX(rates, NewMemQuoteStore(), time.Minute)
+	fx.clock = func() time.Time { return now }
+	fx.SetSpread("USD", "NGN", 100)
+	SetFX(fx)
+	defer SetFX(nil)
+
+	q, err := fx.NewQuote("alice", "USD", "NGN", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Buy != 14850 {
+		t.Fatalf("expect 14850 NGN with 1%% spread, got %v", q.Buy)
+	}
+	if r, _ := rates.Rate("NGN", "USD"); r.Mid != 1.0/1500 {
+		t.Fatalf("unexpected reverse rate %v", r.Mid)
+	}
+
+	h := opaytest.NewHarness(2, "USD", "NGN")
+	meta := h.RegMeta("exchange", new(Exchange), opay.Status{Code: 1, Step: opay.SYNC_DEAL})
+	h.Ledger.Fund("alice", "USD", 100)
+	exchange := func(quoteId string, sell, buy float64) error {
+		return h.Opay.Do(&opay.Request{
+			Initiator:   opaytest.NewOrder(meta, quoteId, "alice", "USD", -sell, 1),
+			Stakeholder: opaytest.NewOrder(meta, quoteId, "alice", "NGN", buy, 1),
+			Addition:    map[string]interface{}{QUOTE_KEY: quoteId},
+		}).Err
+	}
+
+	if err := exchange(q.Id, 10, 1000000); !errors.Is(err, ErrQuoteMismatch) {
+		t.Fatalf("expect ErrQuoteMismatch, got %v", err)
+	}
+	// 兑换失败时报价随事务回滚，仍可使用
+	if err := exchange(q.Id, 10, 14850); err != nil {
+		t.Fatal(err)
+	}
+	h.Ledger.AssertBalance(t, "alice", "USD", 90)
+	h.Ledger.AssertBalance(t, "alice", "NGN", 14850)
+	if err := exchange(q.Id, 10, 14850); !errors.Is(err, ErrQuoteUsed) {
+		t.Fatalf("expect ErrQuoteUsed, got %v", err)
+	}
+
+	q, _ = fx.NewQuote("alice", "USD", "NGN", 10)
+	now = now.Add(time.Minute)
+	if err := exchange(q.Id, 10, 14850); !errors.Is(err, ErrQuoteExpired) {
+		t.Fatalf("expect ErrQuoteExpired, got %v", err)
+	}
+	if err := exchange("", 10, 14850); !errors.Is(err, ErrQuoteRequired) {
+		t.Fatalf("expect ErrQuoteRequired, got %v", err)
+	}
+	h.Ledger.AssertBalance(t, "alice", "USD", 90)
+}
@@ -0,0 +1,391 @@
+package handles
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"simplopay.com/backend/pkg/opay"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+ * 支付网关充值
+ * 充值订单先以等待处理状态创建，订单ID即为支付网关的付款参考号，
+ * 网关的到账回调经 HMAC 签名校验及防重放校验后，携带回调将订单推进为成功，
+ * Recharge 仅在回调的参考号、金额与币种均与订单一致时入账，不一致的回调进入人工复核队列
+ */
+type (
+	// 网关回调
+	GatewayCallback struct {
+		EventId   string  `json:"event_id"`  //网关事件ID，用于防重放
+		Reference string  `json:"reference"` //付款参考号，即充值订单ID
+		Amount    float64 `json:"amount"`
+		Currency  string  `json:"currency"`
+		Status    string  `json:"status"`    //PAYMENT_SUCCEEDED or PAYMENT_FAILED
+		Timestamp int64   `json:"timestamp"` //网关签发回调的时间，秒
+	}
+
+	// 待复核的回调
+	PaymentReview struct {
+		Id         int64           `json:"id" db:"id"`
+		EventId    string          `json:"event_id" db:"event_id"`
+		Reference  string          `json:"reference" db:"reference"`
+		Callback   json.RawMessage `json:"callback" db:"callback"`
+		Reason     string          `json:"reason" db:"reason"`
+		Status     string          `json:"status" db:"status"`
+		Note       string          `json:"note" db:"note"` //复核说明
+		CreatedAt  int64           `json:"created_at" db:"created_at"`
+		ResolvedAt int64           `json:"resolved_at" db:"resolved_at"`
+	}
+
+	// 网关回调存储接口，记录已处理的事件及待复核的回调
+	GatewayStore interface {
+		// 事件是否已处理
+		EventSeen(eventId string) (bool, error)
+
+		// 记录已处理的事件，重复记录返回 ErrCallbackReplay
+		SaveEvent(eventId string, at int64) error
+
+		// 加入复核队列
+		AddReview(r *PaymentReview) error
+
+		// 按状态查询复核记录，按ID正序
+		Reviews(status string, limit int) ([]*PaymentReview, error)
+
+		// 完成复核
+		ResolveReview(id int64, note string, at int64) (*PaymentReview, error)
+	}
+
+	// 按回调结束充值订单，成功的回调将订单推进为成功，失败的回调将订单推进为失败
+	// 订单已处于该结果时应返回 nil，无对应的待处理订单时应返回 ErrPaymentUnmatched
+	GatewayFinishFunc func(cb *GatewayCallback) error
+
+	// 支付网关
+	Gateway struct {
+		secret    []byte
+		tolerance time.Duration
+		store     GatewayStore
+		finish    GatewayFinishFunc
+		clock     func() time.Time
+	}
+)
+
+// 网关付款结果
+const (
+	PAYMENT_SUCCEEDED = "succeeded"
+	PAYMENT_FAILED    = "failed"
+)
+
+// 回调的处理结果
+const (
+	CALLBACK_CREDITED = "credited" //已入账
+	CALLBACK_FAILED   = "failed"   //订单已标记为失败
+	CALLBACK_REVIEW   = "review"   //已进入复核队列
+)
+
+// 复核状态
+const (
+	REVIEW_OPEN     = "open"
+	REVIEW_RESOLVED = "resolved"
+)
+
+// 每次查询的复核记录数量
+const DEFAULT_REVIEW_LIMIT = 100
+
+// 网关回调在订单附加参数中的键
+const GATEWAY_PAYMENT_KEY = "gateway_payment"
+
+var (
+	ErrCallbackSignature = errors.New("回调签名不正确")
+	ErrCallbackFormat    = errors.New("回调格式不正确")
+	ErrCallbackExpired   = errors.New("回调已过期")
+	ErrCallbackReplay    = errors.New("回调已处理")
+	ErrPaymentRequired   = errors.New("充值须提供网关到账回调")
+	ErrPaymentMismatch   = errors.New("到账回调与充值订单不符")
+	ErrPaymentUnmatched  = errors.New("到账回调无对应的待处理充值订单")
+	ErrReviewNotFound    = errors.New("复核记录不存在")
+	ErrReviewResolved    = errors.New("复核记录已完成")
+	ErrReviewNote        = errors.New("完成复核须提供说明")
+)
+
+// 新建支付网关，回调以 secret 签名，签发时间与当前时间相差须在 tolerance 内
+func NewGateway(secret []byte, tolerance time.Duration, store GatewayStore, finish GatewayFinishFunc) *Gateway {
+	return &Gateway{
+		secret:    secret,
+		tolerance: tolerance,
+		store:     store,
+		finish:    finish,
+		clock:     time.Now,
+	}
+}
+
+// 回调内容的签名，为十六进制的 HMAC-SHA256
+func (g *Gateway) Sign(body []byte) string {
+	return hex.EncodeToString(g.mac(body))
+}
+
+func (g *Gateway) mac(body []byte) []byte {
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// 校验回调的签名、格式及签发时间，不检查是否重放
+func (g *Gateway) Verify(body []byte, signature string) (*GatewayCallback, error) {
+	sig, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, g.mac(body)) {
+		return nil, ErrCallbackSignature
+	}
+	var cb GatewayCallback
+	if err := json.Unmarshal(body, &cb); err != nil {
+		return nil, ErrCallbackFormat
+	}
+	if len(cb.EventId) == 0 || len(cb.Reference) == 0 || len(cb.Currency) == 0 ||
+		(cb.Status != PAYMENT_SUCCEEDED && cb.Status != PAYMENT_FAILED) {
+		return nil, ErrCallbackFormat
+	}
+	at := time.Unix(cb.Timestamp, 0)
+	if d := g.clock().Sub(at); d > g.tolerance || d < -g.tolerance {
+		return nil, ErrCallbackExpired
+	}
+	return &cb, nil
+}
+
+// 处理网关回调，返回处理结果
+// 事件在处理成功或进入复核队列后才记为已处理，处理出错时网关可以重发
+func (g *Gateway) Handle(body []byte, signature string) (*GatewayCallback, string, error) {
+	cb, err := g.Verify(body, signature)
+	if err != nil {
+		return nil, "", err
+	}
+	seen, err := g.store.EventSeen(cb.EventId)
+	if err != nil {
+		return nil, "", err
+	}
+	if seen {
+		return cb, "", ErrCallbackReplay
+	}
+	result := CALLBACK_CREDITED
+	if cb.Status == PAYMENT_FAILED {
+		result = CALLBACK_FAILED
+	}
+	err = g.finish(cb)
+	if errors.Is(err, ErrPaymentMismatch) || errors.Is(err, ErrPaymentUnmatched) {
+		result = CALLBACK_REVIEW
+		err = g.store.AddReview(&PaymentReview{
+			EventId:   cb.EventId,
+			Reference: cb.Reference,
+			Callback:  json.RawMessage(body),
+			Reason:    err.Error(),
+			Status:    REVIEW_OPEN,
+			CreatedAt: g.clock().Unix(),
+		})
+	}
+	if err != nil {
+		return cb, "", err
+	}
+	return cb, result, g.store.SaveEvent(cb.EventId, g.clock().Unix())
+}
+
+// 待复核的回调
+func (g *Gateway) Reviews(status string, limit int) ([]*PaymentReview, error) {
+	return g.store.Reviews(status, limit)
+}
+
+// 完成复核，须说明处理方式，如已人工入账
+func (g *Gateway) Resolve(id int64, note string) (*PaymentReview, error) {
+	if len(note) == 0 {
+		return nil, ErrReviewNote
+	}
+	return g.store.ResolveReview(id, note, g.clock().Unix())
+}
+
+// 校验推进充值订单的到账回调
+func verifyPayment(ctx *opay.Context) error {
+	cb, ok := ctx.Get(GATEWAY_PAYMENT_KEY).(*GatewayCallback)
+	if !ok || cb.Status != PAYMENT_SUCCEEDED {
+		return ErrPaymentRequired
+	}
+	initiator := ctx.Request.Initiator
+	id, err := orderId(initiator)
+	if err != nil {
+		return err
+	}
+	if cb.Reference != id {
+		return fmt.Errorf("%w: reference %s", ErrPaymentMismatch, cb.Reference)
+	}
+	if cb.Currency != initiator.GetAid() || !ctx.Equal(cb.Amount, initiator.GetAmount()) {
+		return fmt.Errorf("%w: paid %s %s", ErrPaymentMismatch, ctx.Ftoa(cb.Amount), cb.Currency)
+	}
+	return nil
+}
+
+/*
+ * 网关回调存储
+ */
+
+// 内存网关回调存储
+type MemGatewayStore struct {
+	events  map[string]int64
+	reviews []*PaymentReview
+	lock    sync.Mutex
+}
+
+var _ GatewayStore = (*MemGatewayStore)(nil)
+
+func NewMemGatewayStore() *MemGatewayStore {
+	return &MemGatewayStore{events: make(map[string]int64)}
+}
+
+func (s *MemGatewayStore) EventSeen(eventId string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.events[eventId]
+	return ok, nil
+}
+
+func (s *MemGatewayStore) SaveEvent(eventId string, at int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.events[eventId]; ok {
+		return ErrCallbackReplay
+	}
+	s.events[eventId] = at
+	return nil
+}
+
+func (s *MemGatewayStore) AddReview(r *PaymentReview) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c := *r
+	c.Id = int64(len(s.reviews) + 1)
+	s.reviews = append(s.reviews, &c)
+	r.Id = c.Id
+	return nil
+}
+
+func (s *MemGatewayStore) Reviews(status string, limit int) ([]*PaymentReview, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var reviews []*PaymentReview
+	for _, r := range s.reviews {
+		if r.Status == status && (limit <= 0 || len(reviews) < limit) {
+			c := *r
+			reviews = append(reviews, &c)
+		}
+	}
+	return reviews, nil
+}
+
+func (s *MemGatewayStore) ResolveReview(id int64, note string, at int64) (*PaymentReview, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if id <= 0 || id > int64(len(s.reviews)) {
+		return nil, ErrReviewNotFound
+	}
+	r := s.reviews[id-1]
+	if r.Status != REVIEW_OPEN {
+		return nil, ErrReviewResolved
+	}
+	r.Status, r.Note, r.ResolvedAt = REVIEW_RESOLVED, note, at
+	c := *r
+	return &c, nil
+}
+
+// 网关回调表结构
+const GatewaySchema = `
+CREATE TABLE IF NOT EXISTS gateway_events (
+	event_id   VARCHAR(128) PRIMARY KEY,
+	created_at BIGINT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS payment_reviews (
+	id          BIGSERIAL PRIMARY KEY,
+	event_id    VARCHAR(128) NOT NULL,
+	reference   VARCHAR(64) NOT NULL,
+	callback    JSONB NOT NULL,
+	reason      TEXT NOT NULL,
+	status      VARCHAR(16) NOT NULL,
+	note        TEXT NOT NULL DEFAULT '',
+	created_at  BIGINT NOT NULL,
+	resolved_at BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS payment_reviews_status_idx ON payment_reviews (status, id);
+`
+
+// 基于SQL数据库的网关回调存储
+type SQLGatewayStore struct {
+	db sqlx.Ext
+}
+
+var _ GatewayStore = (*SQLGatewayStore)(nil)
+
+func NewSQLGatewayStore(db sqlx.Ext) *SQLGatewayStore {
+	return &SQLGatewayStore{db: db}
+}
+
+func (s *SQLGatewayStore) EventSeen(eventId string) (bool, error) {
+	var n int
+	err := sqlx.Get(s.db, &n, s.db.Rebind(`SELECT COUNT(*) FROM gateway_events WHERE event_id = ?`), eventId)
+	return n > 0, err
+}
+
+func (s *SQLGatewayStore) SaveEvent(eventId string, at int64) error {
+	result, err := s.db.Exec(s.db.Rebind(`INSERT INTO gateway_events (event_id, created_at) VALUES (?, ?)
+		ON CONFLICT (event_id) DO NOTHING`), eventId, at)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrCallbackReplay
+	}
+	return nil
+}
+
+func (s *SQLGatewayStore) AddReview(r *PaymentReview) error {
+	return sqlx.Get(s.db, &r.Id, s.db.Rebind(`INSERT INTO payment_reviews
+		(event_id, reference, callback, reason, status, note, created_at, resolved_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`),
+		r.EventId, r.Reference, []byte(r.Callback), r.Reason, r.Status, r.Note, r.CreatedAt, r.ResolvedAt)
+}
+
+func (s *SQLGatewayStore) Reviews(status string, limit int) ([]*PaymentReview, error) {
+	if limit <= 0 {
+		limit = DEFAULT_REVIEW_LIMIT
+	}
+	reviews := []*PaymentReview{}
+	err := sqlx.Select(s.db, &reviews, s.db.Rebind(`SELECT * FROM payment_reviews
+		WHERE status = ? ORDER BY id LIMIT ?`), status, limit)
+	return reviews, err
+}
+
+func (s *SQLGatewayStore) ResolveReview(id int64, note string, at int64) (*PaymentReview, error) {
+	var r PaymentReview
+	err := sqlx.Get(s.db, &r, s.db.Rebind(`UPDATE payment_reviews SET status = ?, note = ?, resolved_at = ?
+		WHERE id = ? AND status = ? RETURNING *`), REVIEW_RESOLVED, note, at, id, REVIEW_OPEN)
+	if err == sql.ErrNoRows {
+		var n int
+		if err = sqlx.Get(s.db, &n, s.db.Rebind(`SELECT COUNT(*) FROM payment_reviews WHERE id = ?`), id); err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, ErrReviewNotFound
+		}
+		return nil, ErrReviewResolved
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
@@ -0,0 +1,114 @@
+package handles
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"simplopay.com/backend/pkg/opay"
+	"simplopay.com/backend/pkg/opay/opaytest"
+)
+
+func TestGatewayRecharge(t *testing.T) {
+	h := opaytest.NewHarness(2, "NGN")
+	meta := h.RegMeta("recharge", new(Recharge),
+		opay.Status{Code: 1, Step: opay.PEND},
+		opay.Status{Code: 3, Step: opay.SUCCEED},
+		opay.Status{Code: 4, Step: opay.FAIL})
+
+	orders := map[string]*opaytest.Order{}
+	finish := func(cb *GatewayCallback) error {
+		o, ok := orders[cb.Reference]
+		if !ok {
+			return ErrPaymentUnmatched
+		}
+		target := int64(3)
+		if cb.Status == PAYMENT_FAILED {
+			target = 4
+		}
+		resp := h.Opay.Do(&opay.Request{Initiator: o.Move(target), Addition: map[string]interface{}{GATEWAY_PAYMENT_KEY: cb}})
+		if resp.Err != nil {
+			o.Move(1)
+		}
+		return resp.Err
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewMemGatewayStore()
+	gateway := NewGateway([]byte("secret"), time.Minute, store, finish)
+	gateway.clock = func() time.Time { return now }
+
+	recharge := func(id string, amount float64) {
+		o := opaytest.NewOrder(meta, id, "alice", "NGN", amount, 1)
+		orders[id] = o
+		if resp := h.Do(o, nil); resp.Err != nil {
+			t.Fatal(resp.Err)
+		}
+	}
+	callback := func(cb GatewayCallback) (string, error) {
+		cb.Timestamp = now.Unix()
+		body, _ := json.Marshal(cb)
+		_, result, err := gateway.Handle(body, gateway.Sign(body))
+		return result, err
+	}
+
+	// 到账后入账，重放的回调被拒绝
+	recharge("1", 50)
+	h.Ledger.AssertBalance(t, "alice", "NGN", 0)
+	paid := GatewayCallback{EventId: "evt-1", Reference: "1", Amount: 50, Currency: "NGN", Status: PAYMENT_SUCCEEDED}
+	if result, err := callback(paid); err != nil || result != CALLBACK_CREDITED {
+		t.Fatalf("expect credited, got %s, %v", result, err)
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 50)
+	if _, err := callback(paid); !errors.Is(err, ErrCallbackReplay) {
+		t.Fatalf("expect ErrCallbackReplay, got %v", err)
+	}
+
+	// 签名错误、过期
+	body, _ := json.Marshal(GatewayCallback{EventId: "evt-2", Reference: "1", Amount: 50, Currency: "NGN", Status: PAYMENT_SUCCEEDED, Timestamp: now.Unix()})
+	if _, _, err := gateway.Handle(body, gateway.Sign([]byte("{}"))); !errors.Is(err, ErrCallbackSignature) {
+		t.Fatalf("expect ErrCallbackSignature, got %v", err)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, _, err := gateway.Handle(body, gateway.Sign(body)); !errors.Is(err, ErrCallbackExpired) {
+		t.Fatalf("expect ErrCallbackExpired, got %v", err)
+	}
+
+	// 金额、币种不符及无对应订单的回调进入复核
+	recharge("2", 80)
+	for i, cb := range []GatewayCallback{
+		{EventId: "evt-3", Reference: "2", Amount: 8, Currency: "NGN", Status: PAYMENT_SUCCEEDED},
+		{EventId: "evt-4", Reference: "2", Amount: 80, Currency: "USD", Status: PAYMENT_SUCCEEDED},
+		{EventId: "evt-5", Reference: "9", Amount: 80, Currency: "NGN", Status: PAYMENT_SUCCEEDED},
+	} {
+		if result, err := callback(cb); err != nil || result != CALLBACK_REVIEW {
+			t.Fatalf("%d: expect review, got %s, %v", i, result, err)
+		}
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 50)
+	reviews, _ := gateway.Reviews(REVIEW_OPEN, 0)
+	if len(reviews) != 3 || reviews[0].Reference != "2" {
+		t.Fatalf("unexpected reviews %+v", reviews)
+	}
+	if _, err := gateway.Resolve(reviews[0].Id, ""); !errors.Is(err, ErrReviewNote) {
+		t.Fatalf("expect ErrReviewNote, got %v", err)
+	}
+	if _, err := gateway.Resolve(reviews[0].Id, "refunded"); err != nil {
+		t.Fatal(err)
+	}
+	if reviews, _ = gateway.Reviews(REVIEW_OPEN, 0); len(reviews) != 2 {
+		t.Fatalf("expect 2 open reviews, got %d", len(reviews))
+	}
+
+	// 付款失败，订单失败且不入账
+	if result, err := callback(GatewayCallback{EventId: "evt-6", Reference: "2", Amount: 80, Currency: "NGN", Status: PAYMENT_FAILED}); err != nil || result != CALLBACK_FAILED {
+		t.Fatalf("expect failed, got %s, %v", result, err)
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 50)
+
+	// 未经网关回调不可入账
+	recharge("3", 10)
+	if resp := h.Do(orders["3"].Move(3), nil); !errors.Is(resp.Err, ErrPaymentRequired) {
+		t.Fatalf("expect ErrPaymentRequired, got %v", resp.Err)
+	}
+}
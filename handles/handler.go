@@ -1,7 +1,7 @@
 package handles
 
 import (
-	"github.com/henrylee2cn/opay"
+	"simplopay.com/backend/pkg/opay"
 )
 
 /*
@@ -30,6 +30,9 @@ type (
 
 		// 同步处理订单，并标记为成功状态
 		SyncDeal() error
+
+		// 冲正已成功的订单，处理账户并保存补偿订单
+		Reverse() error
 	}
 
 	// 实现基本操作接口
@@ -54,6 +57,8 @@ func (b *Background) Call(handler Handler, ctx *opay.Context) error {
 		return handler.Succeed()
 	case opay.SYNC_DEAL:
 		return handler.SyncDeal()
+	case opay.REVERSE:
+		return handler.Reverse()
 	}
 	return opay.ErrIllegalStep
 }
@@ -62,3 +67,8 @@ func (b *Background) Call(handler Handler, ctx *opay.Context) error {
 func (b *Background) SyncDeal() error {
 	return opay.ErrIllegalStep
 }
+
+// 冲正已成功的订单，默认不支持
+func (b *Background) Reverse() error {
+	return opay.ErrIllegalStep
+}
@@ -0,0 +1,136 @@
+package handles
+
+import (
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	"simplopay.com/backend/pkg/opay"
+	"simplopay.com/backend/pkg/opay/opaytest"
+)
+
+func TestTransfer(t *testing.T) {
+	h := opaytest.NewHarness(2, "NGN")
+	meta := h.RegMeta("transfer", new(Transfer),
+		opay.Status{Code: 1, Note: "转账完成", Step: opay.SYNC_DEAL})
+	h.Ledger.Fund("alice", "NGN", 100)
+
+	resp := h.Do(opaytest.NewOrder(meta, "1", "alice", "NGN", -30, 1), opaytest.NewOrder(meta, "1", "bob", "NGN", 30, 1))
+	if resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 70)
+	h.Ledger.AssertBalance(t, "bob", "NGN", 30)
+
+	// 两笔金额不对等
+	resp = h.Do(opaytest.NewOrder(meta, "2", "alice", "NGN", -30, 1), opaytest.NewOrder(meta, "2", "bob", "NGN", 40, 1))
+	if !errors.Is(resp.Err, opay.ErrIncorrectAmount) {
+		t.Fatalf("expect ErrIncorrectAmount, got %v", resp.Err)
+	}
+	resp = h.Do(opaytest.NewOrder(meta, "3", "alice", "NGN", -30, 1), nil)
+	if !errors.Is(resp.Err, opay.ErrStakeholderNotExist) {
+		t.Fatalf("expect ErrStakeholderNotExist, got %v", resp.Err)
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 70)
+}
+
+func TestWithdraw(t *testing.T) {
+	h := opaytest.NewHarness(2, "NGN")
+	meta := h.RegMeta("withdraw", new(Withdraw),
+		opay.Status{Code: 1, Note: "提现中", Step: opay.PEND},
+		opay.Status{Code: 2, Note: "提现成功", Step: opay.SUCCEED},
+		opay.Status{Code: 3, Note: "提现失败", Step: opay.FAIL})
+	h.Ledger.Fund("alice", "NGN", 100)
+	SetPayouts(NewPayouts(NewFakePayoutProvider("fake"), NewMemPayoutStore(), time.Hour, nil))
+	defer SetPayouts(nil)
+
+	// 先扣款，失败后退回
+	order := opaytest.NewOrder(meta, "1", "alice", "NGN", -40, 1)
+	if resp := h.Do(order, nil); resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 60)
+	if resp := h.Do(order.Move(3), nil); resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 100)
+
+	order = opaytest.NewOrder(meta, "2", "alice", "NGN", -40, 1)
+	if resp := h.Do(order, nil); resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+	if resp := h.Do(order.Move(2), nil); resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 60)
+
+	// 超出余额
+	resp := h.Do(opaytest.NewOrder(meta, "3", "alice", "NGN", -80, 1), nil)
+	if !errors.Is(resp.Err, opaytest.ErrInsufficientBalance) {
+		t.Fatalf("expect ErrInsufficientBalance, got %v", resp.Err)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	db, mock := opaytest.NewSQLMock(t)
+	o := opay.NewOpay(db, 10, 2)
+	o.SettleFuncMap = opay.NewSettleFuncMap()
+	o.RegSettleFunc("NGN", func(uid string, amount float64, tx opay.Tx) error { return nil })
+	o.RegBalanceFunc("NGN", func(uid string, tx opay.Tx) (float64, error) { return 100, nil })
+	meta, err := o.RegMeta("authorization", new(Authorize), []opay.Status{
+		{Code: 1, Note: "冻结", Step: opay.PEND},
+		{Code: 3, Note: "扣款", Step: opay.SUCCEED},
+		{Code: 4, Note: "过期", Step: opay.FAIL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go o.Serve()
+	SetHolds(NewSQLHoldStore(), 0)
+	defer SetHolds(nil, 0)
+
+	// 账面余额100，已冻结80，可用余额不足30
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^SELECT COALESCE\(SUM\(amount\), 0\) FROM holds`).
+		WillReturnRows([]string{"sum"}, []driver.Value{80.0})
+	mock.ExpectRollback()
+	resp := o.Do(&opay.Request{Initiator: opaytest.NewOrder(meta, "1", "alice", "NGN", -30, 1)})
+	if !errors.Is(resp.Err, ErrInsufficientFund) {
+		t.Fatalf("expect ErrInsufficientFund, got %v", resp.Err)
+	}
+
+	// 可用余额足够时冻结
+	mock.ExpectBegin()
+	mock.ExpectQuery(`^SELECT COALESCE\(SUM\(amount\), 0\) FROM holds`).
+		WillReturnRows([]string{"sum"}, []driver.Value{80.0})
+	mock.ExpectExec(`^INSERT INTO holds`).WillReturnResult(1)
+	mock.ExpectCommit()
+	held := opaytest.NewOrder(meta, "2", "alice", "NGN", -20, 1)
+	resp = o.Do(&opay.Request{Initiator: held})
+	if resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+
+	// 过期的冻结将订单推进至过期状态
+	mock.ExpectQuery(`^SELECT order_id FROM holds`).
+		WillReturnRows([]string{"order_id"}, []driver.Value{"2"})
+	mock.ExpectBegin()
+	mock.ExpectExec(`^UPDATE holds SET status`).WillReturnResult(1)
+	mock.ExpectCommit()
+	n, err := ExpireHolds(db, 0, func(orderId string) error {
+		if orderId != held.Id {
+			t.Fatalf("expect order %s, got %s", held.Id, orderId)
+		}
+		return o.Do(&opay.Request{Initiator: held.Move(4)}).Err
+	})
+	if err != nil || n != 1 {
+		t.Fatalf("expect 1 expired, got %d, %v", n, err)
+	}
+	if held.Target != 4 {
+		t.Fatalf("expect status 4, got %d", held.Target)
+	}
+	if err := mock.Done(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,170 @@
+package handles
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+ * 资金冻结
+ */
+type (
+	// 冻结记录，冻结金额只减少可用余额，不影响账面余额
+	Hold struct {
+		OrderId   string  `json:"order_id" db:"order_id"`
+		Uid       string  `json:"uid" db:"uid"`
+		Aid       string  `json:"aid" db:"aid"`
+		Amount    float64 `json:"amount" db:"amount"`     //冻结金额，正数
+		Captured  float64 `json:"captured" db:"captured"` //已扣款金额，正数
+		Status    string  `json:"status" db:"status"`
+		ExpiresAt int64   `json:"expires_at" db:"expires_at"`
+		CreatedAt int64   `json:"created_at" db:"created_at"`
+		UpdatedAt int64   `json:"updated_at" db:"updated_at"`
+	}
+
+	// 冻结记录存储接口
+	HoldStore interface {
+		// 新建冻结
+		Place(tx *sqlx.Tx, hold *Hold) error
+
+		// 查询冻结
+		Get(tx *sqlx.Tx, orderId string) (*Hold, error)
+
+		// 扣款并解除冻结，amount为正数且不超过冻结金额
+		Capture(tx *sqlx.Tx, orderId string, amount float64) error
+
+		// 解除冻结
+		Void(tx *sqlx.Tx, orderId string) error
+
+		// 统计账户有效的冻结总额
+		Held(q sqlx.Ext, uid, aid string) (float64, error)
+
+		// 将冻结标记为过期，已过期的冻结不报错
+		Expire(tx *sqlx.Tx, orderId string) error
+
+		// 查询已过期但仍有效的冻结的订单ID，最多limit个
+		Expired(q sqlx.Ext, limit int) ([]string, error)
+	}
+)
+
+// 冻结状态
+const (
+	HOLD_ACTIVE   = "active"
+	HOLD_CAPTURED = "captured"
+	HOLD_VOIDED   = "voided"
+	HOLD_EXPIRED  = "expired"
+)
+
+var (
+	ErrHoldNotFound     = errors.New("冻结记录不存在")
+	ErrHoldNotActive    = errors.New("冻结记录已失效")
+	ErrInsufficientFund = errors.New("可用余额不足")
+)
+
+// 冻结表结构
+const HoldSchema = `
+CREATE TABLE IF NOT EXISTS holds (
+	order_id   VARCHAR(64) PRIMARY KEY,
+	uid        VARCHAR(64) NOT NULL,
+	aid        VARCHAR(32) NOT NULL,
+	amount     NUMERIC(20, 8) NOT NULL CHECK (amount > 0),
+	captured   NUMERIC(20, 8) NOT NULL DEFAULT 0,
+	status     VARCHAR(16) NOT NULL,
+	expires_at BIGINT NOT NULL,
+	created_at BIGINT NOT NULL,
+	updated_at BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS holds_account_idx ON holds (uid, aid, status);
+CREATE INDEX IF NOT EXISTS holds_expiry_idx ON holds (status, expires_at);
+`
+
+// 基于SQL数据库的冻结记录存储
+type SQLHoldStore struct{}
+
+var _ HoldStore = (*SQLHoldStore)(nil)
+
+func NewSQLHoldStore() *SQLHoldStore {
+	return &SQLHoldStore{}
+}
+
+func (*SQLHoldStore) Place(tx *sqlx.Tx, hold *Hold) error {
+	_, err := tx.NamedExec(`INSERT INTO holds
+		(order_id, uid, aid, amount, captured, status, expires_at, created_at, updated_at)
+		VALUES (:order_id, :uid, :aid, :amount, :captured, :status, :expires_at, :created_at, :updated_at)`, hold)
+	return err
+}
+
+func (*SQLHoldStore) Get(tx *sqlx.Tx, orderId string) (*Hold, error) {
+	var hold Hold
+	err := tx.Get(&hold, tx.Rebind(`SELECT * FROM holds WHERE order_id = ? FOR UPDATE`), orderId)
+	if err == sql.ErrNoRows {
+		return nil, ErrHoldNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &hold, nil
+}
+
+// 仅可扣款有效且未过期的冻结
+func (*SQLHoldStore) Capture(tx *sqlx.Tx, orderId string, amount float64) error {
+	now := time.Now().Unix()
+	result, err := tx.Exec(tx.Rebind(`UPDATE holds SET status = ?, captured = ?, updated_at = ?
+		WHERE order_id = ? AND status = ? AND expires_at > ? AND amount >= ?`),
+		HOLD_CAPTURED, amount, now, orderId, HOLD_ACTIVE, now, amount)
+	if err != nil {
+		return err
+	}
+	return checkHoldAffected(result)
+}
+
+// 已过期的冻结也可撤销
+func (*SQLHoldStore) Void(tx *sqlx.Tx, orderId string) error {
+	result, err := tx.Exec(tx.Rebind(`UPDATE holds SET status = ?, updated_at = ?
+		WHERE order_id = ? AND status IN (?, ?)`),
+		HOLD_VOIDED, time.Now().Unix(), orderId, HOLD_ACTIVE, HOLD_EXPIRED)
+	if err != nil {
+		return err
+	}
+	return checkHoldAffected(result)
+}
+
+func (*SQLHoldStore) Held(q sqlx.Ext, uid, aid string) (float64, error) {
+	var held float64
+	err := sqlx.Get(q, &held, q.Rebind(`SELECT COALESCE(SUM(amount), 0) FROM holds
+		WHERE uid = ? AND aid = ? AND status = ? AND expires_at > ?`),
+		uid, aid, HOLD_ACTIVE, time.Now().Unix())
+	return held, err
+}
+
+func (*SQLHoldStore) Expire(tx *sqlx.Tx, orderId string) error {
+	result, err := tx.Exec(tx.Rebind(`UPDATE holds SET status = ?, updated_at = ?
+		WHERE order_id = ? AND status IN (?, ?)`),
+		HOLD_EXPIRED, time.Now().Unix(), orderId, HOLD_ACTIVE, HOLD_EXPIRED)
+	if err != nil {
+		return err
+	}
+	return checkHoldAffected(result)
+}
+
+func (*SQLHoldStore) Expired(q sqlx.Ext, limit int) ([]string, error) {
+	var ids []string
+	err := sqlx.Select(q, &ids, q.Rebind(`SELECT order_id FROM holds
+		WHERE status = ? AND expires_at <= ? ORDER BY expires_at LIMIT ?`),
+		HOLD_ACTIVE, time.Now().Unix(), limit)
+	return ids, err
+}
+
+func checkHoldAffected(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrHoldNotActive
+	}
+	return nil
+}
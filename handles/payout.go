@@ -0,0 +1,723 @@
+package handles
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"simplopay.com/backend/pkg/opay"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+ * 提现代付
+ * 提现订单新建时在同一事务中记录未发起的代付，进入处理中(DO)时通过代付通道发起代付，并记录通道流水号，
+ * 之后由通道回调或定时查询得到代付结果，通过 PayoutFinishFunc 将订单标记为成功或失败，失败时退回提现金额及手续费
+ * 发起失败的代付由定时查询通过 PayoutDispatchFunc 重新发起，
+ * 超过期限仍未得到结果的代付须由通道确认撤销后才按失败处理，否则转人工审核
+ */
+type (
+	// 代付请求
+	PayoutRequest struct {
+		OrderId     string
+		Uid         string
+		Aid         string
+		Amount      float64 //代付金额，正数
+		Destination string  //收款账户，为空时由通道按用户的默认收款账户代付
+	}
+
+	// 代付结果
+	PayoutResult struct {
+		Status string //PAYOUT_PENDING, PAYOUT_SUCCEEDED or PAYOUT_FAILED
+		Reason string
+	}
+
+	// 代付通道
+	PayoutProvider interface {
+		// 通道名称
+		Name() string
+
+		// 发起代付，以订单ID为幂等键，重复发起须返回同一流水号
+		Dispatch(req *PayoutRequest) (reference string, err error)
+
+		// 按流水号查询代付结果
+		Query(reference string) (*PayoutResult, error)
+	}
+
+	// 可撤销代付的通道，确认代付已撤销且不会付款时返回 nil
+	PayoutCanceler interface {
+		// reference 为空时按订单ID撤销
+		Cancel(orderId, reference string) error
+	}
+
+	// 代付记录，Reference 为空时尚未发起
+	Payout struct {
+		OrderId     string  `json:"order_id" db:"order_id"`
+		Provider    string  `json:"provider" db:"provider"`
+		Reference   string  `json:"reference" db:"reference"`
+		Uid         string  `json:"uid" db:"uid"`
+		Aid         string  `json:"aid" db:"aid"`
+		Amount      float64 `json:"amount" db:"amount"`
+		Destination string  `json:"destination" db:"destination"`
+		Status      string  `json:"status" db:"status"`
+		Reason      string  `json:"reason" db:"reason"`
+		Deadline    int64   `json:"deadline" db:"deadline"` //超过期限仍未得到结果即按失败处理
+		CreatedAt   int64   `json:"created_at" db:"created_at"`
+		UpdatedAt   int64   `json:"updated_at" db:"updated_at"`
+	}
+
+	// 代付记录存储接口，除 Prepare 外代付记录不随订单事务回滚
+	PayoutStore interface {
+		// 在提现订单的事务中新建未发起的代付记录
+		Prepare(tx opay.Tx, p *Payout) error
+
+		// 在提现订单的事务中结束未发起的代付，已发起的代付返回 ErrPayoutStatus
+		Close(tx opay.Tx, orderId, reason string) error
+
+		// 新建或更新代付记录
+		Save(p *Payout) error
+
+		// 按订单ID查询
+		Get(orderId string) (*Payout, error)
+
+		// 按通道流水号查询
+		ByReference(provider, reference string) (*Payout, error)
+
+		// 未完成的代付，按期限正序
+		Unfinished(limit int) ([]*Payout, error)
+
+		// 待人工审核的代付，按期限正序
+		Reviews(limit int) ([]*Payout, error)
+	}
+
+	// 将提现订单标记为成功或失败，p.Status 为 PAYOUT_SUCCEEDED 或 PAYOUT_FAILED，
+	// 订单已处于该结果时应返回 nil
+	PayoutFinishFunc func(p *Payout) error
+
+	// 将仍在等待处理的提现订单标记为处理中，以重新发起代付
+	PayoutDispatchFunc func(p *Payout) error
+
+	// 代付管理
+	Payouts struct {
+		provider   PayoutProvider
+		store      PayoutStore
+		timeout    time.Duration
+		finish     PayoutFinishFunc
+		redispatch PayoutDispatchFunc
+		clock      func() time.Time
+	}
+)
+
+// 代付状态
+const (
+	PAYOUT_PENDING   = "pending"
+	PAYOUT_SUCCEEDED = "succeeded"
+	PAYOUT_FAILED    = "failed"
+	PAYOUT_REVIEW    = "review" //超过期限且通道未确认撤销，待人工审核
+)
+
+// 收款账户在订单附加参数中的键
+const PAYOUT_DESTINATION_KEY = "payout_destination"
+
+// 每次查询的未完成代付数量
+const DEFAULT_PAYOUT_BATCH = 100
+
+// 超时的代付的失败原因
+const PAYOUT_TIMEOUT_REASON = "timeout"
+
+// 发起失败的代付在新建后至少间隔该时长才重新发起，以免与首次发起并发
+const PAYOUT_RETRY_AFTER = time.Minute
+
+var (
+	ErrPayoutsUnset     = errors.New("未设置代付通道")
+	ErrPayoutNotFound   = errors.New("代付记录不存在")
+	ErrPayoutProvider   = errors.New("代付通道不符")
+	ErrPayoutStatus     = errors.New("代付状态不正确")
+	ErrPayoutConflict   = errors.New("代付结果与已记录的结果不符")
+	ErrPayoutReference  = errors.New("代付通道未返回流水号")
+	ErrPayoutFinishFunc = errors.New("未设置代付完成处理")
+)
+
+func (p *Payout) open() bool {
+	return p.Status == PAYOUT_PENDING || p.Status == PAYOUT_REVIEW
+}
+
+// 新建代付管理，代付须在 timeout 内得到结果
+func NewPayouts(provider PayoutProvider, store PayoutStore, timeout time.Duration, finish PayoutFinishFunc) *Payouts {
+	return &Payouts{
+		provider: provider,
+		store:    store,
+		timeout:  timeout,
+		finish:   finish,
+		clock:    time.Now,
+	}
+}
+
+// 设置发起失败的代付的重新发起处理，未设置时不重新发起，超过期限后撤销或转人工审核
+func (ps *Payouts) SetRedispatch(redispatch PayoutDispatchFunc) {
+	ps.redispatch = redispatch
+}
+
+// 代付通道名称
+func (ps *Payouts) Provider() string {
+	return ps.provider.Name()
+}
+
+func (ps *Payouts) newPayout(ctx *opay.Context) (*Payout, error) {
+	initiator := ctx.Request.Initiator
+	id, err := orderId(initiator)
+	if err != nil {
+		return nil, err
+	}
+	now := ps.clock()
+	destination, _ := ctx.Get(PAYOUT_DESTINATION_KEY).(string)
+	return &Payout{
+		OrderId:     id,
+		Provider:    ps.provider.Name(),
+		Uid:         initiator.GetUid(),
+		Aid:         initiator.GetAid(),
+		Amount:      math.Abs(initiator.GetAmount()),
+		Destination: destination,
+		Status:      PAYOUT_PENDING,
+		Deadline:    now.Add(ps.timeout).Unix(),
+		CreatedAt:   now.Unix(),
+		UpdatedAt:   now.Unix(),
+	}, nil
+}
+
+// 在提现订单的事务中记录未发起的代付，订单未能发起代付时据此重新发起或超时撤销
+func (ps *Payouts) prepare(ctx *opay.Context) error {
+	p, err := ps.newPayout(ctx)
+	if err != nil {
+		return err
+	}
+	return ps.store.Prepare(ctx.Request.Tx, p)
+}
+
+// 在撤销提现订单的事务中结束未发起的代付
+func (ps *Payouts) close(ctx *opay.Context, reason string) error {
+	id, err := orderId(ctx.Request.Initiator)
+	if err != nil {
+		return err
+	}
+	return ps.store.Close(ctx.Request.Tx, id, reason)
+}
+
+// 为提现订单发起代付，重复发起时沿用已有的代付记录
+func (ps *Payouts) dispatch(ctx *opay.Context) (*Payout, error) {
+	p, err := ps.newPayout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if prepared, err := ps.store.Get(p.OrderId); err == nil {
+		p = prepared
+	} else if err != ErrPayoutNotFound {
+		return nil, err
+	}
+	if p.Status != PAYOUT_PENDING {
+		return nil, ErrPayoutStatus
+	}
+	reference, err := ps.provider.Dispatch(&PayoutRequest{
+		OrderId:     p.OrderId,
+		Uid:         p.Uid,
+		Aid:         p.Aid,
+		Amount:      p.Amount,
+		Destination: p.Destination,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(reference) == 0 {
+		return nil, ErrPayoutReference
+	}
+	p.Reference = reference
+	p.UpdatedAt = ps.clock().Unix()
+	return p, ps.store.Save(p)
+}
+
+// 处理通道回调，回调仅作为通知，结果以向通道查询的为准
+func (ps *Payouts) Notify(provider, reference string) (*Payout, error) {
+	if provider != ps.provider.Name() {
+		return nil, ErrPayoutProvider
+	}
+	p, err := ps.store.ByReference(provider, reference)
+	if err != nil {
+		return nil, err
+	}
+	return p, ps.check(p)
+}
+
+// 查询全部未完成的代付，完成或超时的代付结束订单，发起失败的代付重新发起，返回结束的数量
+// 单个代付出错不影响其他代付，返回最后一个错误
+func (ps *Payouts) Poll(limit int) (int, error) {
+	if limit <= 0 {
+		limit = DEFAULT_PAYOUT_BATCH
+	}
+	payouts, err := ps.store.Unfinished(limit)
+	if err != nil {
+		return 0, err
+	}
+	// 待人工审核的代付仍查询通道，得到结果时结束订单
+	reviews, err := ps.store.Reviews(limit)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, p := range append(payouts, reviews...) {
+		if e := ps.check(p); e != nil {
+			err = e
+			continue
+		}
+		if !p.open() {
+			n++
+		}
+	}
+	return n, err
+}
+
+// 向通道查询代付结果，完成时结束订单，已结束的代付的结果与记录不符时返回 ErrPayoutConflict
+func (ps *Payouts) check(p *Payout) error {
+	if len(p.Reference) == 0 {
+		return ps.retry(p)
+	}
+	result, err := ps.provider.Query(p.Reference)
+	if err != nil {
+		return err
+	}
+	switch result.Status {
+	case PAYOUT_SUCCEEDED, PAYOUT_FAILED:
+		return ps.complete(p, result.Status, result.Reason)
+	case PAYOUT_PENDING:
+		if p.Status == PAYOUT_PENDING && ps.clock().Unix() >= p.Deadline {
+			return ps.expire(p)
+		}
+		return nil
+	}
+	return ErrPayoutStatus
+}
+
+// 重新发起未发起的代付，超过期限后不再发起
+func (ps *Payouts) retry(p *Payout) error {
+	if p.Status != PAYOUT_PENDING {
+		return nil
+	}
+	now := ps.clock()
+	if now.Unix() >= p.Deadline {
+		return ps.expire(p)
+	}
+	if ps.redispatch == nil || now.Before(time.Unix(p.CreatedAt, 0).Add(PAYOUT_RETRY_AFTER)) {
+		return nil
+	}
+	if err := ps.redispatch(p); err != nil {
+		return fmt.Errorf("payout of order %s: %w", p.OrderId, err)
+	}
+	return nil
+}
+
+// 超过期限仍未得到结果的代付，通道确认撤销后按失败处理，否则转人工审核
+func (ps *Payouts) expire(p *Payout) error {
+	reason := PAYOUT_TIMEOUT_REASON
+	if canceler, ok := ps.provider.(PayoutCanceler); ok {
+		err := canceler.Cancel(p.OrderId, p.Reference)
+		if err == nil {
+			return ps.complete(p, PAYOUT_FAILED, PAYOUT_TIMEOUT_REASON)
+		}
+		reason = fmt.Sprintf("%s, cancel: %v", PAYOUT_TIMEOUT_REASON, err)
+	}
+	review := *p
+	review.Status, review.Reason, review.UpdatedAt = PAYOUT_REVIEW, reason, ps.clock().Unix()
+	if err := ps.store.Save(&review); err != nil {
+		return err
+	}
+	*p = review
+	return nil
+}
+
+// 人工审核超时的代付，按向通道核实的结果结束订单
+func (ps *Payouts) Resolve(orderId string, succeeded bool, reason string) (*Payout, error) {
+	p, err := ps.store.Get(orderId)
+	if err != nil {
+		return nil, err
+	}
+	if p.Status != PAYOUT_REVIEW {
+		return nil, ErrPayoutStatus
+	}
+	status := PAYOUT_FAILED
+	if succeeded {
+		status = PAYOUT_SUCCEEDED
+	}
+	return p, ps.complete(p, status, reason)
+}
+
+// 待人工审核的代付
+func (ps *Payouts) Reviews(limit int) ([]*Payout, error) {
+	if limit <= 0 {
+		limit = DEFAULT_PAYOUT_BATCH
+	}
+	return ps.store.Reviews(limit)
+}
+
+// 结束订单后记录代付结果，记录失败时再次查询会重新结束订单
+func (ps *Payouts) complete(p *Payout, status, reason string) error {
+	if !p.open() {
+		if p.Status != status {
+			log.Printf("Payout of order %s is %s by %s, but the provider reports %s late: %s",
+				p.OrderId, p.Status, p.Reason, status, reason)
+			return ErrPayoutConflict
+		}
+		return nil
+	}
+	if ps.finish == nil {
+		return ErrPayoutFinishFunc
+	}
+	done := *p
+	done.Status, done.Reason, done.UpdatedAt = status, reason, ps.clock().Unix()
+	if err := ps.finish(&done); err != nil {
+		return fmt.Errorf("payout of order %s: %w", p.OrderId, err)
+	}
+	if err := ps.store.Save(&done); err != nil {
+		return err
+	}
+	*p = done
+	return nil
+}
+
+var payoutSetting = struct {
+	payouts *Payouts
+	lock    sync.RWMutex
+}{}
+
+// 设置提现使用的代付管理
+func SetPayouts(payouts *Payouts) {
+	payoutSetting.lock.Lock()
+	payoutSetting.payouts = payouts
+	payoutSetting.lock.Unlock()
+}
+
+func getPayouts() (*Payouts, error) {
+	payoutSetting.lock.RLock()
+	defer payoutSetting.lock.RUnlock()
+	if payoutSetting.payouts == nil {
+		return nil, ErrPayoutsUnset
+	}
+	return payoutSetting.payouts, nil
+}
+
+/*
+ * 模拟代付通道
+ */
+
+// 模拟代付通道，代付结果由 Settle 指定，用于测试及本地开发
+type FakePayoutProvider struct {
+	name     string
+	results  map[string]*PayoutResult //流水号
+	refs     map[string]string        //订单ID
+	requests []PayoutRequest
+	err      error
+	cancel   error
+	lock     sync.Mutex
+}
+
+var (
+	_ PayoutProvider = (*FakePayoutProvider)(nil)
+	_ PayoutCanceler = (*FakePayoutProvider)(nil)
+)
+
+func NewFakePayoutProvider(name string) *FakePayoutProvider {
+	return &FakePayoutProvider{
+		name:    name,
+		results: make(map[string]*PayoutResult),
+		refs:    make(map[string]string),
+	}
+}
+
+func (f *FakePayoutProvider) Name() string {
+	return f.name
+}
+
+// 之后的代付均以 err 失败，为 nil 时恢复
+func (f *FakePayoutProvider) FailDispatch(err error) {
+	f.lock.Lock()
+	f.err = err
+	f.lock.Unlock()
+}
+
+// 之后的撤销均以 err 失败，为 nil 时恢复
+func (f *FakePayoutProvider) FailCancel(err error) {
+	f.lock.Lock()
+	f.cancel = err
+	f.lock.Unlock()
+}
+
+// 撤销未完成的代付，撤销后查询结果为失败
+func (f *FakePayoutProvider) Cancel(orderId, reference string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.cancel != nil {
+		return f.cancel
+	}
+	ref, ok := f.refs[orderId]
+	if !ok {
+		return nil //未收到的代付不会付款
+	}
+	if f.results[ref].Status != PAYOUT_PENDING {
+		return ErrPayoutStatus
+	}
+	f.results[ref] = &PayoutResult{Status: PAYOUT_FAILED, Reason: "cancelled"}
+	return nil
+}
+
+func (f *FakePayoutProvider) Dispatch(req *PayoutRequest) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return "", f.err
+	}
+	f.requests = append(f.requests, *req)
+	if ref, ok := f.refs[req.OrderId]; ok {
+		return ref, nil
+	}
+	ref := fmt.Sprintf("%s-%d", f.name, len(f.refs)+1)
+	f.refs[req.OrderId] = ref
+	f.results[ref] = &PayoutResult{Status: PAYOUT_PENDING}
+	return ref, nil
+}
+
+func (f *FakePayoutProvider) Query(reference string) (*PayoutResult, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	result, ok := f.results[reference]
+	if !ok {
+		return nil, ErrPayoutNotFound
+	}
+	r := *result
+	return &r, nil
+}
+
+// 指定订单的代付结果
+func (f *FakePayoutProvider) Settle(orderId, status, reason string) (reference string, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ref, ok := f.refs[orderId]
+	if !ok {
+		return "", ErrPayoutNotFound
+	}
+	f.results[ref] = &PayoutResult{Status: status, Reason: reason}
+	return ref, nil
+}
+
+// 收到的代付请求，包括重复发起的
+func (f *FakePayoutProvider) Requests() []PayoutRequest {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]PayoutRequest(nil), f.requests...)
+}
+
+/*
+ * 代付记录存储
+ */
+
+// 内存代付记录存储
+type MemPayoutStore struct {
+	payouts map[string]*Payout
+	lock    sync.Mutex
+}
+
+var _ PayoutStore = (*MemPayoutStore)(nil)
+
+func NewMemPayoutStore() *MemPayoutStore {
+	return &MemPayoutStore{payouts: make(map[string]*Payout)}
+}
+
+func (s *MemPayoutStore) Prepare(tx opay.Tx, p *Payout) error {
+	return s.Save(p)
+}
+
+func (s *MemPayoutStore) Close(tx opay.Tx, orderId, reason string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	p, ok := s.payouts[orderId]
+	if !ok || !p.open() {
+		return nil
+	}
+	if len(p.Reference) > 0 || p.Status != PAYOUT_PENDING {
+		return ErrPayoutStatus
+	}
+	p.Status, p.Reason, p.UpdatedAt = PAYOUT_FAILED, reason, time.Now().Unix()
+	return nil
+}
+
+func (s *MemPayoutStore) Save(p *Payout) error {
+	s.lock.Lock()
+	c := *p
+	s.payouts[p.OrderId] = &c
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemPayoutStore) Get(orderId string) (*Payout, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	p, ok := s.payouts[orderId]
+	if !ok {
+		return nil, ErrPayoutNotFound
+	}
+	c := *p
+	return &c, nil
+}
+
+func (s *MemPayoutStore) ByReference(provider, reference string) (*Payout, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, p := range s.payouts {
+		if p.Provider == provider && p.Reference == reference {
+			c := *p
+			return &c, nil
+		}
+	}
+	return nil, ErrPayoutNotFound
+}
+
+func (s *MemPayoutStore) Unfinished(limit int) ([]*Payout, error) {
+	return s.filter(func(p *Payout) bool { return p.Status == PAYOUT_PENDING }, limit)
+}
+
+func (s *MemPayoutStore) Reviews(limit int) ([]*Payout, error) {
+	return s.filter(func(p *Payout) bool { return p.Status == PAYOUT_REVIEW }, limit)
+}
+
+func (s *MemPayoutStore) filter(match func(p *Payout) bool, limit int) ([]*Payout, error) {
+	s.lock.Lock()
+	var payouts []*Payout
+	for _, p := range s.payouts {
+		if match(p) {
+			c := *p
+			payouts = append(payouts, &c)
+		}
+	}
+	s.lock.Unlock()
+	sort.Slice(payouts, func(i, j int) bool {
+		return payouts[i].Deadline < payouts[j].Deadline
+	})
+	if limit > 0 && len(payouts) > limit {
+		payouts = payouts[:limit]
+	}
+	return payouts, nil
+}
+
+// 代付记录表结构
+const PayoutSchema = `
+CREATE TABLE IF NOT EXISTS payouts (
+	order_id    VARCHAR(64) PRIMARY KEY,
+	provider    VARCHAR(32) NOT NULL,
+	reference   VARCHAR(128) NOT NULL,
+	uid         VARCHAR(64) NOT NULL,
+	aid         VARCHAR(32) NOT NULL,
+	amount      NUMERIC(20, 8) NOT NULL CHECK (amount > 0),
+	destination VARCHAR(128) NOT NULL DEFAULT '',
+	status      VARCHAR(16) NOT NULL,
+	reason      TEXT NOT NULL DEFAULT '',
+	deadline    BIGINT NOT NULL,
+	created_at  BIGINT NOT NULL,
+	updated_at  BIGINT NOT NULL
+);
+DROP INDEX IF EXISTS payouts_reference_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS payouts_dispatched_idx ON payouts (provider, reference) WHERE reference <> '';
+CREATE INDEX IF NOT EXISTS payouts_unfinished_idx ON payouts (deadline) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS payouts_review_idx ON payouts (deadline) WHERE status = 'review';
+`
+
+// 基于SQL数据库的代付记录存储
+type SQLPayoutStore struct {
+	db sqlx.Ext
+}
+
+var _ PayoutStore = (*SQLPayoutStore)(nil)
+
+func NewSQLPayoutStore(db sqlx.Ext) *SQLPayoutStore {
+	return &SQLPayoutStore{db: db}
+}
+
+func (s *SQLPayoutStore) Prepare(tx opay.Tx, p *Payout) error {
+	sqlTx, err := opay.AsSqlxTx(tx)
+	if err != nil {
+		return err
+	}
+	_, err = sqlx.NamedExec(sqlTx, `INSERT INTO payouts
+		(order_id, provider, reference, uid, aid, amount, destination, status, reason, deadline, created_at, updated_at)
+		VALUES (:order_id, :provider, :reference, :uid, :aid, :amount, :destination, :status, :reason, :deadline, :created_at, :updated_at)`, p)
+	return err
+}
+
+func (s *SQLPayoutStore) Close(tx opay.Tx, orderId, reason string) error {
+	sqlTx, err := opay.AsSqlxTx(tx)
+	if err != nil {
+		return err
+	}
+	var reference, status string
+	err = sqlTx.QueryRowx(sqlTx.Rebind(`SELECT reference, status FROM payouts WHERE order_id = ? FOR UPDATE`),
+		orderId).Scan(&reference, &status)
+	if err == sql.ErrNoRows || (err == nil && status != PAYOUT_PENDING && status != PAYOUT_REVIEW) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(reference) > 0 || status != PAYOUT_PENDING {
+		return ErrPayoutStatus
+	}
+	_, err = sqlTx.Exec(sqlTx.Rebind(`UPDATE payouts SET status = ?, reason = ?, updated_at = ? WHERE order_id = ?`),
+		PAYOUT_FAILED, reason, time.Now().Unix(), orderId)
+	return err
+}
+
+// 已完成的代付不再更新
+func (s *SQLPayoutStore) Save(p *Payout) error {
+	_, err := sqlx.NamedExec(s.db, `INSERT INTO payouts
+		(order_id, provider, reference, uid, aid, amount, destination, status, reason, deadline, created_at, updated_at)
+		VALUES (:order_id, :provider, :reference, :uid, :aid, :amount, :destination, :status, :reason, :deadline, :created_at, :updated_at)
+		ON CONFLICT (order_id) DO UPDATE SET reference = EXCLUDED.reference, status = EXCLUDED.status,
+			reason = EXCLUDED.reason, updated_at = EXCLUDED.updated_at
+		WHERE payouts.status IN ('pending', 'review')`, p)
+	return err
+}
+
+func (s *SQLPayoutStore) Get(orderId string) (*Payout, error) {
+	return s.get(`order_id = ?`, orderId)
+}
+
+func (s *SQLPayoutStore) ByReference(provider, reference string) (*Payout, error) {
+	return s.get(`provider = ? AND reference = ?`, provider, reference)
+}
+
+func (s *SQLPayoutStore) get(where string, args ...interface{}) (*Payout, error) {
+	var p Payout
+	err := sqlx.Get(s.db, &p, s.db.Rebind(`SELECT * FROM payouts WHERE `+where), args...)
+	if err == sql.ErrNoRows {
+		return nil, ErrPayoutNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s *SQLPayoutStore) Unfinished(limit int) ([]*Payout, error) {
+	var payouts []*Payout
+	err := sqlx.Select(s.db, &payouts, s.db.Rebind(`SELECT * FROM payouts
+		WHERE status = ? ORDER BY deadline LIMIT ?`), PAYOUT_PENDING, limit)
+	return payouts, err
+}
+
+func (s *SQLPayoutStore) Reviews(limit int) ([]*Payout, error) {
+	var payouts []*Payout
+	err := sqlx.Select(s.db, &payouts, s.db.Rebind(`SELECT * FROM payouts
+		WHERE status = ? ORDER BY deadline LIMIT ?`), PAYOUT_REVIEW, limit)
+	return payouts, err
+}
@@ -0,0 +1,163 @@
+package handles
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"simplopay.com/backend/pkg/opay"
+	"simplopay.com/backend/pkg/opay/opaytest"
+)
+
+func TestPayout(t *testing.T) {
+	h := opaytest.NewHarness(2, "NGN")
+	meta := h.RegMeta("withdraw", new(Withdraw),
+		opay.Status{Code: 1, Step: opay.PEND},
+		opay.Status{Code: 2, Step: opay.DO},
+		opay.Status{Code: 3, Step: opay.SUCCEED},
+		opay.Status{Code: 4, Step: opay.FAIL})
+	h.Ledger.Fund("alice", "NGN", 100)
+
+	// 按代付结果结束订单
+	orders := map[string]*opaytest.Order{}
+	finish := func(p *Payout) error {
+		target := int64(3)
+		if p.Status == PAYOUT_FAILED {
+			target = 4
+		}
+		return h.Do(orders[p.OrderId].Move(target), nil).Err
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	provider := NewFakePayoutProvider("fake")
+	store := NewMemPayoutStore()
+	payouts := NewPayouts(provider, store, time.Hour, finish)
+	payouts.clock = func() time.Time { return now }
+	payouts.SetRedispatch(func(p *Payout) error {
+		return h.Do(orders[p.OrderId].Move(2), nil).Err
+	})
+	SetPayouts(payouts)
+	defer SetPayouts(nil)
+
+	pend := func(id string, amount float64) *opaytest.Order {
+		o := opaytest.NewOrder(meta, id, "alice", "NGN", -amount, 1)
+		orders[id] = o
+		if resp := h.Opay.Do(&opay.Request{Initiator: o, Addition: map[string]interface{}{PAYOUT_DESTINATION_KEY: "0123456789"}}); resp.Err != nil {
+			t.Fatal(resp.Err)
+		}
+		return o
+	}
+	withdraw := func(id string, amount float64) *opaytest.Order {
+		o := pend(id, amount)
+		if resp := h.Do(o.Move(2), nil); resp.Err != nil {
+			t.Fatal(resp.Err)
+		}
+		return o
+	}
+
+	// 代付成功
+	withdraw("1", 30)
+	p, _ := store.Get("1")
+	if p.Reference != "fake-1" || p.Amount != 30 || p.Destination != "0123456789" {
+		t.Fatalf("unexpected payout %+v", p)
+	}
+	if _, err := payouts.Notify("fake", p.Reference); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ = store.Get("1"); p.Status != PAYOUT_PENDING {
+		t.Fatalf("expect the payout pending, got %s", p.Status)
+	}
+	provider.Settle("1", PAYOUT_SUCCEEDED, "")
+	if _, err := payouts.Notify("fake", p.Reference); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := payouts.Notify("fake", p.Reference); err != nil {
+		t.Fatal(err)
+	}
+	if orders["1"].Target != 3 {
+		t.Fatalf("expect the withdrawal succeeded, got %d", orders["1"].Target)
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 70)
+
+	// 代付失败与超时均退回
+	withdraw("2", 20)
+	withdraw("3", 10)
+	h.Ledger.AssertBalance(t, "alice", "NGN", 40)
+	provider.Settle("2", PAYOUT_FAILED, "account closed")
+	if n, err := payouts.Poll(0); err != nil || n != 1 {
+		t.Fatalf("expect 1 finished, got %d, %v", n, err)
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 60)
+	now = now.Add(time.Hour)
+	if n, err := payouts.Poll(0); err != nil || n != 1 {
+		t.Fatalf("expect 1 finished, got %d, %v", n, err)
+	}
+	if p, _ = store.Get("3"); p.Status != PAYOUT_FAILED || p.Reason != PAYOUT_TIMEOUT_REASON {
+		t.Fatalf("unexpected payout %+v", p)
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 70)
+
+	// 通道未确认撤销的超时代付转人工审核，之后通道的结果与审核结果不符时报告冲突
+	provider.FailCancel(errors.New("cancel refused"))
+	withdraw("5", 10)
+	now = now.Add(time.Hour)
+	if n, err := payouts.Poll(0); err != nil || n != 0 {
+		t.Fatalf("expect 0 finished, got %d, %v", n, err)
+	}
+	if reviews, _ := payouts.Reviews(0); len(reviews) != 1 || reviews[0].OrderId != "5" {
+		t.Fatalf("expect the payout 5 in review, got %+v", reviews)
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 60)
+	if _, err := payouts.Resolve("1", false, "checked"); !errors.Is(err, ErrPayoutStatus) {
+		t.Fatalf("expect ErrPayoutStatus, got %v", err)
+	}
+	if _, err := payouts.Resolve("5", false, "checked"); err != nil {
+		t.Fatal(err)
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 70)
+	ref, _ := provider.Settle("5", PAYOUT_SUCCEEDED, "")
+	if _, err := payouts.Notify("fake", ref); !errors.Is(err, ErrPayoutConflict) {
+		t.Fatalf("expect ErrPayoutConflict, got %v", err)
+	}
+	provider.FailCancel(nil)
+
+	// 发起代付失败时订单仍等待处理，之后重新发起
+	errDown := errors.New("provider is down")
+	provider.FailDispatch(errDown)
+	o := pend("4", 10)
+	if resp := h.Do(o.Move(2), nil); !errors.Is(resp.Err, errDown) {
+		t.Fatalf("expect errDown, got %v", resp.Err)
+	}
+	o.Target = 1 //订单仍等待处理
+	if p, _ = store.Get("4"); p.Status != PAYOUT_PENDING || p.Reference != "" || p.Destination != "0123456789" {
+		t.Fatalf("unexpected payout %+v", p)
+	}
+	provider.FailDispatch(nil)
+	if _, err := payouts.Poll(0); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ = store.Get("4"); p.Reference != "" {
+		t.Fatalf("expect no dispatch before %v, got %+v", PAYOUT_RETRY_AFTER, p)
+	}
+	now = now.Add(PAYOUT_RETRY_AFTER)
+	if _, err := payouts.Poll(0); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ = store.Get("4"); p.Reference == "" || o.Target != 2 {
+		t.Fatalf("expect the payout dispatched again, got %+v", p)
+	}
+
+	// 超过期限仍未发起的代付撤销后退回
+	provider.FailDispatch(errDown)
+	o = pend("6", 10)
+	h.Do(o.Move(2), nil)
+	o.Target = 1
+	h.Ledger.AssertBalance(t, "alice", "NGN", 50)
+	now = now.Add(time.Hour)
+	if n, err := payouts.Poll(0); err != nil || n != 2 {
+		t.Fatalf("expect 2 finished, got %d, %v", n, err)
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 70)
+	if _, err := payouts.Notify("other", "fake-1"); !errors.Is(err, ErrPayoutProvider) {
+		t.Fatalf("expect ErrPayoutProvider, got %v", err)
+	}
+}
@@ -1,11 +1,13 @@
 package handles
 
 import (
-	"github.com/henrylee2cn/opay"
+	"simplopay.com/backend/pkg/opay"
 )
 
 /*
  * 充值
+ * 经支付网关的充值先创建等待处理的订单，到账回调校验通过后标记为成功并入账，
+ * 运营人员确认到账的充值可同步处理
  */
 type Recharge struct {
 	Background
@@ -25,10 +27,15 @@ func (r *Recharge) ServeOpay(ctx *opay.Context) error {
 	return r.Call(r, ctx)
 }
 
-// 处理账户并标记订单为成功状态
+// 校验网关的到账回调，处理账户并标记订单为成功状态
 func (r *Recharge) Succeed() error {
+	err := verifyPayment(r.Background.Context)
+	if err != nil {
+		return err
+	}
+
 	// 操作账户
-	err := r.Background.Context.UpdateBalance()
+	err = r.Background.Context.UpdateBalance()
 	if err != nil {
 		return err
 	}
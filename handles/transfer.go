@@ -1,7 +1,7 @@
 package handles
 
 import (
-	"github.com/henrylee2cn/opay"
+	"simplopay.com/backend/pkg/opay"
 )
 
 /*
@@ -19,14 +19,31 @@ func (t *Transfer) ServeOpay(ctx *opay.Context) error {
 	if !ctx.HasStakeholder() {
 		return opay.ErrStakeholderNotExist
 	}
-	if ctx.GreaterOrEqual(ctx.Request.Initiator.GetAmount(), 0) ||
-		ctx.SmallerOrEqual(ctx.Request.Stakeholder.GetAmount(), 0) ||
-		!ctx.Equal(ctx.Request.Initiator.GetAmount(), -ctx.Request.Stakeholder.GetAmount()) {
+	payer, payee := ctx.Request.Initiator.GetAmount(), ctx.Request.Stakeholder.GetAmount()
+	// 冲正时资金反向流动
+	if ctx.Step() == opay.REVERSE {
+		payer, payee = -payer, -payee
+	}
+	if ctx.GreaterOrEqual(payer, 0) ||
+		ctx.SmallerOrEqual(payee, 0) ||
+		!ctx.Equal(payer, -payee) {
 		return opay.ErrIncorrectAmount
 	}
 	return t.Call(t, ctx)
 }
 
+// 新建订单，并标记为等待处理状态，
+// 手续费在此时计算并记录，成功时收取
+func (t *Transfer) Pend() error {
+	err := lockFee(t.Background.Context)
+	if err != nil {
+		return err
+	}
+
+	// 创建订单
+	return t.Background.Context.Pend()
+}
+
 // 处理账户并标记订单为成功状态，
 // IOrder.Succeed()中应包含Uid2的订单创建与标记成功
 func (t *Transfer) Succeed() error {
@@ -36,14 +53,31 @@ func (t *Transfer) Succeed() error {
 		return err
 	}
 
+	// 收取手续费
+	err = chargeFee(t.Background.Context)
+	if err != nil {
+		return err
+	}
+
 	// 更新订单
 	return t.Background.Context.Succeed()
 }
 
 // 实时转账
 func (t *Transfer) SyncDeal() error {
+	err := lockFee(t.Background.Context)
+	if err != nil {
+		return err
+	}
+
 	// 操作账户
-	err := t.Background.Context.UpdateBalance()
+	err = t.Background.Context.UpdateBalance()
+	if err != nil {
+		return err
+	}
+
+	// 收取手续费
+	err = chargeFee(t.Background.Context)
 	if err != nil {
 		return err
 	}
@@ -51,3 +85,16 @@ func (t *Transfer) SyncDeal() error {
 	// 更新订单
 	return t.Background.Context.SyncDeal()
 }
+
+// 冲正转账，收款方退回款项，
+// 已收取的手续费不退还
+func (t *Transfer) Reverse() error {
+	// 操作账户
+	err := t.Background.Context.UpdateBalance()
+	if err != nil {
+		return err
+	}
+
+	// 保存补偿订单
+	return t.Background.Context.Reverse()
+}
@@ -1,7 +1,7 @@
 package handles
 
 import (
-	"github.com/henrylee2cn/opay"
+	"simplopay.com/backend/pkg/opay"
 )
 
 /*
@@ -27,10 +27,31 @@ func (w *Withdraw) ServeOpay(ctx *opay.Context) error {
 }
 
 // 新建订单，并标记为等待处理状态，
-// 先从账户扣除提现金额。
+// 先从账户扣除提现金额及手续费，并记录未发起的代付。
 func (w *Withdraw) Pend() error {
+	payouts, err := getPayouts()
+	if err != nil {
+		return err
+	}
+	err = lockFee(w.Background.Context)
+	if err != nil {
+		return err
+	}
+
 	// 操作账户
-	err := w.Background.Context.UpdateBalance()
+	err = w.Background.Context.UpdateBalance()
+	if err != nil {
+		return err
+	}
+
+	// 收取手续费
+	err = chargeFee(w.Background.Context)
+	if err != nil {
+		return err
+	}
+
+	// 记录代付
+	err = payouts.prepare(w.Background.Context)
 	if err != nil {
 		return err
 	}
@@ -39,15 +60,46 @@ func (w *Withdraw) Pend() error {
 	return w.Background.Context.Pend()
 }
 
+// 发起代付，并标记订单为正在处理状态，
+// 代付结果由 Payouts 查询后将订单标记为成功或失败
+func (w *Withdraw) Do() error {
+	payouts, err := getPayouts()
+	if err != nil {
+		return err
+	}
+	_, err = payouts.dispatch(w.Background.Context)
+	if err != nil {
+		return err
+	}
+
+	// 更新订单
+	return w.Background.Context.Do()
+}
+
 // 处理账户并标记订单为成功状态
 func (w *Withdraw) Succeed() error {
 	return w.Background.Context.Succeed()
 }
 
-// 标记订单为撤销状态
+// 标记订单为撤销状态，已发起代付的订单不可撤销
 func (w *Withdraw) Cancel() error {
+	payouts, err := getPayouts()
+	if err != nil {
+		return err
+	}
+	err = payouts.close(w.Background.Context, "cancelled")
+	if err != nil {
+		return err
+	}
+
 	// 回滚账户
-	err := w.Background.Context.RollbackBalance()
+	err = w.Background.Context.RollbackBalance()
+	if err != nil {
+		return err
+	}
+
+	// 退回手续费
+	err = refundFee(w.Background.Context)
 	if err != nil {
 		return err
 	}
@@ -64,6 +116,12 @@ func (w *Withdraw) Fail() error {
 		return err
 	}
 
+	// 退回手续费
+	err = refundFee(w.Background.Context)
+	if err != nil {
+		return err
+	}
+
 	// 更新订单
 	return w.Background.Context.Fail()
 }
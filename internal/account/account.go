@@ -4,12 +4,14 @@ import (
 	"errors"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 	"github.com/shopspring/decimal"
 )
 
 var (
-	ErrAccountNotFound = errors.New("account not found")
+	ErrAccountNotFound     = errors.New("account not found")
+	ErrInsufficientBalance = errors.New("insufficient balance")
 )
 
 // Account represents a user's financial account/wallet.
@@ -31,5 +33,33 @@ type AccountRepository interface {
 	UpdateAccountBalance(tx *sqlx.Tx, id string, balanceChange decimal.Decimal) error
 	// FindAccountByUserIDAndCurrency finds a user's account for a specific currency.
 	FindAccountByUserIDAndCurrency(userID, currency string) (*Account, error)
+	// GetAccountBalance reads an account's balance within a transaction, and locks it until the transaction ends.
+	GetAccountBalance(tx *sqlx.Tx, id string) (decimal.Decimal, error)
 	// Add other necessary methods.
 }
+
+// EnsureAccount finds the account of a user in a currency, or creates it with a zero balance.
+// It provisions the house accounts, such as the fee revenue account, at startup.
+func EnsureAccount(repo AccountRepository, userID, currency string) (*Account, error) {
+	acc, err := repo.FindAccountByUserIDAndCurrency(userID, currency)
+	if !errors.Is(err, ErrAccountNotFound) {
+		return acc, err
+	}
+	now := time.Now()
+	acc = &Account{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Currency:  currency,
+		Balance:   decimal.Zero,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := repo.CreateAccount(acc); err != nil {
+		// Another replica may have created it first
+		if found, findErr := repo.FindAccountByUserIDAndCurrency(userID, currency); findErr == nil {
+			return found, nil
+		}
+		return nil, err
+	}
+	return acc, nil
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 
+	"simplopay.com/backend/pkg/opay"
+
 	"github.com/jmoiron/sqlx"
 	"github.com/shopspring/decimal"
 )
@@ -27,10 +29,11 @@ func NewNIBSSSettleServiceImpl() *NIBSSSettleServiceImpl {
 
 // UpdateBalance simulates updating a balance on an external NIBSS account.
 // It implements the opay.SettleFunc signature.
-func (s *NIBSSSettleServiceImpl) UpdateBalance(uid string, amount float64, tx *sqlx.Tx) error {
+func (s *NIBSSSettleServiceImpl) UpdateBalance(uid string, amount float64, tx opay.Tx) error {
 	// TODO: Implement actual logic for interacting with the NIBSS API.
 	// This would involve making HTTP requests to the NIBSS endpoint
 	// to credit or debit the external account associated with the uid.
+	// The requests must be made with opay.TxContext(tx), canceled when the settle policy times out.
 
 	// Convert float64 amount to decimal.Decimal for consistency if needed for API interaction
 	decimalAmount := decimal.NewFromFloat(amount)
@@ -10,9 +10,13 @@ import (
 	"github.com/shopspring/decimal"
 )
 
+// HeldFunc sums the active holds of the user's account of the asset, see handles.HoldStore.
+type HeldFunc func(q sqlx.Ext, uid, aid string) (float64, error)
+
 // InternalSettleService implements opay.SettleFunc for internal accounts.
 type InternalSettleService struct {
 	accountRepo AccountRepository
+	held        HeldFunc
 	// TODO: Maybe add a way to get the default currency or pass it in
 }
 
@@ -21,9 +25,19 @@ func NewInternalSettleService(accountRepo AccountRepository) *InternalSettleServ
 	return &InternalSettleService{accountRepo: accountRepo}
 }
 
+// SetHeld makes the debits keep the held amount of the accounts, only the available balance can be debited.
+func (s *InternalSettleService) SetHeld(held HeldFunc) {
+	s.held = held
+}
+
 // UpdateBalance is the SettleFunc implementation for internal accounts.
 // It updates the balance of the user's account for the default currency within the provided transaction.
-func (s *InternalSettleService) UpdateBalance(uid string, amount float64, tx *sqlx.Tx) error {
+func (s *InternalSettleService) UpdateBalance(uid string, amount float64, tx opay.Tx) error {
+	sqlxTx, err := opay.AsSqlxTx(tx)
+	if err != nil {
+		return err
+	}
+
 	// Assuming uid is the UserID and we are dealing with the default currency (NGN)
 	userID := uid
 	currency := "NGN" // TODO: Make this configurable
@@ -41,8 +55,24 @@ func (s *InternalSettleService) UpdateBalance(uid string, amount float64, tx *sq
 		return fmt.Errorf("failed to find internal account for user %s and currency %s: %w", userID, currency, err)
 	}
 
+	// A debit can't touch the held amount. The account is locked before the holds are summed,
+	// so that an authorization can't place a hold on the balance being debited meanwhile.
+	if decimalAmount.IsNegative() && s.held != nil {
+		balance, err := s.accountRepo.GetAccountBalance(sqlxTx, acc.ID)
+		if err != nil {
+			return fmt.Errorf("failed to lock account %s: %w", acc.ID, err)
+		}
+		held, err := s.held(sqlxTx, userID, currency)
+		if err != nil {
+			return fmt.Errorf("failed to sum the holds of account %s: %w", acc.ID, err)
+		}
+		if balance.Sub(decimal.NewFromFloat(held)).Add(decimalAmount).IsNegative() {
+			return fmt.Errorf("account %s has %v held: %w", acc.ID, held, ErrInsufficientBalance)
+		}
+	}
+
 	// Update the account balance using the provided transaction
-	err = s.accountRepo.UpdateAccountBalance(tx, acc.ID, decimalAmount)
+	err = s.accountRepo.UpdateAccountBalance(sqlxTx, acc.ID, decimalAmount)
 	if err != nil {
 		return fmt.Errorf("failed to update balance for account %s: %w", acc.ID, err)
 	}
@@ -50,7 +80,33 @@ func (s *InternalSettleService) UpdateBalance(uid string, amount float64, tx *sq
 	return nil
 }
 
+// Balance is the BalanceFunc implementation for internal accounts.
+// It reads the balance of the user's default currency account within the provided transaction, and locks the account.
+func (s *InternalSettleService) Balance(uid string, tx opay.Tx) (float64, error) {
+	sqlxTx, err := opay.AsSqlxTx(tx)
+	if err != nil {
+		return 0, err
+	}
+	currency := "NGN" // TODO: Make this configurable
+
+	acc, err := s.accountRepo.FindAccountByUserIDAndCurrency(uid, currency)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find internal account for user %s and currency %s: %w", uid, currency, err)
+	}
+
+	balance, err := s.accountRepo.GetAccountBalance(sqlxTx, acc.ID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get balance for account %s: %w", acc.ID, err)
+	}
+
+	f, _ := balance.Float64()
+	return f, nil
+}
+
 // Ensure UpdateBalance has the opay.SettleFunc signature.
 var _ opay.SettleFunc = (*InternalSettleService)(nil).UpdateBalance
 
+// Ensure Balance has the opay.BalanceFunc signature.
+var _ opay.BalanceFunc = (*InternalSettleService)(nil).Balance
+
 // TODO: Implement other necessary account-related logic here or in a separate service
@@ -0,0 +1,72 @@
+package account
+
+import (
+	"errors"
+	"testing"
+
+	"simplopay.com/backend/pkg/opay"
+	"simplopay.com/backend/pkg/opay/opaytest"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/shopspring/decimal"
+)
+
+// fakeAccountRepo keeps a single NGN account of alice in memory.
+type fakeAccountRepo struct {
+	AccountRepository
+	balance decimal.Decimal
+	locked  bool
+}
+
+func (r *fakeAccountRepo) FindAccountByUserIDAndCurrency(userID, currency string) (*Account, error) {
+	if userID != "alice" {
+		return nil, ErrAccountNotFound
+	}
+	return &Account{ID: "acc-1", UserID: userID, Currency: currency, Balance: r.balance}, nil
+}
+
+func (r *fakeAccountRepo) GetAccountBalance(tx *sqlx.Tx, id string) (decimal.Decimal, error) {
+	r.locked = true
+	return r.balance, nil
+}
+
+func (r *fakeAccountRepo) UpdateAccountBalance(tx *sqlx.Tx, id string, change decimal.Decimal) error {
+	r.balance = r.balance.Add(change)
+	return nil
+}
+
+func TestUpdateBalanceKeepsHolds(t *testing.T) {
+	db, mock := opaytest.NewSQLMock(t)
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+	tx, err := opay.NewSqlxTxManager(db).Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	repo := &fakeAccountRepo{balance: decimal.NewFromInt(100)}
+	s := NewInternalSettleService(repo)
+	s.SetHeld(func(q sqlx.Ext, uid, aid string) (float64, error) {
+		if !repo.locked {
+			t.Fatal("the holds are summed before the account is locked")
+		}
+		return 80, nil
+	})
+
+	// Only 20 of the 100 is available.
+	if err := s.UpdateBalance("alice", -30, tx); !errors.Is(err, ErrInsufficientBalance) {
+		t.Fatalf("got error %v, want %v", err, ErrInsufficientBalance)
+	}
+	if err := s.UpdateBalance("alice", -20, tx); err != nil {
+		t.Fatal(err)
+	}
+	// Credits don't look at the holds.
+	repo.locked = false
+	if err := s.UpdateBalance("alice", 10, tx); err != nil {
+		t.Fatal(err)
+	}
+	if !repo.balance.Equal(decimal.NewFromInt(90)) {
+		t.Fatalf("got balance %s, want 90", repo.balance)
+	}
+}
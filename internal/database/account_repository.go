@@ -63,8 +63,9 @@ func (r *AccountRepositoryImpl) FindAccountsByUserID(userID string) ([]*account.
 }
 
 // UpdateAccountBalance updates an account's balance within a transaction.
+// A debit never takes the balance below zero, account.ErrInsufficientBalance is returned instead.
 func (r *AccountRepositoryImpl) UpdateAccountBalance(tx *sqlx.Tx, id string, balanceChange decimal.Decimal) error {
-	query := `UPDATE accounts SET balance = balance + $1, updated_at = $2 WHERE id = $3`
+	query := `UPDATE accounts SET balance = balance + $1, updated_at = $2 WHERE id = $3 AND ($1 >= 0 OR balance + $1 >= 0)`
 	result, err := tx.Exec(query, balanceChange, time.Now(), id)
 	if err != nil {
 		return fmt.Errorf("failed to update account balance within transaction: %w", err)
@@ -76,6 +77,16 @@ func (r *AccountRepositoryImpl) UpdateAccountBalance(tx *sqlx.Tx, id string, bal
 	}
 
 	if rowsAffected == 0 {
+		if balanceChange.IsNegative() {
+			var exists bool
+			err = tx.Get(&exists, `SELECT EXISTS (SELECT 1 FROM accounts WHERE id = $1)`, id)
+			if err != nil {
+				return fmt.Errorf("failed to check account %s after a rejected debit: %w", id, err)
+			}
+			if exists {
+				return fmt.Errorf("account %s: %w", id, account.ErrInsufficientBalance)
+			}
+		}
 		// This indicates the account with the given ID was not found within the transaction
 		return fmt.Errorf("account with ID %s not found for balance update", id)
 	}
@@ -83,6 +94,24 @@ func (r *AccountRepositoryImpl) UpdateAccountBalance(tx *sqlx.Tx, id string, bal
 	return nil
 }
 
+// GetAccountBalance reads an account's balance within a transaction,
+// so that the uncommitted balance updates of the transaction are visible.
+// The account is locked until the transaction ends, the checks on the balance hold.
+func (r *AccountRepositoryImpl) GetAccountBalance(tx *sqlx.Tx, id string) (decimal.Decimal, error) {
+	query := `SELECT balance FROM accounts WHERE id = $1 FOR UPDATE`
+
+	var balance decimal.Decimal
+	err := tx.Get(&balance, query, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return decimal.Zero, account.ErrAccountNotFound
+		}
+		return decimal.Zero, fmt.Errorf("failed to get account balance within transaction: %w", err)
+	}
+
+	return balance, nil
+}
+
 // FindAccountByUserIDAndCurrency finds a user's account for a specific currency.
 func (r *AccountRepositoryImpl) FindAccountByUserIDAndCurrency(userID, currency string) (*account.Account, error) {
 	query := `SELECT id, user_id, currency, balance, created_at, updated_at FROM accounts WHERE user_id = $1 AND currency = $2`
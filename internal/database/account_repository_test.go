@@ -0,0 +1,88 @@
+package database
+
+import (
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"simplopay.com/backend/internal/account"
+	"simplopay.com/backend/pkg/opay/opaytest"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestUpdateAccountBalance(t *testing.T) {
+	const update = `^UPDATE accounts SET balance = balance \+ \$1, updated_at = \$2 WHERE id = \$3 AND \(\$1 >= 0 OR balance \+ \$1 >= 0\)$`
+	const exists = `^SELECT EXISTS \(SELECT 1 FROM accounts WHERE id = \$1\)$`
+	cases := []struct {
+		name   string
+		change string
+		script func(m *opaytest.SQLMock)
+		err    error
+		other  bool // any other error
+	}{
+		{
+			name:   "credit",
+			change: "10",
+			script: func(m *opaytest.SQLMock) {
+				m.ExpectExec(update).WillReturnResult(1)
+			},
+		},
+		{
+			name:   "debit",
+			change: "-10",
+			script: func(m *opaytest.SQLMock) {
+				m.ExpectExec(update).WillReturnResult(1)
+			},
+		},
+		{
+			name:   "overdraft",
+			change: "-10",
+			script: func(m *opaytest.SQLMock) {
+				m.ExpectExec(update).WillReturnResult(0)
+				m.ExpectQuery(exists).WithArgs("acc-1").WillReturnRows([]string{"exists"}, []driver.Value{true})
+			},
+			err: account.ErrInsufficientBalance,
+		},
+		{
+			name:   "debit of a missing account",
+			change: "-10",
+			script: func(m *opaytest.SQLMock) {
+				m.ExpectExec(update).WillReturnResult(0)
+				m.ExpectQuery(exists).WithArgs("acc-1").WillReturnRows([]string{"exists"}, []driver.Value{false})
+			},
+			other: true,
+		},
+		{
+			name:   "credit of a missing account",
+			change: "10",
+			script: func(m *opaytest.SQLMock) {
+				m.ExpectExec(update).WillReturnResult(0)
+			},
+			other: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db, mock := opaytest.NewSQLMock(t)
+			mock.ExpectBegin()
+			c.script(mock)
+			mock.ExpectRollback()
+
+			tx, err := db.Beginx()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+			err = NewAccountRepositoryImpl(db).UpdateAccountBalance(tx, "acc-1", decimal.RequireFromString(c.change))
+			switch {
+			case c.other:
+				if err == nil || errors.Is(err, account.ErrInsufficientBalance) {
+					t.Fatalf("got error %v, want account not found", err)
+				}
+			case !errors.Is(err, c.err):
+				t.Fatalf("got error %v, want %v", err, c.err)
+			}
+		})
+	}
+}
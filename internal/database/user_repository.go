@@ -10,6 +10,9 @@ import (
 	"github.com/lib/pq"
 )
 
+// UserKycSchema adds the KYC tier of the users, an empty tier is unrated.
+const UserKycSchema = `ALTER TABLE users ADD COLUMN IF NOT EXISTS kyc_tier VARCHAR(16) NOT NULL DEFAULT ''`
+
 // UserRepositoryImpl is a database implementation of UserRepository.
 type UserRepositoryImpl struct {
 	db *sql.DB
@@ -69,3 +72,16 @@ func (r *UserRepositoryImpl) FindUserByID(id string) (*userpkg.User, error) {
 
 	return &u, nil
 }
+
+// KycTier finds the KYC tier of a user, the fee schedules of the tier apply to the user's orders.
+func (r *UserRepositoryImpl) KycTier(id string) (string, error) {
+	var tier string
+	err := r.db.QueryRow(`SELECT kyc_tier FROM users WHERE id = $1`, id).Scan(&tier)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", userpkg.ErrUserNotFound
+		}
+		return "", fmt.Errorf("failed to find user KYC tier: %w", err)
+	}
+	return tier, nil
+}
@@ -0,0 +1,182 @@
+// Package schedule keeps the standing orders of the users,
+// and submits their transfers when they fall due.
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Kinds of recurrence
+const (
+	KindOnce     = "once"     // a single transfer at StartAt
+	KindInterval = "interval" // every Interval seconds from StartAt
+	KindCron     = "cron"     // at the times matching Cron, from StartAt on
+)
+
+// Statuses of a schedule
+const (
+	StatusActive    = "active"
+	StatusPaused    = "paused"
+	StatusCancelled = "cancelled"
+	StatusCompleted = "completed" // no occurrence is left
+)
+
+// What to do with an occurrence that still fails after its retries
+const (
+	OnFailureSkip  = "skip"  // skip the occurrence, and go on with the next one
+	OnFailurePause = "pause" // pause the schedule until the user resumes it
+)
+
+// Limits of the schedules
+const (
+	MinInterval   = 60 // seconds
+	MaxRetries    = 10
+	MinRetryDelay = 60 // seconds
+)
+
+var (
+	ErrScheduleNotFound = errors.New("schedule not found")
+	ErrScheduleConflict = errors.New("schedule has been changed by others")
+	ErrScheduleStatus   = errors.New("schedule is not in a status for this action")
+	ErrInvalidSchedule  = errors.New("invalid schedule")
+	ErrNoOccurrence     = errors.New("schedule has no occurrence in the future")
+)
+
+// Schedule is a standing order of transfers from the user to the payee.
+type Schedule struct {
+	ID        string  `json:"id" db:"id"`
+	UserID    string  `json:"user_id" db:"user_id"`
+	PayeeID   string  `json:"payee_id" db:"payee_id"`
+	Amount    float64 `json:"amount" db:"amount"`
+	Note      string  `json:"note" db:"note"`
+	Kind      string  `json:"kind" db:"kind"`
+	Interval  int64   `json:"interval,omitempty" db:"interval_secs"` // seconds, for KindInterval
+	Cron      string  `json:"cron,omitempty" db:"cron"`              // "minute hour day-of-month month day-of-week", for KindCron
+	StartAt   int64   `json:"start_at" db:"start_at"`
+	EndAt     int64   `json:"end_at,omitempty" db:"end_at"`     // no occurrence after it, unlimited if 0
+	MaxRuns   int     `json:"max_runs,omitempty" db:"max_runs"` // number of occurrences, unlimited if 0
+	OnFailure string  `json:"on_failure" db:"on_failure"`
+	// retries of an occurrence failed for insufficient funds
+	MaxRetries int   `json:"max_retries" db:"max_retries"`
+	RetryDelay int64 `json:"retry_delay" db:"retry_delay"` // seconds
+
+	Status      string `json:"status" db:"status"`
+	OccursAt    int64  `json:"occurs_at" db:"occurs_at"`     // the current occurrence
+	NextRunAt   int64  `json:"next_run_at" db:"next_run_at"` // the next attempt of the current occurrence
+	Runs        int    `json:"runs" db:"runs"`               // occurrences done, paid or skipped
+	Retries     int    `json:"retries" db:"retries"`         // retries of the current occurrence
+	LastOrderID string `json:"last_order_id,omitempty" db:"last_order_id"`
+	LastError   string `json:"last_error,omitempty" db:"last_error"`
+	Version     int64  `json:"version" db:"version"` // incremented by every update
+	CreatedAt   int64  `json:"created_at" db:"created_at"`
+	UpdatedAt   int64  `json:"updated_at" db:"updated_at"`
+
+	cron *Cron
+}
+
+// validate checks the schedule given by the user, and defaults its failure policy.
+func (s *Schedule) validate() error {
+	if s.UserID == "" || s.PayeeID == "" {
+		return fmt.Errorf("%w: user and payee are required", ErrInvalidSchedule)
+	}
+	if s.UserID == s.PayeeID {
+		return fmt.Errorf("%w: cannot transfer to yourself", ErrInvalidSchedule)
+	}
+	if s.Amount <= 0 {
+		return fmt.Errorf("%w: amount must be positive", ErrInvalidSchedule)
+	}
+	if s.StartAt <= 0 {
+		return fmt.Errorf("%w: start time is required", ErrInvalidSchedule)
+	}
+	if s.EndAt != 0 && s.EndAt < s.StartAt {
+		return fmt.Errorf("%w: end time is before the start time", ErrInvalidSchedule)
+	}
+	if s.MaxRuns < 0 {
+		return fmt.Errorf("%w: max runs must not be negative", ErrInvalidSchedule)
+	}
+	switch s.Kind {
+	case KindOnce:
+		if s.Interval != 0 || s.Cron != "" {
+			return fmt.Errorf("%w: a one-off schedule has no recurrence", ErrInvalidSchedule)
+		}
+	case KindInterval:
+		if s.Interval < MinInterval || s.Cron != "" {
+			return fmt.Errorf("%w: interval must be at least %d seconds", ErrInvalidSchedule, MinInterval)
+		}
+	case KindCron:
+		if s.Interval != 0 {
+			return fmt.Errorf("%w: a cron schedule has no interval", ErrInvalidSchedule)
+		}
+		if err := s.parse(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w: unknown kind %q", ErrInvalidSchedule, s.Kind)
+	}
+	switch s.OnFailure {
+	case "":
+		s.OnFailure = OnFailureSkip
+	case OnFailureSkip, OnFailurePause:
+	default:
+		return fmt.Errorf("%w: unknown failure policy %q", ErrInvalidSchedule, s.OnFailure)
+	}
+	if s.MaxRetries < 0 || s.MaxRetries > MaxRetries {
+		return fmt.Errorf("%w: max retries must be between 0 and %d", ErrInvalidSchedule, MaxRetries)
+	}
+	if s.MaxRetries > 0 && s.RetryDelay < MinRetryDelay {
+		return fmt.Errorf("%w: retry delay must be at least %d seconds", ErrInvalidSchedule, MinRetryDelay)
+	}
+	return nil
+}
+
+// parse parses the cron expression once.
+func (s *Schedule) parse() error {
+	if s.cron != nil {
+		return nil
+	}
+	c, err := ParseCron(s.Cron)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSchedule, err)
+	}
+	s.cron = c
+	return nil
+}
+
+// next returns the first occurrence at or after the time, in the location of the cron expressions.
+// It returns false if there is none within the end conditions.
+func (s *Schedule) next(at int64, loc *time.Location) (int64, bool) {
+	if s.MaxRuns > 0 && s.Runs >= s.MaxRuns {
+		return 0, false
+	}
+	if at < s.StartAt {
+		at = s.StartAt
+	}
+	var t int64
+	switch s.Kind {
+	case KindOnce:
+		if s.Runs > 0 {
+			return 0, false
+		}
+		t = s.StartAt
+	case KindInterval:
+		n := (at - s.StartAt + s.Interval - 1) / s.Interval
+		t = s.StartAt + n*s.Interval
+	case KindCron:
+		if s.parse() != nil {
+			return 0, false
+		}
+		next, ok := s.cron.Next(time.Unix(at, 0).In(loc).Add(-time.Second))
+		if !ok {
+			return 0, false
+		}
+		t = next.Unix()
+	default:
+		return 0, false
+	}
+	if s.EndAt != 0 && t > s.EndAt {
+		return 0, false
+	}
+	return t, true
+}
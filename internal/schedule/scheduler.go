@@ -0,0 +1,298 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"simplopay.com/backend/internal/account"
+
+	"github.com/google/uuid"
+)
+
+// TransferFunc submits the transfer of the schedule's occurrence, and returns the order id.
+type TransferFunc func(s *Schedule) (orderID string, err error)
+
+// Events of the notifications
+const (
+	EventRetrying = "retrying" // the occurrence failed for insufficient funds, and is to be retried
+	EventSkipped  = "skipped"  // the occurrence failed, and is skipped
+	EventPaused   = "paused"   // the occurrence failed, and the schedule is paused
+)
+
+// DefaultBatch is the number of the due schedules of a poll.
+const DefaultBatch = 100
+
+// Notification tells the user that an occurrence of the schedule failed.
+type Notification struct {
+	ScheduleID string `json:"schedule_id"`
+	UserID     string `json:"user_id"`
+	Event      string `json:"event"`
+	OccursAt   int64  `json:"occurs_at"`
+	NextRunAt  int64  `json:"next_run_at,omitempty"` // the retry or the next occurrence, none if 0
+	Reason     string `json:"reason"`
+}
+
+// Notifier notifies the users of the failed occurrences.
+type Notifier interface {
+	Notify(n *Notification) error
+}
+
+// NotifierFunc is a function notifier.
+type NotifierFunc func(n *Notification) error
+
+// Notify calls the function.
+func (f NotifierFunc) Notify(n *Notification) error {
+	return f(n)
+}
+
+// LogNotifier only logs the notifications.
+var LogNotifier = NotifierFunc(func(n *Notification) error {
+	log.Printf("Schedule %s of user %s %s: %s", n.ScheduleID, n.UserID, n.Event, n.Reason)
+	return nil
+})
+
+// Scheduler keeps the schedules in the store, and submits their transfers when they fall due.
+// Poll must not run concurrently, e.g. as a cluster job.
+type Scheduler struct {
+	store    Store
+	transfer TransferFunc
+	notifier Notifier
+	location *time.Location
+	clock    func() time.Time
+
+	// Retryable reports whether the failed transfer is retried, insufficient balance by default.
+	Retryable func(error) bool
+	// Owns reports whether the schedules of the user are run by this scheduler, all of them if nil.
+	// The replicas share the schedules by setting it to opay.Cluster.Owns.
+	Owns func(userID string) bool
+}
+
+// NewScheduler creates a scheduler, the cron expressions are in the location.
+func NewScheduler(store Store, transfer TransferFunc, notifier Notifier, location *time.Location) *Scheduler {
+	return &Scheduler{
+		store:    store,
+		transfer: transfer,
+		notifier: notifier,
+		location: location,
+		clock:    time.Now,
+		Retryable: func(err error) bool {
+			return errors.Is(err, account.ErrInsufficientBalance)
+		},
+	}
+}
+
+// Create validates the schedule and stores it as active from its first occurrence.
+func (sc *Scheduler) Create(s *Schedule) (*Schedule, error) {
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	now := sc.clock().Unix()
+	s.Runs, s.Retries = 0, 0
+	first, ok := s.next(now, sc.location)
+	if !ok {
+		return nil, ErrNoOccurrence
+	}
+	s.ID = uuid.New().String()
+	s.Status = StatusActive
+	s.OccursAt, s.NextRunAt = first, first
+	s.LastOrderID, s.LastError = "", ""
+	s.Version = 0
+	s.CreatedAt, s.UpdatedAt = now, now
+	if err := sc.store.Create(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get finds the schedule of the user.
+func (sc *Scheduler) Get(userID, id string) (*Schedule, error) {
+	s, err := sc.store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if s.UserID != userID {
+		return nil, ErrScheduleNotFound
+	}
+	return s, nil
+}
+
+// List lists the schedules of the user.
+func (sc *Scheduler) List(userID string) ([]*Schedule, error) {
+	return sc.store.ListByUser(userID)
+}
+
+// Pause pauses the active schedule of the user.
+func (sc *Scheduler) Pause(userID, id string) (*Schedule, error) {
+	return sc.change(userID, id, func(s *Schedule, now int64) error {
+		if s.Status != StatusActive {
+			return ErrScheduleStatus
+		}
+		s.Status = StatusPaused
+		return nil
+	})
+}
+
+// Resume resumes the paused schedule of the user, the occurrences missed meanwhile are skipped.
+func (sc *Scheduler) Resume(userID, id string) (*Schedule, error) {
+	return sc.change(userID, id, func(s *Schedule, now int64) error {
+		if s.Status != StatusPaused {
+			return ErrScheduleStatus
+		}
+		s.Status, s.Retries = StatusActive, 0
+		if s.OccursAt >= now {
+			s.NextRunAt = s.OccursAt
+			return nil
+		}
+		next, ok := s.next(now, sc.location)
+		if !ok {
+			s.Status = StatusCompleted
+			return nil
+		}
+		s.OccursAt, s.NextRunAt = next, next
+		return nil
+	})
+}
+
+// Cancel cancels the active or paused schedule of the user.
+func (sc *Scheduler) Cancel(userID, id string) (*Schedule, error) {
+	return sc.change(userID, id, func(s *Schedule, now int64) error {
+		if s.Status != StatusActive && s.Status != StatusPaused {
+			return ErrScheduleStatus
+		}
+		s.Status = StatusCancelled
+		return nil
+	})
+}
+
+func (sc *Scheduler) change(userID, id string, fn func(s *Schedule, now int64) error) (*Schedule, error) {
+	s, err := sc.Get(userID, id)
+	if err != nil {
+		return nil, err
+	}
+	now := sc.clock().Unix()
+	if err := fn(s, now); err != nil {
+		return nil, err
+	}
+	s.UpdatedAt = now
+	if err := sc.store.Update(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Poll submits the transfers of up to limit due schedules it owns, and returns the number of the submitted ones.
+// The due schedules are paged through, so that those of the other replicas don't starve its own.
+// A failed schedule doesn't stop the others, the last error is returned.
+func (sc *Scheduler) Poll(limit int) (int, error) {
+	if limit <= 0 {
+		limit = DefaultBatch
+	}
+	now := sc.clock().Unix()
+	// A schedule still due after its run comes again later in the pages, it's run once a poll.
+	ran := make(map[string]bool)
+	var n int
+	var err error
+	var after *Schedule
+	for len(ran) < limit {
+		due, e := sc.store.Due(now, after, limit)
+		if e != nil {
+			return n, e
+		}
+		if len(due) == 0 {
+			break
+		}
+		last := *due[len(due)-1]
+		after = &last
+		for _, s := range due {
+			if ran[s.ID] || (sc.Owns != nil && !sc.Owns(s.UserID)) {
+				continue
+			}
+			ran[s.ID] = true
+			submitted, e := sc.run(s)
+			if submitted {
+				n++
+			}
+			if e != nil {
+				err = fmt.Errorf("schedule %s: %w", s.ID, e)
+			}
+			if len(ran) == limit {
+				break
+			}
+		}
+		if len(due) < limit {
+			break
+		}
+	}
+	return n, err
+}
+
+// run submits the transfer of the current occurrence.
+// The occurrence is recorded as done before the transfer, so that it's never paid twice,
+// and is put back for a retry if the transfer fails.
+func (sc *Scheduler) run(s *Schedule) (submitted bool, err error) {
+	now := sc.clock().Unix()
+	done := *s
+	sc.advance(&done, now)
+	done.LastError = ""
+	if err := sc.store.Update(&done); err != nil {
+		if errors.Is(err, ErrScheduleConflict) {
+			// Paused or cancelled meanwhile.
+			return false, nil
+		}
+		return false, err
+	}
+
+	orderID, terr := sc.transfer(s)
+	if terr == nil {
+		done.LastOrderID = orderID
+		return true, sc.store.Update(&done)
+	}
+
+	failed := done
+	failed.LastError = terr.Error()
+	n := &Notification{ScheduleID: s.ID, UserID: s.UserID, OccursAt: s.OccursAt, Reason: terr.Error()}
+	retryAt := now + s.RetryDelay
+	switch {
+	case sc.Retryable(terr) && s.Retries < s.MaxRetries && (done.Status != StatusActive || retryAt < done.OccursAt):
+		// Retry before the next occurrence.
+		failed.Status, failed.Runs, failed.Retries = StatusActive, s.Runs, s.Retries+1
+		failed.OccursAt, failed.NextRunAt = s.OccursAt, retryAt
+		n.Event, n.NextRunAt = EventRetrying, retryAt
+	case s.OnFailure == OnFailurePause:
+		failed.Status, failed.Runs, failed.Retries = StatusPaused, s.Runs, 0
+		failed.OccursAt, failed.NextRunAt = s.OccursAt, s.OccursAt
+		n.Event = EventPaused
+	default:
+		n.Event = EventSkipped
+		if done.Status == StatusActive {
+			n.NextRunAt = done.NextRunAt
+		}
+	}
+	failed.UpdatedAt = now
+	if err := sc.store.Update(&failed); err != nil {
+		return true, err
+	}
+	if err := sc.notifier.Notify(n); err != nil {
+		log.Printf("Failed to notify schedule %s %s: %v", s.ID, n.Event, err)
+	}
+	return true, nil
+}
+
+// advance counts the current occurrence as done, and moves to the next one after now.
+func (sc *Scheduler) advance(s *Schedule, now int64) {
+	s.Runs++
+	s.Retries = 0
+	s.UpdatedAt = now
+	at := now + 1
+	if s.OccursAt >= at {
+		at = s.OccursAt + 1
+	}
+	next, ok := s.next(at, sc.location)
+	if !ok {
+		s.Status = StatusCompleted
+		return
+	}
+	s.OccursAt, s.NextRunAt = next, next
+}
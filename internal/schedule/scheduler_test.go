@@ -0,0 +1,235 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"simplopay.com/backend/internal/account"
+)
+
+var wat = time.FixedZone("WAT", 3600)
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, wat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	cases := []struct {
+		expr, from, next string
+	}{
+		{"0 9 1 * *", "2026-01-15 10:00", "2026-02-01 09:00"},
+		{"0 9 1 * *", "2026-02-01 08:59", "2026-02-01 09:00"},
+		{"0 9 1 * *", "2026-02-01 09:00", "2026-03-01 09:00"},
+		{"30 8 * * 6", "2026-10-18 12:00", "2026-10-24 08:30"},
+		{"*/15 * * * *", "2026-10-18 12:07", "2026-10-18 12:15"},
+		{"0 0 * * 7", "2026-10-18 12:00", "2026-10-25 00:00"},
+		{"0 12 1,15 * 1-5", "2026-10-10 13:00", "2026-10-12 12:00"},
+		{"0 0 29 2 *", "2026-03-01 00:00", "2028-02-29 00:00"},
+	}
+	for _, c := range cases {
+		cron, err := ParseCron(c.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", c.expr, err)
+		}
+		next, ok := cron.Next(at(c.from))
+		if !ok || !next.Equal(at(c.next)) {
+			t.Errorf("%s from %s: got %s, want %s", c.expr, c.from, next, c.next)
+		}
+	}
+	if cron, _ := ParseCron("0 0 30 2 *"); cron != nil {
+		if _, ok := cron.Next(at("2026-01-01 00:00")); ok {
+			t.Error("expect no time for 30 February")
+		}
+	}
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("expect an error for %q", expr)
+		}
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, wat)
+	balances := map[string]float64{"alice": 50, "dad": 10}
+	var orders int
+	transfer := func(s *Schedule) (string, error) {
+		if balances[s.UserID] < s.Amount {
+			return "", fmt.Errorf("transfer failed: %w", account.ErrInsufficientBalance)
+		}
+		if s.PayeeID == "closed" {
+			return "", errors.New("payee account is closed")
+		}
+		balances[s.UserID] -= s.Amount
+		balances[s.PayeeID] += s.Amount
+		orders++
+		return fmt.Sprintf("order-%d", orders), nil
+	}
+	var notes []*Notification
+	notifier := NotifierFunc(func(n *Notification) error {
+		notes = append(notes, n)
+		return nil
+	})
+	sc := NewScheduler(NewMemStore(), transfer, notifier, wat)
+	sc.clock = func() time.Time { return now }
+	poll := func(want int) {
+		t.Helper()
+		if n, err := sc.Poll(0); err != nil || n != want {
+			t.Fatalf("expect %d submitted, got %d, %v", want, n, err)
+		}
+	}
+
+	for _, s := range []*Schedule{
+		{UserID: "alice", PayeeID: "alice", Amount: 1, Kind: KindOnce, StartAt: now.Unix()},
+		{UserID: "alice", PayeeID: "bob", Amount: 0, Kind: KindOnce, StartAt: now.Unix()},
+		{UserID: "alice", PayeeID: "bob", Amount: 1, Kind: KindInterval, Interval: 30, StartAt: now.Unix()},
+		{UserID: "alice", PayeeID: "bob", Amount: 1, Kind: KindCron, Cron: "0 9 * *", StartAt: now.Unix()},
+		{UserID: "alice", PayeeID: "bob", Amount: 1, Kind: KindOnce, StartAt: now.Unix(), OnFailure: "retry"},
+		{UserID: "alice", PayeeID: "bob", Amount: 1, Kind: KindOnce, StartAt: now.Unix(), MaxRetries: 3},
+	} {
+		if _, err := sc.Create(s); !errors.Is(err, ErrInvalidSchedule) {
+			t.Fatalf("expect ErrInvalidSchedule for %+v, got %v", s, err)
+		}
+	}
+
+	// Rent on the 1st for two months, retried twice a day if short of funds.
+	rent, err := sc.Create(&Schedule{UserID: "alice", PayeeID: "landlord", Amount: 80, Kind: KindCron, Cron: "0 9 1 * *",
+		StartAt: now.Unix(), MaxRuns: 2, MaxRetries: 2, RetryDelay: 12 * 3600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2026, 11, 1, 9, 0, 0, 0, wat).Unix(); rent.NextRunAt != want || rent.OnFailure != OnFailureSkip {
+		t.Fatalf("unexpected rent %+v", rent)
+	}
+	// A weekly allowance, paused if it fails.
+	allowance, err := sc.Create(&Schedule{UserID: "dad", PayeeID: "kid", Amount: 10, Kind: KindInterval, Interval: 7 * 86400,
+		StartAt: now.Add(time.Hour).Unix(), OnFailure: OnFailurePause})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poll(0)
+	now = now.Add(time.Hour)
+	poll(1)
+	if balances["kid"] != 10 {
+		t.Fatalf("expect the allowance paid, got %v", balances)
+	}
+	s, _ := sc.Get("dad", allowance.ID)
+	if s.Runs != 1 || s.LastOrderID != "order-1" || s.NextRunAt != now.Add(7*24*time.Hour).Unix() {
+		t.Fatalf("unexpected allowance %+v", s)
+	}
+
+	// The rent is short of funds, paid on the second retry.
+	// The allowance due meanwhile fails too, and pauses its schedule.
+	now = time.Date(2026, 11, 1, 9, 0, 0, 0, wat)
+	poll(2)
+	s, _ = sc.Get("alice", rent.ID)
+	if s.Status != StatusActive || s.Retries != 1 || s.Runs != 0 || s.NextRunAt != now.Add(12*time.Hour).Unix() {
+		t.Fatalf("unexpected rent %+v", s)
+	}
+	events := func(id string) string {
+		var events []string
+		for _, n := range notes {
+			if n.ScheduleID == id {
+				events = append(events, n.Event)
+			}
+		}
+		return fmt.Sprint(events)
+	}
+	if events(rent.ID) != "[retrying]" || events(allowance.ID) != "[paused]" {
+		t.Fatalf("unexpected notifications %+v", notes)
+	}
+	now = now.Add(12 * time.Hour)
+	poll(1)
+	balances["alice"] += 100
+	now = now.Add(12 * time.Hour)
+	poll(1)
+	s, _ = sc.Get("alice", rent.ID)
+	if balances["landlord"] != 80 || s.LastError != "" || s.Runs != 1 || s.Retries != 0 || s.OccursAt != time.Date(2026, 12, 1, 9, 0, 0, 0, wat).Unix() {
+		t.Fatalf("unexpected rent %+v, balances %v", s, balances)
+	}
+
+	// The second rent is skipped after its retries, and the schedule is completed.
+	balances["alice"] = 0
+	now = time.Date(2026, 12, 1, 9, 0, 0, 0, wat)
+	notes = nil
+	for i := 0; i < 3; i++ {
+		if _, err := sc.Poll(0); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(12 * time.Hour)
+	}
+	s, _ = sc.Get("alice", rent.ID)
+	if s.Status != StatusCompleted || s.Runs != 2 {
+		t.Fatalf("unexpected rent %+v", s)
+	}
+	if events(rent.ID) != "[retrying retrying skipped]" {
+		t.Fatalf("unexpected rent notifications %+v", notes)
+	}
+
+	// Resuming the allowance skips the occurrences missed meanwhile.
+	s, _ = sc.Get("dad", allowance.ID)
+	if s.Status != StatusPaused || s.Runs != 1 {
+		t.Fatalf("expect the allowance paused, got %+v", s)
+	}
+	if _, err := sc.Pause("dad", allowance.ID); !errors.Is(err, ErrScheduleStatus) {
+		t.Fatalf("expect ErrScheduleStatus, got %v", err)
+	}
+	if _, err := sc.Resume("bob", allowance.ID); !errors.Is(err, ErrScheduleNotFound) {
+		t.Fatalf("expect ErrScheduleNotFound, got %v", err)
+	}
+	s, err = sc.Resume("dad", allowance.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Status != StatusActive || s.NextRunAt <= now.Unix() || (s.NextRunAt-allowance.StartAt)%(7*86400) != 0 {
+		t.Fatalf("unexpected resumed allowance %+v", s)
+	}
+
+	// A cancelled schedule never runs again.
+	if _, err := sc.Cancel("dad", allowance.ID); err != nil {
+		t.Fatal(err)
+	}
+	balances["alice"], balances["dad"] = 100, 100
+	now = now.Add(30 * 24 * time.Hour)
+	poll(0)
+
+	// A one-off transfer to a closed account is skipped without retries.
+	once, err := sc.Create(&Schedule{UserID: "alice", PayeeID: "closed", Amount: 5, Kind: KindOnce, StartAt: now.Unix(), MaxRetries: 1, RetryDelay: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes = nil
+	poll(1)
+	s, _ = sc.Get("alice", once.ID)
+	if s.Status != StatusCompleted || s.LastError == "" || len(notes) != 1 || notes[0].Event != EventSkipped {
+		t.Fatalf("unexpected one-off %+v, notifications %+v", s, notes)
+	}
+	if list, _ := sc.List("alice"); len(list) != 2 {
+		t.Fatalf("expect 2 schedules, got %d", len(list))
+	}
+
+	// A replica runs its own due schedule behind a page of the others'.
+	for _, uid := range []string{"bob", "carol", "erin"} {
+		balances[uid] = 10
+		if _, err := sc.Create(&Schedule{UserID: uid, PayeeID: "alice", Amount: 1, Kind: KindOnce, StartAt: now.Unix()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mine, err := sc.Create(&Schedule{UserID: "dad", PayeeID: "alice", Amount: 1, Kind: KindOnce, StartAt: now.Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Hour)
+	sc.Owns = func(uid string) bool { return uid == "dad" }
+	if n, err := sc.Poll(2); err != nil || n != 1 {
+		t.Fatalf("expect 1 submitted, got %d, %v", n, err)
+	}
+	if s, _ = sc.Get("dad", mine.ID); s.Status != StatusCompleted || s.Runs != 1 {
+		t.Fatalf("unexpected own schedule %+v", s)
+	}
+}
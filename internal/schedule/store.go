@@ -0,0 +1,233 @@
+package schedule
+
+import (
+	"database/sql"
+	"sort"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Store keeps the schedules.
+type Store interface {
+	// Create stores the new schedule.
+	Create(s *Schedule) error
+	// Update saves the schedule only if its version is still the stored one, then increments the version.
+	// It returns ErrScheduleConflict otherwise.
+	Update(s *Schedule) error
+	// Get finds the schedule.
+	Get(id string) (*Schedule, error)
+	// ListByUser lists the schedules of the user, the latest first.
+	ListByUser(userID string) ([]*Schedule, error)
+	// Due lists the active schedules to run at or before now, the earliest first and by id at the same time.
+	// The page starts after the schedule of the previous page, or at the beginning if after is nil.
+	Due(now int64, after *Schedule, limit int) ([]*Schedule, error)
+}
+
+// MemStore is an in-memory Store.
+type MemStore struct {
+	schedules map[string]*Schedule
+	lock      sync.Mutex
+}
+
+var _ Store = (*MemStore)(nil)
+
+// NewMemStore creates an in-memory Store.
+func NewMemStore() *MemStore {
+	return &MemStore{schedules: make(map[string]*Schedule)}
+}
+
+func (m *MemStore) Create(s *Schedule) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.schedules[s.ID]; ok {
+		return ErrScheduleConflict
+	}
+	c := *s
+	m.schedules[s.ID] = &c
+	return nil
+}
+
+func (m *MemStore) Update(s *Schedule) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	stored, ok := m.schedules[s.ID]
+	if !ok {
+		return ErrScheduleNotFound
+	}
+	if stored.Version != s.Version {
+		return ErrScheduleConflict
+	}
+	s.Version++
+	c := *s
+	m.schedules[s.ID] = &c
+	return nil
+}
+
+func (m *MemStore) Get(id string) (*Schedule, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s, ok := m.schedules[id]
+	if !ok {
+		return nil, ErrScheduleNotFound
+	}
+	c := *s
+	return &c, nil
+}
+
+func (m *MemStore) ListByUser(userID string) ([]*Schedule, error) {
+	m.lock.Lock()
+	var list []*Schedule
+	for _, s := range m.schedules {
+		if s.UserID == userID {
+			c := *s
+			list = append(list, &c)
+		}
+	}
+	m.lock.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CreatedAt != list[j].CreatedAt {
+			return list[i].CreatedAt > list[j].CreatedAt
+		}
+		return list[i].ID > list[j].ID
+	})
+	return list, nil
+}
+
+func (m *MemStore) Due(now int64, after *Schedule, limit int) ([]*Schedule, error) {
+	m.lock.Lock()
+	var due []*Schedule
+	for _, s := range m.schedules {
+		if s.Status == StatusActive && s.NextRunAt <= now && (after == nil || dueAfter(s, after)) {
+			c := *s
+			due = append(due, &c)
+		}
+	}
+	m.lock.Unlock()
+	sort.Slice(due, func(i, j int) bool {
+		return dueAfter(due[j], due[i])
+	})
+	if limit > 0 && len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
+
+// dueAfter reports whether s runs after the other schedule in the order of Due.
+func dueAfter(s, other *Schedule) bool {
+	if s.NextRunAt != other.NextRunAt {
+		return s.NextRunAt > other.NextRunAt
+	}
+	return s.ID > other.ID
+}
+
+// Schema is the table of SQLStore.
+const Schema = `
+CREATE TABLE IF NOT EXISTS schedules (
+	id            VARCHAR(64) PRIMARY KEY,
+	user_id       VARCHAR(64) NOT NULL,
+	payee_id      VARCHAR(64) NOT NULL,
+	amount        NUMERIC(20, 8) NOT NULL CHECK (amount > 0),
+	note          TEXT NOT NULL DEFAULT '',
+	kind          VARCHAR(16) NOT NULL,
+	interval_secs BIGINT NOT NULL DEFAULT 0,
+	cron          VARCHAR(128) NOT NULL DEFAULT '',
+	start_at      BIGINT NOT NULL,
+	end_at        BIGINT NOT NULL DEFAULT 0,
+	max_runs      INT NOT NULL DEFAULT 0,
+	on_failure    VARCHAR(16) NOT NULL,
+	max_retries   INT NOT NULL DEFAULT 0,
+	retry_delay   BIGINT NOT NULL DEFAULT 0,
+	status        VARCHAR(16) NOT NULL,
+	occurs_at     BIGINT NOT NULL,
+	next_run_at   BIGINT NOT NULL,
+	runs          INT NOT NULL DEFAULT 0,
+	retries       INT NOT NULL DEFAULT 0,
+	last_order_id VARCHAR(64) NOT NULL DEFAULT '',
+	last_error    TEXT NOT NULL DEFAULT '',
+	version       BIGINT NOT NULL DEFAULT 0,
+	created_at    BIGINT NOT NULL,
+	updated_at    BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS schedules_user_idx ON schedules (user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS schedules_due_idx ON schedules (next_run_at, id) WHERE status = 'active';
+`
+
+const scheduleColumns = `id, user_id, payee_id, amount, note, kind, interval_secs, cron, start_at, end_at, max_runs,
+	on_failure, max_retries, retry_delay, status, occurs_at, next_run_at, runs, retries, last_order_id, last_error,
+	version, created_at, updated_at`
+
+// SQLStore is a Store in the SQL database.
+type SQLStore struct {
+	db sqlx.Ext
+}
+
+var _ Store = (*SQLStore)(nil)
+
+// NewSQLStore creates a Store in the SQL database.
+func NewSQLStore(db sqlx.Ext) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+func (st *SQLStore) Create(s *Schedule) error {
+	_, err := sqlx.NamedExec(st.db, `INSERT INTO schedules (`+scheduleColumns+`)
+		VALUES (:id, :user_id, :payee_id, :amount, :note, :kind, :interval_secs, :cron, :start_at, :end_at, :max_runs,
+			:on_failure, :max_retries, :retry_delay, :status, :occurs_at, :next_run_at, :runs, :retries, :last_order_id, :last_error,
+			:version, :created_at, :updated_at)`, s)
+	return err
+}
+
+// Only the state of the schedule is updated, the terms are kept as created.
+func (st *SQLStore) Update(s *Schedule) error {
+	result, err := st.db.Exec(st.db.Rebind(`UPDATE schedules SET status = ?, occurs_at = ?, next_run_at = ?,
+		runs = ?, retries = ?, last_order_id = ?, last_error = ?, version = version + 1, updated_at = ?
+		WHERE id = ? AND version = ?`),
+		s.Status, s.OccursAt, s.NextRunAt, s.Runs, s.Retries, s.LastOrderID, s.LastError, s.UpdatedAt, s.ID, s.Version)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		if _, err := st.Get(s.ID); err != nil {
+			return err
+		}
+		return ErrScheduleConflict
+	}
+	s.Version++
+	return nil
+}
+
+func (st *SQLStore) Get(id string) (*Schedule, error) {
+	var s Schedule
+	err := sqlx.Get(st.db, &s, st.db.Rebind(`SELECT `+scheduleColumns+` FROM schedules WHERE id = ?`), id)
+	if err == sql.ErrNoRows {
+		return nil, ErrScheduleNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (st *SQLStore) ListByUser(userID string) ([]*Schedule, error) {
+	var list []*Schedule
+	err := sqlx.Select(st.db, &list, st.db.Rebind(`SELECT `+scheduleColumns+` FROM schedules
+		WHERE user_id = ? ORDER BY created_at DESC, id DESC`), userID)
+	return list, err
+}
+
+func (st *SQLStore) Due(now int64, after *Schedule, limit int) ([]*Schedule, error) {
+	var due []*Schedule
+	if after == nil {
+		err := sqlx.Select(st.db, &due, st.db.Rebind(`SELECT `+scheduleColumns+` FROM schedules
+			WHERE status = ? AND next_run_at <= ? ORDER BY next_run_at, id LIMIT ?`), StatusActive, now, limit)
+		return due, err
+	}
+	err := sqlx.Select(st.db, &due, st.db.Rebind(`SELECT `+scheduleColumns+` FROM schedules
+		WHERE status = ? AND next_run_at <= ? AND (next_run_at, id) > (?, ?) ORDER BY next_run_at, id LIMIT ?`),
+		StatusActive, now, after.NextRunAt, after.ID, limit)
+	return due, err
+}
@@ -0,0 +1,66 @@
+package transaction
+
+import (
+	"errors"
+	"sync"
+
+	"simplopay.com/backend/base"
+	"simplopay.com/backend/handles"
+	"simplopay.com/backend/pkg/opay"
+)
+
+// ErrFeeLegMeta is returned when a fee is charged before SetFeeLegMeta.
+var ErrFeeLegMeta = errors.New("fee leg order type is not set")
+
+// The order type of the fee legs, set at startup and read by the requests, see SetFeeLegMeta
+var feeLegSetting = struct {
+	meta *opay.Meta
+	lock sync.RWMutex
+}{}
+
+// Ensure Order records its fee legs
+var _ handles.FeeLegOrder = (*Order)(nil)
+
+// SetFeeLegMeta sets the order type of the fee legs, whose SYNC_DEAL status is charged and REVERSE status refunded.
+// It must be set before serving the orders charging a fee.
+func SetFeeLegMeta(meta *opay.Meta) {
+	feeLegSetting.lock.Lock()
+	feeLegSetting.meta = meta
+	feeLegSetting.lock.Unlock()
+}
+
+func feeLegMeta() *opay.Meta {
+	feeLegSetting.lock.RLock()
+	defer feeLegSetting.lock.RUnlock()
+	return feeLegSetting.meta
+}
+
+// AddFeeLeg saves the amount posted to the fee account as a child of the order,
+// the order is saved later in the same transaction with the group.
+func (o *Order) AddFeeLeg(tx opay.Tx, account string, amount float64, refund bool) error {
+	meta := feeLegMeta()
+	if meta == nil {
+		return ErrFeeLegMeta
+	}
+	step, summary := opay.SYNC_DEAL, "Fee of "+o.Id
+	if refund {
+		step, summary = opay.REVERSE, "Fee refund of "+o.Id
+	}
+	code, ok := statusCode(meta, step)
+	if !ok {
+		return ErrFeeLegMeta
+	}
+	leg, err := base.NewBaseOrderWithAudit(meta, o.Aid, account, amount, summary, code,
+		base.Audit{ActorType: base.ACTOR_SYSTEM, Reason: "fee"})
+	if err != nil {
+		return err
+	}
+	if err := o.AddChild(leg, base.RELATION_FEE); err != nil {
+		return err
+	}
+	e, err := opay.AsSqlxTx(tx)
+	if err != nil {
+		return err
+	}
+	return o.store.Insert(e, leg)
+}
@@ -0,0 +1,88 @@
+package transaction
+
+import (
+	"simplopay.com/backend/base"
+	"simplopay.com/backend/pkg/opay"
+)
+
+// Order is a base.BaseOrder kept in the order store, served by the shared handlers in package handles.
+// Every step saves the order with its target status: the first one inserts it,
+// the later ones update it only if nobody else has moved it meanwhile.
+type Order struct {
+	*base.BaseOrder
+	store base.OrderStore
+	audit base.Audit //the audit of the compensating orders created by NewReversal
+}
+
+// Ensure Order implements opay.IOrder
+var _ opay.IOrder = (*Order)(nil)
+
+// NewOrder wraps the order to be saved in the store.
+func NewOrder(store base.OrderStore, o *base.BaseOrder) *Order {
+	return &Order{BaseOrder: o, store: store}
+}
+
+// save inserts the new order, or updates the status of the stored one.
+func (o *Order) save(tx opay.Tx) error {
+	e, err := opay.AsSqlxTx(tx)
+	if err != nil {
+		return err
+	}
+	if o.PreStatus() == o.GetMeta().UnsetCode() {
+		return o.store.Insert(e, o.BaseOrder)
+	}
+	return o.store.UpdateStatus(e, o.BaseOrder)
+}
+
+// Pend saves the order as pending.
+func (o *Order) Pend(tx opay.Tx, kv opay.KV) error {
+	return o.save(tx)
+}
+
+// Do saves the order as being processed.
+func (o *Order) Do(tx opay.Tx, kv opay.KV) error {
+	return o.save(tx)
+}
+
+// Succeed saves the order as successful, the handler has settled the accounts.
+func (o *Order) Succeed(tx opay.Tx, kv opay.KV) error {
+	return o.save(tx)
+}
+
+// Cancel saves the order as canceled.
+func (o *Order) Cancel(tx opay.Tx, kv opay.KV) error {
+	return o.save(tx)
+}
+
+// Fail saves the order as failed.
+func (o *Order) Fail(tx opay.Tx, kv opay.KV) error {
+	return o.save(tx)
+}
+
+// SyncDeal saves the order as successful, the handler has settled the accounts.
+func (o *Order) SyncDeal(tx opay.Tx, kv opay.KV) error {
+	return o.save(tx)
+}
+
+// NewOrderCodec creates the codec of the orders kept in the store, so that the failed requests can be replayed.
+func NewOrderCodec(store base.OrderStore) opay.OrderCodec {
+	factory := func(meta *opay.Meta) opay.IOrder {
+		o := NewOrder(store, new(base.BaseOrder))
+		o.SetMeta(meta)
+		return o
+	}
+	return opay.JSONOrderCodec{
+		NewInitiator:   factory,
+		NewStakeholder: factory,
+	}
+}
+
+// statusCode returns the status code of the step declared by the order type, the lowest one if several.
+func statusCode(meta *opay.Meta, step opay.Step) (int64, bool) {
+	for _, status := range meta.Statuses() {
+		if status.Step == step {
+			return status.Code, true
+		}
+	}
+	return 0, false
+}
@@ -1,65 +0,0 @@
-package transaction
-
-import (
-	"fmt"
-
-	"simplopay.com/backend/internal/account"
-	"simplopay.com/backend/internal/user"
-	"simplopay.com/backend/pkg/opay"
-	// TODO: Import necessary internal packages like account and user
-)
-
-// P2PHandler handles the processing of P2P transfer orders.
-type P2PHandler struct {
-	accountRepo account.AccountRepository
-	userRepo    user.UserRepository
-	// TODO: Add dependencies like AccountRepository and UserRepository
-}
-
-// NewP2PHandler creates a new P2PHandler.
-func NewP2PHandler(accountRepo account.AccountRepository, userRepo user.UserRepository) *P2PHandler {
-	return &P2PHandler{accountRepo: accountRepo, userRepo: userRepo}
-}
-
-// Ensure P2PHandler implements opay.Handler
-var _ opay.Handler = (*P2PHandler)(nil)
-
-// ServeOpay processes the P2P order based on its current step.
-func (h *P2PHandler) ServeOpay(ctx *opay.Context) error {
-	// Retrieve the P2P order from the context. We need to type assert it.
-	order, ok := ctx.Request.Initiator.(*P2POrder) // Assuming Initiator is the P2POrder
-	if !ok {
-		// This should not happen if the meta is registered correctly
-		return fmt.Errorf("invalid order type in P2PHandler: %T", ctx.Request.Initiator)
-	}
-
-	// TODO: Implement logic based on the order's current step (order.PreStatus() and order.TargetStatus())
-	// This will involve calling the appropriate methods on the opay.Context, which will in turn call the IOrder methods on the P2POrder.
-	// For example, if the target step is PEND, call ctx.Pend(). If it's SUCCEED, call ctx.Succeed(), etc.
-
-	fmt.Printf("Processing P2P order %s from %s to %s for amount %s. Current Status: %d, Target Status: %d\n",
-		order.OrderID, order.SenderUserID, order.ReceiverUserID, order.Amount.String(), order.CurrentStatus, order.TargetStatusCode)
-
-	// Example of a state transition (simplistic for now)
-	switch opay.Step(order.TargetStatusCode) {
-	case opay.PEND:
-		return ctx.Pend() // Calls the Pend method on the P2POrder via the context
-	case opay.DO:
-		return ctx.Do()
-	case opay.SUCCEED:
-		// TODO: Implement the core transfer logic here or in the P2POrder.Succeed method
-		// This will involve updating account balances using the AccountRepository (within the transaction)
-		return ctx.Succeed()
-	case opay.CANCEL:
-		return ctx.Cancel()
-	case opay.FAIL:
-		return ctx.Fail()
-	case opay.SYNC_DEAL:
-		// TODO: Implement synchronous dealing logic
-		return ctx.SyncDeal()
-	default:
-		return fmt.Errorf("unsupported target step for P2P order: %d", order.TargetStatusCode)
-	}
-
-	// TODO: After calling the context method, handle the response or error and potentially write back to the request
-}
@@ -0,0 +1,54 @@
+package transaction
+
+import (
+	"simplopay.com/backend/base"
+	"simplopay.com/backend/pkg/opay"
+)
+
+// Reversal is the compensating order of a stored order, created by Order.NewReversal.
+type Reversal struct {
+	*Order
+	original *Order
+}
+
+// Ensure Order can be reversed by Reversal
+var (
+	_ opay.Reversible = (*Order)(nil)
+	_ opay.Reversal   = (*Reversal)(nil)
+)
+
+// NewReversal creates the compensating order of the amount as a child of the order,
+// its first detail is recorded with the audit set by the caller.
+func (o *Order) NewReversal(amount float64) (opay.Reversal, error) {
+	meta := o.GetMeta()
+	code, ok := meta.ReverseCode()
+	if !ok {
+		return nil, opay.ErrNotReversible
+	}
+	r, err := base.NewBaseOrderWithAudit(meta, o.Aid, o.Uid, amount, "Reversal of "+o.Id, code, o.audit)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.AddChild(r, base.RELATION_REVERSAL); err != nil {
+		return nil, err
+	}
+	return &Reversal{Order: NewOrder(o.store, r), original: o}, nil
+}
+
+// GetOriginal returns the reversed order.
+func (r *Reversal) GetOriginal() opay.Reversible {
+	return r.original
+}
+
+// Reverse adds the amount to the reversed amount of the original order under its row lock,
+// so that the concurrent reversals in total never exceed it, and saves the compensating order.
+func (r *Reversal) Reverse(tx opay.Tx, kv opay.KV) error {
+	e, err := opay.AsSqlxTx(tx)
+	if err != nil {
+		return err
+	}
+	if err := r.store.AddReversed(e, r.original.BaseOrder, -r.Amount); err != nil {
+		return err
+	}
+	return r.store.Insert(e, r.BaseOrder)
+}
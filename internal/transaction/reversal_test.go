@@ -0,0 +1,101 @@
+package transaction
+
+import (
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"testing"
+
+	"simplopay.com/backend/base"
+	"simplopay.com/backend/handles"
+	"simplopay.com/backend/pkg/opay"
+	"simplopay.com/backend/pkg/opay/opaytest"
+)
+
+var orderColumns = []string{"id", "aid", "uid", "link_id", "link_uid", "group_id", "parent_id", "relation",
+	"type", "amount", "fee", "fee_vat", "reversed", "summary", "details", "status", "created_at"}
+
+// orderRow is a stored p2p transfer order of 100, with the reversed amount.
+func orderRow(id, uid, linkId, linkUid string, amount, reversed float64) []driver.Value {
+	return []driver.Value{id, "NGN", uid, linkId, linkUid, "", "", "", OrderTypeP2PTransfer,
+		amount, 0.0, 0.0, reversed, "", []byte("[]"), int64(6), int64(1600000000)}
+}
+
+// reversalEngine serves the p2p transfers on the mock database, the balances are kept in memory.
+func reversalEngine(t *testing.T) (*TransactionServiceImpl, *opaytest.SQLMock, map[string]float64) {
+	g, _ := base.NewSnowflakeGenerator(1)
+	base.SetIDGenerator(g)
+	t.Cleanup(func() { base.SetIDGenerator(nil) })
+	db, mock := opaytest.NewSQLMock(t)
+	o := opay.NewOpay(db, 10, 2)
+	o.SettleFuncMap = opay.NewSettleFuncMap()
+	balances := map[string]float64{}
+	var mu sync.Mutex
+	o.RegSettleFunc("NGN", func(uid string, amount float64, tx opay.Tx) error {
+		mu.Lock()
+		defer mu.Unlock()
+		balances[uid] += amount
+		return nil
+	})
+	_, err := o.RegMeta(OrderTypeP2PTransfer, &handles.Transfer{}, []opay.Status{
+		{Code: 6, Note: "completed", Step: opay.SYNC_DEAL},
+		{Code: 7, Note: "reversed", Step: opay.REVERSE},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go o.Serve()
+	return NewTransactionServiceImpl(o, fakeUserRepo{}, nil, base.NewSQLOrderStore()), mock, balances
+}
+
+// expectLoad expects the transfer to be loaded with the reversed amount of the sender's order.
+func expectLoad(mock *opaytest.SQLMock, reversed float64) {
+	mock.ExpectQuery(`FROM base_orders WHERE id = \?$`).WithArgs("o-alice").
+		WillReturnRows(orderColumns, orderRow("o-alice", "alice", "o-bob", "bob", -100, reversed))
+	mock.ExpectQuery(`FROM base_orders WHERE id = \?$`).WithArgs("o-bob").
+		WillReturnRows(orderColumns, orderRow("o-bob", "bob", "o-alice", "alice", 100, -reversed))
+}
+
+func TestReverseP2PTransfer(t *testing.T) {
+	s, mock, balances := reversalEngine(t)
+	audit := base.Audit{ActorId: "operator", Note: "refund"}
+
+	// Partial reversal: the receiver's order is locked and reversed first.
+	expectLoad(mock, 0)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`WHERE id = \? FOR UPDATE$`).WithArgs("o-bob").
+		WillReturnRows(orderColumns, orderRow("o-bob", "bob", "o-alice", "alice", 100, 0))
+	mock.ExpectExec(`^UPDATE base_orders SET reversed = reversed \+ \?`).WillReturnResult(1)
+	mock.ExpectExec(`^INSERT INTO base_orders`).WillReturnResult(1)
+	mock.ExpectQuery(`WHERE id = \? FOR UPDATE$`).WithArgs("o-alice").
+		WillReturnRows(orderColumns, orderRow("o-alice", "alice", "o-bob", "bob", -100, 0))
+	mock.ExpectExec(`^UPDATE base_orders SET reversed = reversed \+ \?`).WillReturnResult(1)
+	mock.ExpectExec(`^INSERT INTO base_orders`).WillReturnResult(1)
+	mock.ExpectCommit()
+	if _, err := s.ReverseP2PTransfer("o-alice", 40, audit); err != nil {
+		t.Fatal(err)
+	}
+	if balances["alice"] != 40 || balances["bob"] != -40 {
+		t.Fatalf("got balances %v, want alice +40 and bob -40", balances)
+	}
+
+	// Over-reversal is refused before any transaction.
+	expectLoad(mock, -40)
+	_, err := s.ReverseP2PTransfer("o-alice", 61, audit)
+	if !errors.Is(err, opay.ErrOverReversal) {
+		t.Fatalf("got error %v, want %v", err, opay.ErrOverReversal)
+	}
+
+	// Concurrent reversal: the order was loaded before another reversal of the remaining amount
+	// committed, the locked order has no room left and the request is rolled back.
+	expectLoad(mock, -40)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`WHERE id = \? FOR UPDATE$`).WithArgs("o-bob").
+		WillReturnRows(orderColumns, orderRow("o-bob", "bob", "o-alice", "alice", 100, 100))
+	mock.ExpectExec(`^UPDATE base_orders SET reversed = reversed \+ \?`).WillReturnResult(0)
+	mock.ExpectRollback()
+	_, err = s.ReverseP2PTransfer("o-alice", 0, audit)
+	if !errors.Is(err, opay.ErrOverReversal) {
+		t.Fatalf("got error %v, want %v", err, opay.ErrOverReversal)
+	}
+}
@@ -6,12 +6,12 @@ import (
 	"log"
 	"time"
 
+	"simplopay.com/backend/base"
+	"simplopay.com/backend/handles"
 	"simplopay.com/backend/internal/account"
 	"simplopay.com/backend/internal/user"
 	"simplopay.com/backend/pkg/opay"
 
-	"github.com/google/uuid"
-	"github.com/jmoiron/sqlx"
 	"github.com/shopspring/decimal"
 	// TODO: Add a JWT library for token generation
 )
@@ -24,8 +24,29 @@ var (
 	// Transaction specific errors
 	ErrInvalidTransferDetails = errors.New("invalid transfer details: sender, receiver, or amount missing/invalid")
 	ErrSelfTransfer           = errors.New("cannot transfer to yourself")
+	ErrInvalidAmount          = errors.New("invalid amount: must be positive")
+	ErrBillsUnavailable       = errors.New("bill payments are not available")
+	ErrEscrowsUnavailable     = errors.New("escrow payments are not available")
+	ErrNotEscrowParty         = errors.New("not allowed for this party of the escrow")
+	ErrEscrowState            = errors.New("escrow is not in a state for this action")
 )
 
+// Order types served by the shared handlers, declared in the meta config
+const (
+	OrderTypeP2PTransfer = "p2p_transfer"
+	OrderTypeRecharge    = "recharge"
+	OrderTypeWithdraw    = "withdraw"
+	OrderTypeBillPayment = "bill_payment"
+	OrderTypeEscrow      = "escrow"
+	// The funds are held by handles.Authorize, and captured or voided later
+	OrderTypeAuthorization = "authorization"
+	// The fees posted to the fee accounts, children of the charged orders
+	OrderTypeFee = "fee"
+)
+
+// The only currency of the wallets for now
+const defaultCurrency = "NGN" // TODO: Make this dynamic/configurable
+
 // Claims defines the structure of the JWT claims.
 type Claims struct {
 	// ... existing code ...
@@ -33,7 +54,46 @@ type Claims struct {
 
 // TransactionService defines the interface for transaction operations.
 type TransactionService interface {
-	InitiateP2PTransfer(senderUserID, receiverUserID string, amount float64) (string, *opay.Response, error)
+	// The audit of the initiating methods records who made the request in the details of the new orders.
+	InitiateP2PTransfer(senderUserID, receiverUserID string, amount float64, audit base.Audit) (string, *opay.Response, error)
+	// Recharge credits the user's wallet, e.g. by an operator after the money has arrived.
+	Recharge(userID string, amount float64, audit base.Audit) (string, *opay.Response, error)
+	// InitiateRecharge creates a pending recharge, whose order id is the payment reference of the gateway.
+	InitiateRecharge(userID string, amount float64, audit base.Audit) (string, *opay.Response, error)
+	// ConfirmRecharge finishes the recharge by the verified callback of the gateway.
+	ConfirmRecharge(cb *handles.GatewayCallback) error
+	// InitiateWithdrawal debits the user's wallet and dispatches the payout to the destination,
+	// the empty destination stands for the user's default payout account.
+	InitiateWithdrawal(userID string, amount float64, destination string, audit base.Audit) (string, *opay.Response, error)
+	// DispatchWithdrawal dispatches the payout of a pending withdrawal, to the destination recorded with it.
+	DispatchWithdrawal(orderID string) (*opay.Response, error)
+	// FinishWithdrawal marks the withdrawal as successful, or failed with the wallet refunded.
+	FinishWithdrawal(orderID string, succeeded bool, reason string) error
+	// PayBill debits the user's wallet and pays the bill through the biller gateway,
+	// the order stays pending while the result is unknown.
+	PayBill(userID string, bill *handles.Bill, amount float64, audit base.Audit) (string, *handles.BillReceipt, error)
+	// RequeryBill finishes the pending bill payment by the result queried from the biller gateway.
+	RequeryBill(orderID string) (*handles.BillReceipt, error)
+	// RequeryPendingBills requeries the bill payments pending for longer than minAge, and returns how many got finished.
+	RequeryPendingBills(minAge time.Duration) (int, error)
+	// InitiateEscrow moves the amount from the buyer's wallet into the escrow account,
+	// it's released to the seller on confirmation, or automatically after the release period.
+	InitiateEscrow(buyerID, sellerID string, amount float64, audit base.Audit) (string, *opay.Response, error)
+	// ConfirmEscrow releases the held amount to the seller on the buyer's confirmation.
+	ConfirmEscrow(orderID, buyerID string, audit base.Audit) (*opay.Response, error)
+	// CancelEscrow refunds the held amount to the buyer on the seller's cancellation.
+	CancelEscrow(orderID, sellerID string, audit base.Audit) (*opay.Response, error)
+	// DisputeEscrow suspends the automatic release until the dispute is resolved.
+	DisputeEscrow(orderID, buyerID string, audit base.Audit) (*opay.Response, error)
+	// ResolveEscrow releases the disputed amount to the seller, or refunds it to the buyer.
+	ResolveEscrow(orderID string, release bool, audit base.Audit) (*opay.Response, error)
+	// ReleaseDueEscrow releases the escrow whose release period is over, if it's still held.
+	ReleaseDueEscrow(orderID string) error
+	// ExpireAuthorization moves the authorization whose hold expired uncaptured to expired, it's a no-op if already there.
+	ExpireAuthorization(orderID string) error
+	// ReverseP2PTransfer returns the amount of a successful transfer to the sender by an operator,
+	// zero amount means the remaining amount, audit.ActorId is the operator.
+	ReverseP2PTransfer(orderID string, amount float64, audit base.Audit) (*opay.Response, error)
 	// Add other transaction types here
 }
 
@@ -42,7 +102,9 @@ type TransactionServiceImpl struct {
 	opayInstance *opay.Opay
 	userRepo     user.UserRepository
 	accountRepo  account.AccountRepository
-	// TODO: Add dependencies like UserRepository and AccountRepository
+	orderStore   base.OrderStore
+	bills        *handles.Bills
+	escrows      *handles.Escrows
 }
 
 // NewTransactionServiceImpl creates a new TransactionServiceImpl.
@@ -50,85 +112,45 @@ func NewTransactionServiceImpl(
 	opayInstance *opay.Opay,
 	userRepo user.UserRepository,
 	accountRepo account.AccountRepository,
+	orderStore base.OrderStore,
 ) *TransactionServiceImpl {
 	return &TransactionServiceImpl{
 		opayInstance: opayInstance,
 		userRepo:     userRepo,
 		accountRepo:  accountRepo,
+		orderStore:   orderStore,
 	}
 }
 
-// Let's go with Option 2 for clarity, defining a minimal struct for the stakeholder.
-type p2pStakeholderOrder struct {
-	OrderID  string
-	UserID   string
-	Amount   decimal.Decimal
-	Currency string
-	meta     *opay.Meta // Ensure this field is present and correctly named
-	// TODO: Add status fields if stakeholder needs independent status tracking
-}
-
-// Implement IOrder for p2pStakeholderOrder
-
-func (o *p2pStakeholderOrder) GetMeta() *opay.Meta {
-	return o.meta
-}
-
-func (o *p2pStakeholderOrder) PreStatus() int64 {
-	// Stakeholder status might not be tracked independently, return a default or zero status code
-	return 0 // Or the code for an initial/unset status if applicable
-}
-
-func (o *p2pStakeholderOrder) TargetStatus() int64 {
-	// Stakeholder target status might not be applicable, return a default or zero status code
-	return 0 // Or the code for a target status if applicable
-}
-
-func (o *p2pStakeholderOrder) GetUid() string {
-	return o.UserID // Stakeholder is the receiver
-}
-
-func (o *p2pStakeholderOrder) GetAid() string {
-	return o.Currency // AID is the currency for settlement
+// SetBills sets the biller catalog and gateway of the bill payments.
+func (s *TransactionServiceImpl) SetBills(bills *handles.Bills) {
+	s.bills = bills
 }
 
-func (o *p2pStakeholderOrder) GetAmount() float64 {
-	amountFloat, _ := o.Amount.Float64()
-	return amountFloat
+// SetEscrows sets the escrow account and the automatic release schedule of the escrow payments.
+func (s *TransactionServiceImpl) SetEscrows(escrows *handles.Escrows) {
+	s.escrows = escrows
 }
 
-func (o *p2pStakeholderOrder) Pend(tx *sqlx.Tx, addition opay.KV) error {
-	// No-op for stakeholder in this simple model
-	return nil
-}
-
-func (o *p2pStakeholderOrder) Do(tx *sqlx.Tx, addition opay.KV) error {
-	// No-op for stakeholder in this simple model
-	return nil
-}
-
-func (o *p2pStakeholderOrder) Succeed(tx *sqlx.Tx, addition opay.KV) error {
-	// No-op for stakeholder in this simple model
-	return nil
-}
-
-func (o *p2pStakeholderOrder) Cancel(tx *sqlx.Tx, addition opay.KV) error {
-	// No-op for stakeholder in this simple model
-	return nil
-}
-
-func (o *p2pStakeholderOrder) Fail(tx *sqlx.Tx, addition opay.KV) error {
-	// No-op for stakeholder in this simple model
-	return nil
-}
-
-func (o *p2pStakeholderOrder) SyncDeal(tx *sqlx.Tx, addition opay.KV) error {
-	// No-op for stakeholder in this simple model
-	return nil
+// newOrder creates an order of the type, moving to the status of the step.
+func (s *TransactionServiceImpl) newOrder(orderType string, step opay.Step, userID string, amount float64, summary string, audit base.Audit) (*Order, error) {
+	meta, ok := s.opayInstance.Meta(orderType)
+	if !ok {
+		return nil, fmt.Errorf("%s order type not registered", orderType) // Should not happen if registration in main is correct
+	}
+	code, ok := statusCode(meta, step)
+	if !ok {
+		return nil, fmt.Errorf("%s order type has no %s status", orderType, step)
+	}
+	o, err := base.NewBaseOrderWithAudit(meta, defaultCurrency, userID, amount, summary, code, audit)
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s order: %w", orderType, err)
+	}
+	return NewOrder(s.orderStore, o), nil
 }
 
 // InitiateP2PTransfer initiates a peer-to-peer transfer.
-func (s *TransactionServiceImpl) InitiateP2PTransfer(senderUserID, receiverUserID string, amount float64) (string, *opay.Response, error) {
+func (s *TransactionServiceImpl) InitiateP2PTransfer(senderUserID, receiverUserID string, amount float64, audit base.Audit) (string, *opay.Response, error) {
 	// TODO: Implement P2P transfer logic using opayInstance.Do()
 
 	// 1. Basic Validation (already partly done in handler, but reinforce here)
@@ -165,50 +187,20 @@ func (s *TransactionServiceImpl) InitiateP2PTransfer(senderUserID, receiverUserI
 		return "", nil, fmt.Errorf("error finding receiver: %w", err)
 	}
 
-	// 3. Create the P2P Order
-	// Assume NGN currency for now
-	currency := "NGN" // TODO: Make this dynamic/configurable
-
-	// Find the order meta for P2P transfer
-	meta, ok := s.opayInstance.Meta("p2p_transfer") // TODO: Add Meta method to Opay struct or access directly if public
-	if !ok {
-		return "", nil, errors.New("p2p_transfer order type not registered") // Should not happen if registration in main is correct
-	}
-
-	orderID := uuid.New().String()
-	now := time.Now()
-
-	initiatorOrder := &P2POrder{
-		OrderID:          orderID,
-		SenderUserID:     senderUserID,
-		ReceiverUserID:   receiverUserID,
-		Amount:           decimalAmount,
-		Currency:         currency,
-		CurrentStatus:    int64(opay.UNSET), // Start with unset status code
-		TargetStatusCode: int64(opay.PEND),  // Target pending status code
-		meta:             meta,
-		CreatedAt:        now,
-		UpdatedAt:        now,
+	// 3. Create the P2P Orders
+	// The sender's order debits the amount and the receiver's one credits it,
+	// both are settled at once by handles.Transfer.
+	amountFloat, _ := decimalAmount.Float64()
+	initiatorOrder, err := s.newOrder(OrderTypeP2PTransfer, opay.SYNC_DEAL, senderUserID, -amountFloat, "P2P transfer to "+receiverUserID, audit)
+	if err != nil {
+		return "", nil, err
 	}
-
-	// For P2P, the receiver is the stakeholder. The Opay framework expects a separate IOrder for the stakeholder.
-	// In this simple case, the stakeholder order can be the same P2POrder instance, but with GetUid() returning receiver ID.
-	// A cleaner approach might be a dedicated StakeholderP2POrder struct implementing IOrder.
-	// For now, let's try passing the same initiator order, but this might need refinement based on Opay's exact stakeholder handling.
-	// Let's assume Opay uses GetUid and GetAmount of the Stakeholder IOrder.
-	// We need a way for the Stakeholder IOrder to return the ReceiverUserID and a positive amount.
-
-	// Option 1: Use the same P2POrder for Stakeholder (requires P2POrder to know its role - less clean)
-	// Option 2: Create a simple struct implementing IOrder for the stakeholder leg.
-
-	// Let's go with Option 2 for clarity, defining a minimal struct for the stakeholder.
-	stakeholderOrder := &p2pStakeholderOrder{
-		OrderID:  orderID, // Use same order ID
-		UserID:   receiverUserID,
-		Amount:   decimalAmount, // Positive amount for credit
-		Currency: currency,
-		meta:     meta,
+	stakeholderOrder, err := s.newOrder(OrderTypeP2PTransfer, opay.SYNC_DEAL, receiverUserID, amountFloat, "P2P transfer from "+senderUserID, audit)
+	if err != nil {
+		return "", nil, err
 	}
+	initiatorOrder.Link(stakeholderOrder.BaseOrder)
+	orderID := initiatorOrder.Id
 
 	// 4. Create the Opay Request
 	req := &opay.Request{ // Create a pointer to Request
@@ -222,7 +214,7 @@ func (s *TransactionServiceImpl) InitiateP2PTransfer(senderUserID, receiverUserI
 	resp := s.opayInstance.Do(req)
 
 	// 6. Handle Opay Response
-	// The P2POrder.Succeed/Fail/Cancel methods would have updated the order status in DB.
+	// The orders have been saved with their final status in the same transaction as the balances.
 	// We can inspect resp.Err to know the outcome.
 
 	if resp.Err != nil {
@@ -231,6 +223,498 @@ func (s *TransactionServiceImpl) InitiateP2PTransfer(senderUserID, receiverUserI
 	}
 
 	// Transfer successful
-	log.Printf("P2P Transfer successful for order %s. Opay Response: %+v\n", req.Initiator.GetUid(), resp)
+	log.Printf("P2P Transfer successful for order %s. Step: %d, Status: %d, Took: %s\n",
+		orderID, resp.Executed, resp.InitiatorStatus, resp.Duration())
 	return orderID, resp, nil
 }
+
+// Recharge credits the user's wallet synchronously through handles.Recharge.
+func (s *TransactionServiceImpl) Recharge(userID string, amount float64, audit base.Audit) (string, *opay.Response, error) {
+	if userID == "" {
+		return "", nil, ErrInvalidTransferDetails
+	}
+	if amount <= 0 {
+		return "", nil, ErrInvalidAmount
+	}
+	if _, err := s.userRepo.FindUserByID(userID); err != nil {
+		return "", nil, fmt.Errorf("error finding user: %w", err)
+	}
+	order, err := s.newOrder(OrderTypeRecharge, opay.SYNC_DEAL, userID, amount, "Recharge", audit)
+	if err != nil {
+		return "", nil, err
+	}
+	resp := s.opayInstance.Do(&opay.Request{Initiator: order})
+	if resp.Err != nil {
+		return "", nil, fmt.Errorf("recharge failed: %w", resp.Err)
+	}
+	return order.Id, resp, nil
+}
+
+// InitiateRecharge creates a pending recharge to be paid through the gateway,
+// the wallet is credited when the gateway confirms the payment.
+func (s *TransactionServiceImpl) InitiateRecharge(userID string, amount float64, audit base.Audit) (string, *opay.Response, error) {
+	if userID == "" {
+		return "", nil, ErrInvalidTransferDetails
+	}
+	if amount <= 0 {
+		return "", nil, ErrInvalidAmount
+	}
+	if _, err := s.userRepo.FindUserByID(userID); err != nil {
+		return "", nil, fmt.Errorf("error finding user: %w", err)
+	}
+	order, err := s.newOrder(OrderTypeRecharge, opay.PEND, userID, amount, "Recharge", audit)
+	if err != nil {
+		return "", nil, err
+	}
+	resp := s.opayInstance.Do(&opay.Request{Initiator: order})
+	if resp.Err != nil {
+		return "", nil, fmt.Errorf("recharge failed: %w", resp.Err)
+	}
+	return order.Id, resp, nil
+}
+
+// ConfirmRecharge moves the pending recharge referenced by the callback to succeeded or failed,
+// handles.Recharge only credits the wallet if the paid amount and currency match the order.
+func (s *TransactionServiceImpl) ConfirmRecharge(cb *handles.GatewayCallback) error {
+	step := opay.FAIL
+	if cb.Status == handles.PAYMENT_SUCCEEDED {
+		step = opay.SUCCEED
+	}
+	o, err := s.load(cb.Reference)
+	if errors.Is(err, base.ErrOrderNotFound) {
+		return fmt.Errorf("%w: %v", handles.ErrPaymentUnmatched, err)
+	}
+	if err != nil {
+		return err
+	}
+	if o.Type != OrderTypeRecharge {
+		return fmt.Errorf("%w: order %s is a %s", handles.ErrPaymentUnmatched, o.Id, o.Type)
+	}
+	if code, _ := statusCode(o.GetMeta(), step); o.Status == code {
+		return nil
+	}
+	if status, _ := o.GetMeta().Status(o.Status); status.Step != opay.PEND {
+		return fmt.Errorf("%w: order %s is %s", handles.ErrPaymentUnmatched, o.Id, status.Step)
+	}
+	audit := base.Audit{
+		ActorType: base.ACTOR_SYSTEM,
+		RequestId: cb.EventId,
+		Reason:    "gateway_" + cb.Status,
+	}
+	_, err = s.move(o, step, audit, map[string]interface{}{handles.GATEWAY_PAYMENT_KEY: cb})
+	return err
+}
+
+// PayBill debits the user's wallet through handles.BillPayment, which validates the bill and the customer,
+// then pays it through the biller gateway and finishes the order by the receipt.
+func (s *TransactionServiceImpl) PayBill(userID string, bill *handles.Bill, amount float64, audit base.Audit) (string, *handles.BillReceipt, error) {
+	if s.bills == nil {
+		return "", nil, ErrBillsUnavailable
+	}
+	if userID == "" || bill == nil {
+		return "", nil, ErrInvalidTransferDetails
+	}
+	if amount <= 0 {
+		return "", nil, ErrInvalidAmount
+	}
+	if _, err := s.userRepo.FindUserByID(userID); err != nil {
+		return "", nil, fmt.Errorf("error finding user: %w", err)
+	}
+	summary := "Bill payment to " + bill.BillerId + "/" + bill.ProductId
+	order, err := s.newOrder(OrderTypeBillPayment, opay.PEND, userID, -amount, summary, audit)
+	if err != nil {
+		return "", nil, err
+	}
+	resp := s.opayInstance.Do(&opay.Request{Initiator: order, Addition: map[string]interface{}{handles.BILL_KEY: bill}})
+	if resp.Err != nil {
+		return "", nil, fmt.Errorf("bill payment failed: %w", resp.Err)
+	}
+	receipt, err := s.bills.Pay(order.Id, bill, amount)
+	if err != nil {
+		// The result is unknown, the payment is to be requeried.
+		log.Printf("Bill payment %s is left pending: %v", order.Id, err)
+		return order.Id, &handles.BillReceipt{OrderId: order.Id, Status: handles.BILL_PENDING}, nil
+	}
+	return order.Id, receipt, s.finishBill(order.Id, receipt)
+}
+
+// RequeryBill queries the result of the bill payment, and finishes the order if it's known.
+func (s *TransactionServiceImpl) RequeryBill(orderID string) (*handles.BillReceipt, error) {
+	if s.bills == nil {
+		return nil, ErrBillsUnavailable
+	}
+	receipt, err := s.bills.Query(orderID)
+	if err != nil {
+		return nil, err
+	}
+	return receipt, s.finishBill(orderID, receipt)
+}
+
+// RequeryPendingBills requeries the pending bill payments created before minAge ago,
+// the younger ones may still be paying. A failed requery doesn't stop the others, the last error is returned.
+func (s *TransactionServiceImpl) RequeryPendingBills(minAge time.Duration) (int, error) {
+	if s.bills == nil {
+		return 0, ErrBillsUnavailable
+	}
+	meta, ok := s.opayInstance.Meta(OrderTypeBillPayment)
+	if !ok {
+		return 0, fmt.Errorf("%s order type not registered", OrderTypeBillPayment)
+	}
+	pending, ok := statusCode(meta, opay.PEND)
+	if !ok {
+		return 0, fmt.Errorf("%s order type has no %s status", OrderTypeBillPayment, opay.PEND)
+	}
+	cutoff := time.Now().Add(-minAge).Unix()
+	var n int
+	var lastErr error
+	for after := ""; ; {
+		orders, err := s.orderStore.FindByStatus(s.opayInstance.DB(), OrderTypeBillPayment, pending, after, base.MAX_PAGE_SIZE)
+		if err != nil {
+			return n, err
+		}
+		for _, o := range orders {
+			if o.CreatedAt > cutoff {
+				continue
+			}
+			receipt, err := s.RequeryBill(o.Id)
+			if err != nil {
+				lastErr = fmt.Errorf("bill payment %s: %w", o.Id, err)
+				continue
+			}
+			if receipt.Status != handles.BILL_PENDING {
+				n++
+			}
+		}
+		if len(orders) < base.MAX_PAGE_SIZE {
+			return n, lastErr
+		}
+		after = orders[len(orders)-1].Id
+	}
+}
+
+// finishBill moves the bill payment to the result of the receipt,
+// the receipt number and the token are kept in the details of the succeeded order.
+func (s *TransactionServiceImpl) finishBill(orderID string, receipt *handles.BillReceipt) error {
+	var err error
+	switch receipt.Status {
+	case handles.BILL_PAID:
+		audit := base.Audit{
+			ActorType: base.ACTOR_SYSTEM,
+			Metadata:  map[string]string{"receipt_no": receipt.ReceiptNo},
+		}
+		if receipt.Token != "" {
+			audit.Metadata["token"] = receipt.Token
+		}
+		_, err = s.advance(orderID, opay.SUCCEED, audit, map[string]interface{}{handles.BILL_RECEIPT_KEY: receipt})
+	case handles.BILL_FAILED:
+		_, err = s.advance(orderID, opay.FAIL, base.Audit{ActorType: base.ACTOR_SYSTEM, Note: receipt.Message}, nil)
+	default:
+		return nil
+	}
+	if errors.Is(err, errAlreadyThere) {
+		return nil
+	}
+	return err
+}
+
+// InitiateEscrow creates the buyer's and the seller's escrow orders, and schedules the automatic release
+// before handles.Escrow moves the amount into the escrow account.
+func (s *TransactionServiceImpl) InitiateEscrow(buyerID, sellerID string, amount float64, audit base.Audit) (string, *opay.Response, error) {
+	if s.escrows == nil {
+		return "", nil, ErrEscrowsUnavailable
+	}
+	if buyerID == "" || sellerID == "" {
+		return "", nil, ErrInvalidTransferDetails
+	}
+	if buyerID == sellerID {
+		return "", nil, ErrSelfTransfer
+	}
+	if amount <= 0 {
+		return "", nil, ErrInvalidAmount
+	}
+	for _, id := range []string{buyerID, sellerID} {
+		if _, err := s.userRepo.FindUserByID(id); err != nil {
+			return "", nil, fmt.Errorf("error finding user %s: %w", id, err)
+		}
+	}
+	buyerOrder, err := s.newOrder(OrderTypeEscrow, opay.PEND, buyerID, -amount, "Escrow payment to "+sellerID, audit)
+	if err != nil {
+		return "", nil, err
+	}
+	sellerOrder, err := s.newOrder(OrderTypeEscrow, opay.PEND, sellerID, amount, "Escrow payment from "+buyerID, audit)
+	if err != nil {
+		return "", nil, err
+	}
+	buyerOrder.Link(sellerOrder.BaseOrder)
+	// A schedule left by a failed request finds no order to release.
+	if _, err := s.escrows.Schedule(buyerOrder.Id, buyerID, buyerOrder.Aid, amount); err != nil {
+		return "", nil, fmt.Errorf("error scheduling escrow release: %w", err)
+	}
+	resp := s.opayInstance.Do(&opay.Request{Initiator: buyerOrder, Stakeholder: sellerOrder})
+	if resp.Err != nil {
+		return "", nil, fmt.Errorf("escrow payment failed: %w", resp.Err)
+	}
+	return buyerOrder.Id, resp, nil
+}
+
+// ConfirmEscrow releases the held or disputed escrow to the seller, only the buyer can confirm it.
+func (s *TransactionServiceImpl) ConfirmEscrow(orderID, buyerID string, audit base.Audit) (*opay.Response, error) {
+	buyer, seller, err := s.loadEscrow(orderID)
+	if err != nil {
+		return nil, err
+	}
+	if buyer.Uid != buyerID {
+		return nil, ErrNotEscrowParty
+	}
+	audit.ActorId, audit.ActorType, audit.Reason = buyerID, base.ACTOR_USER, "buyer_confirmed"
+	return s.moveEscrow(buyer, seller, opay.SUCCEED, audit, opay.PEND, opay.DO)
+}
+
+// CancelEscrow refunds the held escrow to the buyer, only the seller can cancel it before any dispute.
+func (s *TransactionServiceImpl) CancelEscrow(orderID, sellerID string, audit base.Audit) (*opay.Response, error) {
+	buyer, seller, err := s.loadEscrow(orderID)
+	if err != nil {
+		return nil, err
+	}
+	if seller.Uid != sellerID {
+		return nil, ErrNotEscrowParty
+	}
+	audit.ActorId, audit.ActorType, audit.Reason = sellerID, base.ACTOR_USER, "seller_cancelled"
+	return s.moveEscrow(buyer, seller, opay.CANCEL, audit, opay.PEND)
+}
+
+// DisputeEscrow moves the held escrow to disputed, only the buyer can dispute it.
+func (s *TransactionServiceImpl) DisputeEscrow(orderID, buyerID string, audit base.Audit) (*opay.Response, error) {
+	buyer, seller, err := s.loadEscrow(orderID)
+	if err != nil {
+		return nil, err
+	}
+	if buyer.Uid != buyerID {
+		return nil, ErrNotEscrowParty
+	}
+	audit.ActorId, audit.ActorType, audit.Reason = buyerID, base.ACTOR_USER, "buyer_disputed"
+	return s.moveEscrow(buyer, seller, opay.DO, audit, opay.PEND)
+}
+
+// ResolveEscrow resolves the disputed escrow by an operator, audit.ActorId is the operator.
+func (s *TransactionServiceImpl) ResolveEscrow(orderID string, release bool, audit base.Audit) (*opay.Response, error) {
+	buyer, seller, err := s.loadEscrow(orderID)
+	if err != nil {
+		return nil, err
+	}
+	step, reason := opay.FAIL, "dispute_refunded"
+	if release {
+		step, reason = opay.SUCCEED, "dispute_released"
+	}
+	audit.ActorType, audit.Reason = base.ACTOR_ADMIN, reason
+	return s.moveEscrow(buyer, seller, step, audit, opay.DO)
+}
+
+// ReleaseDueEscrow is the handles.EscrowReleaseFunc, the escrow finished or disputed meanwhile is left as it is.
+func (s *TransactionServiceImpl) ReleaseDueEscrow(orderID string) error {
+	buyer, seller, err := s.loadEscrow(orderID)
+	if errors.Is(err, base.ErrOrderNotFound) {
+		// The request of the schedule failed, nothing was held.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	audit := base.Audit{ActorType: base.ACTOR_SYSTEM, Reason: "auto_released"}
+	_, err = s.moveEscrow(buyer, seller, opay.SUCCEED, audit, opay.PEND)
+	if errors.Is(err, ErrEscrowState) {
+		return nil
+	}
+	return err
+}
+
+// loadEscrow finds the buyer's and the seller's escrow orders by the id of either one.
+func (s *TransactionServiceImpl) loadEscrow(orderID string) (buyer, seller *base.BaseOrder, err error) {
+	buyer, err = s.load(orderID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if buyer.Type != OrderTypeEscrow {
+		return nil, nil, fmt.Errorf("%w: order %s is a %s", base.ErrOrderNotFound, orderID, buyer.Type)
+	}
+	seller, err = s.orderStore.FindLinked(s.opayInstance.DB(), buyer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error finding the linked order of %s: %w", orderID, err)
+	}
+	if err := seller.SetMeta(buyer.GetMeta()); err != nil {
+		return nil, nil, err
+	}
+	if buyer.Amount > 0 {
+		buyer, seller = seller, buyer
+	}
+	return buyer, seller, nil
+}
+
+// moveEscrow submits both escrow orders to the status of the step, if they are at one of the steps from.
+func (s *TransactionServiceImpl) moveEscrow(buyer, seller *base.BaseOrder, step opay.Step, audit base.Audit, from ...opay.Step) (*opay.Response, error) {
+	meta := buyer.GetMeta()
+	current, _ := meta.Status(buyer.Status)
+	allowed := false
+	for _, f := range from {
+		allowed = allowed || current.Step == f
+	}
+	if !allowed {
+		return nil, fmt.Errorf("%w: order %s is %s", ErrEscrowState, buyer.Id, current.Step)
+	}
+	code, ok := statusCode(meta, step)
+	if !ok {
+		return nil, fmt.Errorf("%s order type has no %s status", buyer.Type, step)
+	}
+	for _, o := range []*base.BaseOrder{buyer, seller} {
+		if err := o.SetTargetAudit(code, audit); err != nil {
+			return nil, err
+		}
+	}
+	resp := s.opayInstance.Do(&opay.Request{
+		Initiator:   NewOrder(s.orderStore, buyer),
+		Stakeholder: NewOrder(s.orderStore, seller),
+	})
+	if resp.Err != nil {
+		return nil, fmt.Errorf("order %s to %s failed: %w", buyer.Id, step, resp.Err)
+	}
+	return resp, nil
+}
+
+// ReverseP2PTransfer reverses the sender's and the receiver's orders of the transfer found by the id of either one.
+// The reversed amount is kept on the stored orders, the reversals in total can't exceed the transfer.
+func (s *TransactionServiceImpl) ReverseP2PTransfer(orderID string, amount float64, audit base.Audit) (*opay.Response, error) {
+	if amount < 0 {
+		return nil, ErrInvalidAmount
+	}
+	sender, err := s.load(orderID)
+	if err != nil {
+		return nil, err
+	}
+	if sender.Type != OrderTypeP2PTransfer {
+		return nil, fmt.Errorf("%w: order %s is a %s", base.ErrOrderNotFound, orderID, sender.Type)
+	}
+	receiver, err := s.orderStore.FindLinked(s.opayInstance.DB(), sender)
+	if err != nil {
+		return nil, fmt.Errorf("error finding the linked order of %s: %w", orderID, err)
+	}
+	if err := receiver.SetMeta(sender.GetMeta()); err != nil {
+		return nil, err
+	}
+	if sender.Amount > 0 {
+		sender, receiver = receiver, sender
+	}
+	audit.ActorType = base.ACTOR_ADMIN
+	if audit.Reason == "" {
+		audit.Reason = "transfer_reversed"
+	}
+	initiator, stakeholder := NewOrder(s.orderStore, sender), NewOrder(s.orderStore, receiver)
+	initiator.audit, stakeholder.audit = audit, audit
+	resp := s.opayInstance.Reverse(initiator, stakeholder, amount, time.Time{})
+	if resp.Err != nil {
+		return nil, fmt.Errorf("reversal of order %s failed: %w", orderID, resp.Err)
+	}
+	return resp, nil
+}
+
+// InitiateWithdrawal debits the user's wallet through handles.Withdraw, and dispatches the payout.
+// The order stays pending if the payout can't be dispatched, and can be dispatched again later.
+func (s *TransactionServiceImpl) InitiateWithdrawal(userID string, amount float64, destination string, audit base.Audit) (string, *opay.Response, error) {
+	if userID == "" {
+		return "", nil, ErrInvalidTransferDetails
+	}
+	if amount <= 0 {
+		return "", nil, ErrInvalidAmount
+	}
+	if _, err := s.userRepo.FindUserByID(userID); err != nil {
+		return "", nil, fmt.Errorf("error finding user: %w", err)
+	}
+	order, err := s.newOrder(OrderTypeWithdraw, opay.PEND, userID, -amount, "Withdrawal", audit)
+	if err != nil {
+		return "", nil, err
+	}
+	resp := s.opayInstance.Do(&opay.Request{Initiator: order,
+		Addition: map[string]interface{}{handles.PAYOUT_DESTINATION_KEY: destination}})
+	if resp.Err != nil {
+		return "", nil, fmt.Errorf("withdrawal failed: %w", resp.Err)
+	}
+	dispatched, err := s.DispatchWithdrawal(order.Id)
+	if err != nil {
+		log.Printf("Withdrawal %s is left pending, its payout is dispatched again later: %v", order.Id, err)
+		return order.Id, resp, nil
+	}
+	return order.Id, dispatched, nil
+}
+
+// DispatchWithdrawal moves the pending withdrawal to in progress, handles.Withdraw dispatches its payout.
+func (s *TransactionServiceImpl) DispatchWithdrawal(orderID string) (*opay.Response, error) {
+	return s.advance(orderID, opay.DO, base.Audit{ActorType: base.ACTOR_SYSTEM}, nil)
+}
+
+// FinishWithdrawal moves the withdrawal to the result of its payout, it's a no-op if already there.
+func (s *TransactionServiceImpl) FinishWithdrawal(orderID string, succeeded bool, reason string) error {
+	step := opay.FAIL
+	if succeeded {
+		step = opay.SUCCEED
+	}
+	_, err := s.advance(orderID, step, base.Audit{ActorType: base.ACTOR_SYSTEM, Reason: reason}, nil)
+	if errors.Is(err, errAlreadyThere) {
+		return nil
+	}
+	return err
+}
+
+// ExpireAuthorization is the expire function of handles.ExpireHolds, handles.Authorize marks the hold expired with the order.
+func (s *TransactionServiceImpl) ExpireAuthorization(orderID string) error {
+	_, err := s.advance(orderID, handles.EXPIRE, base.Audit{ActorType: base.ACTOR_SYSTEM, Reason: "hold_expired"}, nil)
+	if errors.Is(err, errAlreadyThere) {
+		return nil
+	}
+	return err
+}
+
+// errAlreadyThere is returned by advance if the order is already in the status of the step.
+var errAlreadyThere = errors.New("order is already in the status")
+
+// advance moves the stored order to the status of the step.
+func (s *TransactionServiceImpl) advance(orderID string, step opay.Step, audit base.Audit, addition map[string]interface{}) (*opay.Response, error) {
+	o, err := s.load(orderID)
+	if err != nil {
+		return nil, err
+	}
+	return s.move(o, step, audit, addition)
+}
+
+// load finds the stored order and sets its meta.
+func (s *TransactionServiceImpl) load(orderID string) (*base.BaseOrder, error) {
+	o, err := s.orderStore.FindById(s.opayInstance.DB(), orderID, false)
+	if err != nil {
+		return nil, fmt.Errorf("error finding order %s: %w", orderID, err)
+	}
+	meta, ok := s.opayInstance.Meta(o.Type)
+	if !ok {
+		return nil, fmt.Errorf("%s order type not registered", o.Type)
+	}
+	if err := o.SetMeta(meta); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// move submits the loaded order to the status of the step.
+func (s *TransactionServiceImpl) move(o *base.BaseOrder, step opay.Step, audit base.Audit, addition map[string]interface{}) (*opay.Response, error) {
+	code, ok := statusCode(o.GetMeta(), step)
+	if !ok {
+		return nil, fmt.Errorf("%s order type has no %s status", o.Type, step)
+	}
+	if o.Status == code {
+		return nil, errAlreadyThere
+	}
+	if err := o.SetTargetAudit(code, audit); err != nil {
+		return nil, err
+	}
+	resp := s.opayInstance.Do(&opay.Request{Initiator: NewOrder(s.orderStore, o), Addition: addition})
+	if resp.Err != nil {
+		return nil, fmt.Errorf("order %s to %s failed: %w", o.Id, step, resp.Err)
+	}
+	return resp, nil
+}
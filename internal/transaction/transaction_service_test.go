@@ -0,0 +1,67 @@
+package transaction
+
+import (
+	"errors"
+	"testing"
+
+	"simplopay.com/backend/base"
+	"simplopay.com/backend/internal/user"
+	"simplopay.com/backend/pkg/opay/opaytest"
+)
+
+type fakeUserRepo map[string]*user.User
+
+func (r fakeUserRepo) CreateUser(u *user.User) error { r[u.ID] = u; return nil }
+
+func (r fakeUserRepo) FindUserByUsername(username string) (*user.User, error) {
+	for _, u := range r {
+		if u.Username == username {
+			return u, nil
+		}
+	}
+	return nil, user.ErrUserNotFound
+}
+
+func (r fakeUserRepo) FindUserByID(id string) (*user.User, error) {
+	if u, ok := r[id]; ok {
+		return u, nil
+	}
+	return nil, user.ErrUserNotFound
+}
+
+func TestInitiateP2PTransferValidation(t *testing.T) {
+	h := opaytest.NewHarness(2, "NGN")
+	users := fakeUserRepo{
+		"alice": {ID: "alice", Username: "alice"},
+		"bob":   {ID: "bob", Username: "bob"},
+	}
+	s := NewTransactionServiceImpl(h.Opay, users, nil, nil)
+
+	cases := []struct {
+		name     string
+		sender   string
+		receiver string
+		amount   float64
+		err      error
+	}{
+		{name: "missing sender", receiver: "bob", amount: 10, err: ErrInvalidTransferDetails},
+		{name: "zero amount", sender: "alice", receiver: "bob", err: ErrInvalidTransferDetails},
+		{name: "negative amount", sender: "alice", receiver: "bob", amount: -1, err: ErrInvalidTransferDetails},
+		{name: "self transfer", sender: "alice", receiver: "alice", amount: 10, err: ErrSelfTransfer},
+		{name: "unknown sender", sender: "carol", receiver: "bob", amount: 10, err: user.ErrUserNotFound},
+		{name: "unknown receiver", sender: "alice", receiver: "carol", amount: 10, err: user.ErrUserNotFound},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, _, err := s.InitiateP2PTransfer(c.sender, c.receiver, c.amount, base.Audit{})
+			if !errors.Is(err, c.err) {
+				t.Fatalf("got error %v, want %v", err, c.err)
+			}
+		})
+	}
+
+	// The order type is not registered to the engine.
+	if _, _, err := s.InitiateP2PTransfer("alice", "bob", 10, base.Audit{}); err == nil {
+		t.Fatal("expect an error for the unregistered order type")
+	}
+}
@@ -0,0 +1,245 @@
+package opay
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+type (
+	// SettlePolicy guards the SettleFunc of an asset, usually backed by an external provider.
+	SettlePolicy struct {
+		Timeout          time.Duration //limit of a call through TxContext, no limit if 0
+		FailureThreshold int           //consecutive failures to open the breaker, never opens if 0
+		OpenFor          time.Duration //time before probing the provider again
+		HalfOpenProbes   int           //concurrent probes allowed when half-open, 1 if 0
+
+		// IsFailure reports whether the error trips the breaker, all errors do if nil.
+		// Business errors such as an insufficient balance should usually not.
+		IsFailure func(error) bool
+	}
+
+	// BreakerStats is a snapshot of the breaker of an asset.
+	BreakerStats struct {
+		State    string    `json:"state"`
+		Failures int       `json:"failures"` //consecutive failures
+		OpenedAt time.Time `json:"opened_at,omitempty"`
+		Calls    int64     `json:"calls"`
+		Rejected int64     `json:"rejected"`
+		Timeouts int64     `json:"timeouts"`
+	}
+
+	// BreakerEvent reports a state change of the breaker of an asset.
+	BreakerEvent struct {
+		Aid  string    `json:"aid"`
+		From string    `json:"from"`
+		To   string    `json:"to"`
+		At   time.Time `json:"at"`
+		Err  string    `json:"error,omitempty"` //the failure opening the breaker
+	}
+
+	breaker struct {
+		aid     string
+		policy  SettlePolicy
+		opay    *Opay
+		stats   BreakerStats
+		probing int
+		mu      sync.Mutex
+	}
+)
+
+// States of the breaker
+const (
+	BREAKER_CLOSED    = "closed"
+	BREAKER_OPEN      = "open"
+	BREAKER_HALF_OPEN = "half_open"
+)
+
+var (
+	ErrSettleTimeout = errors.New("opay: settlement timed out")
+	ErrBreakerOpen   = errors.New("opay: settlement provider is unavailable")
+)
+
+// SetSettlePolicy guards the SettleFunc of the asset with a timeout and a circuit breaker.
+// A rejected or timed out settlement fails the request, which is kept as a dead letter for a later replay.
+func (opay *Opay) SetSettlePolicy(aid string, policy SettlePolicy) {
+	if policy.HalfOpenProbes <= 0 {
+		policy.HalfOpenProbes = 1
+	}
+	opay.breakersLock.Lock()
+	defer opay.breakersLock.Unlock()
+	opay.breakers[aid] = &breaker{
+		aid:    aid,
+		policy: policy,
+		opay:   opay,
+		stats:  BreakerStats{State: BREAKER_CLOSED},
+	}
+}
+
+// OnBreakerEvent adds a listener of the breaker state changes.
+// The listeners are called synchronously, and should return quickly.
+func (opay *Opay) OnBreakerEvent(fn func(BreakerEvent)) {
+	opay.breakersLock.Lock()
+	opay.breakerListeners = append(opay.breakerListeners, fn)
+	opay.breakersLock.Unlock()
+}
+
+// Gets the SettleFunc of the asset, guarded if it has a policy.
+func (opay *Opay) guardedSettleFunc(aid string) (SettleFunc, error) {
+	fn, err := opay.GetSettleFunc(aid)
+	if err != nil {
+		return nil, err
+	}
+	opay.breakersLock.RLock()
+	b, ok := opay.breakers[aid]
+	opay.breakersLock.RUnlock()
+	if !ok {
+		return fn, nil
+	}
+	return b.guard(fn), nil
+}
+
+func (opay *Opay) breakerStats() map[string]BreakerStats {
+	opay.breakersLock.RLock()
+	defer opay.breakersLock.RUnlock()
+	if len(opay.breakers) == 0 {
+		return nil
+	}
+	stats := make(map[string]BreakerStats, len(opay.breakers))
+	for aid, b := range opay.breakers {
+		stats[aid] = b.snapshot()
+	}
+	return stats
+}
+
+func (opay *Opay) emitBreakerEvent(event BreakerEvent) {
+	opay.breakersLock.RLock()
+	listeners := opay.breakerListeners
+	opay.breakersLock.RUnlock()
+	for _, fn := range listeners {
+		fn(event)
+	}
+}
+
+func (b *breaker) guard(fn SettleFunc) SettleFunc {
+	return func(uid string, amount float64, tx Tx) error {
+		probe, err := b.allow()
+		if err != nil {
+			return err
+		}
+		err = b.call(fn, uid, amount, tx)
+		b.record(err, probe)
+		return err
+	}
+}
+
+// Run the call with the timeout, in the request goroutine.
+// The context of the transaction is canceled when the timeout expires, so that the call
+// returns before the transaction is rolled back. The call is failed with ErrSettleTimeout then.
+func (b *breaker) call(fn SettleFunc, uid string, amount float64, tx Tx) error {
+	if b.policy.Timeout <= 0 {
+		return fn(uid, amount, tx)
+	}
+	ctx, cancel := context.WithTimeout(TxContext(tx), b.policy.Timeout)
+	defer cancel()
+	err := fn(uid, amount, &ctxTx{Tx: tx, ctx: ctx})
+	if ctx.Err() == context.DeadlineExceeded {
+		b.mu.Lock()
+		b.stats.Timeouts++
+		b.mu.Unlock()
+		return ErrSettleTimeout
+	}
+	return err
+}
+
+// Checks whether a call is allowed, moving an expired open breaker to half-open.
+// The call allowed when half-open is a probe.
+func (b *breaker) allow() (probe bool, err error) {
+	b.mu.Lock()
+	var event *BreakerEvent
+	defer func() {
+		b.mu.Unlock()
+		if event != nil {
+			b.opay.emitBreakerEvent(*event)
+		}
+	}()
+	b.stats.Calls++
+	switch b.stats.State {
+	case BREAKER_OPEN:
+		if b.opay.clock.Now().Sub(b.stats.OpenedAt) < b.policy.OpenFor {
+			b.stats.Rejected++
+			return false, ErrBreakerOpen
+		}
+		event = b.transit(BREAKER_HALF_OPEN, nil)
+		fallthrough
+	case BREAKER_HALF_OPEN:
+		if b.probing >= b.policy.HalfOpenProbes {
+			b.stats.Rejected++
+			return false, ErrBreakerOpen
+		}
+		b.probing++
+		return true, nil
+	}
+	return false, nil
+}
+
+// Records the outcome of an allowed call.
+func (b *breaker) record(err error, probe bool) {
+	failed := err != nil && (b.policy.IsFailure == nil || errors.Is(err, ErrSettleTimeout) || b.policy.IsFailure(err))
+	b.mu.Lock()
+	var event *BreakerEvent
+	defer func() {
+		b.mu.Unlock()
+		if event != nil {
+			b.opay.emitBreakerEvent(*event)
+		}
+	}()
+	if probe {
+		b.probing--
+	}
+	if b.stats.State == BREAKER_HALF_OPEN {
+		if failed {
+			event = b.transit(BREAKER_OPEN, err)
+		} else {
+			event = b.transit(BREAKER_CLOSED, nil)
+		}
+		return
+	}
+	if !failed {
+		b.stats.Failures = 0
+		return
+	}
+	b.stats.Failures++
+	if b.stats.State == BREAKER_CLOSED && b.policy.FailureThreshold > 0 && b.stats.Failures >= b.policy.FailureThreshold {
+		event = b.transit(BREAKER_OPEN, err)
+	}
+}
+
+// Changes the state, the lock must be held.
+func (b *breaker) transit(state string, err error) *BreakerEvent {
+	event := &BreakerEvent{
+		Aid:  b.aid,
+		From: b.stats.State,
+		To:   state,
+		At:   b.opay.clock.Now(),
+	}
+	if err != nil {
+		event.Err = err.Error()
+	}
+	b.stats.State = state
+	switch state {
+	case BREAKER_OPEN:
+		b.stats.OpenedAt = event.At
+	case BREAKER_CLOSED:
+		b.stats.Failures = 0
+		b.stats.OpenedAt = time.Time{}
+	}
+	return event
+}
+
+func (b *breaker) snapshot() BreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stats
+}
@@ -0,0 +1,510 @@
+package opay
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"hash/fnv"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type (
+	// Locker is a session scoped exclusive lock service.
+	// All locks held by a session are released when the session ends,
+	// which is what makes the failover of a dead replica automatic.
+	Locker interface {
+		// Try to acquire the lock without waiting.
+		TryLock(key int64) (bool, error)
+
+		// Release a lock held by this session.
+		Unlock(key int64) error
+
+		// Count how many of the keys are held by any session.
+		Held(keys []int64) (int, error)
+
+		// End the session and release all of its locks.
+		Close() error
+	}
+
+	// Cluster coordinates the replicas that run Opay.Serve on the same database.
+	// It elects a leader for singleton background jobs and partitions
+	// the account shards across the live replicas.
+	Cluster struct {
+		locker    Locker
+		space     int64
+		numShards int
+		interval  time.Duration
+
+		slot   int
+		leader bool
+		owned  map[int]bool
+		jobs   []*clusterJob
+
+		stop chan struct{}
+		wg   sync.WaitGroup
+		mu   sync.RWMutex
+	}
+
+	clusterJob struct {
+		name     string
+		interval time.Duration
+		fn       func()
+		sharded  bool //runs on every member instead of the leader only
+	}
+)
+
+const (
+	// DEFAULT_NUM_OF_SHARDS is the default number of account shards.
+	DEFAULT_NUM_OF_SHARDS = 64
+	// MAX_CLUSTER_MEMBERS is the maximum number of replicas in a cluster.
+	MAX_CLUSTER_MEMBERS = 256
+
+	leaderLockId      = 0
+	memberLockIdBase  = 1 << 16
+	shardLockIdBase   = 2 << 16
+	defaultSyncPeriod = 5 * time.Second
+)
+
+var ErrClusterFull = errors.New("opay: no free cluster member slot")
+
+// NewCluster creates a cluster member.
+// @name  cluster name, replicas sharing it compete for the same locks
+// @numOfShards  number of account shards, DEFAULT_NUM_OF_SHARDS if not positive
+// @interval  how often to renew the locks and rebalance the shards
+func NewCluster(locker Locker, name string, numOfShards int, interval time.Duration) *Cluster {
+	if numOfShards <= 0 {
+		numOfShards = DEFAULT_NUM_OF_SHARDS
+	}
+	if interval <= 0 {
+		interval = defaultSyncPeriod
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return &Cluster{
+		locker:    locker,
+		space:     int64(h.Sum32()) << 32,
+		numShards: numOfShards,
+		interval:  interval,
+		slot:      -1,
+		owned:     make(map[int]bool),
+		stop:      make(chan struct{}),
+	}
+}
+
+// IsLeader reports whether this replica holds the leader lease.
+func (c *Cluster) IsLeader() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.leader
+}
+
+// NumOfShards returns the number of account shards.
+func (c *Cluster) NumOfShards() int {
+	return c.numShards
+}
+
+// ShardOf returns the shard of the account key, such as a user id.
+func (c *Cluster) ShardOf(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(c.numShards))
+}
+
+// OwnsShard reports whether this replica owns the shard.
+func (c *Cluster) OwnsShard(shard int) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.owned[shard]
+}
+
+// Owns reports whether this replica owns the shard of the account key.
+// The sharded jobs only handle the accounts owned by their replica.
+func (c *Cluster) Owns(key string) bool {
+	return c.OwnsShard(c.ShardOf(key))
+}
+
+// Shards returns the sorted shards owned by this replica.
+func (c *Cluster) Shards() []int {
+	c.mu.RLock()
+	shards := make([]int, 0, len(c.owned))
+	for shard := range c.owned {
+		shards = append(shards, shard)
+	}
+	c.mu.RUnlock()
+	sort.Ints(shards)
+	return shards
+}
+
+// RegJob registers a singleton background job, which only runs on the leader.
+// Must be called before Start.
+func (c *Cluster) RegJob(name string, interval time.Duration, fn func()) {
+	c.jobs = append(c.jobs, &clusterJob{
+		name:     name,
+		interval: interval,
+		fn:       fn,
+	})
+}
+
+// RegShardedJob registers a background job, which runs on every replica
+// and only handles the accounts owned by it, see Owns.
+// Must be called before Start.
+func (c *Cluster) RegShardedJob(name string, interval time.Duration, fn func()) {
+	c.jobs = append(c.jobs, &clusterJob{
+		name:     name,
+		interval: interval,
+		fn:       fn,
+		sharded:  true,
+	})
+}
+
+// Start joins the cluster and keeps the leases in the background.
+func (c *Cluster) Start() {
+	if err := c.Sync(); err != nil {
+		log.Printf("opay: cluster sync: %v", err)
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				if err := c.Sync(); err != nil {
+					log.Printf("opay: cluster sync: %v", err)
+				}
+			}
+		}
+	}()
+	for _, job := range c.jobs {
+		c.wg.Add(1)
+		go c.runJob(job)
+	}
+}
+
+// Stop leaves the cluster and releases all the leases,
+// so that the other replicas take over at their next sync.
+func (c *Cluster) Stop() error {
+	close(c.stop)
+	c.wg.Wait()
+	c.mu.Lock()
+	c.leader = false
+	c.owned = make(map[int]bool)
+	c.slot = -1
+	c.mu.Unlock()
+	return c.locker.Close()
+}
+
+func (c *Cluster) runJob(job *clusterJob) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(job.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			if job.sharded {
+				if !c.isMember() {
+					continue
+				}
+			} else if !c.IsLeader() {
+				continue
+			}
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						log.Printf("opay: cluster job %s panic: %v", job.name, r)
+					}
+				}()
+				job.fn()
+			}()
+		}
+	}
+}
+
+func (c *Cluster) isMember() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.slot >= 0
+}
+
+// Sync renews the member slot and the leader lease, then rebalances the shards.
+// It is called periodically after Start, and may be called directly in tests.
+func (c *Cluster) Sync() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.syncSlot(); err != nil {
+		c.reset()
+		return err
+	}
+
+	if !c.leader {
+		ok, err := c.locker.TryLock(c.key(leaderLockId))
+		if err != nil {
+			c.reset()
+			return err
+		}
+		c.leader = ok
+	}
+
+	members, err := c.locker.Held(c.memberKeys())
+	if err != nil {
+		c.reset()
+		return err
+	}
+	if members == 0 {
+		members = 1
+	}
+	share := (c.numShards + members - 1) / members
+
+	// Release the extra shards first, so the newcomers can pick them up.
+	if len(c.owned) > share {
+		owned := make([]int, 0, len(c.owned))
+		for shard := range c.owned {
+			owned = append(owned, shard)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(owned)))
+		for _, shard := range owned[:len(owned)-share] {
+			if err := c.locker.Unlock(c.key(shardLockIdBase + shard)); err != nil {
+				c.reset()
+				return err
+			}
+			delete(c.owned, shard)
+		}
+	}
+
+	for shard := 0; shard < c.numShards && len(c.owned) < share; shard++ {
+		if c.owned[shard] {
+			continue
+		}
+		ok, err := c.locker.TryLock(c.key(shardLockIdBase + shard))
+		if err != nil {
+			c.reset()
+			return err
+		}
+		if ok {
+			c.owned[shard] = true
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) syncSlot() error {
+	if c.slot >= 0 {
+		return nil
+	}
+	for slot := 0; slot < MAX_CLUSTER_MEMBERS; slot++ {
+		ok, err := c.locker.TryLock(c.key(memberLockIdBase + slot))
+		if err != nil {
+			return err
+		}
+		if ok {
+			c.slot = slot
+			return nil
+		}
+	}
+	return ErrClusterFull
+}
+
+// When the locker fails, the session may have been lost together with all of its locks.
+func (c *Cluster) reset() {
+	c.leader = false
+	c.owned = make(map[int]bool)
+	c.slot = -1
+}
+
+func (c *Cluster) key(id int) int64 {
+	return c.space | int64(id)
+}
+
+func (c *Cluster) memberKeys() []int64 {
+	keys := make([]int64, MAX_CLUSTER_MEMBERS)
+	for i := range keys {
+		keys[i] = c.key(memberLockIdBase + i)
+	}
+	return keys
+}
+
+// PgLocker implements Locker with Postgres session level advisory locks.
+type PgLocker struct {
+	db   *sqlx.DB
+	conn *sql.Conn
+	mu   sync.Mutex
+}
+
+var _ Locker = (*PgLocker)(nil)
+
+// NewPgLocker opens a locker session on a dedicated connection of db.
+func NewPgLocker(db *sqlx.DB) *PgLocker {
+	return &PgLocker{db: db}
+}
+
+func (l *PgLocker) session() (*sql.Conn, error) {
+	if l.conn != nil {
+		if err := l.conn.PingContext(context.Background()); err == nil {
+			return l.conn, nil
+		}
+		// The session is gone, and so are its locks.
+		l.conn.Close()
+		l.conn = nil
+		return nil, errors.New("opay: advisory lock session lost")
+	}
+	conn, err := l.db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	l.conn = conn
+	return conn, nil
+}
+
+// TryLock implements Locker.
+func (l *PgLocker) TryLock(key int64) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	conn, err := l.session()
+	if err != nil {
+		return false, err
+	}
+	var ok bool
+	err = conn.QueryRowContext(context.Background(), `SELECT pg_try_advisory_lock($1)`, key).Scan(&ok)
+	return ok, err
+}
+
+// Unlock implements Locker.
+func (l *PgLocker) Unlock(key int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	conn, err := l.session()
+	if err != nil {
+		return err
+	}
+	var ok bool
+	return conn.QueryRowContext(context.Background(), `SELECT pg_advisory_unlock($1)`, key).Scan(&ok)
+}
+
+// Held implements Locker.
+func (l *PgLocker) Held(keys []int64) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	conn, err := l.session()
+	if err != nil {
+		return 0, err
+	}
+	query, args, err := sqlx.In(`SELECT count(*) FROM pg_locks
+		WHERE locktype = 'advisory' AND granted AND objsubid = 1
+		AND ((classid::bigint << 32) | objid::bigint) IN (?)`, keys)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	err = conn.QueryRowContext(context.Background(), l.db.Rebind(query), args...).Scan(&n)
+	return n, err
+}
+
+// Close implements Locker.
+func (l *PgLocker) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return nil
+	}
+	err := l.conn.Close()
+	l.conn = nil
+	return err
+}
+
+// MemLockServer is an in-process lock service standing in for Postgres,
+// so that several engines can be coordinated in one process.
+type MemLockServer struct {
+	holders map[int64]*MemLocker
+	mu      sync.Mutex
+}
+
+// MemLocker is a session of MemLockServer.
+type MemLocker struct {
+	server *MemLockServer
+	closed bool
+}
+
+var _ Locker = (*MemLocker)(nil)
+
+func NewMemLockServer() *MemLockServer {
+	return &MemLockServer{holders: make(map[int64]*MemLocker)}
+}
+
+// Session opens a new locker session.
+func (s *MemLockServer) Session() *MemLocker {
+	return &MemLocker{server: s}
+}
+
+var errLockerClosed = errors.New("opay: locker session closed")
+
+// TryLock implements Locker.
+func (l *MemLocker) TryLock(key int64) (bool, error) {
+	s := l.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l.closed {
+		return false, errLockerClosed
+	}
+	holder, ok := s.holders[key]
+	if ok {
+		return holder == l, nil
+	}
+	s.holders[key] = l
+	return true, nil
+}
+
+// Unlock implements Locker.
+func (l *MemLocker) Unlock(key int64) error {
+	s := l.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l.closed {
+		return errLockerClosed
+	}
+	if s.holders[key] == l {
+		delete(s.holders, key)
+	}
+	return nil
+}
+
+// Held implements Locker.
+func (l *MemLocker) Held(keys []int64) (int, error) {
+	s := l.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l.closed {
+		return 0, errLockerClosed
+	}
+	var n int
+	for _, key := range keys {
+		if _, ok := s.holders[key]; ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Close implements Locker, it behaves like the death of a replica.
+func (l *MemLocker) Close() error {
+	s := l.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l.closed = true
+	for key, holder := range s.holders {
+		if holder == l {
+			delete(s.holders, key)
+		}
+	}
+	return nil
+}
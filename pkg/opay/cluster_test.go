@@ -0,0 +1,76 @@
+package opay
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestClusterFailover(t *testing.T) {
+	server := NewMemLockServer()
+	var engines []*Opay
+	for i := 0; i < 3; i++ {
+		engine := NewOpayWithTxManager(NewMemStore(), 10, 2)
+		engine.SetCluster(NewCluster(server.Session(), "test", 8, 0))
+		engines = append(engines, engine)
+	}
+	sync := func() {
+		// Twice: the first round releases the extra shards, the second picks them up.
+		for round := 0; round < 2; round++ {
+			for _, engine := range engines {
+				if err := engine.Cluster().Sync(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	check := func() {
+		var leaders int
+		owners := make(map[int]int)
+		for _, engine := range engines {
+			if engine.IsLeader() {
+				leaders++
+			}
+			for _, shard := range engine.Cluster().Shards() {
+				owners[shard]++
+			}
+		}
+		if leaders != 1 {
+			t.Fatalf("expect 1 leader, got %d", leaders)
+		}
+		for shard := 0; shard < 8; shard++ {
+			if owners[shard] != 1 {
+				t.Fatalf("shard %d has %d owners", shard, owners[shard])
+			}
+		}
+		// The sharded jobs of the replicas handle every account once.
+		for i := 0; i < 32; i++ {
+			key := fmt.Sprintf("user-%d", i)
+			var n int
+			for _, engine := range engines {
+				if engine.Cluster().Owns(key) {
+					n++
+				}
+			}
+			if n != 1 {
+				t.Fatalf("account %s has %d owners", key, n)
+			}
+		}
+	}
+
+	sync()
+	check()
+	if !engines[0].IsLeader() {
+		t.Fatal("the first replica should be elected")
+	}
+
+	// The leader dies.
+	engines[0].Cluster().locker.Close()
+	engines = engines[1:]
+	sync()
+	check()
+	for _, engine := range engines {
+		if n := len(engine.Cluster().Shards()); n != 4 {
+			t.Fatalf("expect 4 shards per replica, got %d", n)
+		}
+	}
+}
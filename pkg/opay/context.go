@@ -1,6 +1,7 @@
 package opay
 
 import (
+	"errors"
 	"time"
 )
 
@@ -8,6 +9,8 @@ import (
 type Context struct {
 	initiatorSettle   SettleFunc
 	stakeholderSettle SettleFunc
+	settleFuncMap     *SettleFuncMap
+	settleOf          func(aid string) (SettleFunc, error)
 	*Request
 	*Response
 	*Floater
@@ -84,6 +87,25 @@ func (ctx *Context) SyncDeal() error {
 	return ctx.Request.Initiator.SyncDeal(ctx.Request.Tx, ctx)
 }
 
+// Reverse saves the compensating orders of a reversal.
+func (ctx *Context) Reverse() error {
+	if ctx.Request.Stakeholder != nil {
+		reversal, ok := ctx.Request.Stakeholder.(Reversal)
+		if !ok {
+			return ErrNotReversible
+		}
+		err := reversal.Reverse(ctx.Request.Tx, ctx)
+		if err != nil {
+			return err
+		}
+	}
+	reversal, ok := ctx.Request.Initiator.(Reversal)
+	if !ok {
+		return ErrNotReversible
+	}
+	return reversal.Reverse(ctx.Request.Tx, ctx)
+}
+
 func (ctx *Context) HasStakeholder() bool {
 	return ctx.Request.Stakeholder != nil
 }
@@ -91,40 +113,79 @@ func (ctx *Context) HasStakeholder() bool {
 // Modify the account balance.
 func (ctx *Context) UpdateBalance() error {
 	if ctx.Request.Stakeholder != nil {
-		err := ctx.stakeholderSettle(
-			ctx.Request.Stakeholder.GetUid(),
-			ctx.Request.Stakeholder.GetAmount(),
-			ctx.Request.Tx,
-		)
+		err := ctx.settle(ctx.stakeholderSettle, ctx.Request.Stakeholder, ctx.Request.Stakeholder.GetAmount())
 		if err != nil {
 			return err
 		}
 	}
-	return ctx.initiatorSettle(
-		ctx.Request.Initiator.GetUid(),
-		ctx.Request.Initiator.GetAmount(),
-		ctx.Request.Tx,
-	)
+	return ctx.settle(ctx.initiatorSettle, ctx.Request.Initiator, ctx.Request.Initiator.GetAmount())
 }
 
 // Roll back the account balance.
 func (ctx *Context) RollbackBalance() error {
 	if ctx.Request.Stakeholder != nil {
-		err := ctx.stakeholderSettle(
-			ctx.Request.Stakeholder.GetUid(),
-			-ctx.Request.Stakeholder.GetAmount(),
-			ctx.Request.Tx,
-		)
+		err := ctx.settle(ctx.stakeholderSettle, ctx.Request.Stakeholder, -ctx.Request.Stakeholder.GetAmount())
 		if err != nil {
 			return err
 		}
 	}
+	return ctx.settle(ctx.initiatorSettle, ctx.Request.Initiator, -ctx.Request.Initiator.GetAmount())
+}
 
-	return ctx.initiatorSettle(
-		ctx.Request.Initiator.GetUid(),
-		-ctx.Request.Initiator.GetAmount(),
-		ctx.Request.Tx,
-	)
+// Settle modifies the balance of an account other than the orders',
+// such as the revenue account of a fee, in the same transaction.
+func (ctx *Context) Settle(uid, aid string, amount float64) error {
+	if ctx.settleOf == nil {
+		return errors.New("opay: settle is not available in this context.")
+	}
+	fn, err := ctx.settleOf(aid)
+	if err != nil {
+		return err
+	}
+	err = fn(uid, amount, ctx.Request.Tx)
+	if err != nil {
+		return err
+	}
+	return ctx.snapshot(uid, aid)
+}
+
+// Balance reads the balance of an account in the transaction by the registered BalanceFunc,
+// which locks the account until the transaction ends.
+func (ctx *Context) Balance(uid, aid string) (float64, error) {
+	if ctx.settleFuncMap == nil {
+		return 0, errors.New("opay: balance is not available in this context.")
+	}
+	fn, ok := ctx.settleFuncMap.GetBalanceFunc(aid)
+	if !ok {
+		return 0, errors.New("opay: not found BalanceFunc '" + aid + "'.")
+	}
+	return fn(uid, ctx.Request.Tx)
+}
+
+// Settle the order's account, and snapshot the balance if it can be queried.
+func (ctx *Context) settle(fn SettleFunc, order IOrder, amount float64) error {
+	err := fn(order.GetUid(), amount, ctx.Request.Tx)
+	if err != nil {
+		return err
+	}
+	return ctx.snapshot(order.GetUid(), order.GetAid())
+}
+
+// Snapshot the account balance into the response.
+func (ctx *Context) snapshot(uid, aid string) error {
+	if ctx.settleFuncMap == nil {
+		return nil
+	}
+	balanceFunc, ok := ctx.settleFuncMap.GetBalanceFunc(aid)
+	if !ok {
+		return nil
+	}
+	balance, err := balanceFunc(uid, ctx.Request.Tx)
+	if err != nil {
+		return err
+	}
+	ctx.Response.setBalance(uid, aid, balance)
+	return nil
 }
 
 // KV key-value
@@ -0,0 +1,633 @@
+package opay
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type (
+	// DeadLetter is a request that failed in Serve, kept for inspection and replay.
+	DeadLetter struct {
+		Id          int64           `json:"id"`
+		OrderType   string          `json:"order_type"`
+		Initiator   json.RawMessage `json:"initiator"`
+		Stakeholder json.RawMessage `json:"stakeholder,omitempty"`
+		Addition    json.RawMessage `json:"addition,omitempty"`
+		Err         string          `json:"error"` //the latest error
+		Status      string          `json:"status"`
+		Attempts    []Attempt       `json:"attempts"`
+		Notes       []AuditNote     `json:"notes"`
+		CreatedAt   time.Time       `json:"created_at"`
+		UpdatedAt   time.Time       `json:"updated_at"`
+	}
+
+	// Attempt is a processing of the request, the first one is the original.
+	Attempt struct {
+		At       time.Time `json:"at"`
+		Retries  int       `json:"retries"`
+		Err      string    `json:"error,omitempty"` //empty if succeeded
+		Operator string    `json:"operator,omitempty"`
+	}
+
+	// AuditNote records who changed the dead letter and why.
+	AuditNote struct {
+		At       time.Time `json:"at"`
+		Operator string    `json:"operator"`
+		Action   string    `json:"action"`
+		Note     string    `json:"note"`
+	}
+
+	// DeadLetterEdit replaces the serialized orders or addition of a pending dead letter,
+	// the fields left nil are kept.
+	DeadLetterEdit struct {
+		Initiator   json.RawMessage `json:"initiator,omitempty"`
+		Stakeholder json.RawMessage `json:"stakeholder,omitempty"`
+		Addition    json.RawMessage `json:"addition,omitempty"`
+		Operator    string          `json:"operator"`
+		Note        string          `json:"note"`
+	}
+
+	// DeadLetterStore persists the dead letters.
+	DeadLetterStore interface {
+		// Insert saves a new dead letter and sets its Id.
+		Insert(dl *DeadLetter) error
+
+		Get(id int64) (*DeadLetter, error)
+
+		// List returns the latest dead letters of the status, all statuses if empty.
+		List(status string, limit int) ([]*DeadLetter, error)
+
+		// Update saves the dead letter only if it is still in the status,
+		// otherwise returns ErrDeadLetterConflict.
+		Update(dl *DeadLetter, status string) error
+	}
+
+	// OrderCodec serializes the orders of a type, so that they can be replayed.
+	OrderCodec interface {
+		EncodeOrder(order IOrder) ([]byte, error)
+		DecodeInitiator(meta *Meta, data []byte) (IOrder, error)
+		DecodeStakeholder(meta *Meta, data []byte) (IOrder, error)
+	}
+
+	// JSONOrderCodec is an OrderCodec with encoding/json,
+	// the factories return the pointers to be unmarshaled into, with the meta attached.
+	JSONOrderCodec struct {
+		NewInitiator   func(meta *Meta) IOrder
+		NewStakeholder func(meta *Meta) IOrder
+	}
+)
+
+// Statuses of DeadLetter
+const (
+	DEAD_LETTER_PENDING   = "pending"
+	DEAD_LETTER_REPLAYING = "replaying"
+	DEAD_LETTER_REPLAYED  = "replayed"
+	DEAD_LETTER_DISCARDED = "discarded"
+)
+
+// Actions of AuditNote
+const (
+	AUDIT_EDIT    = "edit"
+	AUDIT_REPLAY  = "replay"
+	AUDIT_DISCARD = "discard"
+	AUDIT_RECOVER = "recover"
+)
+
+var (
+	ErrNoDeadLetterStore  = errors.New("opay: no dead letter store")
+	ErrDeadLetterNotFound = errors.New("opay: dead letter not found")
+	ErrDeadLetterConflict = errors.New("opay: dead letter has been changed by others")
+	ErrNotPending         = errors.New("opay: dead letter is not pending")
+	ErrNoOrderCodec       = errors.New("opay: no order codec of the order type")
+	ErrAuditNoteRequired  = errors.New("opay: operator and note are required")
+)
+
+var orderCodecs = struct {
+	m  map[string]OrderCodec
+	mu sync.RWMutex
+}{m: make(map[string]OrderCodec)}
+
+// RegOrderCodec registers the codec of an order type.
+func RegOrderCodec(orderType string, codec OrderCodec) error {
+	orderCodecs.mu.Lock()
+	defer orderCodecs.mu.Unlock()
+	if _, ok := orderCodecs.m[orderType]; ok {
+		return errors.New("opay: order codec of '" + orderType + "' has been registered.")
+	}
+	orderCodecs.m[orderType] = codec
+	return nil
+}
+
+func getOrderCodec(orderType string) (OrderCodec, bool) {
+	orderCodecs.mu.RLock()
+	defer orderCodecs.mu.RUnlock()
+	codec, ok := orderCodecs.m[orderType]
+	return codec, ok
+}
+
+// EncodeOrder implements OrderCodec.
+func (c JSONOrderCodec) EncodeOrder(order IOrder) ([]byte, error) {
+	return json.Marshal(order)
+}
+
+// DecodeInitiator implements OrderCodec.
+func (c JSONOrderCodec) DecodeInitiator(meta *Meta, data []byte) (IOrder, error) {
+	return decodeJSONOrder(c.NewInitiator, meta, data)
+}
+
+// DecodeStakeholder implements OrderCodec.
+func (c JSONOrderCodec) DecodeStakeholder(meta *Meta, data []byte) (IOrder, error) {
+	return decodeJSONOrder(c.NewStakeholder, meta, data)
+}
+
+func decodeJSONOrder(factory func(*Meta) IOrder, meta *Meta, data []byte) (IOrder, error) {
+	if factory == nil {
+		return nil, ErrNoOrderCodec
+	}
+	order := factory(meta)
+	if err := json.Unmarshal(data, order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// SetDeadLetters sets the store of the failed requests, nil disables it.
+func (opay *Opay) SetDeadLetters(store DeadLetterStore) {
+	opay.deadLetters = store
+}
+
+// DeadLetters returns the store of the failed requests, or nil.
+func (opay *Opay) DeadLetters() DeadLetterStore {
+	return opay.deadLetters
+}
+
+// Persist the failed request, the replays are recorded by Replay instead.
+func (opay *Opay) bury(req *Request, err error) {
+	if opay.deadLetters == nil || err == nil || req.replay {
+		return
+	}
+	now := opay.clock.Now()
+	dl := &DeadLetter{
+		OrderType: req.Initiator.GetMeta().OrderType(),
+		Err:       err.Error(),
+		Status:    DEAD_LETTER_PENDING,
+		Attempts:  []Attempt{{At: now, Retries: req.retries, Err: err.Error()}},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	codec, _ := getOrderCodec(dl.OrderType)
+	dl.Initiator = encodeOrder(codec, req.Initiator)
+	if req.Stakeholder != nil {
+		dl.Stakeholder = encodeOrder(codec, req.Stakeholder)
+	}
+	if len(req.Addition) > 0 {
+		if addition, e := json.Marshal(req.Addition); e == nil {
+			dl.Addition = addition
+		}
+	}
+	if e := opay.deadLetters.Insert(dl); e != nil {
+		log.Printf("opay: bury the failed %s request: %v", dl.OrderType, e)
+	}
+}
+
+// Without the codec, the order is still marshaled as is for inspection.
+func encodeOrder(codec OrderCodec, order IOrder) json.RawMessage {
+	var data []byte
+	var err error
+	if codec != nil {
+		data, err = codec.EncodeOrder(order)
+	} else {
+		data, err = json.Marshal(order)
+	}
+	if err != nil {
+		data, _ = json.Marshal(map[string]string{"unserializable": fmt.Sprintf("%+v", order)})
+	}
+	return data
+}
+
+// Decode the request of the dead letter.
+func (opay *Opay) unbury(dl *DeadLetter) (*Request, error) {
+	meta, ok := opay.Meta(dl.OrderType)
+	if !ok {
+		return nil, fmt.Errorf("opay: order type %s is not registered", dl.OrderType)
+	}
+	codec, ok := getOrderCodec(dl.OrderType)
+	if !ok {
+		return nil, ErrNoOrderCodec
+	}
+	req := &Request{retries: len(dl.Attempts)}
+	var err error
+	if req.Initiator, err = codec.DecodeInitiator(meta, dl.Initiator); err != nil {
+		return nil, err
+	}
+	if len(dl.Stakeholder) > 0 && string(dl.Stakeholder) != "null" {
+		if req.Stakeholder, err = codec.DecodeStakeholder(meta, dl.Stakeholder); err != nil {
+			return nil, err
+		}
+	}
+	if len(dl.Addition) > 0 {
+		if err = json.Unmarshal(dl.Addition, &req.Addition); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// Replay resubmits a pending dead letter through Do.
+// The dead letter is marked replayed on success, otherwise it stays pending with the new attempt.
+func (opay *Opay) Replay(id int64, operator, note string) (*Response, error) {
+	if opay.deadLetters == nil {
+		return nil, ErrNoDeadLetterStore
+	}
+	if len(operator) == 0 || len(note) == 0 {
+		return nil, ErrAuditNoteRequired
+	}
+	dl, err := opay.deadLetters.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if dl.Status != DEAD_LETTER_PENDING {
+		return nil, ErrNotPending
+	}
+	req, err := opay.unbury(dl)
+	if err != nil {
+		return nil, err
+	}
+	req.replay = true
+
+	// Claim the dead letter, so that it is replayed only once at a time.
+	now := opay.clock.Now()
+	dl.Status = DEAD_LETTER_REPLAYING
+	dl.Notes = append(dl.Notes, AuditNote{At: now, Operator: operator, Action: AUDIT_REPLAY, Note: note})
+	dl.UpdatedAt = now
+	if err = opay.deadLetters.Update(dl, DEAD_LETTER_PENDING); err != nil {
+		return nil, err
+	}
+
+	resp := opay.Do(req)
+
+	attempt := Attempt{At: opay.clock.Now(), Retries: req.retries, Operator: operator}
+	dl.Status = DEAD_LETTER_REPLAYED
+	if resp.Err != nil {
+		attempt.Err = resp.Err.Error()
+		dl.Err = attempt.Err
+		dl.Status = DEAD_LETTER_PENDING
+	}
+	dl.Attempts = append(dl.Attempts, attempt)
+	dl.UpdatedAt = attempt.At
+	return resp, opay.deadLetters.Update(dl, DEAD_LETTER_REPLAYING)
+}
+
+// RecoverReplays moves the dead letters replaying for longer than the timeout back to pending,
+// such as those whose replaying process crashed, and returns their number.
+// The timeout must exceed the longest request. If the replay did commit, the orders refuse
+// the next replay by their stored status, so it fails without effect.
+func (opay *Opay) RecoverReplays(timeout time.Duration) (int, error) {
+	if opay.deadLetters == nil {
+		return 0, ErrNoDeadLetterStore
+	}
+	list, err := opay.deadLetters.List(DEAD_LETTER_REPLAYING, 0)
+	if err != nil {
+		return 0, err
+	}
+	now := opay.clock.Now()
+	var n int
+	for _, dl := range list {
+		if now.Sub(dl.UpdatedAt) < timeout {
+			continue
+		}
+		dl.Status = DEAD_LETTER_PENDING
+		dl.Notes = append(dl.Notes, AuditNote{
+			At:       now,
+			Operator: "opay",
+			Action:   AUDIT_RECOVER,
+			Note:     fmt.Sprintf("replay unfinished after %s", timeout),
+		})
+		dl.UpdatedAt = now
+		err = opay.deadLetters.Update(dl, DEAD_LETTER_REPLAYING)
+		if errors.Is(err, ErrDeadLetterConflict) {
+			// Finished meanwhile.
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// EditDeadLetter corrects a pending dead letter before it is replayed.
+// The edited orders must still be decodable.
+func (opay *Opay) EditDeadLetter(id int64, edit DeadLetterEdit) (*DeadLetter, error) {
+	if opay.deadLetters == nil {
+		return nil, ErrNoDeadLetterStore
+	}
+	if len(edit.Operator) == 0 || len(edit.Note) == 0 {
+		return nil, ErrAuditNoteRequired
+	}
+	dl, err := opay.deadLetters.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if dl.Status != DEAD_LETTER_PENDING {
+		return nil, ErrNotPending
+	}
+	if edit.Initiator != nil {
+		dl.Initiator = edit.Initiator
+	}
+	if edit.Stakeholder != nil {
+		dl.Stakeholder = edit.Stakeholder
+	}
+	if edit.Addition != nil {
+		dl.Addition = edit.Addition
+	}
+	if _, err = opay.unbury(dl); err != nil {
+		return nil, err
+	}
+	now := opay.clock.Now()
+	dl.Notes = append(dl.Notes, AuditNote{At: now, Operator: edit.Operator, Action: AUDIT_EDIT, Note: edit.Note})
+	dl.UpdatedAt = now
+	return dl, opay.deadLetters.Update(dl, DEAD_LETTER_PENDING)
+}
+
+// DiscardDeadLetter gives up a pending dead letter.
+func (opay *Opay) DiscardDeadLetter(id int64, operator, note string) (*DeadLetter, error) {
+	if opay.deadLetters == nil {
+		return nil, ErrNoDeadLetterStore
+	}
+	if len(operator) == 0 || len(note) == 0 {
+		return nil, ErrAuditNoteRequired
+	}
+	dl, err := opay.deadLetters.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if dl.Status != DEAD_LETTER_PENDING {
+		return nil, ErrNotPending
+	}
+	now := opay.clock.Now()
+	dl.Status = DEAD_LETTER_DISCARDED
+	dl.Notes = append(dl.Notes, AuditNote{At: now, Operator: operator, Action: AUDIT_DISCARD, Note: note})
+	dl.UpdatedAt = now
+	return dl, opay.deadLetters.Update(dl, DEAD_LETTER_PENDING)
+}
+
+// MemDeadLetterStore keeps the dead letters in memory, for tests and single process tools.
+type MemDeadLetterStore struct {
+	letters map[int64]*DeadLetter
+	seq     int64
+	mu      sync.Mutex
+}
+
+var _ DeadLetterStore = (*MemDeadLetterStore)(nil)
+
+func NewMemDeadLetterStore() *MemDeadLetterStore {
+	return &MemDeadLetterStore{letters: make(map[int64]*DeadLetter)}
+}
+
+// Insert implements DeadLetterStore.
+func (s *MemDeadLetterStore) Insert(dl *DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	dl.Id = s.seq
+	s.letters[dl.Id] = copyDeadLetter(dl)
+	return nil
+}
+
+// Get implements DeadLetterStore.
+func (s *MemDeadLetterStore) Get(id int64) (*DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dl, ok := s.letters[id]
+	if !ok {
+		return nil, ErrDeadLetterNotFound
+	}
+	return copyDeadLetter(dl), nil
+}
+
+// List implements DeadLetterStore.
+func (s *MemDeadLetterStore) List(status string, limit int) ([]*DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []*DeadLetter
+	for _, dl := range s.letters {
+		if len(status) == 0 || dl.Status == status {
+			list = append(list, copyDeadLetter(dl))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id > list[j].Id })
+	if limit > 0 && len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
+
+// Update implements DeadLetterStore.
+func (s *MemDeadLetterStore) Update(dl *DeadLetter, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.letters[dl.Id]
+	if !ok {
+		return ErrDeadLetterNotFound
+	}
+	if old.Status != status {
+		return ErrDeadLetterConflict
+	}
+	s.letters[dl.Id] = copyDeadLetter(dl)
+	return nil
+}
+
+func copyDeadLetter(dl *DeadLetter) *DeadLetter {
+	c := *dl
+	c.Attempts = append([]Attempt(nil), dl.Attempts...)
+	c.Notes = append([]AuditNote(nil), dl.Notes...)
+	return &c
+}
+
+// Dead letter table
+const DeadLetterSchema = `
+CREATE TABLE IF NOT EXISTS opay_dead_letters (
+	id          BIGSERIAL PRIMARY KEY,
+	order_type  VARCHAR(64) NOT NULL,
+	initiator   JSONB NOT NULL,
+	stakeholder JSONB,
+	addition    JSONB,
+	error       TEXT NOT NULL,
+	status      VARCHAR(16) NOT NULL,
+	attempts    JSONB NOT NULL,
+	notes       JSONB NOT NULL,
+	created_at  TIMESTAMPTZ NOT NULL,
+	updated_at  TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS opay_dead_letters_status_idx ON opay_dead_letters (status, id);
+`
+
+// SQLDeadLetterStore keeps the dead letters in the table of DeadLetterSchema.
+// It writes outside of the request transactions, which are rolled back on failure.
+type SQLDeadLetterStore struct {
+	db *sqlx.DB
+}
+
+var _ DeadLetterStore = (*SQLDeadLetterStore)(nil)
+
+func NewSQLDeadLetterStore(db *sqlx.DB) *SQLDeadLetterStore {
+	return &SQLDeadLetterStore{db: db}
+}
+
+type deadLetterRow struct {
+	Id          int64     `db:"id"`
+	OrderType   string    `db:"order_type"`
+	Initiator   []byte    `db:"initiator"`
+	Stakeholder []byte    `db:"stakeholder"`
+	Addition    []byte    `db:"addition"`
+	Err         string    `db:"error"`
+	Status      string    `db:"status"`
+	Attempts    []byte    `db:"attempts"`
+	Notes       []byte    `db:"notes"`
+	CreatedAt   time.Time `db:"created_at"`
+	UpdatedAt   time.Time `db:"updated_at"`
+}
+
+func toDeadLetterRow(dl *DeadLetter) (*deadLetterRow, error) {
+	attempts, err := json.Marshal(dl.Attempts)
+	if err != nil {
+		return nil, err
+	}
+	notes, err := json.Marshal(dl.Notes)
+	if err != nil {
+		return nil, err
+	}
+	return &deadLetterRow{
+		Id:          dl.Id,
+		OrderType:   dl.OrderType,
+		Initiator:   dl.Initiator,
+		Stakeholder: nullJSON(dl.Stakeholder),
+		Addition:    nullJSON(dl.Addition),
+		Err:         dl.Err,
+		Status:      dl.Status,
+		Attempts:    attempts,
+		Notes:       notes,
+		CreatedAt:   dl.CreatedAt,
+		UpdatedAt:   dl.UpdatedAt,
+	}, nil
+}
+
+func (row *deadLetterRow) deadLetter() (*DeadLetter, error) {
+	dl := &DeadLetter{
+		Id:          row.Id,
+		OrderType:   row.OrderType,
+		Initiator:   row.Initiator,
+		Stakeholder: row.Stakeholder,
+		Addition:    row.Addition,
+		Err:         row.Err,
+		Status:      row.Status,
+		CreatedAt:   row.CreatedAt,
+		UpdatedAt:   row.UpdatedAt,
+	}
+	if err := json.Unmarshal(row.Attempts, &dl.Attempts); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(row.Notes, &dl.Notes); err != nil {
+		return nil, err
+	}
+	return dl, nil
+}
+
+func nullJSON(data json.RawMessage) []byte {
+	if len(data) == 0 {
+		return nil
+	}
+	return data
+}
+
+// Insert implements DeadLetterStore.
+func (s *SQLDeadLetterStore) Insert(dl *DeadLetter) error {
+	row, err := toDeadLetterRow(dl)
+	if err != nil {
+		return err
+	}
+	query, args, err := s.db.BindNamed(`INSERT INTO opay_dead_letters
+		(order_type, initiator, stakeholder, addition, error, status, attempts, notes, created_at, updated_at)
+		VALUES (:order_type, :initiator, :stakeholder, :addition, :error, :status, :attempts, :notes, :created_at, :updated_at)
+		RETURNING id`, row)
+	if err != nil {
+		return err
+	}
+	return s.db.Get(&dl.Id, query, args...)
+}
+
+// Get implements DeadLetterStore.
+func (s *SQLDeadLetterStore) Get(id int64) (*DeadLetter, error) {
+	var row deadLetterRow
+	err := s.db.Get(&row, s.db.Rebind(`SELECT * FROM opay_dead_letters WHERE id = ?`), id)
+	if err == sql.ErrNoRows {
+		return nil, ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return row.deadLetter()
+}
+
+// List implements DeadLetterStore.
+func (s *SQLDeadLetterStore) List(status string, limit int) ([]*DeadLetter, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	var rows []deadLetterRow
+	var err error
+	if len(status) == 0 {
+		err = s.db.Select(&rows, s.db.Rebind(`SELECT * FROM opay_dead_letters ORDER BY id DESC LIMIT ?`), limit)
+	} else {
+		err = s.db.Select(&rows, s.db.Rebind(`SELECT * FROM opay_dead_letters WHERE status = ? ORDER BY id DESC LIMIT ?`), status, limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*DeadLetter, 0, len(rows))
+	for i := range rows {
+		dl, err := rows[i].deadLetter()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, dl)
+	}
+	return list, nil
+}
+
+// Update implements DeadLetterStore.
+func (s *SQLDeadLetterStore) Update(dl *DeadLetter, status string) error {
+	row, err := toDeadLetterRow(dl)
+	if err != nil {
+		return err
+	}
+	result, err := s.db.Exec(s.db.Rebind(`UPDATE opay_dead_letters
+		SET initiator = ?, stakeholder = ?, addition = ?, error = ?, status = ?, attempts = ?, notes = ?, updated_at = ?
+		WHERE id = ? AND status = ?`),
+		row.Initiator, row.Stakeholder, row.Addition, row.Err, row.Status, row.Attempts, row.Notes, row.UpdatedAt,
+		row.Id, status)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		if _, err := s.Get(dl.Id); err != nil {
+			return err
+		}
+		return ErrDeadLetterConflict
+	}
+	return nil
+}
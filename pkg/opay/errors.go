@@ -31,4 +31,10 @@ var (
 	ErrDifferentStep = errors.New("关联订单的操作不一致")
 	// ErrDifferentOperator = errors.New("opay: initiator's type and stakeholder's must be same.")
 	ErrDifferentType = errors.New("关联订单的类型不一致")
+	// ErrIllegalTransition = errors.New("opay: the status can not move to the target.")
+	ErrIllegalTransition = errors.New("非法的交易订单状态变更")
+	// ErrNotReversible     = errors.New("opay: the order cannot be reversed.")
+	ErrNotReversible = errors.New("交易订单不可冲正")
+	// ErrOverReversal      = errors.New("opay: reversal amount exceeds the original amount.")
+	ErrOverReversal = errors.New("冲正金额超过原订单金额")
 )
@@ -1,9 +1,5 @@
 package opay
 
-import (
-	"github.com/jmoiron/sqlx"
-)
-
 type (
 	// Operation interface of order.
 	IOrder interface {
@@ -27,21 +23,49 @@ type (
 		GetAmount() float64
 
 		// Async execution, and mark pending.
-		Pend(*sqlx.Tx, KV) error
+		Pend(Tx, KV) error
 
 		// Async execution, and mark the doing.
-		Do(*sqlx.Tx, KV) error
+		Do(Tx, KV) error
 
 		// Async execution, and mark the successful.
-		Succeed(*sqlx.Tx, KV) error
+		Succeed(Tx, KV) error
 
 		// Async execution, and mark canceled.
-		Cancel(*sqlx.Tx, KV) error
+		Cancel(Tx, KV) error
 
 		// Async execution, and mark failure.
-		Fail(*sqlx.Tx, KV) error
+		Fail(Tx, KV) error
 
 		// Sync execution, and mark the successful.
-		SyncDeal(*sqlx.Tx, KV) error
+		SyncDeal(Tx, KV) error
+	}
+
+	// Order that can be reversed after success.
+	Reversible interface {
+		IOrder
+
+		// Get the order's id.
+		GetId() string
+
+		// Get the amount already reversed,
+		// balance of positive and negative representation as GetAmount.
+		GetReversed() float64
+
+		// Create the compensating order linked to this one, whose amount has
+		// the opposite sign of GetAmount, and whose target status is the meta's reversal status.
+		NewReversal(amount float64) (Reversal, error)
+	}
+
+	// Compensating order of a reversal.
+	Reversal interface {
+		IOrder
+
+		// Get the reversed order.
+		GetOriginal() Reversible
+
+		// Sync execution, save the compensating order and accumulate the original one's
+		// reversed amount, which must be guarded against exceeding the original amount in storage.
+		Reverse(Tx, KV) error
 	}
 )
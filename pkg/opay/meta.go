@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math"
 	"reflect"
+	"sort"
 )
 
 type (
@@ -13,11 +14,15 @@ type (
 		handler   reflect.Value
 		statuses  map[int64]Status
 		unsetCode int64
+
+		reverseCode int64
+		reversible  bool
 	}
 	Status struct {
 		Code int64
 		Note string
 		Step Step
+		Next []int64 //the status codes allowed to move to, not limited if empty
 	}
 )
 
@@ -49,8 +54,22 @@ func (o *Opay) RegMeta(orderType string, handler Handler, statuses []Status) (*M
 		if !ok {
 			return nil, fmt.Errorf("opay: invalid Step: %d", status.Step)
 		}
+		if status.Step == REVERSE {
+			if meta.reversible {
+				return nil, errors.New("opay: repeat reversal status of order meta: " + orderType)
+			}
+			meta.reverseCode = status.Code
+			meta.reversible = true
+		}
 		meta.statuses[status.Code] = status
 	}
+	for _, status := range statuses {
+		for _, code := range status.Next {
+			if _, ok := meta.statuses[code]; !ok {
+				return nil, fmt.Errorf("opay: status %d moves to unregistered status %d", status.Code, code)
+			}
+		}
+	}
 
 	for i := int64(math.MinInt64); i <= math.MaxInt64; i++ {
 		if _, ok := meta.statuses[i]; !ok {
@@ -73,54 +92,52 @@ func (o *Opay) Meta(orderType string) (*Meta, bool) {
 	return meta, ok
 }
 
-// func (o *Opay) MetaStatus(orderType string, code int64) (Status, bool) {
-// 	o.metasLock.RLock()
-// 	defer o.metasLock.RUnlock()
-// 	meta, ok := o.metas[orderType]
-// 	if !ok {
-// 		return Status{}, ok
-// 	}
-// 	status, ok := meta.statuses[code], ok
-// 	return status, ok
-// }
-
-// func (o *Opay) MetaUnsetCode(orderType string) (int64, bool) {
-// 	o.metasLock.RLock()
-// 	defer o.metasLock.RUnlock()
-// 	meta, ok := o.metas[orderType]
-// 	if !ok {
-// 		return 0, ok
-// 	}
-// 	return meta.unsetCode, ok
-// }
-
-// func (o *Opay) MetaStep(orderType string, code int64) Step {
-// 	o.metasLock.RLock()
-// 	defer o.metasLock.RUnlock()
-// 	meta, ok := o.metas[orderType]
-// 	if !ok {
-// 		return UNSET
-// 	}
-// 	status, ok := meta.statuses[code]
-// 	if !ok {
-// 		return UNSET
-// 	}
-// 	return status.Step
-// }
-
-// func (o *Opay) MetaNote(orderType string, code int64) string {
-// 	o.metasLock.RLock()
-// 	defer o.metasLock.RUnlock()
-// 	meta, ok := o.metas[orderType]
-// 	if !ok {
-// 		return ""
-// 	}
-// 	status, ok := meta.statuses[code]
-// 	if !ok {
-// 		return ""
-// 	}
-// 	return status.Note
-// }
+// Metas returns the registered order metas, sorted by order type.
+func (o *Opay) Metas() []*Meta {
+	o.metasLock.RLock()
+	metas := make([]*Meta, 0, len(o.metas))
+	for _, meta := range o.metas {
+		metas = append(metas, meta)
+	}
+	o.metasLock.RUnlock()
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].orderType < metas[j].orderType
+	})
+	return metas
+}
+
+func (o *Opay) MetaStatus(orderType string, code int64) (Status, bool) {
+	o.metasLock.RLock()
+	defer o.metasLock.RUnlock()
+	meta, ok := o.metas[orderType]
+	if !ok {
+		return Status{}, ok
+	}
+	return meta.Status(code)
+}
+
+func (o *Opay) MetaUnsetCode(orderType string) (int64, bool) {
+	o.metasLock.RLock()
+	defer o.metasLock.RUnlock()
+	meta, ok := o.metas[orderType]
+	if !ok {
+		return 0, ok
+	}
+	return meta.unsetCode, ok
+}
+
+func (o *Opay) MetaStep(orderType string, code int64) Step {
+	status, ok := o.MetaStatus(orderType, code)
+	if !ok {
+		return UNSET
+	}
+	return status.Step
+}
+
+func (o *Opay) MetaNote(orderType string, code int64) string {
+	status, _ := o.MetaStatus(orderType, code)
+	return status.Note
+}
 
 func (m *Meta) OrderType() string {
 	return m.orderType
@@ -130,11 +147,46 @@ func (m *Meta) UnsetCode() int64 {
 	return m.unsetCode
 }
 
+// ReverseCode returns the declared reversal status code,
+// false if the order type can not be reversed.
+func (m *Meta) ReverseCode() (int64, bool) {
+	return m.reverseCode, m.reversible
+}
+
 func (m *Meta) Status(code int64) (Status, bool) {
 	status, ok := m.statuses[code]
 	return status, ok
 }
 
+// CanTransit reports whether the order can move from one status to the other.
+func (m *Meta) CanTransit(from, to int64) bool {
+	status, ok := m.statuses[from]
+	if !ok {
+		return false
+	}
+	if len(status.Next) == 0 {
+		return true
+	}
+	for _, code := range status.Next {
+		if code == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Statuses returns all the statuses including the unset one, sorted by code.
+func (m *Meta) Statuses() []Status {
+	statuses := make([]Status, 0, len(m.statuses))
+	for _, status := range m.statuses {
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Code < statuses[j].Code
+	})
+	return statuses
+}
+
 func (m *Meta) Note(code int64) string {
 	status, ok := m.Status(code)
 	if !ok {
@@ -145,9 +197,12 @@ func (m *Meta) Note(code int64) string {
 
 // Execute order processing
 func (m *Meta) serve(ctx *Context) error {
-	// If the structure type, then create a new instance
+	// If the structure type, then serve with a copy of the registered value,
+	// so that the configured fields are kept and each request has its own instance.
 	if m.handler.Kind() == reflect.Struct {
-		m.handler = reflect.New(m.handler.Type())
+		h := reflect.New(m.handler.Type())
+		h.Elem().Set(m.handler)
+		return h.Interface().(Handler).ServeOpay(ctx)
 	}
 	return m.handler.Interface().(Handler).ServeOpay(ctx)
 }
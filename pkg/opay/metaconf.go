@@ -0,0 +1,392 @@
+package opay
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	// MetaConfig declares the order types, their statuses and transitions.
+	MetaConfig struct {
+		Version int          `json:"version" yaml:"version"`
+		Types   []TypeConfig `json:"types" yaml:"types"`
+	}
+
+	// TypeConfig declares an order type served by a registered handler factory.
+	TypeConfig struct {
+		OrderType string         `json:"order_type" yaml:"order_type"`
+		Handler   string         `json:"handler" yaml:"handler"`
+		Statuses  []StatusConfig `json:"statuses" yaml:"statuses"`
+	}
+
+	// StatusConfig declares a status code.
+	// Name is the stable identity of the status, by which the versions are compared.
+	StatusConfig struct {
+		Code int64   `json:"code" yaml:"code"`
+		Name string  `json:"name" yaml:"name"`
+		Note string  `json:"note" yaml:"note"`
+		Step string  `json:"step" yaml:"step"`
+		Next []int64 `json:"next,omitempty" yaml:"next,omitempty"`
+	}
+
+	// HandlerFactory creates the handler of an order type.
+	HandlerFactory func() Handler
+
+	// MetaDiff reports the changes of a MetaConfig against its previous version.
+	MetaDiff struct {
+		Changes []MetaChange
+	}
+
+	// MetaChange is a change of an order type or a status.
+	// It is breaking when the live orders would be misread,
+	// such as a renumbered status or a code reused for another status.
+	MetaChange struct {
+		OrderType string
+		Code      int64
+		Kind      string
+		Detail    string
+		Breaking  bool
+	}
+)
+
+// Kinds of MetaChange
+const (
+	TYPE_ADDED        = "type_added"
+	TYPE_REMOVED      = "type_removed"
+	STATUS_ADDED      = "status_added"
+	STATUS_REMOVED    = "status_removed"
+	STATUS_CHANGED    = "status_changed"
+	STATUS_RENUMBERED = "status_renumbered"
+)
+
+// MetaConfigSchema keeps the applied versions of the MetaConfig, the last one is the previous version for the next diff.
+const MetaConfigSchema = `
+CREATE TABLE IF NOT EXISTS opay_meta_configs (
+	id         BIGSERIAL PRIMARY KEY,
+	config     JSONB NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL
+);
+`
+
+var ErrBreakingMetaChange = errors.New("opay: breaking changes of the order metas")
+
+var handlerFactories = struct {
+	m  map[string]HandlerFactory
+	mu sync.RWMutex
+}{m: make(map[string]HandlerFactory)}
+
+// RegHandlerFactory registers a handler factory by name, for the order types declared in MetaConfig.
+func RegHandlerFactory(name string, factory HandlerFactory) error {
+	handlerFactories.mu.Lock()
+	defer handlerFactories.mu.Unlock()
+	if _, ok := handlerFactories.m[name]; ok {
+		return errors.New("opay: handler factory '" + name + "' has been registered.")
+	}
+	handlerFactories.m[name] = factory
+	return nil
+}
+
+func getHandlerFactory(name string) (HandlerFactory, bool) {
+	handlerFactories.mu.RLock()
+	defer handlerFactories.mu.RUnlock()
+	factory, ok := handlerFactories.m[name]
+	return factory, ok
+}
+
+// LoadMetaConfig reads a MetaConfig from a .json, .yaml or .yml file.
+func LoadMetaConfig(path string) (*MetaConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMetaConfig(data, strings.TrimPrefix(filepath.Ext(path), "."))
+}
+
+// ParseMetaConfig parses a MetaConfig in the format "json", "yaml" or "yml".
+func ParseMetaConfig(data []byte, format string) (*MetaConfig, error) {
+	var cfg MetaConfig
+	var err error
+	switch strings.ToLower(format) {
+	case "json":
+		err = json.Unmarshal(data, &cfg)
+	case "yaml", "yml":
+		err = yaml.Unmarshal(data, &cfg)
+	default:
+		return nil, fmt.Errorf("opay: unsupported meta config format: %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks the MetaConfig and its handler factories.
+func (cfg *MetaConfig) Validate() error {
+	types := make(map[string]bool, len(cfg.Types))
+	for _, t := range cfg.Types {
+		if len(t.OrderType) == 0 {
+			return errors.New("opay: empty order type")
+		}
+		if types[t.OrderType] {
+			return errors.New("opay: repeat order type: " + t.OrderType)
+		}
+		types[t.OrderType] = true
+		if _, ok := getHandlerFactory(t.Handler); !ok {
+			return fmt.Errorf("opay: order type %s: not found handler factory '%s'", t.OrderType, t.Handler)
+		}
+		codes := make(map[int64]bool, len(t.Statuses))
+		names := make(map[string]bool, len(t.Statuses))
+		for _, s := range t.Statuses {
+			if codes[s.Code] {
+				return fmt.Errorf("opay: order type %s: repeat status code %d", t.OrderType, s.Code)
+			}
+			codes[s.Code] = true
+			if len(s.Name) == 0 || names[s.Name] {
+				return fmt.Errorf("opay: order type %s: empty or repeat status name %q", t.OrderType, s.Name)
+			}
+			names[s.Name] = true
+			step, err := ParseStep(s.Step)
+			if err != nil {
+				return fmt.Errorf("opay: order type %s: %v", t.OrderType, err)
+			}
+			if step == UNSET {
+				return fmt.Errorf("opay: order type %s: status %d can not declare the UNSET step", t.OrderType, s.Code)
+			}
+		}
+		for _, s := range t.Statuses {
+			for _, code := range s.Next {
+				if !codes[code] {
+					return fmt.Errorf("opay: order type %s: status %d moves to undeclared status %d", t.OrderType, s.Code, code)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// DiffMetaConfig compares the MetaConfig with its previous version, prev may be nil.
+func DiffMetaConfig(prev, next *MetaConfig) *MetaDiff {
+	diff := new(MetaDiff)
+	if prev == nil {
+		prev = new(MetaConfig)
+	}
+	prevTypes := make(map[string]TypeConfig, len(prev.Types))
+	for _, t := range prev.Types {
+		prevTypes[t.OrderType] = t
+	}
+	nextTypes := make(map[string]bool, len(next.Types))
+	for _, t := range next.Types {
+		nextTypes[t.OrderType] = true
+		p, ok := prevTypes[t.OrderType]
+		if !ok {
+			diff.add(MetaChange{OrderType: t.OrderType, Kind: TYPE_ADDED})
+			continue
+		}
+		diff.diffStatuses(t.OrderType, p.Statuses, t.Statuses)
+	}
+	for _, t := range prev.Types {
+		if !nextTypes[t.OrderType] {
+			// The live orders of the type could no longer be processed.
+			diff.add(MetaChange{OrderType: t.OrderType, Kind: TYPE_REMOVED, Breaking: true})
+		}
+	}
+	sort.SliceStable(diff.Changes, func(i, j int) bool {
+		if diff.Changes[i].OrderType != diff.Changes[j].OrderType {
+			return diff.Changes[i].OrderType < diff.Changes[j].OrderType
+		}
+		return diff.Changes[i].Code < diff.Changes[j].Code
+	})
+	return diff
+}
+
+func (d *MetaDiff) diffStatuses(orderType string, prev, next []StatusConfig) {
+	prevByName := make(map[string]StatusConfig, len(prev))
+	prevByCode := make(map[int64]StatusConfig, len(prev))
+	for _, s := range prev {
+		prevByName[s.Name] = s
+		prevByCode[s.Code] = s
+	}
+	nextByName := make(map[string]bool, len(next))
+	for _, s := range next {
+		nextByName[s.Name] = true
+		p, ok := prevByName[s.Name]
+		switch {
+		case ok && p.Code != s.Code:
+			d.add(MetaChange{
+				OrderType: orderType,
+				Code:      s.Code,
+				Kind:      STATUS_RENUMBERED,
+				Detail:    fmt.Sprintf("%s: %d -> %d", s.Name, p.Code, s.Code),
+				Breaking:  true,
+			})
+		case ok && p.Step != s.Step:
+			d.add(MetaChange{
+				OrderType: orderType,
+				Code:      s.Code,
+				Kind:      STATUS_CHANGED,
+				Detail:    fmt.Sprintf("%s: step %s -> %s", s.Name, p.Step, s.Step),
+				Breaking:  true,
+			})
+		case ok && (p.Note != s.Note || !equalCodes(p.Next, s.Next)):
+			d.add(MetaChange{
+				OrderType: orderType,
+				Code:      s.Code,
+				Kind:      STATUS_CHANGED,
+				Detail:    s.Name,
+			})
+		case !ok:
+			change := MetaChange{
+				OrderType: orderType,
+				Code:      s.Code,
+				Kind:      STATUS_ADDED,
+				Detail:    s.Name,
+			}
+			// A code reused for another status.
+			if old, reused := prevByCode[s.Code]; reused {
+				change.Detail = fmt.Sprintf("%s reuses the code of %s", s.Name, old.Name)
+				change.Breaking = true
+			}
+			d.add(change)
+		}
+	}
+	for _, s := range prev {
+		if !nextByName[s.Name] {
+			d.add(MetaChange{
+				OrderType: orderType,
+				Code:      s.Code,
+				Kind:      STATUS_REMOVED,
+				Detail:    s.Name,
+				Breaking:  true,
+			})
+		}
+	}
+}
+
+func (d *MetaDiff) add(change MetaChange) {
+	d.Changes = append(d.Changes, change)
+}
+
+// Breaking returns the breaking changes.
+func (d *MetaDiff) Breaking() []MetaChange {
+	var changes []MetaChange
+	for _, change := range d.Changes {
+		if change.Breaking {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// String returns the report of the changes, one per line.
+func (d *MetaDiff) String() string {
+	var b strings.Builder
+	for _, change := range d.Changes {
+		if change.Breaking {
+			b.WriteString("! ")
+		} else {
+			b.WriteString("  ")
+		}
+		fmt.Fprintf(&b, "%s %s", change.OrderType, change.Kind)
+		if change.Kind != TYPE_ADDED && change.Kind != TYPE_REMOVED {
+			fmt.Fprintf(&b, " %d", change.Code)
+		}
+		if len(change.Detail) > 0 {
+			b.WriteString(" (" + change.Detail + ")")
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// RegMetaConfig validates the MetaConfig, compares it with the previous version,
+// and registers its order types. The breaking changes are refused unless allowed.
+func (o *Opay) RegMetaConfig(cfg, prev *MetaConfig, allowBreaking bool) (*MetaDiff, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	diff := DiffMetaConfig(prev, cfg)
+	if breaking := diff.Breaking(); len(breaking) > 0 && !allowBreaking {
+		return diff, fmt.Errorf("%w:\n%s", ErrBreakingMetaChange, (&MetaDiff{Changes: breaking}).String())
+	}
+	for _, t := range cfg.Types {
+		statuses := make([]Status, 0, len(t.Statuses))
+		for _, s := range t.Statuses {
+			step, _ := ParseStep(s.Step)
+			statuses = append(statuses, Status{
+				Code: s.Code,
+				Note: s.Note,
+				Step: step,
+				Next: s.Next,
+			})
+		}
+		factory, _ := getHandlerFactory(t.Handler)
+		if _, err := o.RegMeta(t.OrderType, factory(), statuses); err != nil {
+			return diff, err
+		}
+	}
+	return diff, nil
+}
+
+// ApplyMetaConfig registers the MetaConfig by RegMetaConfig against the version applied last in the database,
+// and records it as the applied version. The table is locked meanwhile, so that the replicas
+// starting at once with different versions are compared with each other in turn.
+func (o *Opay) ApplyMetaConfig(db *sqlx.DB, cfg *MetaConfig, allowBreaking bool) (*MetaDiff, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`LOCK TABLE opay_meta_configs IN EXCLUSIVE MODE`); err != nil {
+		return nil, err
+	}
+	var prev *MetaConfig
+	var data []byte
+	err = tx.Get(&data, `SELECT config FROM opay_meta_configs ORDER BY id DESC LIMIT 1`)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, err
+	default:
+		if prev, err = ParseMetaConfig(data, "json"); err != nil {
+			return nil, err
+		}
+	}
+	diff, err := o.RegMetaConfig(cfg, prev, allowBreaking)
+	if err != nil {
+		return diff, err
+	}
+	if prev == nil || len(diff.Changes) > 0 {
+		data, err = json.Marshal(cfg)
+		if err != nil {
+			return diff, err
+		}
+		_, err = tx.Exec(tx.Rebind(`INSERT INTO opay_meta_configs (config, applied_at) VALUES (?, ?)`),
+			string(data), o.Clock().Now())
+		if err != nil {
+			return diff, err
+		}
+	}
+	return diff, tx.Commit()
+}
+
+func equalCodes(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
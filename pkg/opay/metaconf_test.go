@@ -0,0 +1,51 @@
+package opay
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRegMetaConfig(t *testing.T) {
+	RegHandlerFactory("test_metaconf", func() Handler {
+		return HandlerFunc(func(*Context) error { return nil })
+	})
+	prev, err := ParseMetaConfig([]byte(`
+version: 1
+types:
+  - order_type: transfer
+    handler: test_metaconf
+    statuses:
+      - {code: 1, name: pending, note: Pending, step: PEND, next: [2, 3]}
+      - {code: 2, name: succeeded, note: Succeeded, step: SUCCEED}
+      - {code: 3, name: failed, note: Failed, step: FAIL}
+`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine := NewOpayWithTxManager(NewMemStore(), 10, 2)
+	if _, err := engine.RegMetaConfig(prev, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	meta, _ := engine.Meta("transfer")
+	if !meta.CanTransit(1, 2) || meta.CanTransit(1, 1) {
+		t.Fatal("unexpected transitions")
+	}
+
+	// Renumbering a live status is refused.
+	next, _ := ParseMetaConfig([]byte(`{"version": 2, "types": [{"order_type": "transfer", "handler": "test_metaconf",
+		"statuses": [
+			{"code": 1, "name": "pending", "note": "Pending", "step": "PEND"},
+			{"code": 3, "name": "succeeded", "note": "Succeeded", "step": "SUCCEED"},
+			{"code": 2, "name": "failed", "note": "Failed", "step": "FAIL"}
+		]}]}`), "json")
+	diff := DiffMetaConfig(prev, next)
+	if n := len(diff.Breaking()); n != 2 {
+		t.Fatalf("expect 2 breaking changes, got %d:\n%s", n, diff)
+	}
+	_, err = NewOpayWithTxManager(NewMemStore(), 10, 2).RegMetaConfig(next, prev, false)
+	if !errors.Is(err, ErrBreakingMetaChange) {
+		t.Fatalf("expect ErrBreakingMetaChange, got %v", err)
+	}
+	t.Log("\n" + diff.String())
+}
@@ -3,24 +3,49 @@ package opay
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"github.com/jmoiron/sqlx"
 )
 
 type Opay struct {
 	metas          map[string]*Meta
-	queue          Queue    //request queue
-	db             *sqlx.DB //global database operation instance
-	*SettleFuncMap          //global map of SettleFunc
+	queue          Queue     //request queue
+	db             *sqlx.DB  //global database operation instance, nil if not backed by sqlx
+	txManager      TxManager //begins the transaction of each request
+	*SettleFuncMap           //global map of SettleFunc
 	*Floater
+	cluster   *Cluster //the optional, coordination with the other replicas
 	metasLock sync.RWMutex
+
+	tracker *tracker //requests being processed
+	clock   Clock
+
+	savepointSeq uint64 //names the savepoints in the caller-supplied transactions
+
+	deadLetters DeadLetterStore //the optional, store of the failed requests
+
+	breakers         map[string]*breaker //guards of the settle functions by aid
+	breakerListeners []func(BreakerEvent)
+	breakersLock     sync.RWMutex
 }
 
+// NewOpay creates an engine on the sqlx database, it panics with ErrNilDB if db is nil.
 func NewOpay(db *sqlx.DB, queueCapacity int, numOfDecimalPlaces int) *Opay {
+	opay := NewOpayWithTxManager(NewSqlxTxManager(db), queueCapacity, numOfDecimalPlaces)
+	opay.db = db
+	return opay
+}
+
+// NewOpayWithTxManager creates an engine on any transactional store, such as MemStore.
+func NewOpayWithTxManager(txManager TxManager, queueCapacity int, numOfDecimalPlaces int) *Opay {
 	opay := &Opay{
 		SettleFuncMap: globalSettleFuncMap,
-		db:            db,
+		txManager:     txManager,
 		metas:         make(map[string]*Meta),
+		tracker:       newTracker(),
+		clock:         SystemClock,
+		breakers:      make(map[string]*breaker),
 		Floater:       NewFloater(numOfDecimalPlaces),
 	}
 	opay.queue = newOrderChan(queueCapacity, opay)
@@ -36,16 +61,51 @@ func (opay *Opay) DB() *sqlx.DB {
 	return opay.db
 }
 
+func (opay *Opay) TxManager() TxManager {
+	return opay.txManager
+}
+
+// SetClock replaces the clock for the deadlines and the response timing.
+func (opay *Opay) SetClock(clock Clock) {
+	opay.clock = clock
+}
+
+func (opay *Opay) Clock() Clock {
+	return opay.clock
+}
+
+// SetCluster sets the coordination with the other replicas.
+func (opay *Opay) SetCluster(cluster *Cluster) {
+	opay.cluster = cluster
+}
+
+// Cluster returns the coordination with the other replicas, nil if running alone.
+func (opay *Opay) Cluster() *Cluster {
+	return opay.cluster
+}
+
+// IsLeader reports whether the singleton background jobs should run on this replica.
+// It is always true when running alone.
+func (opay *Opay) IsLeader() bool {
+	if opay.cluster == nil {
+		return true
+	}
+	return opay.cluster.IsLeader()
+}
+
 // Opay start.
 func (opay *Opay) Serve() {
-	if err := opay.db.Ping(); err != nil {
-		panic(err)
+	if opay.db != nil {
+		if err := opay.db.Ping(); err != nil {
+			panic(err)
+		}
 	}
 	var maxRoutine = opay.queue.GetCap() / 5
 	if maxRoutine == 0 {
 		maxRoutine = 1
 	}
 	var src = make(chan struct{}, maxRoutine)
+	opay.tracker.setMaxWorkers(maxRoutine)
 	for {
 		// Gets an execute permission
 		src <- struct{}{}
@@ -62,18 +122,20 @@ func (opay *Opay) Serve() {
 			stakeholderSettle SettleFunc
 		)
 
-		initiatorSettle, err = opay.GetSettleFunc(req.Initiator.GetAid())
+		initiatorSettle, err = opay.guardedSettleFunc(req.Initiator.GetAid())
 		if err != nil {
 			// Returns if the operation interface of the specified asset account does not exist.
 			req.setError(err)
+			opay.bury(req, err)
 			req.writeback()
 			continue
 		}
 		if req.Stakeholder != nil {
-			stakeholderSettle, err = opay.GetSettleFunc(req.Stakeholder.GetAid())
+			stakeholderSettle, err = opay.guardedSettleFunc(req.Stakeholder.GetAid())
 			if err != nil {
 				// Returns if the operation interface of the specified asset account does not exist
 				req.setError(err)
+				opay.bury(req, err)
 				req.writeback()
 				continue
 			}
@@ -89,33 +151,75 @@ func (opay *Opay) Serve() {
 				}
 
 				// Close the request, and mark the end of the request processing
-				req.setError(err)
+				req.conclude(err)
+				opay.tracker.end(req, err)
+				opay.bury(req, err)
 				req.writeback()
 				// Frees an execute permission
 				<-src
 			}()
 
-			if req.Tx == nil {
-				req.Tx, err = opay.db.Beginx()
-				if err != nil {
-					return
-				}
-				defer func() {
-					if err != nil {
-						req.Tx.Rollback()
-					} else {
-						req.Tx.Commit()
-					}
-				}()
-			}
+			req.response.start()
+			opay.tracker.begin(req)
 
-			err = req.Initiator.GetMeta().serve(&Context{
-				initiatorSettle:   initiatorSettle,
-				stakeholderSettle: stakeholderSettle,
-				Request:           req,
-				Response:          req.response,
-				Floater:           opay.Floater,
+			err = opay.transact(req, func() error {
+				return req.Initiator.GetMeta().serve(&Context{
+					initiatorSettle:   initiatorSettle,
+					stakeholderSettle: stakeholderSettle,
+					settleFuncMap:     opay.SettleFuncMap,
+					settleOf:          opay.guardedSettleFunc,
+					Request:           req,
+					Response:          req.response,
+					Floater:           opay.Floater,
+				})
 			})
 		}()
 	}
 }
+
+// Run fn in the transaction of the request.
+// Without a caller-supplied transaction, a new one is begun and committed when fn succeeds.
+// Otherwise the writes of fn are wrapped in a savepoint, and undone on error or panic,
+// while committing is left to the caller. ErrNoSavepoint is returned if it is not a Savepointer.
+func (opay *Opay) transact(req *Request, fn func() error) (err error) {
+	var end func(error) error
+	if req.Tx == nil {
+		req.Tx, err = opay.txManager.Begin()
+		if err != nil {
+			return err
+		}
+		tx := req.Tx
+		end = func(err error) error {
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			return tx.Commit()
+		}
+	} else if sp, ok := AsSavepointer(req.Tx); ok {
+		name := fmt.Sprintf("opay_%d", atomic.AddUint64(&opay.savepointSeq, 1))
+		if err = sp.Savepoint(name); err != nil {
+			return err
+		}
+		end = func(err error) error {
+			if err != nil {
+				sp.RollbackTo(name)
+				sp.Release(name)
+				return err
+			}
+			return sp.Release(name)
+		}
+	} else {
+		// A failed order could not be undone without the caller's other writes.
+		return ErrNoSavepoint
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("opay panic: %v", r)
+		}
+		if end != nil {
+			err = end(err)
+		}
+	}()
+	return fn()
+}
@@ -0,0 +1,42 @@
+package opaytest
+
+import (
+	"sync"
+	"time"
+
+	"simplopay.com/backend/pkg/opay"
+)
+
+// Clock is a controllable opay.Clock, the time only moves when told.
+type Clock struct {
+	now time.Time
+	mu  sync.RWMutex
+}
+
+var _ opay.Clock = (*Clock)(nil)
+
+// NewClock creates a clock stopped at the time.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now implements opay.Clock.
+func (c *Clock) Now() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.now
+}
+
+// Advance moves the time forward.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// Set moves the time to t.
+func (c *Clock) Set(t time.Time) {
+	c.mu.Lock()
+	c.now = t
+	c.mu.Unlock()
+}
@@ -0,0 +1,49 @@
+package opaytest
+
+import (
+	"time"
+
+	"simplopay.com/backend/pkg/opay"
+)
+
+// Harness runs an engine in-process on a MemStore,
+// with a Ledger for the assets and a stopped Clock.
+type Harness struct {
+	Opay   *opay.Opay
+	Store  *opay.MemStore
+	Ledger *Ledger
+	Clock  *Clock
+}
+
+// NewHarness creates and serves an engine, the settle functions of the assets are backed by the Ledger.
+// The engine has its own SettleFuncMap, the global one is untouched.
+func NewHarness(numOfDecimalPlaces int, aids ...string) *Harness {
+	store := opay.NewMemStore()
+	h := &Harness{
+		Opay:   opay.NewOpayWithTxManager(store, 10, numOfDecimalPlaces),
+		Store:  store,
+		Ledger: NewLedger(store),
+		Clock:  NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)),
+	}
+	h.Opay.SettleFuncMap = opay.NewSettleFuncMap()
+	if err := h.Ledger.Register(h.Opay.SettleFuncMap, aids...); err != nil {
+		panic(err)
+	}
+	h.Opay.SetClock(h.Clock)
+	go h.Opay.Serve()
+	return h
+}
+
+// RegMeta registers an order type to the engine, and panics on error.
+func (h *Harness) RegMeta(orderType string, handler opay.Handler, statuses ...opay.Status) *opay.Meta {
+	meta, err := h.Opay.RegMeta(orderType, handler, statuses)
+	if err != nil {
+		panic(err)
+	}
+	return meta
+}
+
+// Do submits the orders and waits for the response, stakeholder may be nil.
+func (h *Harness) Do(initiator, stakeholder opay.IOrder) *opay.Response {
+	return h.Opay.Do(&opay.Request{Initiator: initiator, Stakeholder: stakeholder})
+}
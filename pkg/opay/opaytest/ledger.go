@@ -0,0 +1,110 @@
+package opaytest
+
+import (
+	"errors"
+	"testing"
+
+	"simplopay.com/backend/pkg/opay"
+)
+
+var ErrInsufficientBalance = errors.New("opaytest: insufficient balance")
+
+// Ledger keeps the account balances in an opay.MemStore,
+// so the balance updates are rolled back together with the request.
+type Ledger struct {
+	store   *opay.MemStore
+	floater *opay.Floater
+
+	// AllowOverdraft lets the balances go negative.
+	AllowOverdraft bool
+}
+
+// NewLedger creates a ledger on the store.
+func NewLedger(store *opay.MemStore) *Ledger {
+	return &Ledger{
+		store:   store,
+		floater: opay.NewFloater(8),
+	}
+}
+
+func ledgerKey(uid, aid string) string {
+	return "ledger/" + aid + "/" + uid
+}
+
+// SettleFunc returns the opay.SettleFunc of the asset.
+func (l *Ledger) SettleFunc(aid string) opay.SettleFunc {
+	return func(uid string, amount float64, tx opay.Tx) error {
+		return l.settle(uid, aid, amount, tx, l.AllowOverdraft)
+	}
+}
+
+func (l *Ledger) settle(uid, aid string, amount float64, tx opay.Tx, overdraft bool) error {
+	mtx, err := opay.AsMemTx(tx)
+	if err != nil {
+		return err
+	}
+	var balance float64
+	if v, ok := mtx.Get(ledgerKey(uid, aid)); ok {
+		balance = v.(float64)
+	}
+	balance = l.floater.Ftof(balance + amount)
+	if balance < 0 && !overdraft {
+		return ErrInsufficientBalance
+	}
+	return mtx.Put(ledgerKey(uid, aid), balance)
+}
+
+// BalanceFunc returns the opay.BalanceFunc of the asset.
+func (l *Ledger) BalanceFunc(aid string) opay.BalanceFunc {
+	return func(uid string, tx opay.Tx) (float64, error) {
+		mtx, err := opay.AsMemTx(tx)
+		if err != nil {
+			return 0, err
+		}
+		v, ok := mtx.Get(ledgerKey(uid, aid))
+		if !ok {
+			return 0, nil
+		}
+		return v.(float64), nil
+	}
+}
+
+// Register registers the settle and balance functions of the assets to the router.
+func (l *Ledger) Register(m *opay.SettleFuncMap, aids ...string) error {
+	for _, aid := range aids {
+		if err := m.RegSettleFunc(aid, l.SettleFunc(aid)); err != nil {
+			return err
+		}
+		if err := m.RegBalanceFunc(aid, l.BalanceFunc(aid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fund adds the amount to the account outside of any request.
+func (l *Ledger) Fund(uid, aid string, amount float64) {
+	tx, _ := l.store.Begin()
+	if err := l.settle(uid, aid, amount, tx, true); err != nil {
+		tx.Rollback()
+		panic(err)
+	}
+	tx.Commit()
+}
+
+// Balance returns the committed balance of the account.
+func (l *Ledger) Balance(uid, aid string) float64 {
+	v, ok := l.store.Get(ledgerKey(uid, aid))
+	if !ok {
+		return 0
+	}
+	return v.(float64)
+}
+
+// AssertBalance fails the test if the committed balance is not as expected.
+func (l *Ledger) AssertBalance(t testing.TB, uid, aid string, want float64) {
+	t.Helper()
+	if got := l.Balance(uid, aid); !l.floater.Equal(got, want) {
+		t.Errorf("balance of %s/%s: got %s, want %s", aid, uid, l.floater.Ftoa(got), l.floater.Ftoa(want))
+	}
+}
@@ -0,0 +1,357 @@
+package opaytest
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"simplopay.com/backend/pkg/opay"
+)
+
+func TestHarness(t *testing.T) {
+	h := NewHarness(2, "NGN")
+	meta := h.RegMeta("transfer", opay.HandlerFunc(func(ctx *opay.Context) error {
+		if err := ctx.UpdateBalance(); err != nil {
+			return err
+		}
+		return ctx.SyncDeal()
+	}), opay.Status{Code: 1, Note: "Succeeded", Step: opay.SYNC_DEAL})
+	h.Ledger.Fund("alice", "NGN", 100)
+
+	errBroken := errors.New("broken")
+	cases := []struct {
+		name   string
+		amount float64
+		errs   map[opay.Step]error
+		err    error
+		alice  float64
+		bob    float64
+	}{
+		{name: "success", amount: 30, alice: 70, bob: 30},
+		{name: "insufficient balance", amount: 80, err: ErrInsufficientBalance, alice: 70, bob: 30},
+		{name: "rolled back", amount: 10, errs: map[opay.Step]error{opay.SYNC_DEAL: errBroken}, err: errBroken, alice: 70, bob: 30},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			initiator := NewOrder(meta, c.name, "alice", "NGN", -c.amount, 1)
+			initiator.Errs = c.errs
+			stakeholder := NewOrder(meta, c.name, "bob", "NGN", c.amount, 1)
+			resp := h.Do(initiator, stakeholder)
+			if !errors.Is(resp.Err, c.err) {
+				t.Fatalf("got error %v, want %v", resp.Err, c.err)
+			}
+			h.Ledger.AssertBalance(t, "alice", "NGN", c.alice)
+			h.Ledger.AssertBalance(t, "bob", "NGN", c.bob)
+			if c.err == nil {
+				if len(resp.Balances) != 2 {
+					t.Fatalf("expect 2 balances, got %v", resp.Balances)
+				}
+				if steps := initiator.Steps(); !reflect.DeepEqual(steps, []opay.Step{opay.SYNC_DEAL}) {
+					t.Fatalf("unexpected steps: %v", steps)
+				}
+			}
+		})
+	}
+}
+
+func TestResponse(t *testing.T) {
+	h := NewHarness(2, "NGN")
+	meta := h.RegMeta("transfer", opay.HandlerFunc(func(ctx *opay.Context) error {
+		if err := ctx.UpdateBalance(); err != nil {
+			return err
+		}
+		ctx.Response.SetResult("fee", 0.5)
+		return ctx.SyncDeal()
+	}),
+		opay.Status{Code: 1, Note: "Pending", Step: opay.PEND},
+		opay.Status{Code: 2, Note: "Succeeded", Step: opay.SYNC_DEAL},
+	)
+	h.Ledger.Fund("alice", "NGN", 100)
+	h.Ledger.Fund("bob", "NGN", 5)
+
+	resp := h.Do(NewOrder(meta, "o1", "alice", "NGN", -30, 2), NewOrder(meta, "o1", "bob", "NGN", 30, 2))
+	if resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+	if resp.Executed != opay.SYNC_DEAL || resp.InitiatorStatus != 2 || resp.StakeholderStatus != 2 {
+		t.Fatalf("unexpected final state: %v, %d, %d", resp.Executed, resp.InitiatorStatus, resp.StakeholderStatus)
+	}
+	// In the order of the settlement, the stakeholder first.
+	want := []opay.Balance{{Uid: "bob", Aid: "NGN", Balance: 35}, {Uid: "alice", Aid: "NGN", Balance: 70}}
+	if !reflect.DeepEqual(resp.Balances, want) {
+		t.Fatalf("got balances %+v, want %+v", resp.Balances, want)
+	}
+	if fee := resp.Result("fee"); fee != 0.5 || resp.Retries != 0 {
+		t.Fatalf("unexpected result %v and retries %d", fee, resp.Retries)
+	}
+	if resp.QueuedAt.IsZero() || resp.StartedAt.IsZero() || resp.FinishedAt.IsZero() {
+		t.Fatalf("unexpected timing: %v, %v, %v", resp.QueuedAt, resp.StartedAt, resp.FinishedAt)
+	}
+
+	// A failed request reports no executed step, nor the snapshots taken before the rollback.
+	resp = h.Do(NewOrder(meta, "o2", "alice", "NGN", -80, 2), NewOrder(meta, "o2", "bob", "NGN", 80, 2))
+	if !errors.Is(resp.Err, ErrInsufficientBalance) || resp.Executed != opay.UNSET || resp.InitiatorStatus != meta.UnsetCode() || len(resp.Balances) != 0 {
+		t.Fatalf("unexpected failed response: %v, %v, %d, %+v", resp.Err, resp.Executed, resp.InitiatorStatus, resp.Balances)
+	}
+}
+
+func TestHarnessTimeout(t *testing.T) {
+	h := NewHarness(2, "NGN")
+	meta := h.RegMeta("transfer", opay.HandlerFunc(func(ctx *opay.Context) error {
+		return ctx.Pend()
+	}), opay.Status{Code: 1, Note: "Pending", Step: opay.PEND})
+
+	order := NewOrder(meta, "o1", "alice", "NGN", 10, 1)
+	deadline := h.Clock.Now().Add(time.Minute)
+	h.Clock.Advance(2 * time.Minute)
+	resp := h.Opay.Do(&opay.Request{Initiator: order, Deadline: deadline})
+	if resp.Err != opay.ErrTimeout {
+		t.Fatalf("expect ErrTimeout, got %v", resp.Err)
+	}
+	if len(order.Calls()) != 0 {
+		t.Fatal("expect the order not to be processed")
+	}
+}
+
+func TestHarnessSavepoint(t *testing.T) {
+	h := NewHarness(2, "NGN")
+	meta := h.RegMeta("transfer", opay.HandlerFunc(func(ctx *opay.Context) error {
+		if err := ctx.UpdateBalance(); err != nil {
+			return err
+		}
+		return ctx.SyncDeal()
+	}), opay.Status{Code: 1, Note: "Succeeded", Step: opay.SYNC_DEAL})
+	h.Ledger.Fund("alice", "NGN", 100)
+
+	// The caller composes its own write with two orders in one transaction.
+	tx, _ := h.Store.Begin()
+	mtx, _ := opay.AsMemTx(tx)
+	mtx.Put("caller", "written")
+
+	resp := h.Opay.Do(&opay.Request{
+		Initiator:   NewOrder(meta, "o1", "alice", "NGN", -30, 1),
+		Stakeholder: NewOrder(meta, "o1", "bob", "NGN", 30, 1),
+		Tx:          tx,
+	})
+	if resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+
+	failing := NewOrder(meta, "o2", "alice", "NGN", -20, 1)
+	failing.Errs = map[opay.Step]error{opay.SYNC_DEAL: errors.New("broken")}
+	resp = h.Opay.Do(&opay.Request{
+		Initiator:   failing,
+		Stakeholder: NewOrder(meta, "o2", "bob", "NGN", 20, 1),
+		Tx:          tx,
+	})
+	if resp.Err == nil {
+		t.Fatal("expect the second order to fail")
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Ledger.AssertBalance(t, "alice", "NGN", 70)
+	h.Ledger.AssertBalance(t, "bob", "NGN", 30)
+	if v, _ := h.Store.Get("caller"); v != "written" {
+		t.Fatalf("expect the caller's write to be kept, got %v", v)
+	}
+
+	// Without savepoints a failed order could not be undone alone, the request is refused.
+	tx, _ = h.Store.Begin()
+	defer tx.Rollback()
+	order := NewOrder(meta, "o3", "alice", "NGN", -10, 1)
+	resp = h.Opay.Do(&opay.Request{
+		Initiator:   order,
+		Stakeholder: NewOrder(meta, "o3", "bob", "NGN", 10, 1),
+		Tx:          plainTx{tx},
+	})
+	if !errors.Is(resp.Err, opay.ErrNoSavepoint) {
+		t.Fatalf("expect ErrNoSavepoint, got %v", resp.Err)
+	}
+	if len(order.Calls()) > 0 {
+		t.Fatalf("expect no step call, got %v", order.Steps())
+	}
+}
+
+// plainTx hides the savepoints of the transaction.
+type plainTx struct {
+	opay.Tx
+}
+
+func init() {
+	opay.RegOrderCodec("dead_letter_transfer", OrderCodec)
+}
+
+func TestDeadLetterReplay(t *testing.T) {
+	h := NewHarness(2, "NGN")
+	meta := h.RegMeta("dead_letter_transfer", opay.HandlerFunc(func(ctx *opay.Context) error {
+		if err := ctx.UpdateBalance(); err != nil {
+			return err
+		}
+		return ctx.SyncDeal()
+	}), opay.Status{Code: 1, Note: "Succeeded", Step: opay.SYNC_DEAL})
+	store := opay.NewMemDeadLetterStore()
+	h.Opay.SetDeadLetters(store)
+	h.Ledger.Fund("alice", "NGN", 100)
+
+	initiator := NewOrder(meta, "o1", "alice", "NGN", -30, 1)
+	initiator.Errs = map[opay.Step]error{opay.SYNC_DEAL: errors.New("nibss unavailable")}
+	if resp := h.Do(initiator, NewOrder(meta, "o1", "bob", "NGN", 30, 1)); resp.Err == nil {
+		t.Fatal("expect the request to fail")
+	}
+	list, _ := store.List(opay.DEAD_LETTER_PENDING, 0)
+	if len(list) != 1 || list[0].Err != "nibss unavailable" {
+		t.Fatalf("expect a pending dead letter, got %+v", list)
+	}
+	id := list[0].Id
+
+	if _, err := h.Opay.Replay(id, "ops", ""); err != opay.ErrAuditNoteRequired {
+		t.Fatalf("expect ErrAuditNoteRequired, got %v", err)
+	}
+	if _, err := h.Opay.EditDeadLetter(id, opay.DeadLetterEdit{
+		Addition: []byte(`{"ticket": "OPS-1"}`),
+		Operator: "ops",
+		Note:     "attach the ticket",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := h.Opay.Replay(id, "ops", "nibss is back")
+	if err != nil || resp.Err != nil {
+		t.Fatalf("replay: %v, %v", err, resp.Err)
+	}
+	if resp.Retries != 1 {
+		t.Fatalf("expect the replay to count 1 previous attempt, got %d", resp.Retries)
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 70)
+	h.Ledger.AssertBalance(t, "bob", "NGN", 30)
+
+	dl, _ := store.Get(id)
+	if dl.Status != opay.DEAD_LETTER_REPLAYED || len(dl.Attempts) != 2 || len(dl.Notes) != 2 {
+		t.Fatalf("unexpected dead letter: %+v", dl)
+	}
+	if _, err := h.Opay.Replay(id, "ops", "again"); err != opay.ErrNotPending {
+		t.Fatalf("expect ErrNotPending, got %v", err)
+	}
+
+	// A replay left unfinished by a crash is moved back to pending after the timeout.
+	stuck := &opay.DeadLetter{OrderType: "dead_letter_transfer", Status: opay.DEAD_LETTER_REPLAYING, UpdatedAt: h.Clock.Now()}
+	store.Insert(stuck)
+	if n, err := h.Opay.RecoverReplays(time.Minute); err != nil || n != 0 {
+		t.Fatalf("expect nothing recovered before the timeout, got %d, %v", n, err)
+	}
+	h.Clock.Advance(time.Minute)
+	if n, err := h.Opay.RecoverReplays(time.Minute); err != nil || n != 1 {
+		t.Fatalf("expect 1 recovered, got %d, %v", n, err)
+	}
+	if dl, _ := store.Get(stuck.Id); dl.Status != opay.DEAD_LETTER_PENDING || len(dl.Notes) != 1 {
+		t.Fatalf("unexpected recovered dead letter: %+v", dl)
+	}
+}
+
+func TestSettleBreaker(t *testing.T) {
+	h := NewHarness(2, "NGN")
+	meta := h.RegMeta("payout", opay.HandlerFunc(func(ctx *opay.Context) error {
+		if err := ctx.UpdateBalance(); err != nil {
+			return err
+		}
+		return ctx.SyncDeal()
+	}),
+		opay.Status{Code: 1, Note: "Pending", Step: opay.PEND},
+		opay.Status{Code: 2, Note: "Paid", Step: opay.SYNC_DEAL},
+	)
+	h.Ledger.Fund("alice", "NGN", 100)
+
+	var providerErr error
+	var delay time.Duration
+	h.Opay.RegSettleFunc("EXT", func(uid string, amount float64, tx opay.Tx) error {
+		select {
+		case <-time.After(delay):
+			return providerErr
+		case <-opay.TxContext(tx).Done():
+			return opay.TxContext(tx).Err()
+		}
+	})
+	h.Opay.SetSettlePolicy("EXT", opay.SettlePolicy{
+		Timeout:          20 * time.Millisecond,
+		FailureThreshold: 2,
+		OpenFor:          time.Minute,
+	})
+	var events []opay.BreakerEvent
+	h.Opay.OnBreakerEvent(func(e opay.BreakerEvent) { events = append(events, e) })
+
+	payout := func(id string) (*Order, *opay.Response) {
+		initiator := NewOrder(meta, id, "alice", "NGN", -10, 2)
+		return initiator, h.Do(initiator, NewOrder(meta, id, "bank", "EXT", 10, 2))
+	}
+
+	// The provider errors are returned as is, until the breaker opens.
+	providerErr = errors.New("bank unavailable")
+	for i := 0; i < 2; i++ {
+		if _, resp := payout("o1"); resp.Err != providerErr {
+			t.Fatalf("expect the provider error, got %v", resp.Err)
+		}
+	}
+	if state := h.Opay.Stats().Breakers["EXT"].State; state != opay.BREAKER_OPEN {
+		t.Fatalf("expect the breaker open, got %s", state)
+	}
+
+	// Rejected without calling the provider, and kept as a dead letter.
+	order, resp := payout("o2")
+	if !errors.Is(resp.Err, opay.ErrBreakerOpen) {
+		t.Fatalf("expect ErrBreakerOpen, got %v", resp.Err)
+	}
+	if steps := order.Steps(); len(steps) != 0 {
+		t.Fatalf("unexpected steps: %v", steps)
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 100)
+
+	// A successful probe closes the breaker.
+	providerErr = nil
+	h.Clock.Advance(time.Minute)
+	if _, resp := payout("o3"); resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+	h.Ledger.AssertBalance(t, "alice", "NGN", 90)
+
+	// A hanging provider times out, its call is canceled.
+	delay = time.Minute
+	if _, resp := payout("o4"); !errors.Is(resp.Err, opay.ErrSettleTimeout) {
+		t.Fatalf("expect ErrSettleTimeout, got %v", resp.Err)
+	}
+
+	stats := h.Opay.Stats()
+	if b := stats.Breakers["EXT"]; b.State != opay.BREAKER_CLOSED || b.Timeouts != 1 || b.Rejected != 1 {
+		t.Fatalf("unexpected breaker stats: %+v", b)
+	}
+	if stats.Types["payout"].Failed != 4 {
+		t.Fatalf("unexpected type stats: %+v", stats.Types["payout"])
+	}
+	if len(events) != 3 || events[0].To != opay.BREAKER_OPEN || events[2].To != opay.BREAKER_CLOSED {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+}
+
+type configuredHandler struct {
+	fee float64
+}
+
+func (h *configuredHandler) ServeOpay(ctx *opay.Context) error {
+	ctx.Set("fee", h.fee)
+	return ctx.SyncDeal()
+}
+
+func TestStructHandler(t *testing.T) {
+	h := NewHarness(2, "NGN")
+	meta := h.RegMeta("configured", &configuredHandler{fee: 1.5}, opay.Status{Code: 1, Step: opay.SYNC_DEAL})
+	for i := 0; i < 2; i++ {
+		req := &opay.Request{Initiator: NewOrder(meta, "1", "alice", "NGN", 10, 1)}
+		if resp := h.Opay.Do(req); resp.Err != nil {
+			t.Fatal(resp.Err)
+		}
+		if fee := req.Addition["fee"]; fee != 1.5 {
+			t.Fatalf("the registered handler is not copied, got fee %v", fee)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package opaytest
+
+import (
+	"sync"
+
+	"simplopay.com/backend/pkg/opay"
+)
+
+type (
+	// Order is a recording opay.IOrder, it captures every step call.
+	// It is also reversible, the compensating orders are created by NewReversal.
+	Order struct {
+		Id     string
+		Meta   *opay.Meta `json:"-"`
+		Uid    string
+		Aid    string
+		Amount float64
+		Pre    int64 //the previous status
+		Target int64 //the target status
+
+		// Errs makes the step calls fail.
+		Errs map[opay.Step]error `json:"-"`
+
+		reversed float64
+		original *Order
+		calls    []Call
+		mu       sync.Mutex
+	}
+
+	// Call is a recorded step call.
+	Call struct {
+		Step opay.Step
+		Tx   opay.Tx
+		KV   opay.KV
+	}
+)
+
+var (
+	_ opay.Reversible = (*Order)(nil)
+	_ opay.Reversal   = (*Order)(nil)
+)
+
+// OrderCodec lets the dead letters of the recording orders be replayed,
+// the injected failures are not serialized.
+var OrderCodec = opay.JSONOrderCodec{
+	NewInitiator:   func(meta *opay.Meta) opay.IOrder { return &Order{Meta: meta} },
+	NewStakeholder: func(meta *opay.Meta) opay.IOrder { return &Order{Meta: meta} },
+}
+
+// NewOrder creates a new order moving from the unset status to the target.
+func NewOrder(meta *opay.Meta, id, uid, aid string, amount float64, target int64) *Order {
+	return &Order{
+		Id:     id,
+		Meta:   meta,
+		Uid:    uid,
+		Aid:    aid,
+		Amount: amount,
+		Pre:    meta.UnsetCode(),
+		Target: target,
+	}
+}
+
+// Move makes the order move from its current target status to the next one,
+// as if it was reloaded from storage.
+func (o *Order) Move(target int64) *Order {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.Pre, o.Target = o.Target, target
+	return o
+}
+
+// Calls returns the recorded step calls.
+func (o *Order) Calls() []Call {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]Call(nil), o.calls...)
+}
+
+// Steps returns the steps of the recorded calls.
+func (o *Order) Steps() []opay.Step {
+	calls := o.Calls()
+	steps := make([]opay.Step, len(calls))
+	for i, call := range calls {
+		steps[i] = call.Step
+	}
+	return steps
+}
+
+func (o *Order) record(step opay.Step, tx opay.Tx, kv opay.KV) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.calls = append(o.calls, Call{Step: step, Tx: tx, KV: kv})
+	return o.Errs[step]
+}
+
+func (o *Order) GetMeta() *opay.Meta  { return o.Meta }
+func (o *Order) PreStatus() int64     { return o.Pre }
+func (o *Order) TargetStatus() int64  { return o.Target }
+func (o *Order) GetUid() string       { return o.Uid }
+func (o *Order) GetAid() string       { return o.Aid }
+func (o *Order) GetAmount() float64   { return o.Amount }
+func (o *Order) GetId() string        { return o.Id }
+func (o *Order) GetReversed() float64 { return o.reversed }
+
+func (o *Order) Pend(tx opay.Tx, kv opay.KV) error     { return o.record(opay.PEND, tx, kv) }
+func (o *Order) Do(tx opay.Tx, kv opay.KV) error       { return o.record(opay.DO, tx, kv) }
+func (o *Order) Succeed(tx opay.Tx, kv opay.KV) error  { return o.record(opay.SUCCEED, tx, kv) }
+func (o *Order) Cancel(tx opay.Tx, kv opay.KV) error   { return o.record(opay.CANCEL, tx, kv) }
+func (o *Order) Fail(tx opay.Tx, kv opay.KV) error     { return o.record(opay.FAIL, tx, kv) }
+func (o *Order) SyncDeal(tx opay.Tx, kv opay.KV) error { return o.record(opay.SYNC_DEAL, tx, kv) }
+
+// NewReversal implements opay.Reversible.
+func (o *Order) NewReversal(amount float64) (opay.Reversal, error) {
+	code, ok := o.Meta.ReverseCode()
+	if !ok {
+		return nil, opay.ErrNotReversible
+	}
+	r := NewOrder(o.Meta, o.Id+"-r", o.Uid, o.Aid, amount, code)
+	r.original = o
+	return r, nil
+}
+
+// GetOriginal implements opay.Reversal.
+func (o *Order) GetOriginal() opay.Reversible {
+	if o.original == nil {
+		return nil
+	}
+	return o.original
+}
+
+// Reverse implements opay.Reversal.
+// The reversed amount is kept in memory, and is not rolled back with the transaction.
+func (o *Order) Reverse(tx opay.Tx, kv opay.KV) error {
+	if err := o.record(opay.REVERSE, tx, kv); err != nil {
+		return err
+	}
+	o.original.mu.Lock()
+	o.original.reversed -= o.Amount
+	o.original.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,249 @@
+package opaytest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// SQLMock is a scripted database/sql driver, the statements are expected in order.
+// It checks the SQL code around the database, e.g. how the affected rows are handled.
+type SQLMock struct {
+	t        testing.TB
+	expected []*Expectation
+	lock     sync.Mutex
+}
+
+// Expectation is an expected statement and its result.
+type Expectation struct {
+	kind    string // "begin", "commit", "rollback", "exec" or "query"
+	pattern *regexp.Regexp
+	args    []driver.Value
+	hasArgs bool
+
+	rowsAffected int64
+	columns      []string
+	rows         [][]driver.Value
+	err          error
+}
+
+var sqlMocks = struct {
+	mocks map[string]*SQLMock
+	next  int
+	lock  sync.Mutex
+}{mocks: make(map[string]*SQLMock)}
+
+func init() {
+	sql.Register("opaytest", sqlMockDriver{})
+}
+
+// NewSQLMock opens a database on a new SQLMock, the expectations are checked when the test finishes.
+func NewSQLMock(t testing.TB) (*sqlx.DB, *SQLMock) {
+	m := &SQLMock{t: t}
+	sqlMocks.lock.Lock()
+	sqlMocks.next++
+	dsn := strconv.Itoa(sqlMocks.next)
+	sqlMocks.mocks[dsn] = m
+	sqlMocks.lock.Unlock()
+
+	db, err := sqlx.Open("opaytest", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The statements of a test are expected in order, on a single connection.
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() {
+		db.Close()
+		sqlMocks.lock.Lock()
+		delete(sqlMocks.mocks, dsn)
+		sqlMocks.lock.Unlock()
+		if err := m.Done(); err != nil {
+			t.Error(err)
+		}
+	})
+	return db, m
+}
+
+func (m *SQLMock) expect(kind, pattern string) *Expectation {
+	e := &Expectation{kind: kind}
+	if pattern != "" {
+		e.pattern = regexp.MustCompile(pattern)
+	}
+	m.lock.Lock()
+	m.expected = append(m.expected, e)
+	m.lock.Unlock()
+	return e
+}
+
+// ExpectBegin expects a transaction to begin.
+func (m *SQLMock) ExpectBegin() *Expectation { return m.expect("begin", "") }
+
+// ExpectCommit expects the transaction to commit.
+func (m *SQLMock) ExpectCommit() *Expectation { return m.expect("commit", "") }
+
+// ExpectRollback expects the transaction to roll back.
+func (m *SQLMock) ExpectRollback() *Expectation { return m.expect("rollback", "") }
+
+// ExpectExec expects a statement matching the regular expression to be executed.
+func (m *SQLMock) ExpectExec(pattern string) *Expectation { return m.expect("exec", pattern) }
+
+// ExpectQuery expects a query matching the regular expression.
+func (m *SQLMock) ExpectQuery(pattern string) *Expectation { return m.expect("query", pattern) }
+
+// Done returns an error if some expectations are not met.
+func (m *SQLMock) Done() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.expected) > 0 {
+		e := m.expected[0]
+		return fmt.Errorf("opaytest: %d expected statements left, the next one is %s %v", len(m.expected), e.kind, e.pattern)
+	}
+	return nil
+}
+
+// WithArgs expects the arguments of the statement, after their conversion to the driver values.
+func (e *Expectation) WithArgs(args ...driver.Value) *Expectation {
+	e.args, e.hasArgs = args, true
+	return e
+}
+
+// WillReturnResult makes the statement affect the number of rows.
+func (e *Expectation) WillReturnResult(rowsAffected int64) *Expectation {
+	e.rowsAffected = rowsAffected
+	return e
+}
+
+// WillReturnRows makes the query return the rows.
+func (e *Expectation) WillReturnRows(columns []string, rows ...[]driver.Value) *Expectation {
+	e.columns, e.rows = columns, rows
+	return e
+}
+
+// WillReturnError makes the statement fail.
+func (e *Expectation) WillReturnError(err error) *Expectation {
+	e.err = err
+	return e
+}
+
+// next pops the expectation of the statement, or fails the test.
+func (m *SQLMock) next(kind, query string, args []driver.NamedValue) (*Expectation, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.expected) == 0 {
+		m.t.Errorf("opaytest: unexpected %s %q", kind, query)
+		return nil, fmt.Errorf("opaytest: unexpected %s", kind)
+	}
+	e := m.expected[0]
+	if e.kind != kind || (e.pattern != nil && !e.pattern.MatchString(query)) {
+		m.t.Errorf("opaytest: got %s %q, want %s %v", kind, query, e.kind, e.pattern)
+		return nil, fmt.Errorf("opaytest: unexpected %s", kind)
+	}
+	if e.hasArgs {
+		got := make([]driver.Value, len(args))
+		for i, a := range args {
+			got[i] = a.Value
+		}
+		if !reflect.DeepEqual(got, e.args) {
+			m.t.Errorf("opaytest: %s %q got args %v, want %v", kind, query, got, e.args)
+			return nil, fmt.Errorf("opaytest: unexpected args")
+		}
+	}
+	m.expected = m.expected[1:]
+	return e, e.err
+}
+
+type sqlMockDriver struct{}
+
+func (sqlMockDriver) Open(dsn string) (driver.Conn, error) {
+	sqlMocks.lock.Lock()
+	m, ok := sqlMocks.mocks[dsn]
+	sqlMocks.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("opaytest: no mock %s", dsn)
+	}
+	return &sqlMockConn{mock: m}, nil
+}
+
+type sqlMockConn struct {
+	mock *SQLMock
+}
+
+var (
+	_ driver.ExecerContext  = (*sqlMockConn)(nil)
+	_ driver.QueryerContext = (*sqlMockConn)(nil)
+	_ driver.ConnBeginTx    = (*sqlMockConn)(nil)
+)
+
+func (c *sqlMockConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("opaytest: prepared statements are not supported")
+}
+
+func (c *sqlMockConn) Close() error { return nil }
+
+func (c *sqlMockConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *sqlMockConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if _, err := c.mock.next("begin", "", nil); err != nil {
+		return nil, err
+	}
+	return sqlMockTx{mock: c.mock}, nil
+}
+
+func (c *sqlMockConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, err := c.mock.next("exec", query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(e.rowsAffected), nil
+}
+
+func (c *sqlMockConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	e, err := c.mock.next("query", query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlMockRows{columns: e.columns, rows: e.rows}, nil
+}
+
+type sqlMockTx struct {
+	mock *SQLMock
+}
+
+func (tx sqlMockTx) Commit() error {
+	_, err := tx.mock.next("commit", "", nil)
+	return err
+}
+
+func (tx sqlMockTx) Rollback() error {
+	_, err := tx.mock.next("rollback", "", nil)
+	return err
+}
+
+type sqlMockRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *sqlMockRows) Columns() []string { return r.columns }
+
+func (r *sqlMockRows) Close() error { return nil }
+
+func (r *sqlMockRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
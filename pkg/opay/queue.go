@@ -12,6 +12,7 @@ type (
 	Queue interface {
 		GetCap() int
 		SetCap(int)
+		Len() int
 		Push(*Request) (respChan <-chan *Response)
 		Pull() *Request
 		GetOpay() *Opay
@@ -45,6 +46,13 @@ func (oc *OrderChan) GetCap() int {
 	return cap(oc.c)
 }
 
+// Len returns the number of queued requests.
+func (oc *OrderChan) Len() int {
+	oc.mu.RLock()
+	defer oc.mu.RUnlock()
+	return len(oc.c)
+}
+
 // SetCap sets the queue capacity.
 func (oc *OrderChan) SetCap(queueCapacity int) {
 	if queueCapacity <= 0 {
@@ -76,7 +84,7 @@ func (oc *OrderChan) Push(req *Request) (respChan <-chan *Response) {
 		return
 	}
 
-	timeout, err := checkTimeout(req.Deadline)
+	timeout, err := checkTimeout(oc.GetOpay().Clock(), req.Deadline)
 
 	if err != nil {
 		// Time out, cancel processing
@@ -123,7 +131,7 @@ func (oc *OrderChan) Pull() *Request {
 		}
 
 		// If timeout, cancel the order.
-		if _, err := checkTimeout(req.Deadline); err != nil {
+		if _, err := checkTimeout(oc.GetOpay().Clock(), req.Deadline); err != nil {
 			req.setError(err)
 			req.writeback()
 			continue
@@ -3,8 +3,6 @@ package opay
 import (
 	"sync"
 	"time"
-
-	"github.com/jmoiron/sqlx"
 )
 
 type Request struct {
@@ -13,7 +11,9 @@ type Request struct {
 	Initiator   IOrder                 //master order
 	Stakeholder IOrder                 //the optional, slave order
 	response    *Response
-	*sqlx.Tx    //the optional, database transaction
+	Tx          Tx   //the optional, transaction supplied by the caller, it must be a Savepointer to wrap each order in a savepoint
+	replay      bool //resubmitted from a dead letter
+	retries     int  //number of previous attempts of the replayed request
 	operator    string
 	step        Step
 	lock        sync.RWMutex
@@ -42,6 +42,9 @@ func (req *Request) prepare(opay *Opay) (respChan <-chan *Response, err error) {
 	respChan = (<-chan *Response)(c)
 
 	req.response = &Response{
+		QueuedAt: opay.Clock().Now(),
+		Retries:  req.retries,
+		clock:    opay.Clock(),
 		respChan: (chan<- *Response)(c),
 	}
 
@@ -71,6 +74,12 @@ func (req *Request) prepare(opay *Opay) (respChan <-chan *Response, err error) {
 		return
 	}
 
+	// 检查状态变更是否被允许
+	if !meta.CanTransit(preStatus.Code, targetStatus.Code) {
+		err = ErrIllegalTransition
+		return
+	}
+
 	// 设置订单的处理阶段
 	req.step = targetStatus.Step
 
@@ -85,7 +94,8 @@ func (req *Request) prepare(opay *Opay) (respChan <-chan *Response, err error) {
 	if curStep == CANCEL ||
 		curStep == FAIL ||
 		curStep == SUCCEED ||
-		curStep == SYNC_DEAL {
+		curStep == SYNC_DEAL ||
+		curStep == REVERSE {
 		err = ErrInvalidStep
 		return
 	}
@@ -122,6 +132,12 @@ func (req *Request) prepare(opay *Opay) (respChan <-chan *Response, err error) {
 			return
 		}
 
+		// 检查状态变更是否被允许
+		if !meta.CanTransit(preStatus2.Code, targetStatus2.Code) {
+			err = ErrIllegalTransition
+			return
+		}
+
 		// 检查主从订单行为是否一致
 		if preStatus2.Step != curStep ||
 			targetStatus2.Step != req.step {
@@ -136,6 +152,14 @@ func (req *Request) prepare(opay *Opay) (respChan <-chan *Response, err error) {
 		}
 	}
 
+	// 检查冲正的补偿订单
+	if req.step == REVERSE {
+		err = opay.prepareReversal(req, curStep)
+		if err != nil {
+			return
+		}
+	}
+
 	if req.Addition == nil {
 		req.Addition = make(map[string]interface{})
 	}
@@ -162,6 +186,28 @@ func (req *Request) setError(err error) {
 	req.response.setError(err)
 }
 
+// Fill the final state of the orders into the response.
+func (req *Request) conclude(err error) {
+	resp := req.response
+	resp.lock.Lock()
+	defer resp.lock.Unlock()
+	resp.Err = err
+	if err != nil {
+		// The snapshots were taken in the rolled back transaction.
+		resp.Balances = nil
+		resp.InitiatorStatus = req.Initiator.PreStatus()
+		if req.Stakeholder != nil {
+			resp.StakeholderStatus = req.Stakeholder.PreStatus()
+		}
+		return
+	}
+	resp.Executed = req.Step()
+	resp.InitiatorStatus = req.Initiator.TargetStatus()
+	if req.Stakeholder != nil {
+		resp.StakeholderStatus = req.Stakeholder.TargetStatus()
+	}
+}
+
 // Complete the dealing of the request.
 func (req *Request) writeback() {
 	req.response.writeback()
@@ -3,15 +3,35 @@ package opay
 import (
 	"log"
 	"sync"
+	"time"
 )
 
-// The result of dealing respuest.
-type Response struct {
-	Err      error
-	respChan chan<- *Response //result signal
-	done     bool
-	lock     sync.RWMutex
-}
+type (
+	// The result of dealing respuest.
+	Response struct {
+		Err               error
+		Executed          Step                   //the executed step, UNSET if failed
+		InitiatorStatus   int64                  //the final status code of the initiator order
+		StakeholderStatus int64                  //the final status code of the stakeholder order, if any
+		Balances          []Balance              //account balance snapshots after settlement
+		Results           map[string]interface{} //result values set by the handler
+		QueuedAt          time.Time              //time of entering the queue
+		StartedAt         time.Time              //time of starting processing
+		FinishedAt        time.Time              //time of writing back
+		Retries           int                    //number of previous attempts, counted by the engine when replaying a dead letter
+		respChan          chan<- *Response       //result signal
+		clock             Clock
+		done              bool
+		lock              sync.RWMutex
+	}
+
+	// Balance is an account balance snapshot.
+	Balance struct {
+		Uid     string  `json:"uid"`
+		Aid     string  `json:"aid"`
+		Balance float64 `json:"balance"`
+	}
+)
 
 // Set response error
 func (resp *Response) setError(err error) {
@@ -20,6 +40,54 @@ func (resp *Response) setError(err error) {
 	resp.lock.Unlock()
 }
 
+// SetResult sets a result value for the caller.
+func (resp *Response) SetResult(k string, v interface{}) {
+	resp.lock.Lock()
+	if resp.Results == nil {
+		resp.Results = make(map[string]interface{})
+	}
+	resp.Results[k] = v
+	resp.lock.Unlock()
+}
+
+// Result gets a result value set by the handler.
+func (resp *Response) Result(k string) interface{} {
+	resp.lock.RLock()
+	defer resp.lock.RUnlock()
+	return resp.Results[k]
+}
+
+// Records the balance snapshot, the later one of the same account wins.
+func (resp *Response) setBalance(uid, aid string, balance float64) {
+	resp.lock.Lock()
+	defer resp.lock.Unlock()
+	for i, b := range resp.Balances {
+		if b.Uid == uid && b.Aid == aid {
+			resp.Balances[i].Balance = balance
+			return
+		}
+	}
+	resp.Balances = append(resp.Balances, Balance{
+		Uid:     uid,
+		Aid:     aid,
+		Balance: balance,
+	})
+}
+
+// The clock of the Opay, or SystemClock if the response was not created by Opay.Do.
+func (resp *Response) now() time.Time {
+	if resp.clock == nil {
+		return SystemClock.Now()
+	}
+	return resp.clock.Now()
+}
+
+func (resp *Response) start() {
+	resp.lock.Lock()
+	resp.StartedAt = resp.now()
+	resp.lock.Unlock()
+}
+
 // Complete the dealing of the respuest.
 func (resp *Response) writeback() {
 	resp.lock.Lock()
@@ -28,7 +96,18 @@ func (resp *Response) writeback() {
 		log.Println("repeated writeback.")
 		return
 	}
+	resp.FinishedAt = resp.now()
 	resp.respChan <- resp
 	resp.done = true
 	close(resp.respChan)
 }
+
+// Duration returns the processing time, excluding the time waiting in the queue.
+func (resp *Response) Duration() time.Duration {
+	resp.lock.RLock()
+	defer resp.lock.RUnlock()
+	if resp.StartedAt.IsZero() {
+		return 0
+	}
+	return resp.FinishedAt.Sub(resp.StartedAt)
+}
@@ -0,0 +1,88 @@
+package opay
+
+import (
+	"math"
+	"time"
+)
+
+// Reverse reverses the successful orders by a compensating request.
+// @amount  the absolute amount of the initiator to reverse, zero means the remaining amount,
+// and the stakeholder is reversed in proportion.
+func (opay *Opay) Reverse(initiator, stakeholder Reversible, amount float64, deadline time.Time) *Response {
+	if initiator == nil {
+		return &Response{Err: ErrInitiatorNil}
+	}
+	if amount < 0 {
+		return &Response{Err: ErrIncorrectAmount}
+	}
+	total := math.Abs(initiator.GetAmount())
+	if opay.Equal(amount, 0) {
+		amount = total - math.Abs(initiator.GetReversed())
+	}
+	initiatorReversal, err := initiator.NewReversal(-sign(initiator.GetAmount()) * amount)
+	if err != nil {
+		return &Response{Err: err}
+	}
+	req := &Request{
+		Deadline:  deadline,
+		Initiator: initiatorReversal,
+	}
+	if stakeholder != nil {
+		part := opay.Ftof(amount * math.Abs(stakeholder.GetAmount()) / total)
+		stakeholderReversal, err := stakeholder.NewReversal(-sign(stakeholder.GetAmount()) * part)
+		if err != nil {
+			return &Response{Err: err}
+		}
+		req.Stakeholder = stakeholderReversal
+	}
+	return opay.Do(req)
+}
+
+// Check the compensating orders early, the reversed amount is checked again by Reversal.Reverse
+// under the lock of the stored original order, so that concurrent reversals can not exceed it.
+func (opay *Opay) prepareReversal(req *Request, curStep Step) error {
+	// 冲正须创建新的补偿订单
+	if curStep != UNSET {
+		return ErrInvalidStep
+	}
+	orders := []IOrder{req.Initiator}
+	if req.Stakeholder != nil {
+		orders = append(orders, req.Stakeholder)
+	}
+	for _, order := range orders {
+		reversal, ok := order.(Reversal)
+		if !ok {
+			return ErrNotReversible
+		}
+		original := reversal.GetOriginal()
+		if original == nil {
+			return ErrNotReversible
+		}
+
+		// 只能冲正已成功的订单
+		status, ok := original.GetMeta().Status(original.TargetStatus())
+		if !ok || (status.Step != SUCCEED && status.Step != SYNC_DEAL) {
+			return ErrNotReversible
+		}
+
+		// 补偿金额与原订单金额方向相反，且累计不超过原订单金额
+		if opay.GreaterOrEqual(reversal.GetAmount()*original.GetAmount(), 0) {
+			return ErrIncorrectAmount
+		}
+		if opay.Greater(
+			math.Abs(reversal.GetAmount())+math.Abs(original.GetReversed()),
+			math.Abs(original.GetAmount()),
+		) {
+			return ErrOverReversal
+		}
+	}
+
+	return nil
+}
+
+func sign(f float64) float64 {
+	if f < 0 {
+		return -1
+	}
+	return 1
+}
@@ -3,17 +3,20 @@ package opay
 import (
 	"errors"
 	"sync"
-
-	"github.com/jmoiron/sqlx"
 )
 
 // SettleFunc: Account balance operation function.
-type SettleFunc func(uid string, amount float64, tx *sqlx.Tx) error
+type SettleFunc func(uid string, amount float64, tx Tx) error
+
+// BalanceFunc: Account balance query function, reads the balance within the transaction
+// and locks the account until the transaction ends.
+type BalanceFunc func(uid string, tx Tx) (float64, error)
 
 // SettleFuncMap: Account Balance Operations Function Router.
 type SettleFuncMap struct {
 	mu sync.RWMutex
 	m  map[string]SettleFunc
+	b  map[string]BalanceFunc
 }
 
 // GetSettleFunc gets the account balance operation function
@@ -41,20 +44,56 @@ func (this *SettleFuncMap) RegSettleFunc(aid string, fn SettleFunc) error {
 	return nil
 }
 
-// Global account operation interface list, the default registered empty asset account empty operation interface.
-var globalSettleFuncMap = &SettleFuncMap{
-	m: map[string]SettleFunc{
-		"": emptySettle,
-	},
+// GetBalanceFunc gets the account balance query function.
+// @aid Assets ID
+func (this *SettleFuncMap) GetBalanceFunc(aid string) (BalanceFunc, bool) {
+	this.mu.RLock()
+	fn, ok := this.b[aid]
+	this.mu.RUnlock()
+	return fn, ok
+}
+
+// RegBalanceFunc registers the account balance query function,
+// which is used to snapshot the balances into the Response after settlement.
+// @aid Assets ID
+func (this *SettleFuncMap) RegBalanceFunc(aid string, fn BalanceFunc) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	_, ok := this.b[aid]
+	if ok {
+		return errors.New("opay: balanceFunc '" + aid + "' has been registered.")
+	}
+	this.b[aid] = fn
+	return nil
+}
+
+// NewSettleFuncMap creates a router with the empty asset registered,
+// to replace the global one of an engine, such as in tests.
+func NewSettleFuncMap() *SettleFuncMap {
+	return &SettleFuncMap{
+		m: map[string]SettleFunc{
+			"": emptySettle,
+		},
+		b: map[string]BalanceFunc{},
+	}
 }
 
+// Global account operation interface list, the default registered empty asset account empty operation interface.
+var globalSettleFuncMap = NewSettleFuncMap()
+
 // RegSettleFunc registers the account balance operation function.
 // @aid Assets ID
 func RegSettleFunc(aid string, acc SettleFunc) error {
 	return globalSettleFuncMap.RegSettleFunc(aid, acc)
 }
 
+// RegBalanceFunc registers the account balance query function.
+// @aid Assets ID
+func RegBalanceFunc(aid string, fn BalanceFunc) error {
+	return globalSettleFuncMap.RegBalanceFunc(aid, fn)
+}
+
 // Empty Settle Function of empty asset.
-func emptySettle(uid string, amount float64, tx *sqlx.Tx) error {
+func emptySettle(uid string, amount float64, tx Tx) error {
 	return errors.New("opay: empty settle function.")
 }
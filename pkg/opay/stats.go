@@ -0,0 +1,152 @@
+package opay
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// Stats is a snapshot of the engine's runtime state.
+	Stats struct {
+		QueueLen      int                   `json:"queue_len"`
+		QueueCap      int                   `json:"queue_cap"`
+		ActiveWorkers int                   `json:"active_workers"`
+		MaxWorkers    int                   `json:"max_workers"`
+		Types         map[string]*TypeStats `json:"types"`
+
+		Breakers map[string]BreakerStats `json:"breakers,omitempty"` //by aid
+	}
+
+	// TypeStats counts the requests of an order type since start.
+	TypeStats struct {
+		Active    int64 `json:"active"`
+		Succeeded int64 `json:"succeeded"`
+		Failed    int64 `json:"failed"`
+	}
+
+	// RequestSummary describes a request being processed.
+	RequestSummary struct {
+		OrderType      string    `json:"order_type"`
+		Step           string    `json:"step"`
+		Uid            string    `json:"uid"`
+		Aid            string    `json:"aid"`
+		Amount         float64   `json:"amount"`
+		StakeholderUid string    `json:"stakeholder_uid,omitempty"`
+		StakeholderAid string    `json:"stakeholder_aid,omitempty"`
+		Retries        int       `json:"retries"`
+		Deadline       time.Time `json:"deadline"`
+		QueuedAt       time.Time `json:"queued_at"`
+		StartedAt      time.Time `json:"started_at"`
+	}
+
+	// Tracks the requests being processed.
+	tracker struct {
+		maxWorkers int
+		inflight   map[*Request]struct{}
+		types      map[string]*TypeStats
+		mu         sync.RWMutex
+	}
+)
+
+func newTracker() *tracker {
+	return &tracker{
+		inflight: make(map[*Request]struct{}),
+		types:    make(map[string]*TypeStats),
+	}
+}
+
+func (t *tracker) setMaxWorkers(n int) {
+	t.mu.Lock()
+	t.maxWorkers = n
+	t.mu.Unlock()
+}
+
+func (t *tracker) begin(req *Request) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inflight[req] = struct{}{}
+	t.typeStats(req.Operator()).Active++
+}
+
+func (t *tracker) end(req *Request, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.inflight[req]; !ok {
+		return
+	}
+	delete(t.inflight, req)
+	stats := t.typeStats(req.Operator())
+	stats.Active--
+	if err != nil {
+		stats.Failed++
+	} else {
+		stats.Succeeded++
+	}
+}
+
+func (t *tracker) typeStats(orderType string) *TypeStats {
+	stats, ok := t.types[orderType]
+	if !ok {
+		stats = new(TypeStats)
+		t.types[orderType] = stats
+	}
+	return stats
+}
+
+// Stats returns a snapshot of the engine's runtime state.
+func (opay *Opay) Stats() Stats {
+	t := opay.tracker
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	stats := Stats{
+		QueueLen:      opay.queue.Len(),
+		QueueCap:      opay.queue.GetCap(),
+		ActiveWorkers: len(t.inflight),
+		MaxWorkers:    t.maxWorkers,
+		Types:         make(map[string]*TypeStats, len(t.types)),
+		Breakers:      opay.breakerStats(),
+	}
+	for orderType, s := range t.types {
+		c := *s
+		stats.Types[orderType] = &c
+	}
+	return stats
+}
+
+// InFlight returns the summaries of the requests being processed, the earliest first.
+func (opay *Opay) InFlight() []RequestSummary {
+	t := opay.tracker
+	t.mu.RLock()
+	summaries := make([]RequestSummary, 0, len(t.inflight))
+	for req := range t.inflight {
+		summaries = append(summaries, req.summary())
+	}
+	t.mu.RUnlock()
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].QueuedAt.Before(summaries[j].QueuedAt)
+	})
+	return summaries
+}
+
+func (req *Request) summary() RequestSummary {
+	s := RequestSummary{
+		OrderType: req.Operator(),
+		Step:      req.Step().String(),
+		Uid:       req.Initiator.GetUid(),
+		Aid:       req.Initiator.GetAid(),
+		Amount:    req.Initiator.GetAmount(),
+		Retries:   req.retries,
+		Deadline:  req.Deadline,
+	}
+	if req.Stakeholder != nil {
+		s.StakeholderUid = req.Stakeholder.GetUid()
+		s.StakeholderAid = req.Stakeholder.GetAid()
+	}
+	resp := req.response
+	resp.lock.RLock()
+	s.QueuedAt = resp.QueuedAt
+	s.StartedAt = resp.StartedAt
+	resp.lock.RUnlock()
+	return s
+}
@@ -1,11 +1,16 @@
 package opay
 
+import (
+	"fmt"
+	"strconv"
+)
+
 type (
 	// handling order's action
 	Step int
 )
 
-// Six order processing behavior states
+// Seven order processing behavior states
 const (
 	FAIL      Step = UNSET - 2 //Processing failed
 	CANCEL    Step = UNSET - 1 //Cancel order
@@ -14,6 +19,7 @@ const (
 	DO        Step = UNSET + 2 //Is being processed
 	SUCCEED   Step = UNSET + 3 //Processing success
 	SYNC_DEAL Step = UNSET + 4 //Processing success synchronously
+	REVERSE   Step = UNSET + 5 //Reverse a successful order by a compensating order
 )
 
 var (
@@ -25,5 +31,35 @@ var (
 		DO:        true,
 		SUCCEED:   true,
 		SYNC_DEAL: true,
+		REVERSE:   true,
 	}
 )
+
+var stepNames = map[Step]string{
+	FAIL:      "FAIL",
+	CANCEL:    "CANCEL",
+	UNSET:     "UNSET",
+	PEND:      "PEND",
+	DO:        "DO",
+	SUCCEED:   "SUCCEED",
+	SYNC_DEAL: "SYNC_DEAL",
+	REVERSE:   "REVERSE",
+}
+
+func (s Step) String() string {
+	name, ok := stepNames[s]
+	if !ok {
+		return "Step(" + strconv.Itoa(int(s)) + ")"
+	}
+	return name
+}
+
+// ParseStep parses the step name, such as "PEND".
+func ParseStep(name string) (Step, error) {
+	for step, n := range stepNames {
+		if n == name {
+			return step, nil
+		}
+	}
+	return UNSET, fmt.Errorf("opay: unknown step name: %q", name)
+}
@@ -0,0 +1,363 @@
+package opay
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type (
+	// Tx is a transaction of the store behind the orders and accounts.
+	Tx interface {
+		Commit() error
+		Rollback() error
+	}
+
+	// TxManager begins the transactions, one per request unless the caller supplies one.
+	TxManager interface {
+		Begin() (Tx, error)
+	}
+
+	// Savepointer is implemented by the transactions supporting savepoints,
+	// so that an order can be undone inside the caller-supplied transaction.
+	Savepointer interface {
+		Savepoint(name string) error
+		RollbackTo(name string) error
+		Release(name string) error
+	}
+)
+
+var (
+	ErrNotSqlxTx = errors.New("opay: the transaction is not backed by sqlx")
+	ErrTxDone    = errors.New("opay: the transaction has already been committed or rolled back")
+	ErrNilDB     = errors.New("opay: the database is nil, use NewOpayWithTxManager for the other stores")
+
+	ErrSavepointNotFound = errors.New("opay: savepoint not found")
+	ErrNoSavepoint       = errors.New("opay: the caller-supplied transaction does not support savepoints")
+)
+
+// SqlxTx adapts *sqlx.Tx to Tx.
+type SqlxTx struct {
+	*sqlx.Tx
+}
+
+var (
+	_ Tx          = (*SqlxTx)(nil)
+	_ Savepointer = (*SqlxTx)(nil)
+)
+
+// Savepoint implements Savepointer.
+func (tx *SqlxTx) Savepoint(name string) error {
+	_, err := tx.Exec("SAVEPOINT " + name)
+	return err
+}
+
+// RollbackTo implements Savepointer.
+func (tx *SqlxTx) RollbackTo(name string) error {
+	_, err := tx.Exec("ROLLBACK TO SAVEPOINT " + name)
+	return err
+}
+
+// Release implements Savepointer.
+func (tx *SqlxTx) Release(name string) error {
+	_, err := tx.Exec("RELEASE SAVEPOINT " + name)
+	return err
+}
+
+// SqlxTxManager begins the transactions on a sqlx database, it is the default TxManager.
+type SqlxTxManager struct {
+	db *sqlx.DB
+}
+
+var _ TxManager = (*SqlxTxManager)(nil)
+
+// NewSqlxTxManager panics if db is nil, the transactions could not be begun.
+func NewSqlxTxManager(db *sqlx.DB) *SqlxTxManager {
+	if db == nil {
+		panic(ErrNilDB)
+	}
+	return &SqlxTxManager{db: db}
+}
+
+// Begin implements TxManager.
+func (m *SqlxTxManager) Begin() (Tx, error) {
+	tx, err := m.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	return &SqlxTx{Tx: tx}, nil
+}
+
+// ctxTx carries the context of the calls made in the transaction.
+type ctxTx struct {
+	Tx
+	ctx context.Context
+}
+
+func (tx *ctxTx) Unwrap() Tx {
+	return tx.Tx
+}
+
+// TxContext returns the context of the calls made in the transaction, such as the requests to a provider.
+// It is canceled when the settle policy times out, context.Background() if there is none.
+func TxContext(tx Tx) context.Context {
+	switch t := tx.(type) {
+	case *ctxTx:
+		return t.ctx
+	case interface{ Unwrap() Tx }:
+		return TxContext(t.Unwrap())
+	}
+	return context.Background()
+}
+
+// AsSqlxTx returns the *sqlx.Tx behind the transaction, for the stores backed by sqlx.
+func AsSqlxTx(tx Tx) (*sqlx.Tx, error) {
+	switch t := tx.(type) {
+	case *SqlxTx:
+		return t.Tx, nil
+	case interface{ Unwrap() Tx }:
+		return AsSqlxTx(t.Unwrap())
+	}
+	return nil, ErrNotSqlxTx
+}
+
+// AsSavepointer returns the Savepointer behind the transaction, if any.
+func AsSavepointer(tx Tx) (Savepointer, bool) {
+	if sp, ok := tx.(Savepointer); ok {
+		return sp, true
+	}
+	if t, ok := tx.(interface{ Unwrap() Tx }); ok {
+		return AsSavepointer(t.Unwrap())
+	}
+	return nil, false
+}
+
+// MemStore is an in-memory key-value store with transactions,
+// so that the handlers can be exercised without a database.
+// The transactions are serialized: Begin waits until the previous one ends.
+type MemStore struct {
+	data map[string]interface{}
+	tx   *MemTx     //the running transaction
+	mu   sync.Mutex //held by the running transaction
+	rw   sync.RWMutex
+}
+
+var _ TxManager = (*MemStore)(nil)
+
+func NewMemStore() *MemStore {
+	return &MemStore{data: make(map[string]interface{})}
+}
+
+// Begin implements TxManager.
+func (s *MemStore) Begin() (Tx, error) {
+	s.mu.Lock()
+	tx := &MemTx{store: s}
+	s.rw.Lock()
+	s.tx = tx
+	s.rw.Unlock()
+	return tx, nil
+}
+
+// Get reads a committed value, the writes of the running transaction are seen as before it.
+// It never waits for the transaction, so it can be called inside one, such as by a SettleFunc.
+func (s *MemStore) Get(key string) (interface{}, bool) {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+	if s.tx != nil {
+		// The first undo of the key keeps its value before the transaction.
+		for _, u := range s.tx.undo {
+			if u.key == key {
+				return u.value, u.exists
+			}
+		}
+	}
+	v, ok := s.data[key]
+	return v, ok
+}
+
+// End the running transaction, and let the next one begin.
+func (s *MemStore) end() {
+	s.rw.Lock()
+	s.tx = nil
+	s.rw.Unlock()
+	s.mu.Unlock()
+}
+
+func (s *MemStore) get(key string) (interface{}, bool) {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+	v, ok := s.data[key]
+	return v, ok
+}
+
+// MemTx is a transaction of MemStore, the writes are undone on Rollback.
+type MemTx struct {
+	store      *MemStore
+	undo       []memUndo
+	savepoints []memSavepoint
+	done       bool
+}
+
+var (
+	_ Tx          = (*MemTx)(nil)
+	_ Savepointer = (*MemTx)(nil)
+)
+
+type memSavepoint struct {
+	name string
+	mark int //length of the undo log
+}
+
+type memUndo struct {
+	key    string
+	value  interface{}
+	exists bool
+}
+
+// AsMemTx returns the *MemTx behind the transaction.
+func AsMemTx(tx Tx) (*MemTx, error) {
+	switch t := tx.(type) {
+	case *MemTx:
+		return t, nil
+	case interface{ Unwrap() Tx }:
+		return AsMemTx(t.Unwrap())
+	}
+	return nil, errors.New("opay: the transaction is not backed by MemStore")
+}
+
+// Get reads a value, including the writes of this transaction.
+func (tx *MemTx) Get(key string) (interface{}, bool) {
+	return tx.store.get(key)
+}
+
+// Put writes a value.
+func (tx *MemTx) Put(key string, value interface{}) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.store.rw.Lock()
+	defer tx.store.rw.Unlock()
+	old, ok := tx.store.data[key]
+	tx.undo = append(tx.undo, memUndo{key: key, value: old, exists: ok})
+	tx.store.data[key] = value
+	return nil
+}
+
+// Delete deletes a value.
+func (tx *MemTx) Delete(key string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.store.rw.Lock()
+	defer tx.store.rw.Unlock()
+	old, ok := tx.store.data[key]
+	if !ok {
+		return nil
+	}
+	tx.undo = append(tx.undo, memUndo{key: key, value: old, exists: true})
+	delete(tx.store.data, key)
+	return nil
+}
+
+// Keys returns the sorted keys with the prefix.
+func (tx *MemTx) Keys(prefix string) []string {
+	tx.store.rw.RLock()
+	var keys []string
+	for key := range tx.store.data {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	tx.store.rw.RUnlock()
+	sort.Strings(keys)
+	return keys
+}
+
+// Commit implements Tx.
+func (tx *MemTx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.store.end()
+	tx.undo = nil
+	tx.savepoints = nil
+	return nil
+}
+
+// Rollback implements Tx.
+func (tx *MemTx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.rollbackTo(0)
+	tx.savepoints = nil
+	tx.done = true
+	tx.store.end()
+	return nil
+}
+
+// Savepoint implements Savepointer.
+func (tx *MemTx) Savepoint(name string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.savepoints = append(tx.savepoints, memSavepoint{name: name, mark: len(tx.undo)})
+	return nil
+}
+
+// RollbackTo implements Savepointer, the savepoint is kept as in SQL.
+func (tx *MemTx) RollbackTo(name string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	i := tx.savepoint(name)
+	if i < 0 {
+		return ErrSavepointNotFound
+	}
+	tx.rollbackTo(tx.savepoints[i].mark)
+	tx.savepoints = tx.savepoints[:i+1]
+	return nil
+}
+
+// Release implements Savepointer, the later savepoints are released too.
+func (tx *MemTx) Release(name string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	i := tx.savepoint(name)
+	if i < 0 {
+		return ErrSavepointNotFound
+	}
+	tx.savepoints = tx.savepoints[:i]
+	return nil
+}
+
+// Index of the latest savepoint with the name, or -1.
+func (tx *MemTx) savepoint(name string) int {
+	for i := len(tx.savepoints) - 1; i >= 0; i-- {
+		if tx.savepoints[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Undo the writes after the mark in reverse order.
+func (tx *MemTx) rollbackTo(mark int) {
+	tx.store.rw.Lock()
+	defer tx.store.rw.Unlock()
+	for i := len(tx.undo) - 1; i >= mark; i-- {
+		u := tx.undo[i]
+		if u.exists {
+			tx.store.data[u.key] = u.value
+		} else {
+			delete(tx.store.data, u.key)
+		}
+	}
+	tx.undo = tx.undo[:mark]
+}
@@ -0,0 +1,107 @@
+package opay
+
+import (
+	"testing"
+)
+
+func TestMemTx(t *testing.T) {
+	store := NewMemStore()
+
+	tx, _ := store.Begin()
+	mtx, err := AsMemTx(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtx.Put("balance/u1", 100.0)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, _ = store.Begin()
+	mtx, _ = AsMemTx(tx)
+	mtx.Put("balance/u1", 50.0)
+	mtx.Put("balance/u2", 50.0)
+	if v, _ := mtx.Get("balance/u1"); v != 50.0 {
+		t.Fatalf("expect to read own write, got %v", v)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != ErrTxDone {
+		t.Fatalf("expect ErrTxDone, got %v", err)
+	}
+
+	if v, _ := store.Get("balance/u1"); v != 100.0 {
+		t.Fatalf("expect 100 after rollback, got %v", v)
+	}
+	if _, ok := store.Get("balance/u2"); ok {
+		t.Fatal("expect balance/u2 to be rolled back")
+	}
+	if _, err := AsSqlxTx(tx); err != ErrNotSqlxTx {
+		t.Fatalf("expect ErrNotSqlxTx, got %v", err)
+	}
+}
+
+func TestMemTxSavepoint(t *testing.T) {
+	store := NewMemStore()
+	tx, _ := store.Begin()
+	mtx, _ := AsMemTx(tx)
+	mtx.Put("a", 1)
+	mtx.Savepoint("sp1")
+	mtx.Put("a", 2)
+	mtx.Savepoint("sp2")
+	mtx.Put("b", 3)
+
+	if err := mtx.RollbackTo("sp1"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := mtx.Get("a"); v != 1 {
+		t.Fatalf("expect 1 after rolling back to sp1, got %v", v)
+	}
+	if _, ok := mtx.Get("b"); ok {
+		t.Fatal("expect b to be rolled back")
+	}
+	if err := mtx.Release("sp2"); err != ErrSavepointNotFound {
+		t.Fatalf("expect sp2 to be discarded, got %v", err)
+	}
+	if err := mtx.Release("sp1"); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+	if v, _ := store.Get("a"); v != 1 {
+		t.Fatalf("expect 1 after commit, got %v", v)
+	}
+}
+
+func TestMemStoreGetInTx(t *testing.T) {
+	store := NewMemStore()
+	tx, _ := store.Begin()
+	mtx, _ := AsMemTx(tx)
+	mtx.Put("a", 1)
+	tx.Commit()
+
+	tx, _ = store.Begin()
+	mtx, _ = AsMemTx(tx)
+	mtx.Put("a", 2)
+	mtx.Put("b", 3)
+	// Reading inside the transaction must not wait for it, and sees the committed values.
+	if v, _ := store.Get("a"); v != 1 {
+		t.Fatalf("expect the committed 1, got %v", v)
+	}
+	if _, ok := store.Get("b"); ok {
+		t.Fatal("expect b to be invisible before commit")
+	}
+	tx.Commit()
+	if v, _ := store.Get("a"); v != 2 {
+		t.Fatalf("expect 2 after commit, got %v", v)
+	}
+}
+
+func TestNewOpayNilDB(t *testing.T) {
+	defer func() {
+		if r := recover(); r != ErrNilDB {
+			t.Fatalf("expect panic with ErrNilDB, got %v", r)
+		}
+	}()
+	NewOpay(nil, 10, 2)
+}
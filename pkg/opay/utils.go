@@ -7,13 +7,27 @@ import (
 	"time"
 )
 
-func checkTimeout(deadline time.Time) (timeout time.Duration, errTimeout error) {
+// Clock tells the time of the engine, it can be replaced in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SystemClock is the default Clock.
+var SystemClock Clock = systemClock{}
+
+func checkTimeout(clock Clock, deadline time.Time) (timeout time.Duration, errTimeout error) {
 	// No timeout
 	if deadline.IsZero() {
 		return
 	}
 
-	timeout = deadline.Sub(time.Now())
+	timeout = deadline.Sub(clock.Now())
 
 	// Timeout, cancel order.
 	if timeout <= 0 {